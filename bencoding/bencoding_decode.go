@@ -1,6 +1,7 @@
 package bencoding
 
 import (
+	"errors"
 	"fmt"
 	"github.com/onepointsixtwo/torrentsgo/model"
 	"io"
@@ -15,6 +16,13 @@ const (
 	END             = "e"
 )
 
+var ErrTooLarge = errors.New("Bencoded data exceeds maximum length")
+
+type limitedReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
 func DecodeBencoding(reader io.Reader) (*model.OrderedMap, error) {
 	// Since we're only supporting the outer structure being a dictionary
 	// we just  check the first byte is d and then proceed to read it in as a dictionary
@@ -28,6 +36,13 @@ func DecodeBencoding(reader io.Reader) (*model.OrderedMap, error) {
 	return decodeDictionary(reader)
 }
 
+// DecodeBencodingLimited decodes as DecodeBencoding but reads no more than maxLength bytes,
+// returning ErrTooLarge if the data is longer. String lengths are checked before anything is
+// allocated for them, so untrusted input can't force a large allocation.
+func DecodeBencodingLimited(reader io.Reader, maxLength int64) (*model.OrderedMap, error) {
+	return DecodeBencoding(&limitedReader{reader: reader, remaining: maxLength})
+}
+
 // Read value
 
 func readValue(reader io.Reader) (interface{}, error) {
@@ -118,6 +133,9 @@ func readStringValue(reader io.Reader, firstLengthCharacter string) (string, err
 	if err != nil {
 		return "", err
 	}
+	if length < 0 {
+		return "", fmt.Errorf("Invalid string length %v", length)
+	}
 
 	return readLengthAsString(reader, length)
 }
@@ -174,6 +192,9 @@ func readLengthAsString(reader io.Reader, length int) (string, error) {
 }
 
 func readLengthAsBytes(reader io.Reader, length int) ([]byte, error) {
+	if limited, ok := reader.(*limitedReader); ok && int64(length) > limited.remaining {
+		return nil, ErrTooLarge
+	}
 	b := make([]byte, length)
 	n, err := reader.Read(b)
 	if err != nil {
@@ -185,3 +206,16 @@ func readLengthAsBytes(reader io.Reader, length int) ([]byte, error) {
 	bytesRead := b[:n]
 	return bytesRead, nil
 }
+
+// Read fills the buffer completely, so that streamed data such as HTTP bodies can be decoded
+func (r *limitedReader) Read(b []byte) (int, error) {
+	if int64(len(b)) > r.remaining {
+		return 0, ErrTooLarge
+	}
+	n, err := io.ReadFull(r.reader, b)
+	r.remaining -= int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -247,3 +247,36 @@ func TestReadListValue(t *testing.T) {
 		t.Errorf("Expected list[5] to be 12 but was %v", list[5])
 	}
 }
+
+// Limits
+
+func TestDecodeBencodingLimited(t *testing.T) {
+	data := "d8:announce4:spam4:infod4:name5:testsee"
+
+	decoded, err := DecodeBencodingLimited(bytes.NewReader([]byte(data)), int64(len(data)))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding data within limit %v", err)
+	}
+	if decoded.Get("announce") != "spam" {
+		t.Errorf("Unexpected announce value %v", decoded.Get("announce"))
+	}
+
+	if _, err := DecodeBencodingLimited(bytes.NewReader([]byte(data)), int64(len(data)-1)); err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge decoding data over the limit but got %v", err)
+	}
+}
+
+func TestDecodeBencodingLimitedRejectsLongStringLength(t *testing.T) {
+	// The claimed string length is checked before allocating a buffer for it
+	_, err := DecodeBencodingLimited(bytes.NewReader([]byte("d4:spam999999999999:e")), 1024)
+	if err != ErrTooLarge {
+		t.Errorf("Expected ErrTooLarge for long string length but got %v", err)
+	}
+}
+
+func TestReadStringValueRejectsNegativeLength(t *testing.T) {
+	reader := mock.NewMockStringReader("1:x")
+	if _, err := readStringValue(reader, "-"); err == nil {
+		t.Errorf("Expected error reading negative string length")
+	}
+}
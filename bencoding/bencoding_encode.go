@@ -7,10 +7,18 @@ import (
 	"strconv"
 )
 
+// EncodeBencoding encodes a dictionary with its keys in the order they were added. Bencoding
+// requires them sorted, so dictionaries built to be sent must add them that way. Keeping the order
+// lets a parsed dictionary be encoded back to the bytes it came from.
 func EncodeBencoding(m *model.OrderedMap) ([]byte, error) {
 	return encodeMap(m)
 }
 
+// EncodeValue encodes a single value, which may be a string, int, list or dictionary
+func EncodeValue(value interface{}) ([]byte, error) {
+	return encodeValue(value)
+}
+
 func encodeValue(value interface{}) ([]byte, error) {
 	switch v := value.(type) {
 	case *model.OrderedMap:
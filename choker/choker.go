@@ -0,0 +1,333 @@
+package choker
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/peer"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// How often Rechoke should be called
+	RECHOKE_INTERVAL = 10 * time.Second
+
+	DEFAULT_UNCHOKE_SLOTS       = 3
+	DEFAULT_OPTIMISTIC_INTERVAL = 30 * time.Second
+	DEFAULT_SEED_TURN           = 30 * time.Second
+
+	// Peers connected for less than NEW_PEER_DURATION are NEW_PEER_WEIGHT times as likely to be
+	// picked as the optimistic unchoke, so they get a chance to start trading
+	NEW_PEER_DURATION = time.Minute
+	NEW_PEER_WEIGHT   = 3
+)
+
+// SeedingAlgorithm decides who is unchoked once we have the whole torrent
+type SeedingAlgorithm int
+
+const (
+	// Interested peers take turns at the unchoke slots
+	SEED_ROUND_ROBIN SeedingAlgorithm = iota
+	// The peers we upload to fastest keep the unchoke slots
+	SEED_FASTEST_UPLOAD
+)
+
+// Types
+
+// Peer is the part of a connection the choker needs, as provided by peer.Conn
+type Peer interface {
+	PeerInterested() bool
+	IsSnubbed() bool
+	Stats() peer.Stats
+	Choke()
+	Unchoke()
+}
+
+type Config struct {
+	// Slots is how many peers are unchoked for reciprocation, besides the optimistic unchoke
+	Slots int
+	// OptimisticInterval is how long each optimistic unchoke lasts
+	OptimisticInterval time.Duration
+	Seeding            SeedingAlgorithm
+	// SeedTurn is how long a peer keeps its slot when seeding round robin
+	SeedTurn time.Duration
+	Clock    util.Clock
+	Rand     *rand.Rand
+}
+
+// Choker decides which peers we upload to. It unchokes the peers giving us the best download rate
+// (or taking the best upload rate when seeding) and one optimistic unchoke, which lets new peers
+// show what they can do. It is not safe for concurrent use.
+type Choker struct {
+	config         Config
+	peers          map[Peer]*peerState
+	optimistic     Peer
+	lastOptimistic time.Time
+	lastRechoke    time.Time
+	seeding        bool
+	added          int
+}
+
+type peerState struct {
+	// order is when the peer was added relative to the others
+	order    int
+	joined   time.Time
+	unchoked bool
+	// changed is when the peer was last choked or unchoked
+	changed      time.Time
+	last         peer.Stats
+	downloadRate float64
+	uploadRate   float64
+}
+
+// Initialiser
+
+func NewChoker(config Config) *Choker {
+	if config.Slots <= 0 {
+		config.Slots = DEFAULT_UNCHOKE_SLOTS
+	}
+	if config.OptimisticInterval <= 0 {
+		config.OptimisticInterval = DEFAULT_OPTIMISTIC_INTERVAL
+	}
+	if config.SeedTurn <= 0 {
+		config.SeedTurn = DEFAULT_SEED_TURN
+	}
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+	if config.Rand == nil {
+		config.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return &Choker{config: config, peers: make(map[Peer]*peerState), lastRechoke: config.Clock.Now()}
+}
+
+// Public Methods
+
+// Add starts tracking a newly connected peer, which is assumed to be choked
+func (c *Choker) Add(p Peer) {
+	now := c.config.Clock.Now()
+	c.peers[p] = &peerState{order: c.added, joined: now, changed: now, last: p.Stats()}
+	c.added++
+}
+
+// Remove stops tracking a peer, giving its slot to another
+func (c *Choker) Remove(p Peer) {
+	if _, ok := c.peers[p]; !ok {
+		return
+	}
+	delete(c.peers, p)
+	if c.optimistic == p {
+		c.optimistic = nil
+	}
+	c.fill()
+}
+
+// SetSeeding switches between ranking peers by download rate and seeding
+func (c *Choker) SetSeeding(seeding bool) {
+	c.seeding = seeding
+}
+
+// Interested unchokes a peer which has become interested straight away if a slot is free, rather
+// than leaving it until the next rechoke
+func (c *Choker) Interested(p Peer) {
+	c.fill()
+}
+
+// NotInterested chokes a peer which no longer wants anything, giving its slot to another
+func (c *Choker) NotInterested(p Peer) {
+	if state, ok := c.peers[p]; ok && state.unchoked {
+		c.choke(p, state, c.config.Clock.Now())
+		if c.optimistic == p {
+			c.optimistic = nil
+		}
+	}
+	c.fill()
+}
+
+// Rechoke recomputes peer rates and decides who is unchoked, rotating the optimistic unchoke when
+// its time is up. It should be called every RECHOKE_INTERVAL.
+func (c *Choker) Rechoke() {
+	now := c.config.Clock.Now()
+	c.updateRates(now)
+
+	regular := c.ranked(now)
+	if len(regular) > c.config.Slots {
+		regular = regular[:c.config.Slots]
+	}
+	unchoke := make(map[Peer]bool)
+	for _, p := range regular {
+		unchoke[p] = true
+	}
+
+	// The optimistic unchoke is replaced when its time is up, when it has lost interest, or when it
+	// has earned a regular slot
+	if c.optimistic == nil || unchoke[c.optimistic] || !c.optimistic.PeerInterested() || now.Sub(c.lastOptimistic) >= c.config.OptimisticInterval {
+		c.optimistic = c.pickOptimistic(now, unchoke)
+		c.lastOptimistic = now
+	}
+	if c.optimistic != nil {
+		unchoke[c.optimistic] = true
+	}
+
+	for p, state := range c.peers {
+		if unchoke[p] && !state.unchoked {
+			c.unchoke(p, state, now)
+		} else if !unchoke[p] && state.unchoked {
+			c.choke(p, state, now)
+		}
+	}
+}
+
+// Unchoked returns whether the choker has unchoked a peer
+func (c *Choker) Unchoked(p Peer) bool {
+	state, ok := c.peers[p]
+	return ok && state.unchoked
+}
+
+// Optimistic returns the optimistically unchoked peer, or nil if there is none
+func (c *Choker) Optimistic() Peer {
+	return c.optimistic
+}
+
+// Helpers
+
+// updateRates measures how fast each peer transferred since the last rechoke
+func (c *Choker) updateRates(now time.Time) {
+	for p, state := range c.peers {
+		since := c.lastRechoke
+		if state.joined.After(since) {
+			since = state.joined
+		}
+		stats := p.Stats()
+		if seconds := now.Sub(since).Seconds(); seconds > 0 {
+			state.downloadRate = float64(stats.Downloaded-state.last.Downloaded) / seconds
+			state.uploadRate = float64(stats.Uploaded-state.last.Uploaded) / seconds
+		}
+		state.last = stats
+	}
+	c.lastRechoke = now
+}
+
+// ranked returns the peers which may have regular slots, best first. Snubbed peers aren't
+// reciprocated while leeching since they aren't giving us anything, though they can still be the
+// optimistic unchoke.
+func (c *Choker) ranked(now time.Time) []Peer {
+	candidates := []Peer{}
+	for _, p := range c.ordered() {
+		if p.PeerInterested() && (c.seeding || !p.IsSnubbed()) {
+			candidates = append(candidates, p)
+		}
+	}
+	c.config.Rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	if c.seeding && c.config.Seeding == SEED_ROUND_ROBIN {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return c.roundRobinBefore(now, candidates[i], candidates[j])
+		})
+		return candidates
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := c.peers[candidates[i]], c.peers[candidates[j]]
+		if c.seeding {
+			return a.uploadRate > b.uploadRate
+		}
+		return a.downloadRate > b.downloadRate
+	})
+	return candidates
+}
+
+// roundRobinBefore orders peers partway through their turn at a regular slot first, then those
+// which have waited longest since they were last choked
+func (c *Choker) roundRobinBefore(now time.Time, p Peer, q Peer) bool {
+	a, b := c.peers[p], c.peers[q]
+	aTurn := a.unchoked && p != c.optimistic && now.Sub(a.changed) < c.config.SeedTurn
+	bTurn := b.unchoked && q != c.optimistic && now.Sub(b.changed) < c.config.SeedTurn
+	if aTurn != bTurn {
+		return aTurn
+	}
+	if a.unchoked != b.unchoked {
+		return !a.unchoked
+	}
+	return a.changed.Before(b.changed)
+}
+
+// pickOptimistic chooses an interested peer without a regular slot at random, favouring new peers
+func (c *Choker) pickOptimistic(now time.Time, regular map[Peer]bool) Peer {
+	candidates := []Peer{}
+	weights := []int{}
+	total := 0
+	for _, p := range c.ordered() {
+		if regular[p] || !p.PeerInterested() {
+			continue
+		}
+		state := c.peers[p]
+		weight := 1
+		if now.Sub(state.joined) < NEW_PEER_DURATION {
+			weight = NEW_PEER_WEIGHT
+		}
+		candidates = append(candidates, p)
+		weights = append(weights, weight)
+		total += weight
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := c.config.Rand.Intn(total)
+	for i, p := range candidates {
+		if n < weights[i] {
+			return p
+		}
+		n -= weights[i]
+	}
+	return nil
+}
+
+// ordered returns the peers in the order they were added, since map order would make choices
+// with a seeded Rand unrepeatable
+func (c *Choker) ordered() []Peer {
+	peers := make([]Peer, 0, len(c.peers))
+	for p := range c.peers {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return c.peers[peers[i]].order < c.peers[peers[j]].order
+	})
+	return peers
+}
+
+// fill unchokes the best waiting peers while there are free regular slots
+func (c *Choker) fill() {
+	now := c.config.Clock.Now()
+	used := 0
+	for p, state := range c.peers {
+		if state.unchoked && p != c.optimistic {
+			used++
+		}
+	}
+	for _, p := range c.ranked(now) {
+		if used >= c.config.Slots {
+			return
+		}
+		if state := c.peers[p]; !state.unchoked {
+			c.unchoke(p, state, now)
+			used++
+		}
+	}
+}
+
+func (c *Choker) unchoke(p Peer, state *peerState, now time.Time) {
+	p.Unchoke()
+	state.unchoked = true
+	state.changed = now
+}
+
+func (c *Choker) choke(p Peer, state *peerState, now time.Time) {
+	p.Choke()
+	state.unchoked = false
+	state.changed = now
+}
@@ -0,0 +1,259 @@
+package choker
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"github.com/onepointsixtwo/torrentsgo/peer"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+type fakePeer struct {
+	name       string
+	interested bool
+	snubbed    bool
+	stats      peer.Stats
+	choked     bool
+}
+
+func (p *fakePeer) PeerInterested() bool { return p.interested }
+func (p *fakePeer) IsSnubbed() bool      { return p.snubbed }
+func (p *fakePeer) Stats() peer.Stats    { return p.stats }
+func (p *fakePeer) Choke()               { p.choked = true }
+func (p *fakePeer) Unchoke()             { p.choked = false }
+
+func TestLeechingUnchokesFastestDownloaders(t *testing.T) {
+	clock := testClock()
+	c := NewChoker(Config{Clock: clock, Rand: rand.New(rand.NewSource(1))})
+	peers := addPeers(c, 6)
+
+	clock.Advance(RECHOKE_INTERVAL)
+	for i, p := range peers {
+		p.stats.Downloaded = int64(i * 1000)
+	}
+	c.Rechoke()
+
+	for _, p := range peers[3:] {
+		if p.choked || !c.Unchoked(p) {
+			t.Errorf("Expected fast peer %v to be unchoked", p.name)
+		}
+	}
+	optimistic := c.Optimistic()
+	if optimistic == nil || optimistic == Peer(peers[3]) || optimistic == Peer(peers[4]) || optimistic == Peer(peers[5]) {
+		t.Fatalf("Expected a slow peer to be the optimistic unchoke but was %v", optimistic)
+	}
+	for _, p := range peers[:3] {
+		if p.choked != (Peer(p) != optimistic) {
+			t.Errorf("Expected slow peer %v to be choked unless optimistic", p.name)
+		}
+	}
+
+	// Rates are measured over the last interval only
+	clock.Advance(RECHOKE_INTERVAL)
+	for i, p := range peers {
+		p.stats.Downloaded += int64(i * 1000)
+	}
+	peers[0].stats.Downloaded += 100000
+	c.Rechoke()
+	if peers[0].choked || (!peers[3].choked && c.Optimistic() != Peer(peers[3])) {
+		t.Errorf("Expected the new fastest peer to replace the slowest")
+	}
+}
+
+func TestSnubbedPeersLoseRegularSlots(t *testing.T) {
+	clock := testClock()
+	c := NewChoker(Config{Slots: 1, Clock: clock, Rand: rand.New(rand.NewSource(1))})
+	peers := addPeers(c, 2)
+	peers[1].interested = false
+
+	clock.Advance(RECHOKE_INTERVAL)
+	peers[0].stats.Downloaded = 5000
+	peers[0].snubbed = true
+	c.Rechoke()
+
+	// With nobody else interested the snubbed peer can only be the optimistic unchoke
+	if c.Optimistic() != Peer(peers[0]) {
+		t.Errorf("Expected snubbed peer to be optimistic but was %v", c.Optimistic())
+	}
+
+	peers[1].interested = true
+	c.Interested(peers[1])
+	if peers[1].choked {
+		t.Errorf("Expected the free regular slot to go to the peer that isn't snubbed")
+	}
+
+	peers[0].snubbed = false
+	clock.Advance(RECHOKE_INTERVAL)
+	peers[0].stats.Downloaded += 5000
+	c.Rechoke()
+	if c.Optimistic() == Peer(peers[0]) || peers[0].choked {
+		t.Errorf("Expected peer to earn a regular slot once it stops snubbing us")
+	}
+}
+
+func TestOptimisticUnchokeRotates(t *testing.T) {
+	clock := testClock()
+	c := NewChoker(Config{Slots: 1, Clock: clock, Rand: rand.New(rand.NewSource(1))})
+	peers := addPeers(c, 4)
+
+	seen := map[Peer]bool{}
+	for rotation := 0; rotation < 20; rotation++ {
+		clock.Advance(RECHOKE_INTERVAL)
+		peers[0].stats.Downloaded += 1000
+		c.Rechoke()
+		optimistic := c.Optimistic()
+		seen[optimistic] = true
+
+		// It keeps its slot until the interval is up
+		for i := 0; i < 2; i++ {
+			clock.Advance(RECHOKE_INTERVAL)
+			peers[0].stats.Downloaded += 1000
+			c.Rechoke()
+			if c.Optimistic() != optimistic {
+				t.Fatalf("Expected optimistic unchoke to last %v", DEFAULT_OPTIMISTIC_INTERVAL)
+			}
+		}
+	}
+	if seen[peers[0]] || len(seen) != 3 {
+		t.Errorf("Expected every peer without a regular slot to get an optimistic turn, had %v", len(seen))
+	}
+}
+
+func TestOptimisticUnchokeFavoursNewPeers(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	newPicks := 0
+	for trial := 0; trial < 1000; trial++ {
+		clock := testClock()
+		c := NewChoker(Config{Slots: 1, Clock: clock, Rand: random})
+		peers := addPeers(c, 2)
+		clock.Advance(2 * NEW_PEER_DURATION)
+		newPeer := &fakePeer{name: "new", interested: true, choked: true}
+		c.Add(newPeer)
+
+		peers[0].stats.Downloaded = 1000
+		c.Rechoke()
+		if c.Optimistic() == Peer(newPeer) {
+			newPicks++
+		}
+	}
+
+	// The new peer is weighted 3 to 1 against the old peer without a regular slot
+	if newPicks < 700 || newPicks > 800 {
+		t.Errorf("Expected the new peer to be picked about 750 times but was %v", newPicks)
+	}
+}
+
+func TestSeedingFastestUploadRanksByUploadRate(t *testing.T) {
+	clock := testClock()
+	c := NewChoker(Config{Slots: 2, Seeding: SEED_FASTEST_UPLOAD, Clock: clock, Rand: rand.New(rand.NewSource(1))})
+	c.SetSeeding(true)
+	peers := addPeers(c, 4)
+
+	clock.Advance(RECHOKE_INTERVAL)
+	peers[1].stats.Uploaded = 3000
+	peers[2].stats.Uploaded = 2000
+	peers[3].stats.Downloaded = 9000
+	peers[3].snubbed = true
+	c.Rechoke()
+
+	if peers[1].choked || peers[2].choked {
+		t.Errorf("Expected the fastest uploads to keep their slots")
+	}
+	if c.Optimistic() != Peer(peers[0]) && c.Optimistic() != Peer(peers[3]) {
+		t.Errorf("Expected a slower peer to be optimistic but was %v", c.Optimistic())
+	}
+}
+
+func TestSeedingRoundRobinTakesTurns(t *testing.T) {
+	clock := testClock()
+	c := NewChoker(Config{Slots: 2, Clock: clock, Rand: rand.New(rand.NewSource(1))})
+	c.SetSeeding(true)
+	peers := addPeers(c, 6)
+
+	regular := func() map[Peer]bool {
+		result := map[Peer]bool{}
+		for _, p := range peers {
+			if !p.choked && Peer(p) != c.Optimistic() {
+				result[p] = true
+			}
+		}
+		return result
+	}
+
+	c.Rechoke()
+	first := regular()
+	if len(first) != 2 {
+		t.Fatalf("Expected 2 regular slots but had %v", len(first))
+	}
+
+	// Slots are kept through a turn, even by peers we upload to slowly
+	clock.Advance(RECHOKE_INTERVAL)
+	peers[5].stats.Uploaded = 100000
+	c.Rechoke()
+	for p := range first {
+		if !regular()[p] {
+			t.Errorf("Expected %v to keep its slot for its turn", p.(*fakePeer).name)
+		}
+	}
+
+	served := map[Peer]bool{}
+	for i := 0; i < 12; i++ {
+		clock.Advance(RECHOKE_INTERVAL)
+		c.Rechoke()
+		for p := range regular() {
+			served[p] = true
+		}
+	}
+	if len(served) != len(peers) {
+		t.Errorf("Expected every peer to have a turn but %v did", len(served))
+	}
+}
+
+func TestFreedSlotsAreRefilled(t *testing.T) {
+	clock := testClock()
+	c := NewChoker(Config{Slots: 1, Clock: clock, Rand: rand.New(rand.NewSource(1))})
+	peers := addPeers(c, 2)
+	for _, p := range peers {
+		p.interested = false
+	}
+
+	peers[0].interested = true
+	c.Interested(peers[0])
+	if peers[0].choked {
+		t.Fatalf("Expected an interested peer to take a free slot straight away")
+	}
+	peers[1].interested = true
+	c.Interested(peers[1])
+	if !peers[1].choked {
+		t.Errorf("Expected no free slot for a second peer")
+	}
+
+	peers[0].interested = false
+	c.NotInterested(peers[0])
+	if !peers[0].choked || peers[1].choked {
+		t.Errorf("Expected the slot to pass to the other peer when the first lost interest")
+	}
+
+	peers[0].interested = true
+	c.Interested(peers[0])
+	c.Remove(peers[1])
+	if peers[0].choked {
+		t.Errorf("Expected the slot to pass back when the peer left")
+	}
+}
+
+// Helpers
+
+func testClock() *mock.MockClock {
+	return mock.NewMockClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// addPeers adds interested, choked peers
+func addPeers(c *Choker, count int) []*fakePeer {
+	peers := make([]*fakePeer, count)
+	for i := range peers {
+		peers[i] = &fakePeer{name: string(rune('a' + i)), interested: true, choked: true}
+		c.Add(peers[i])
+	}
+	return peers
+}
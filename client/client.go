@@ -0,0 +1,348 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/choker"
+	"github.com/onepointsixtwo/torrentsgo/dht"
+	"github.com/onepointsixtwo/torrentsgo/extension"
+	"github.com/onepointsixtwo/torrentsgo/lsd"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/peer"
+	"github.com/onepointsixtwo/torrentsgo/peerid"
+	"github.com/onepointsixtwo/torrentsgo/peerwire"
+	"github.com/onepointsixtwo/torrentsgo/proxy"
+	"github.com/onepointsixtwo/torrentsgo/storage"
+	"github.com/onepointsixtwo/torrentsgo/tracker"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"github.com/onepointsixtwo/torrentsgo/utp"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_PEERS             = 200
+	DEFAULT_MAX_PEERS_PER_TORRENT = 50
+)
+
+var (
+	ErrClientClosed   = errors.New("Client is closed")
+	ErrTorrentStopped = errors.New("Torrent has been stopped")
+)
+
+// Types
+
+type Config struct {
+	PeerId []byte
+	// ListenAddr is where incoming peer connections are accepted, or empty to accept none
+	ListenAddr string
+	// UTP also carries peer connections over uTP. Incoming ones are accepted on ListenAddr's
+	// port, and outgoing ones are tried over uTP when TCP fails. uTP connections don't go
+	// through Dialer.
+	UTP bool
+	// MaxPeers limits connections across all torrents, and MaxPeersPerTorrent for each one
+	MaxPeers           int
+	MaxPeersPerTorrent int
+	// UploadSlots is how many peers each torrent unchokes besides its optimistic unchoke, see
+	// choker.Config
+	UploadSlots      int
+	SeedingAlgorithm choker.SeedingAlgorithm
+	// Dialer is used for outgoing peer connections, see proxy.Config.PeerDialer
+	Dialer proxy.Dialer
+	// TrackerDialer is used by the tracker manager, see proxy.Config.TrackerDialer
+	TrackerDialer proxy.Dialer
+	// DHT finds peers for torrents which aren't private and for magnet links. The caller
+	// bootstraps it and closes it, so its nodes can be saved.
+	DHT *dht.Server
+	// LSD finds peers on the local network for torrents which aren't private and for magnet
+	// links. The caller closes it.
+	LSD   *lsd.Service
+	Clock util.Clock
+}
+
+// Client runs any number of torrents, sharing a listening port, a tracker manager and a limit
+// on peer connections between them
+type Client struct {
+	config   Config
+	listener net.Listener
+	socket   *utp.Socket
+	manager  *tracker.Manager
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	lock     sync.Mutex
+	torrents map[string]*Torrent
+	fetches  map[string]*fetch
+	numPeers int
+	closed   bool
+}
+
+// Initialiser
+
+func NewClient(config Config) (*Client, error) {
+	if config.PeerId == nil {
+		config.PeerId = peerid.New()
+	}
+	if config.MaxPeers <= 0 {
+		config.MaxPeers = DEFAULT_MAX_PEERS
+	}
+	if config.MaxPeersPerTorrent <= 0 {
+		config.MaxPeersPerTorrent = DEFAULT_MAX_PEERS_PER_TORRENT
+	}
+	if config.Dialer == nil {
+		config.Dialer = proxy.Direct()
+	}
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{config: config, ctx: ctx, cancel: cancel, torrents: make(map[string]*Torrent), fetches: make(map[string]*fetch)}
+
+	port := 0
+	if config.ListenAddr != "" {
+		listener, err := net.Listen("tcp", config.ListenAddr)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		c.listener = listener
+		_, port, _ = addrIPPort(listener.Addr())
+	}
+	if config.UTP {
+		// uTP shares the TCP port, so peers can reach us on either at the port we announce
+		address := ":0"
+		if c.listener != nil {
+			host, _, _ := net.SplitHostPort(config.ListenAddr)
+			address = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		socket, err := utp.Listen(address)
+		if err != nil {
+			cancel()
+			if c.listener != nil {
+				c.listener.Close()
+			}
+			return nil, err
+		}
+		c.socket = socket
+	}
+	c.manager = tracker.NewManager(tracker.ManagerConfig{PeerId: config.PeerId, Port: port, Dialer: config.TrackerDialer, Clock: config.Clock})
+
+	c.wg.Add(1)
+	go c.routeTrackerPeers()
+	if c.listener != nil {
+		c.wg.Add(1)
+		go c.acceptLoop(c.listener)
+		if c.socket != nil {
+			c.wg.Add(1)
+			go c.acceptLoop(c.socket)
+		}
+	}
+	return c, nil
+}
+
+// Public Methods
+
+// AddTorrent adds a torrent stored in s, given the pieces already in it (which may be nil). The
+// torrent does nothing until it is started.
+func (c *Client) AddTorrent(metaInfo *model.MetaInfo, s storage.Storage, have *model.Bitfield) (*Torrent, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil, ErrClientClosed
+	}
+	key := string(metaInfo.Info.Hash)
+	if _, exists := c.torrents[key]; exists {
+		return nil, fmt.Errorf("Torrent %x has already been added", metaInfo.Info.Hash)
+	}
+	if err := metaInfo.Info.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid torrent %x - %v", metaInfo.Info.Hash, err)
+	}
+	if have != nil && have.Len() != metaInfo.Info.NumPieces() {
+		return nil, fmt.Errorf("Bitfield has %v pieces but torrent has %v", have.Len(), metaInfo.Info.NumPieces())
+	}
+
+	t := newTorrent(c, metaInfo, s, have)
+	c.torrents[key] = t
+	return t, nil
+}
+
+// Addr returns the address peers can connect to over TCP, or nil if not listening. With UTP set,
+// they can connect over uTP on the same port.
+func (c *Client) Addr() net.Addr {
+	if c.listener == nil {
+		return nil
+	}
+	return c.listener.Addr()
+}
+
+func (c *Client) PeerId() []byte {
+	return c.config.PeerId
+}
+
+// Close stops every torrent and the listeners
+func (c *Client) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	torrents := make([]*Torrent, 0, len(c.torrents))
+	for _, t := range c.torrents {
+		torrents = append(torrents, t)
+	}
+	c.lock.Unlock()
+
+	for _, t := range torrents {
+		t.Stop()
+	}
+	c.cancel()
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.socket != nil {
+		c.socket.Close()
+	}
+	c.manager.Close()
+	c.wg.Wait()
+	return nil
+}
+
+// Helpers
+
+func (c *Client) acceptLoop(listener net.Listener) {
+	defer c.wg.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		if !c.reservePeer() {
+			conn.Close()
+			continue
+		}
+		c.wg.Add(1)
+		go c.accept(conn)
+	}
+}
+
+// accept completes the handshake of an incoming connection and passes it to its torrent
+func (c *Client) accept(conn net.Conn) {
+	defer c.wg.Done()
+
+	var target *Torrent
+	_, remote, err := peer.Accept(c.ctx, conn, func(infoHash []byte) (*peerwire.Handshake, bool) {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		t, ok := c.torrents[string(infoHash)]
+		if !ok || !t.Running() {
+			return nil, false
+		}
+		target = t
+		return t.handshake(), true
+	})
+	if err != nil {
+		c.releasePeer()
+		return
+	}
+	target.incoming(conn, remote)
+}
+
+// dial connects to a peer through the configured dialer, trying uTP too if that fails to connect
+func (c *Client) dial(ctx context.Context, address string, local *peerwire.Handshake) (net.Conn, *peerwire.Handshake, error) {
+	conn, remote, err := peer.Dial(ctx, c.config.Dialer, address, local)
+	var opErr *net.OpError
+	if err != nil && c.socket != nil && ctx.Err() == nil && errors.As(err, &opErr) && opErr.Op == "dial" {
+		return peer.Dial(ctx, c.socket, address, local)
+	}
+	return conn, remote, err
+}
+
+// routeTrackerPeers passes the peers trackers return to their torrents
+func (c *Client) routeTrackerPeers() {
+	defer c.wg.Done()
+	for batch := range c.manager.Peers() {
+		c.lock.Lock()
+		t, ok := c.torrents[string(batch.InfoHash)]
+		f := c.fetches[string(batch.InfoHash)]
+		c.lock.Unlock()
+		if !ok && f == nil {
+			continue
+		}
+
+		addresses := make([]string, 0, len(batch.Peers))
+		for _, p := range batch.Peers {
+			addresses = append(addresses, net.JoinHostPort(p.IP.String(), fmt.Sprint(p.Port)))
+		}
+		if ok {
+			t.AddPeers(addresses...)
+		} else {
+			f.addPeers(addresses)
+		}
+	}
+}
+
+// reservePeer claims one of the client's peer connections, returning false if there are none left
+func (c *Client) reservePeer() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.numPeers >= c.config.MaxPeers {
+		return false
+	}
+	c.numPeers++
+	return true
+}
+
+func (c *Client) releasePeer() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.numPeers--
+}
+
+// dhtPort returns the port our DHT node listens on, or 0 without one
+func (c *Client) dhtPort() int {
+	if c.config.DHT == nil {
+		return 0
+	}
+	if addr, ok := c.config.DHT.Addr().(*net.UDPAddr); ok {
+		return addr.Port
+	}
+	return 0
+}
+
+// extensionConfig is what we tell a peer in our extension handshake
+func (c *Client) extensionConfig(remote net.Addr) extension.SessionConfig {
+	config := extension.SessionConfig{Reqq: peer.DEFAULT_MAX_INCOMING_REQUESTS}
+	if client := peerid.Parse(c.config.PeerId); client.Style != peerid.STYLE_UNKNOWN {
+		config.Version = client.String()
+	}
+	if _, port, ok := addrIPPort(c.Addr()); ok {
+		config.Port = port
+	}
+	if ip, _, ok := addrIPPort(remote); ok {
+		config.RemoteIP = ip
+	}
+	return config
+}
+
+func (c *Client) remove(t *Torrent) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.torrents, string(t.info.Hash))
+}
+
+// addrIPPort returns the IP and port of a TCP or uTP connection's address
+func addrIPPort(addr net.Addr) (net.IP, int, bool) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port, true
+	case *net.UDPAddr:
+		return addr.IP, addr.Port, true
+	}
+	return nil, 0, false
+}
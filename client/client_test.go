@@ -0,0 +1,116 @@
+package client
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/storage"
+	"testing"
+	"time"
+)
+
+const TEST_TIMEOUT = 20 * time.Second
+
+func TestAddTorrentRejectsDuplicatesAndBadBitfields(t *testing.T) {
+	c := newTestClient(t, Config{})
+	metaInfo, _ := testTorrent(t, []int{40000})
+
+	if _, err := c.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), model.NewBitfield(3)); err == nil {
+		t.Errorf("Expected a bitfield of the wrong length to be rejected")
+	}
+	broken := *metaInfo.Info
+	broken.PieceLength = 0
+	if _, err := c.AddTorrent(&model.MetaInfo{Info: &broken}, storage.NewMemoryStorage(metaInfo.Info), nil); err == nil {
+		t.Errorf("Expected a torrent with piece length 0 to be rejected")
+	}
+	if _, err := c.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil); err != nil {
+		t.Fatalf("Unexpected error adding torrent %v", err)
+	}
+	if _, err := c.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil); err == nil {
+		t.Errorf("Expected a torrent added twice to be rejected")
+	}
+}
+
+func TestClosedClientStopsTorrents(t *testing.T) {
+	c := newTestClient(t, Config{})
+	metaInfo, _ := testTorrent(t, []int{40000})
+	torrent, err := c.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error adding torrent %v", err)
+	}
+	torrent.Start()
+
+	c.Close()
+	if state := torrent.Stats().State; state != STATE_STOPPED {
+		t.Errorf("Expected torrent to be stopped but was %v", state)
+	}
+	if err := torrent.Start(); err != ErrTorrentStopped {
+		t.Errorf("Expected stopped torrent not to start but was %v", err)
+	}
+	if _, err := c.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil); err != ErrClientClosed {
+		t.Errorf("Expected closed client to refuse torrents but was %v", err)
+	}
+}
+
+// Helpers
+
+func newTestClient(t *testing.T, config Config) *Client {
+	if config.ListenAddr == "" {
+		config.ListenAddr = "127.0.0.1:0"
+	}
+	c, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("Unexpected error creating client %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// testTorrent generates a torrent of random data with 32KiB pieces, returning its data too
+func testTorrent(t *testing.T, lengths []int) (*model.MetaInfo, []byte) {
+	total := 0
+	files := make([]*model.File, len(lengths))
+	for i, length := range lengths {
+		files[i] = &model.File{Path: string(rune('a' + i)), Length: length}
+		total += length
+	}
+	data := make([]byte, total)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("Unexpected error generating data %v", err)
+	}
+
+	pieceLength := 32 * 1024
+	pieces := []byte{}
+	for offset := 0; offset < total; offset += pieceLength {
+		end := offset + pieceLength
+		if end > total {
+			end = total
+		}
+		hash := sha1.Sum(data[offset:end])
+		pieces = append(pieces, hash[:]...)
+	}
+	hash := sha1.Sum(data)
+
+	info := &model.Info{PieceLength: pieceLength, Pieces: pieces, Files: files, DirectoryName: "test", Hash: hash[:]}
+	return &model.MetaInfo{Info: info}, data
+}
+
+// seeded returns memory storage holding all of a torrent's data
+func seeded(t *testing.T, info *model.Info, data []byte) storage.Storage {
+	s := storage.NewMemoryStorage(info)
+	for piece := 0; piece < info.NumPieces(); piece++ {
+		offset := piece * info.PieceLength
+		if _, err := s.WriteAt(data[offset:offset+info.PieceSize(piece)], piece, 0); err != nil {
+			t.Fatalf("Unexpected error seeding piece %v: %v", piece, err)
+		}
+	}
+	return s
+}
+
+func waitComplete(t *testing.T, torrent *Torrent) {
+	select {
+	case <-torrent.Completed():
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatalf("Timed out waiting for download, stats %+v err %v", torrent.Stats(), torrent.Err())
+	}
+}
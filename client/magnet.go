@@ -0,0 +1,300 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/extension"
+	"github.com/onepointsixtwo/torrentsgo/metadata"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/peerwire"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Fetches announce this much left, as trackers may not give seeds to peers reporting 0
+	FETCH_LEFT = metadata.PIECE_LENGTH
+	// Writes to a peer taking longer than this close the connection
+	FETCH_WRITE_TIMEOUT = 30 * time.Second
+)
+
+// Types
+
+// fetch gets the metadata for a magnet link. Its connections only speak the extension protocol,
+// as nothing else can be done without the info. Its maps are only used by FetchMetadata's
+// goroutine.
+type fetch struct {
+	client    *Client
+	magnet    *model.Magnet
+	exchange  *metadata.Exchange
+	registry  *extension.Registry
+	ctx       context.Context
+	wg        sync.WaitGroup
+	added     chan []string
+	connected chan *connection
+	events    chan fetchEvent
+
+	peers      map[*fetchConn]*extension.Session
+	known      map[string]bool
+	addresses  []string
+	connecting int
+}
+
+// fetchConn is a connection to a peer we're fetching metadata from
+type fetchConn struct {
+	conn   net.Conn
+	writer *peerwire.Writer
+}
+
+type fetchEvent struct {
+	conn    *fetchConn
+	message *peerwire.Extended
+	closed  bool
+}
+
+// Public Methods
+
+// FetchMetadata fetches the info for a magnet link from peers supporting ut_metadata (BEP 9),
+// which are found from the link and its trackers. It returns once the info has been checked
+// against the info hash, giving meta info which can be passed to AddTorrent, or when ctx is done.
+// Links to mutable torrents have their current info hash looked up in the DHT first (BEP 46).
+func (c *Client) FetchMetadata(ctx context.Context, magnet *model.Magnet) (*model.MetaInfo, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if magnet.InfoHash == nil {
+		resolved, err := c.resolveMagnet(ctx, magnet)
+		if err != nil {
+			return nil, err
+		}
+		magnet = resolved
+	}
+
+	f := &fetch{
+		client:    c,
+		magnet:    magnet,
+		exchange:  metadata.NewExchange(magnet.InfoHash),
+		registry:  extension.NewRegistry(),
+		ctx:       ctx,
+		added:     make(chan []string),
+		connected: make(chan *connection),
+		events:    make(chan fetchEvent),
+		peers:     make(map[*fetchConn]*extension.Session),
+		known:     make(map[string]bool),
+	}
+	f.registry.Register(f.exchange)
+
+	key := string(magnet.InfoHash)
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, ErrClientClosed
+	}
+	if _, exists := c.fetches[key]; exists {
+		c.lock.Unlock()
+		return nil, fmt.Errorf("Metadata for %x is already being fetched", magnet.InfoHash)
+	}
+	c.fetches[key] = f
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.fetches, key)
+		c.lock.Unlock()
+	}()
+
+	if len(magnet.Trackers) > 0 {
+		err := c.manager.Add(magnet.InfoHash, magnet.MetaInfo(nil).AnnounceTiers(), func() (int64, int64, int64) { return 0, 0, FETCH_LEFT })
+		if err != nil {
+			return nil, err
+		}
+		defer c.manager.Remove(magnet.InfoHash)
+	}
+
+	return f.run(cancel)
+}
+
+// Helpers
+
+// resolveMagnet returns a copy of a mutable torrent's magnet link with its current info hash
+func (c *Client) resolveMagnet(ctx context.Context, magnet *model.Magnet) (*model.Magnet, error) {
+	if magnet.PublicKey == nil {
+		return nil, fmt.Errorf("Magnet link has no info hash")
+	}
+	if c.config.DHT == nil {
+		return nil, fmt.Errorf("Mutable torrent magnet links need the DHT")
+	}
+	infoHash, err := c.config.DHT.ResolveTorrent(ctx, magnet.PublicKey, magnet.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve mutable torrent %x - %v", magnet.PublicKey, err)
+	}
+	resolved := *magnet
+	resolved.InfoHash = infoHash
+	return &resolved, nil
+}
+
+func (f *fetch) run(cancel context.CancelFunc) (*model.MetaInfo, error) {
+	defer func() {
+		cancel()
+		for conn, session := range f.peers {
+			conn.conn.Close()
+			session.Close()
+			f.client.releasePeer()
+		}
+		f.wg.Wait()
+	}()
+
+	f.queue(f.magnet.Peers)
+	if f.client.config.DHT != nil {
+		f.wg.Add(1)
+		go f.lookupDHT()
+	}
+	if service := f.client.config.LSD; service != nil {
+		service.Add(f.magnet.InfoHash, 0, f.addPeers)
+		defer service.Remove(f.magnet.InfoHash)
+	}
+	for {
+		f.connectPeers()
+		select {
+		case <-f.exchange.Done():
+			return f.magnet.MetaInfo(f.exchange.Info()), nil
+		case <-f.ctx.Done():
+			return nil, f.ctx.Err()
+		case <-f.client.ctx.Done():
+			return nil, ErrClientClosed
+		case addresses := <-f.added:
+			f.queue(addresses)
+		case c := <-f.connected:
+			f.addPeer(c)
+		case e := <-f.events:
+			session, ok := f.peers[e.conn]
+			if !ok {
+				continue
+			}
+			if e.closed {
+				delete(f.peers, e.conn)
+				session.Close()
+				f.client.releasePeer()
+			} else if err := session.Handle(e.message.ExtendedId, e.message.Payload); err != nil {
+				e.conn.conn.Close()
+			}
+		}
+	}
+}
+
+// addPeers passes on peers from a tracker or the DHT
+func (f *fetch) addPeers(addresses []string) {
+	select {
+	case f.added <- addresses:
+	case <-f.ctx.Done():
+	}
+}
+
+// lookupDHT regularly asks the DHT for peers of the torrent
+func (f *fetch) lookupDHT() {
+	defer f.wg.Done()
+	for {
+		if peers, _ := f.client.config.DHT.GetPeers(f.ctx, f.magnet.InfoHash); len(peers) > 0 {
+			f.addPeers(peers)
+		}
+		timer := f.client.config.Clock.NewTimer(DHT_RETRY_INTERVAL)
+		select {
+		case <-timer.C():
+		case <-f.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (f *fetch) queue(addresses []string) {
+	for _, address := range addresses {
+		if !f.known[address] {
+			f.known[address] = true
+			f.addresses = append(f.addresses, address)
+		}
+	}
+}
+
+// connectPeers dials queued addresses while there is room under the peer limits
+func (f *fetch) connectPeers() {
+	for len(f.addresses) > 0 && len(f.peers)+f.connecting < f.client.config.MaxPeersPerTorrent {
+		if !f.client.reservePeer() {
+			return
+		}
+		address := f.addresses[0]
+		f.addresses = f.addresses[1:]
+		f.connecting++
+
+		handshake := &peerwire.Handshake{InfoHash: f.magnet.InfoHash, PeerId: f.client.config.PeerId}
+		handshake.SetReserved(peerwire.RESERVED_EXTENSION_PROTOCOL)
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			ctx, cancel := context.WithTimeout(f.ctx, DIAL_TIMEOUT)
+			conn, remote, err := f.client.dial(ctx, address, handshake)
+			cancel()
+			if err == nil && !remote.HasReserved(peerwire.RESERVED_EXTENSION_PROTOCOL) {
+				conn.Close()
+				err = fmt.Errorf("Peer %v doesn't support extensions", address)
+			}
+
+			select {
+			case f.connected <- &connection{conn: conn, remote: remote, address: address, outgoing: true, err: err}:
+			case <-f.ctx.Done():
+				if err == nil {
+					conn.Close()
+				}
+				f.client.releasePeer()
+			}
+		}()
+	}
+}
+
+func (f *fetch) addPeer(c *connection) {
+	f.connecting--
+	if c.err != nil {
+		f.client.releasePeer()
+		return
+	}
+
+	conn := &fetchConn{conn: c.conn, writer: peerwire.NewWriter(c.conn)}
+	session := f.registry.NewSession(f.client.extensionConfig(c.conn.RemoteAddr()), conn.send)
+	f.peers[conn] = session
+	if err := session.SendHandshake(); err != nil {
+		conn.conn.Close()
+	}
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		reader := peerwire.NewReader(conn.conn)
+		for {
+			message, err := reader.ReadMessage()
+			if err != nil {
+				break
+			}
+			// Everything but the extension protocol is ignored
+			if extended, ok := message.(*peerwire.Extended); ok {
+				select {
+				case f.events <- fetchEvent{conn: conn, message: extended}:
+				case <-f.ctx.Done():
+					return
+				}
+			}
+		}
+		select {
+		case f.events <- fetchEvent{conn: conn, closed: true}:
+		case <-f.ctx.Done():
+		}
+	}()
+}
+
+// send writes an extended message, closing the connection if it fails. It is only called from
+// the fetch's goroutine.
+func (c *fetchConn) send(id byte, payload []byte) {
+	c.conn.SetWriteDeadline(time.Now().Add(FETCH_WRITE_TIMEOUT))
+	if err := c.writer.WriteMessage(&peerwire.Extended{ExtendedId: id, Payload: payload}); err != nil {
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/dht"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/parser"
+	"github.com/onepointsixtwo/torrentsgo/storage"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFetchMetadataFromSeeder(t *testing.T) {
+	metaInfo, data := parsedTorrent(t, []int{100000, 30000})
+	seeder, _ := newSeeder(t, metaInfo, data)
+	leecher := newTestClient(t, Config{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	magnet := &model.Magnet{InfoHash: metaInfo.Info.Hash, Peers: []string{seeder.Addr().String()}}
+	fetched, err := leecher.FetchMetadata(ctx, magnet)
+	if err != nil {
+		t.Fatalf("Unexpected error fetching metadata %v", err)
+	}
+	if !bytes.Equal(fetched.Info.Raw, metaInfo.Info.Raw) || fetched.Info.NumPieces() != metaInfo.Info.NumPieces() {
+		t.Fatalf("Expected fetched info to match the seeder's")
+	}
+
+	// The fetched info is enough to download the torrent
+	s := storage.NewMemoryStorage(fetched.Info)
+	download, err := leecher.AddTorrent(fetched, s, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error adding torrent %v", err)
+	}
+	download.Start()
+	download.AddPeers(seeder.Addr().String())
+	waitComplete(t, download)
+	if !bytes.Equal(s.Bytes(), data) {
+		t.Errorf("Expected downloaded data to match")
+	}
+}
+
+func TestFetchMetadataEndsWithContext(t *testing.T) {
+	metaInfo, _ := parsedTorrent(t, []int{1000})
+	c := newTestClient(t, Config{})
+
+	// The only peer doesn't have the torrent
+	other := newTestClient(t, Config{})
+	magnet := &model.Magnet{InfoHash: metaInfo.Info.Hash, Peers: []string{other.Addr().String()}}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		_, err := c.FetchMetadata(ctx, magnet)
+		done <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if _, err := c.FetchMetadata(ctx, magnet); err == nil {
+		t.Errorf("Expected an error fetching the same metadata twice")
+	}
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("Expected the fetch to end with its context but was %v", err)
+	}
+}
+
+func TestFetchMetadataThroughDHT(t *testing.T) {
+	metaInfo, data := parsedTorrent(t, []int{40000})
+	network := mock.NewMockPacketNetwork()
+	seederNode, leecherNode := newTestDHT(t, network), newTestDHT(t, network)
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	if _, err := leecherNode.Ping(ctx, seederNode.Addr().String()); err != nil {
+		t.Fatalf("Unexpected error joining the DHT %v", err)
+	}
+
+	seeder := newTestClient(t, Config{DHT: seederNode})
+	have := model.NewBitfieldForInfo(metaInfo.Info)
+	have.SetAll()
+	seed, _ := seeder.AddTorrent(metaInfo, seeded(t, metaInfo.Info, data), have)
+	seed.Start()
+	waitFor(t, func() bool {
+		peers, _ := leecherNode.GetPeers(ctx, metaInfo.Info.Hash)
+		return len(peers) > 0
+	})
+
+	// The magnet link has neither trackers nor peers
+	leecher := newTestClient(t, Config{DHT: leecherNode})
+	fetched, err := leecher.FetchMetadata(ctx, &model.Magnet{InfoHash: metaInfo.Info.Hash})
+	if err != nil {
+		t.Fatalf("Unexpected error fetching metadata %v", err)
+	}
+	if !bytes.Equal(fetched.Info.Raw, metaInfo.Info.Raw) {
+		t.Errorf("Expected fetched info to match the seeder's")
+	}
+}
+
+func TestFetchMutableTorrentMetadata(t *testing.T) {
+	metaInfo, data := parsedTorrent(t, []int{40000})
+	network := mock.NewMockPacketNetwork()
+	seederNode, leecherNode := newTestDHT(t, network), newTestDHT(t, network)
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	if _, err := leecherNode.Ping(ctx, seederNode.Addr().String()); err != nil {
+		t.Fatalf("Unexpected error joining the DHT %v", err)
+	}
+
+	seeder := newTestClient(t, Config{DHT: seederNode})
+	have := model.NewBitfieldForInfo(metaInfo.Info)
+	have.SetAll()
+	seed, _ := seeder.AddTorrent(metaInfo, seeded(t, metaInfo.Info, data), have)
+	seed.Start()
+	// Announce now rather than waiting on the torrent's own announce, which may not have reached
+	// the leecher's node before it looks
+	if _, err := seederNode.Announce(ctx, metaInfo.Info.Hash, seeder.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("Unexpected error announcing the seeder %v", err)
+	}
+
+	// The seeder publishes the torrent as the current version of a mutable torrent
+	publicKey, privateKey, _ := ed25519.GenerateKey(nil)
+	item, err := dht.NewTorrentItem(privateKey, []byte("latest"), 1, metaInfo.Info.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := seederNode.Put(ctx, item); err != nil {
+		t.Fatalf("Unexpected error publishing mutable torrent %v", err)
+	}
+
+	leecher := newTestClient(t, Config{DHT: leecherNode})
+	fetched, err := leecher.FetchMetadata(ctx, &model.Magnet{PublicKey: publicKey, Salt: []byte("latest")})
+	if err != nil {
+		t.Fatalf("Unexpected error fetching metadata %v", err)
+	}
+	if !bytes.Equal(fetched.Info.Raw, metaInfo.Info.Raw) {
+		t.Errorf("Expected fetched info to match the seeder's")
+	}
+
+	// Without the DHT the info hash can't be found
+	if _, err := newTestClient(t, Config{}).FetchMetadata(ctx, &model.Magnet{PublicKey: publicKey}); err == nil {
+		t.Errorf("Expected an error fetching a mutable torrent without the DHT")
+	}
+}
+
+// parsedTorrent is testTorrent with the info encoded and parsed back, so it has raw bytes to serve
+func parsedTorrent(t *testing.T, lengths []int) (*model.MetaInfo, []byte) {
+	metaInfo, data := testTorrent(t, lengths)
+	files := []interface{}{}
+	for _, file := range metaInfo.Info.Files {
+		dict := model.NewOrderedMap()
+		dict.Add("length", file.Length)
+		dict.Add("path", []interface{}{file.Path})
+		files = append(files, dict)
+	}
+	dict := model.NewOrderedMap()
+	dict.Add("files", files)
+	dict.Add("name", metaInfo.Info.DirectoryName)
+	dict.Add("piece length", metaInfo.Info.PieceLength)
+	dict.Add("pieces", string(metaInfo.Info.Pieces))
+
+	raw, err := bencoding.EncodeBencoding(dict)
+	if err != nil {
+		t.Fatalf("Unexpected error encoding info %v", err)
+	}
+	info, err := parser.ParseInfo(raw)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing info %v", err)
+	}
+	return &model.MetaInfo{Info: info}, data
+}
@@ -0,0 +1,864 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"github.com/onepointsixtwo/torrentsgo/choker"
+	"github.com/onepointsixtwo/torrentsgo/extension"
+	"github.com/onepointsixtwo/torrentsgo/metadata"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/peer"
+	"github.com/onepointsixtwo/torrentsgo/peerwire"
+	"github.com/onepointsixtwo/torrentsgo/pex"
+	"github.com/onepointsixtwo/torrentsgo/picker"
+	"github.com/onepointsixtwo/torrentsgo/storage"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	MAINTENANCE_INTERVAL = time.Second
+	DIAL_TIMEOUT         = 10 * time.Second
+	// How often torrents look for peers in the DHT, or retry when no DHT node could be reached
+	DHT_ANNOUNCE_INTERVAL = 15 * time.Minute
+	DHT_RETRY_INTERVAL    = time.Minute
+)
+
+type State int
+
+const (
+	// Added but not started, or paused
+	STATE_PAUSED State = iota
+	STATE_RUNNING
+	// Stopped for good and removed from the client
+	STATE_STOPPED
+)
+
+// Types
+
+type Stats struct {
+	State      State
+	Complete   bool
+	NumPieces  int
+	Have       int
+	Downloaded int64
+	Uploaded   int64
+	// Left is how many bytes are still to be downloaded
+	Left  int64
+	Peers int
+}
+
+// Torrent downloads and seeds one torrent. Peer connections, picking, hash checking and storage
+// writes are all run by a single goroutine for each run between Start and Pause or Stop.
+type Torrent struct {
+	client     *Client
+	metaInfo   *model.MetaInfo
+	info       *model.Info
+	storage    storage.Storage
+	wake       chan struct{}
+	complete   chan struct{}
+	extensions *extension.Registry
+	// pex is nil for private torrents
+	pex *pex.Exchange
+
+	// Only used by the run goroutine
+	picker  *picker.Picker
+	buffers map[int][]byte
+
+	lock       sync.Mutex
+	state      State
+	session    *session
+	have       *model.Bitfield
+	known      map[string]bool
+	queued     []string
+	downloaded int64
+	uploaded   int64
+	numPeers   int
+	err        error
+}
+
+// session is one run of a torrent. Its maps are only used by the run goroutine.
+type session struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	wg         sync.WaitGroup
+	connected  chan *connection
+	events     chan peerEvent
+	peers      map[*peer.Conn]*peerState
+	choker     *choker.Choker
+	addresses  []string
+	connecting int
+}
+
+// connection is the result of dialling or accepting a peer
+type connection struct {
+	conn     net.Conn
+	remote   *peerwire.Handshake
+	address  string
+	outgoing bool
+	err      error
+}
+
+type peerEvent struct {
+	conn   *peer.Conn
+	event  peer.Event
+	closed bool
+}
+
+type peerState struct {
+	address  string
+	outgoing bool
+	bits     *model.Bitfield
+	// extensions is nil unless the peer supports the extension protocol
+	extensions *extension.Session
+	// pingedDHT is set once the DHT node the peer told us about has been pinged, so a peer
+	// repeating its port can't have us send more pings
+	pingedDHT bool
+}
+
+// Initialiser
+
+func newTorrent(client *Client, metaInfo *model.MetaInfo, s storage.Storage, have *model.Bitfield) *Torrent {
+	info := metaInfo.Info
+	if have == nil {
+		have = model.NewBitfieldForInfo(info)
+	} else {
+		have = have.Copy()
+	}
+
+	t := &Torrent{
+		client:     client,
+		metaInfo:   metaInfo,
+		info:       info,
+		storage:    s,
+		wake:       make(chan struct{}, 1),
+		complete:   make(chan struct{}),
+		extensions: extension.NewRegistry(),
+		picker:     picker.NewPicker(info, have, rand.New(rand.NewSource(time.Now().UnixNano()))),
+		buffers:    make(map[int][]byte),
+		have:       have,
+		known:      make(map[string]bool),
+	}
+	if have.All() {
+		close(t.complete)
+	}
+	// Peers fetching the torrent from a magnet link can get the metadata from us
+	if info.Raw != nil {
+		t.extensions.Register(metadata.NewExchangeForInfo(info))
+	}
+	// Private torrents only get peers from their trackers
+	if !info.IsPrivate() {
+		t.pex = pex.NewExchange(pex.Config{AddPeers: func(addresses []string) { t.AddPeers(addresses...) }, Clock: client.config.Clock})
+		t.extensions.Register(t.pex)
+	}
+	return t
+}
+
+// Public Methods
+
+// Start connects to peers and announces to trackers until the torrent is paused or stopped
+func (t *Torrent) Start() error {
+	t.lock.Lock()
+	switch t.state {
+	case STATE_STOPPED:
+		t.lock.Unlock()
+		return ErrTorrentStopped
+	case STATE_RUNNING:
+		t.lock.Unlock()
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(t.client.ctx)
+	config := t.client.config
+	s := &session{
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		connected: make(chan *connection),
+		events:    make(chan peerEvent),
+		peers:     make(map[*peer.Conn]*peerState),
+		choker:    choker.NewChoker(choker.Config{Slots: config.UploadSlots, Seeding: config.SeedingAlgorithm, Clock: config.Clock}),
+	}
+	s.choker.SetSeeding(t.have.All())
+	t.session = s
+	t.state = STATE_RUNNING
+	t.err = nil
+	// Every peer we've been given is worth trying again
+	t.queued = t.queued[:0]
+	for address := range t.known {
+		t.queued = append(t.queued, address)
+	}
+	go t.run(s)
+	if t.useDHT() {
+		s.wg.Add(1)
+		go t.announceDHT(s)
+	}
+	if t.useLSD() {
+		s.wg.Add(1)
+		go t.discoverLocalPeers(s)
+	}
+	t.lock.Unlock()
+	t.signal()
+
+	if t.hasTrackers() {
+		// A run which failed leaves its announces going, so they are restarted
+		t.client.manager.Remove(t.info.Hash)
+		return t.client.manager.Add(t.info.Hash, t.metaInfo.AnnounceTiers(), t.transferStats)
+	}
+	return nil
+}
+
+// Pause disconnects from every peer and stops announcing. Start picks up where it left off.
+func (t *Torrent) Pause() {
+	t.lock.Lock()
+	if t.state != STATE_RUNNING {
+		t.lock.Unlock()
+		return
+	}
+	t.state = STATE_PAUSED
+	s := t.session
+	t.session = nil
+	t.lock.Unlock()
+
+	t.shutdown(s)
+}
+
+// Stop pauses the torrent for good, removes it from the client and closes its storage
+func (t *Torrent) Stop() error {
+	t.Pause()
+
+	t.lock.Lock()
+	if t.state == STATE_STOPPED {
+		t.lock.Unlock()
+		return nil
+	}
+	t.state = STATE_STOPPED
+	t.lock.Unlock()
+
+	t.client.remove(t)
+	if err := t.storage.Flush(); err != nil {
+		t.storage.Close()
+		return err
+	}
+	return t.storage.Close()
+}
+
+// AddPeers gives addresses of peers to connect to, as host:port
+func (t *Torrent) AddPeers(addresses ...string) {
+	t.lock.Lock()
+	for _, address := range addresses {
+		if !t.known[address] {
+			t.known[address] = true
+			t.queued = append(t.queued, address)
+		}
+	}
+	t.lock.Unlock()
+	t.signal()
+}
+
+// Completed is closed once every piece has been downloaded and checked
+func (t *Torrent) Completed() <-chan struct{} {
+	return t.complete
+}
+
+func (t *Torrent) Running() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.state == STATE_RUNNING
+}
+
+// Err returns the error which stopped the last run, such as a storage failure
+func (t *Torrent) Err() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err
+}
+
+func (t *Torrent) InfoHash() []byte {
+	return t.info.Hash
+}
+
+// Extensions returns the registry of protocol extensions offered to this torrent's peers.
+// Extensions should be registered before Start, as connections only use those registered when
+// they were made.
+func (t *Torrent) Extensions() *extension.Registry {
+	return t.extensions
+}
+
+// Bitfield returns a copy of the pieces we have
+func (t *Torrent) Bitfield() *model.Bitfield {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.have.Copy()
+}
+
+func (t *Torrent) Stats() Stats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	left := t.info.TotalLength()
+	for index := t.have.NextSet(0); index >= 0; index = t.have.NextSet(index + 1) {
+		left -= int64(t.info.PieceSize(index))
+	}
+	return Stats{
+		State:      t.state,
+		Complete:   t.have.All(),
+		NumPieces:  t.have.Len(),
+		Have:       t.have.Count(),
+		Downloaded: t.downloaded,
+		Uploaded:   t.uploaded,
+		Left:       left,
+		Peers:      t.numPeers,
+	}
+}
+
+// Running
+
+func (t *Torrent) run(s *session) {
+	defer close(s.done)
+
+	timer := t.client.config.Clock.NewTimer(MAINTENANCE_INTERVAL)
+	rechoke := t.client.config.Clock.NewTimer(choker.RECHOKE_INTERVAL)
+	for {
+		select {
+		case <-t.wake:
+			t.takeQueued(s)
+			t.connectPeers(s)
+		case c := <-s.connected:
+			t.addPeer(s, c)
+		case e := <-s.events:
+			if e.closed {
+				t.removePeer(s, e.conn)
+			} else {
+				t.handle(s, e.conn, e.event)
+			}
+		case <-timer.C():
+			t.connectPeers(s)
+			for conn := range s.peers {
+				t.requestBlocks(s, conn)
+			}
+			if t.pex != nil {
+				t.pex.Tick(t.exchangeablePeers(s))
+			}
+			timer = t.client.config.Clock.NewTimer(MAINTENANCE_INTERVAL)
+		case <-rechoke.C():
+			s.choker.Rechoke()
+			rechoke = t.client.config.Clock.NewTimer(choker.RECHOKE_INTERVAL)
+		case <-s.ctx.Done():
+			timer.Stop()
+			rechoke.Stop()
+			t.closePeers(s)
+			return
+		}
+	}
+}
+
+// announceDHT regularly looks the torrent up in the DHT, announcing us as a peer when we accept
+// connections
+func (t *Torrent) announceDHT(s *session) {
+	defer s.wg.Done()
+	server := t.client.config.DHT
+	for {
+		var peers []string
+		var err error
+		if _, port, ok := addrIPPort(t.client.Addr()); ok {
+			peers, err = server.Announce(s.ctx, t.info.Hash, port)
+		} else {
+			peers, err = server.GetPeers(s.ctx, t.info.Hash)
+		}
+		if len(peers) > 0 {
+			t.AddPeers(peers...)
+		}
+
+		interval := DHT_ANNOUNCE_INTERVAL
+		if err != nil {
+			interval = DHT_RETRY_INTERVAL
+		}
+		timer := t.client.config.Clock.NewTimer(interval)
+		select {
+		case <-timer.C():
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// discoverLocalPeers announces the torrent on the local network while the session runs, passing
+// on the local peers announcing it
+func (t *Torrent) discoverLocalPeers(s *session) {
+	defer s.wg.Done()
+	_, port, _ := addrIPPort(t.client.Addr())
+	service := t.client.config.LSD
+	service.Add(t.info.Hash, port, func(addresses []string) { t.AddPeers(addresses...) })
+	<-s.ctx.Done()
+	service.Remove(t.info.Hash)
+}
+
+// addDHTNode pings the DHT node a peer told us about, so it is added to the routing table if it
+// answers. Only the first port each peer sends is pinged.
+func (t *Torrent) addDHTNode(s *session, conn *peer.Conn, state *peerState, port uint16) {
+	ip, _, ok := addrIPPort(conn.RemoteAddr())
+	if !ok || port == 0 || !t.useDHT() || state.pingedDHT {
+		return
+	}
+	state.pingedDHT = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t.client.config.DHT.Ping(s.ctx, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}()
+}
+
+// shutdown ends a session and waits for its connections to close
+func (t *Torrent) shutdown(s *session) {
+	if t.hasTrackers() {
+		t.client.manager.Remove(t.info.Hash)
+	}
+	s.cancel()
+	<-s.done
+}
+
+// closePeers closes every connection when the session ends, forgetting what they had requested
+func (t *Torrent) closePeers(s *session) {
+	for conn, state := range s.peers {
+		conn.Close()
+		t.picker.PeerLeft(conn, state.bits)
+		if state.extensions != nil {
+			state.extensions.Close()
+		}
+	}
+	s.wg.Wait()
+
+	t.lock.Lock()
+	t.numPeers = 0
+	t.lock.Unlock()
+}
+
+// Peers
+
+func (t *Torrent) takeQueued(s *session) {
+	t.lock.Lock()
+	queued := t.queued
+	t.queued = nil
+	t.lock.Unlock()
+
+	s.addresses = append(s.addresses, queued...)
+}
+
+// connectPeers dials known addresses while there is room under the peer limits
+func (t *Torrent) connectPeers(s *session) {
+	for len(s.addresses) > 0 && len(s.peers)+s.connecting < t.client.config.MaxPeersPerTorrent {
+		if !t.client.reservePeer() {
+			return
+		}
+		address := s.addresses[0]
+		s.addresses = s.addresses[1:]
+		s.connecting++
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ctx, cancel := context.WithTimeout(s.ctx, DIAL_TIMEOUT)
+			conn, remote, err := t.client.dial(ctx, address, t.handshake())
+			cancel()
+
+			select {
+			case s.connected <- &connection{conn: conn, remote: remote, address: address, outgoing: true, err: err}:
+			case <-s.ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+				t.client.releasePeer()
+			}
+		}()
+	}
+}
+
+// incoming passes on an accepted connection, which already holds a reservation with the client
+func (t *Torrent) incoming(conn net.Conn, remote *peerwire.Handshake) {
+	t.lock.Lock()
+	s := t.session
+	t.lock.Unlock()
+
+	if s != nil {
+		select {
+		case s.connected <- &connection{conn: conn, remote: remote, address: conn.RemoteAddr().String()}:
+			return
+		case <-s.ctx.Done():
+		}
+	}
+	conn.Close()
+	t.client.releasePeer()
+}
+
+func (t *Torrent) addPeer(s *session, c *connection) {
+	if c.outgoing {
+		s.connecting--
+	}
+	if c.err != nil {
+		t.client.releasePeer()
+		return
+	}
+
+	for conn, state := range s.peers {
+		if !bytes.Equal(conn.PeerId(), c.remote.PeerId) {
+			continue
+		}
+		// When we and the peer connect to each other at once, both sides keep the connection
+		// made by whichever has the lower peer id
+		if state.outgoing != c.outgoing && c.outgoing != (bytes.Compare(t.client.config.PeerId, c.remote.PeerId) < 0) {
+			c.conn.Close()
+			t.client.releasePeer()
+			return
+		}
+		// Otherwise a peer connecting again has usually dropped its old connection before we
+		// noticed, so the new one replaces it
+		conn.Close()
+		t.removePeer(s, conn)
+	}
+	if !c.outgoing && len(s.peers)+s.connecting >= t.client.config.MaxPeersPerTorrent {
+		c.conn.Close()
+		t.client.releasePeer()
+		return
+	}
+
+	conn := peer.NewConn(c.conn, c.remote, peer.Config{NumPieces: t.info.NumPieces(), Fast: true, Extensions: true, Clock: t.client.config.Clock})
+	t.lock.Lock()
+	have := t.have.Copy()
+	t.numPeers++
+	t.lock.Unlock()
+	conn.SendBitfield(have)
+	conn.AllowFast(t.allowedFast(c.conn.RemoteAddr(), have)...)
+	if port := t.client.dhtPort(); port > 0 && t.useDHT() && c.remote.HasReserved(peerwire.RESERVED_DHT) {
+		conn.SendPort(uint16(port))
+	}
+	state := &peerState{address: c.address, outgoing: c.outgoing, bits: model.NewBitfieldForInfo(t.info)}
+	if conn.SupportsExtensions() {
+		state.extensions = t.extensions.NewSession(t.client.extensionConfig(c.conn.RemoteAddr()), conn.SendExtended)
+		if err := state.extensions.SendHandshake(); err != nil {
+			conn.Close()
+		}
+	}
+	conn.Start(s.ctx)
+	s.peers[conn] = state
+	s.choker.Add(conn)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for event := range conn.Events() {
+			select {
+			case s.events <- peerEvent{conn: conn, event: event}:
+			case <-s.ctx.Done():
+			}
+		}
+		t.client.releasePeer()
+		select {
+		case s.events <- peerEvent{conn: conn, closed: true}:
+		case <-s.ctx.Done():
+		}
+	}()
+}
+
+func (t *Torrent) removePeer(s *session, conn *peer.Conn) {
+	state, ok := s.peers[conn]
+	if !ok {
+		return
+	}
+	delete(s.peers, conn)
+	t.picker.PeerLeft(conn, state.bits)
+	s.choker.Remove(conn)
+	if state.extensions != nil {
+		state.extensions.Close()
+	}
+
+	t.lock.Lock()
+	t.numPeers--
+	t.lock.Unlock()
+}
+
+// Protocol
+
+func (t *Torrent) handle(s *session, conn *peer.Conn, event peer.Event) {
+	state, ok := s.peers[conn]
+	if !ok {
+		return
+	}
+
+	switch event.Type {
+	case peer.EVENT_BITFIELD:
+		state.bits = conn.Bitfield()
+		t.picker.PeerBitfield(state.bits)
+		t.updateInterest(conn, state)
+	case peer.EVENT_HAVE:
+		state.bits.Set(int(event.Index))
+		t.picker.PeerHave(int(event.Index))
+		t.updateInterest(conn, state)
+	case peer.EVENT_UNCHOKED, peer.EVENT_ALLOWED_FAST:
+		t.requestBlocks(s, conn)
+	case peer.EVENT_CHOKED:
+		// Requests to a choking peer may never be answered, so they go back to be picked again
+		// unless the peer allows them fast
+		allowed := conn.AllowedFast()
+		for _, block := range conn.Pending() {
+			if !allowed.Test(int(block.Index)) {
+				conn.Cancel(block)
+				t.picker.Abort(conn, block)
+			}
+		}
+	case peer.EVENT_REQUEST_TIMEOUT, peer.EVENT_REJECTED:
+		t.picker.Abort(conn, event.Block)
+		t.requestBlocks(s, conn)
+	case peer.EVENT_BLOCK:
+		t.receiveBlock(s, conn, event.Block, event.Data)
+	case peer.EVENT_INTERESTED:
+		s.choker.Interested(conn)
+	case peer.EVENT_NOT_INTERESTED:
+		s.choker.NotInterested(conn)
+	case peer.EVENT_REQUEST:
+		t.sendBlock(conn, event.Block)
+	case peer.EVENT_PORT:
+		t.addDHTNode(s, conn, state, event.Port)
+	case peer.EVENT_EXTENDED:
+		if state.extensions != nil {
+			if err := state.extensions.Handle(event.ExtendedId, event.Data); err != nil {
+				conn.Close()
+			}
+		}
+	}
+}
+
+// updateInterest tells a peer whether it has anything we still want
+func (t *Torrent) updateInterest(conn *peer.Conn, state *peerState) {
+	t.lock.Lock()
+	wanted := state.bits.Copy()
+	wanted.AndNot(t.have)
+	t.lock.Unlock()
+
+	conn.SetInterested(!wanted.None())
+}
+
+// requestBlocks fills a peer's pipeline from the picker. While the peer is choking us only pieces
+// it allows fast are requested.
+func (t *Torrent) requestBlocks(s *session, conn *peer.Conn) {
+	if !conn.AmInterested() {
+		return
+	}
+	bits := s.peers[conn].bits
+	if conn.PeerChoking() {
+		bits = bits.Copy()
+		bits.And(conn.AllowedFast())
+		if bits.None() {
+			return
+		}
+	}
+	want := peer.DEFAULT_PIPELINE_LENGTH - len(conn.Pending())
+	if want <= 0 {
+		return
+	}
+	if blocks := t.picker.Pick(conn, bits, want); len(blocks) > 0 {
+		conn.Request(blocks...)
+	}
+}
+
+func (t *Torrent) receiveBlock(s *session, conn *peer.Conn, block peer.Block, data []byte) {
+	cancels, complete, accepted := t.picker.BlockReceived(conn, block)
+	if !accepted {
+		return
+	}
+	for _, other := range cancels {
+		other.(*peer.Conn).Cancel(block)
+	}
+
+	index := int(block.Index)
+	buffer, ok := t.buffers[index]
+	if !ok {
+		buffer = make([]byte, t.info.PieceSize(index))
+		t.buffers[index] = buffer
+	}
+	copy(buffer[block.Begin:], data)
+
+	t.lock.Lock()
+	t.downloaded += int64(len(data))
+	t.lock.Unlock()
+
+	if complete {
+		t.finishPiece(s, index, buffer)
+	}
+	t.requestBlocks(s, conn)
+}
+
+// finishPiece checks a downloaded piece against its hash and stores it
+func (t *Torrent) finishPiece(s *session, index int, buffer []byte) {
+	delete(t.buffers, index)
+
+	hash := sha1.Sum(buffer)
+	if !bytes.Equal(hash[:], t.info.PieceHash(index)) {
+		t.picker.PieceFailed(index)
+		return
+	}
+	if _, err := t.storage.WriteAt(buffer, index, 0); err != nil {
+		t.picker.PieceFailed(index)
+		t.fail(s, err)
+		return
+	}
+	t.picker.PieceVerified(index)
+
+	t.lock.Lock()
+	t.have.Set(index)
+	done := t.have.All()
+	t.lock.Unlock()
+
+	for conn, state := range s.peers {
+		conn.SendHave(uint32(index))
+		t.updateInterest(conn, state)
+	}
+	if done {
+		s.choker.SetSeeding(true)
+		t.storage.Flush()
+		close(t.complete)
+		if t.hasTrackers() {
+			t.client.manager.Completed(t.info.Hash)
+		}
+	}
+}
+
+func (t *Torrent) sendBlock(conn *peer.Conn, block peer.Block) {
+	t.lock.Lock()
+	have := t.have.Test(int(block.Index))
+	t.lock.Unlock()
+	if !have {
+		conn.Reject(block)
+		return
+	}
+
+	data := make([]byte, block.Length)
+	if _, err := t.storage.ReadAt(data, int(block.Index), int(block.Begin)); err != nil {
+		conn.Reject(block)
+		return
+	}
+	if conn.SendBlock(block.Index, block.Begin, data) {
+		t.lock.Lock()
+		t.uploaded += int64(len(data))
+		t.lock.Unlock()
+	}
+}
+
+// Helpers
+
+// fail stops a session after an error it can't continue from
+func (t *Torrent) fail(s *session, err error) {
+	t.lock.Lock()
+	if t.session == s {
+		t.err = err
+		t.state = STATE_PAUSED
+		t.session = nil
+	}
+	t.lock.Unlock()
+	s.cancel()
+}
+
+func (t *Torrent) handshake() *peerwire.Handshake {
+	handshake := peerwire.NewHandshake(t.info, t.client.config.PeerId)
+	handshake.SetReserved(peerwire.RESERVED_FAST)
+	handshake.SetReserved(peerwire.RESERVED_EXTENSION_PROTOCOL)
+	if t.useDHT() {
+		handshake.SetReserved(peerwire.RESERVED_DHT)
+	}
+	return handshake
+}
+
+// exchangeablePeers returns the peers which can be passed on by peer exchange, which are those we
+// know a listening port for
+func (t *Torrent) exchangeablePeers(s *session) []pex.Peer {
+	peers := make([]pex.Peer, 0, len(s.peers))
+	for conn, state := range s.peers {
+		ip, port, ok := addrIPPort(conn.RemoteAddr())
+		if !ok {
+			continue
+		}
+		remote := t.remoteHandshake(state)
+		p := pex.Peer{IP: ip, Port: port}
+		if _, utp := conn.RemoteAddr().(*net.UDPAddr); utp {
+			p.Flags |= pex.FLAG_UTP
+		}
+		if state.outgoing {
+			p.Flags |= pex.FLAG_OUTGOING
+		} else if remote != nil && remote.Port > 0 {
+			// Peers connecting to us come from a port other than the one they listen on
+			p.Port = remote.Port
+		} else {
+			continue
+		}
+		if state.bits.All() {
+			p.Flags |= pex.FLAG_SEED
+		}
+		if remote != nil && remote.Extensions["ut_holepunch"] > 0 {
+			p.Flags |= pex.FLAG_HOLEPUNCH
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// remoteHandshake returns a peer's extension handshake, or nil if it hasn't sent one
+func (t *Torrent) remoteHandshake(state *peerState) *extension.Handshake {
+	if state.extensions == nil {
+		return nil
+	}
+	return state.extensions.Remote()
+}
+
+// allowedFast returns the pieces of the peer's allowed fast set which we have to give it
+func (t *Torrent) allowedFast(addr net.Addr, have *model.Bitfield) []uint32 {
+	ip, _, ok := addrIPPort(addr)
+	if !ok {
+		return nil
+	}
+	allowed := []uint32{}
+	for _, index := range peerwire.AllowedFastSet(peerwire.ALLOWED_FAST_COUNT, t.info.NumPieces(), t.info.Hash, ip) {
+		if have.Test(int(index)) {
+			allowed = append(allowed, index)
+		}
+	}
+	return allowed
+}
+
+// useDHT reports whether the torrent finds peers through the DHT. Private torrents only get peers
+// from their trackers.
+func (t *Torrent) useDHT() bool {
+	return t.client.config.DHT != nil && !t.info.IsPrivate()
+}
+
+// useLSD reports whether the torrent finds peers on the local network, which private torrents
+// don't
+func (t *Torrent) useLSD() bool {
+	return t.client.config.LSD != nil && !t.info.IsPrivate()
+}
+
+func (t *Torrent) hasTrackers() bool {
+	for _, tier := range t.metaInfo.AnnounceTiers() {
+		if len(tier) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Torrent) transferStats() (int64, int64, int64) {
+	stats := t.Stats()
+	return stats.Uploaded, stats.Downloaded, stats.Left
+}
+
+func (t *Torrent) signal() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,481 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/onepointsixtwo/torrentsgo/dht"
+	"github.com/onepointsixtwo/torrentsgo/extension"
+	"github.com/onepointsixtwo/torrentsgo/lsd"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/peer"
+	"github.com/onepointsixtwo/torrentsgo/peerwire"
+	"github.com/onepointsixtwo/torrentsgo/pex"
+	"github.com/onepointsixtwo/torrentsgo/storage"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDownloadFromSeeder(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{100000, 0, 70000, 12345})
+	seeder, seed := newSeeder(t, metaInfo, data)
+	leecher := newTestClient(t, Config{})
+
+	s := storage.NewMemoryStorage(metaInfo.Info)
+	download, err := leecher.AddTorrent(metaInfo, s, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error adding torrent %v", err)
+	}
+	download.Start()
+	download.AddPeers(seeder.Addr().String())
+	waitComplete(t, download)
+
+	if !bytes.Equal(s.Bytes(), data) {
+		t.Errorf("Expected downloaded data to match")
+	}
+	stats := download.Stats()
+	if !stats.Complete || stats.Left != 0 || stats.Have != metaInfo.Info.NumPieces() || stats.Downloaded != int64(len(data)) {
+		t.Errorf("Unexpected leecher stats %+v", stats)
+	}
+	waitFor(t, func() bool { return seed.Stats().Uploaded == int64(len(data)) })
+}
+
+func TestDownloadOverUTP(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{150000})
+	seeder := newTestClient(t, Config{UTP: true})
+	have := model.NewBitfieldForInfo(metaInfo.Info)
+	have.SetAll()
+	seed, _ := seeder.AddTorrent(metaInfo, seeded(t, metaInfo.Info, data), have)
+	seed.Start()
+
+	// TCP connections fail, so the leecher falls back to uTP
+	leecher := newTestClient(t, Config{UTP: true, Dialer: refusingDialer{}})
+	s := storage.NewMemoryStorage(metaInfo.Info)
+	download, _ := leecher.AddTorrent(metaInfo, s, nil)
+	download.Start()
+	download.AddPeers(seeder.Addr().String())
+	waitComplete(t, download)
+
+	if !bytes.Equal(s.Bytes(), data) {
+		t.Errorf("Expected downloaded data to match")
+	}
+}
+
+func TestSeederConnectsToLeecher(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{200000})
+	_, seed := newSeeder(t, metaInfo, data)
+	leecher := newTestClient(t, Config{})
+
+	s := storage.NewMemoryStorage(metaInfo.Info)
+	download, _ := leecher.AddTorrent(metaInfo, s, nil)
+	download.Start()
+	seed.AddPeers(leecher.Addr().String())
+	waitComplete(t, download)
+
+	if !bytes.Equal(s.Bytes(), data) {
+		t.Errorf("Expected downloaded data to match")
+	}
+}
+
+func TestPartialDownloadSharesBothWays(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{300000})
+	info := metaInfo.Info
+	first, second := newTestClient(t, Config{}), newTestClient(t, Config{})
+
+	// Each side starts with alternate pieces, so each needs the other's
+	haveEven, haveOdd := model.NewBitfieldForInfo(info), model.NewBitfieldForInfo(info)
+	for piece := 0; piece < info.NumPieces(); piece++ {
+		if piece%2 == 0 {
+			haveEven.Set(piece)
+		} else {
+			haveOdd.Set(piece)
+		}
+	}
+	even, _ := first.AddTorrent(metaInfo, seeded(t, info, data), haveEven)
+	odd, _ := second.AddTorrent(metaInfo, seeded(t, info, data), haveOdd)
+	even.Start()
+	odd.Start()
+	even.AddPeers(second.Addr().String())
+
+	waitComplete(t, even)
+	waitComplete(t, odd)
+	if even.Stats().Uploaded == 0 || odd.Stats().Uploaded == 0 {
+		t.Errorf("Expected both sides to upload, %+v %+v", even.Stats(), odd.Stats())
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{150000})
+	seeder, _ := newSeeder(t, metaInfo, data)
+	leecher := newTestClient(t, Config{})
+
+	s := storage.NewMemoryStorage(metaInfo.Info)
+	download, _ := leecher.AddTorrent(metaInfo, s, nil)
+	download.AddPeers(seeder.Addr().String())
+	time.Sleep(50 * time.Millisecond)
+	if stats := download.Stats(); stats.State != STATE_PAUSED || stats.Peers != 0 {
+		t.Errorf("Expected torrent not to connect before starting, %+v", stats)
+	}
+
+	download.Start()
+	waitFor(t, func() bool { return download.Stats().Peers == 1 })
+	download.Pause()
+	if stats := download.Stats(); stats.State != STATE_PAUSED || stats.Peers != 0 {
+		t.Errorf("Expected paused torrent to drop its peers, %+v", stats)
+	}
+
+	// Peers given before pausing are tried again
+	download.Start()
+	waitComplete(t, download)
+	if !bytes.Equal(s.Bytes(), data) {
+		t.Errorf("Expected downloaded data to match")
+	}
+
+	if err := download.Stop(); err != nil {
+		t.Errorf("Unexpected error stopping %v", err)
+	}
+	if _, err := s.ReadAt(make([]byte, 1), 0, 0); err != storage.ErrClosed {
+		t.Errorf("Expected stopping to close storage but was %v", err)
+	}
+}
+
+func TestPeerLimits(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{100000})
+	seeders := []*Client{}
+	for i := 0; i < 3; i++ {
+		seeder, _ := newSeeder(t, metaInfo, data)
+		seeders = append(seeders, seeder)
+	}
+	leecher := newTestClient(t, Config{MaxPeersPerTorrent: 2})
+
+	download, _ := leecher.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	download.Start()
+	for _, seeder := range seeders {
+		download.AddPeers(seeder.Addr().String())
+	}
+	waitComplete(t, download)
+	if peers := download.Stats().Peers; peers > 2 {
+		t.Errorf("Expected at most 2 peers but had %v", peers)
+	}
+
+	// A client with no room left refuses incoming connections
+	full := newTestClient(t, Config{MaxPeers: 1})
+	other, _ := testTorrent(t, []int{100})
+	busy, _ := full.AddTorrent(other, storage.NewMemoryStorage(other.Info), nil)
+	busy.Start()
+	idle, _ := newSeeder(t, other, nil)
+	busy.AddPeers(idle.Addr().String())
+	waitFor(t, func() bool { return busy.Stats().Peers == 1 })
+
+	seed, _ := full.AddTorrent(metaInfo, seeded(t, metaInfo.Info, data), nil)
+	seed.Start()
+	late, _ := newTestClient(t, Config{}).AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	late.Start()
+	late.AddPeers(full.Addr().String())
+	time.Sleep(200 * time.Millisecond)
+	if peers := seed.Stats().Peers; peers != 0 {
+		t.Errorf("Expected full client to refuse connections but had %v peers", peers)
+	}
+}
+
+// Helpers
+
+// newSeeder starts a client seeding a torrent. With no data it has none of the torrent.
+func newSeeder(t *testing.T, metaInfo *model.MetaInfo, data []byte) (*Client, *Torrent) {
+	c := newTestClient(t, Config{})
+	s, have := storage.Storage(storage.NewMemoryStorage(metaInfo.Info)), model.NewBitfieldForInfo(metaInfo.Info)
+	if data != nil {
+		s = seeded(t, metaInfo.Info, data)
+		have.SetAll()
+	}
+	torrent, err := c.AddTorrent(metaInfo, s, have)
+	if err != nil {
+		t.Fatalf("Unexpected error adding torrent %v", err)
+	}
+	torrent.Start()
+	return c, torrent
+}
+
+// refusingDialer fails every connection as if nothing was listening
+type refusingDialer struct{}
+
+func (refusingDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("Connection refused")}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(TEST_TIMEOUT)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUploadSlotPassesBetweenLeechers(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{100000})
+	seeder := newTestClient(t, Config{UploadSlots: 1})
+	have := model.NewBitfieldForInfo(metaInfo.Info)
+	have.SetAll()
+	seed, _ := seeder.AddTorrent(metaInfo, seeded(t, metaInfo.Info, data), have)
+	seed.Start()
+
+	// With one slot and no rechoke due, the second leecher is only unchoked once the first is done
+	downloads := []*Torrent{}
+	for i := 0; i < 2; i++ {
+		download, _ := newTestClient(t, Config{}).AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+		download.Start()
+		download.AddPeers(seeder.Addr().String())
+		downloads = append(downloads, download)
+	}
+	for _, download := range downloads {
+		waitComplete(t, download)
+	}
+	if uploaded := seed.Stats().Uploaded; uploaded != 2*int64(len(data)) {
+		t.Errorf("Expected the seeder to upload everything twice but uploaded %v", uploaded)
+	}
+}
+
+type echoExtension struct {
+	received chan string
+}
+
+type echoHandler struct {
+	extension *echoExtension
+	session   *extension.Session
+}
+
+func (e *echoExtension) Name() string { return "test_echo" }
+
+func (e *echoExtension) NewHandler(session *extension.Session) extension.Handler {
+	return &echoHandler{extension: e, session: session}
+}
+
+func (h *echoHandler) Handshake(remote *extension.Handshake) {
+	h.session.Send("test_echo", []byte(remote.Version))
+}
+
+func (h *echoHandler) Message(payload []byte) error {
+	h.extension.received <- string(payload)
+	return nil
+}
+
+func TestExtensionsAreNegotiatedWithPeers(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{50000})
+	seeder, leecher := newTestClient(t, Config{}), newTestClient(t, Config{})
+	have := model.NewBitfieldForInfo(metaInfo.Info)
+	have.SetAll()
+	seed, _ := seeder.AddTorrent(metaInfo, seeded(t, metaInfo.Info, data), have)
+	download, _ := leecher.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+
+	seedEcho, downloadEcho := &echoExtension{received: make(chan string, 1)}, &echoExtension{received: make(chan string, 1)}
+	if err := seed.Extensions().Register(seedEcho); err != nil {
+		t.Fatalf("Unexpected error registering extension %v", err)
+	}
+	download.Extensions().Register(downloadEcho)
+	seed.Start()
+	download.Start()
+	download.AddPeers(seeder.Addr().String())
+
+	// Each side echoes the version from the other's handshake back over the extension
+	for _, echo := range []*echoExtension{seedEcho, downloadEcho} {
+		select {
+		case version := <-echo.received:
+			if version != "torrentsgo 0.0.0.1" {
+				t.Errorf("Expected our own version echoed back but was %q", version)
+			}
+		case <-time.After(TEST_TIMEOUT):
+			t.Fatalf("Timed out waiting for extension message")
+		}
+	}
+	waitComplete(t, download)
+}
+
+func TestPeerExchangeFindsPeers(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{50000})
+	seeder, _ := newSeeder(t, metaInfo, data)
+	first, second := newTestClient(t, Config{}), newTestClient(t, Config{})
+	firstTorrent, _ := first.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	secondTorrent, _ := second.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	firstTorrent.Start()
+	secondTorrent.Start()
+
+	// The second leecher only knows the first, which tells it about the seeder
+	firstTorrent.AddPeers(seeder.Addr().String())
+	waitFor(t, func() bool { return firstTorrent.Stats().Peers == 1 })
+	secondTorrent.AddPeers(first.Addr().String())
+	waitFor(t, func() bool { return secondTorrent.Stats().Peers == 2 })
+	waitComplete(t, secondTorrent)
+}
+
+func TestSimultaneousConnectionsKeepOne(t *testing.T) {
+	metaInfo, _ := testTorrent(t, []int{50000})
+	lower := newTestClient(t, Config{PeerId: []byte("-TG0001-aaaaaaaaaaaa")})
+	higher := newTestClient(t, Config{PeerId: []byte("-TG0001-bbbbbbbbbbbb")})
+	lowerTorrent, _ := lower.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	higherTorrent, _ := higher.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	lowerTorrent.Start()
+	higherTorrent.Start()
+
+	// Each side dials the other, so both see two connections to the same peer and must agree on
+	// which to drop
+	lowerTorrent.AddPeers(higher.Addr().String())
+	higherTorrent.AddPeers(lower.Addr().String())
+	waitFor(t, func() bool { return lowerTorrent.Stats().Peers == 1 && higherTorrent.Stats().Peers == 1 })
+	time.Sleep(200 * time.Millisecond)
+	if lowerTorrent.Stats().Peers != 1 || higherTorrent.Stats().Peers != 1 {
+		t.Errorf("Expected one connection each but got %v and %v", lowerTorrent.Stats().Peers, higherTorrent.Stats().Peers)
+	}
+}
+
+func TestPrivateTorrentsDontExchangePeers(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{50000})
+	metaInfo.Info.Private = 1
+	seeder, _ := newSeeder(t, metaInfo, data)
+	first, second := newTestClient(t, Config{}), newTestClient(t, Config{})
+	firstTorrent, _ := first.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	secondTorrent, _ := second.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	for _, name := range firstTorrent.Extensions().Names() {
+		if name == pex.EXTENSION_NAME {
+			t.Fatalf("Expected no peer exchange for a private torrent")
+		}
+	}
+	firstTorrent.Start()
+	secondTorrent.Start()
+
+	firstTorrent.AddPeers(seeder.Addr().String())
+	waitFor(t, func() bool { return firstTorrent.Stats().Peers == 1 })
+	secondTorrent.AddPeers(first.Addr().String())
+	waitFor(t, func() bool { return secondTorrent.Stats().Peers == 1 })
+	time.Sleep(2 * MAINTENANCE_INTERVAL)
+	if peers := secondTorrent.Stats().Peers; peers != 1 {
+		t.Errorf("Expected the second leecher to only know the first but had %v peers", peers)
+	}
+}
+
+func TestTorrentsFindPeersThroughDHT(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{50000})
+	network := mock.NewMockPacketNetwork()
+	seederNode, leecherNode := newTestDHT(t, network), newTestDHT(t, network)
+	ctx, cancel := context.WithTimeout(context.Background(), TEST_TIMEOUT)
+	defer cancel()
+	if _, err := leecherNode.Ping(ctx, seederNode.Addr().String()); err != nil {
+		t.Fatalf("Unexpected error joining the DHT %v", err)
+	}
+
+	seeder := newTestClient(t, Config{DHT: seederNode})
+	have := model.NewBitfieldForInfo(metaInfo.Info)
+	have.SetAll()
+	seed, _ := seeder.AddTorrent(metaInfo, seeded(t, metaInfo.Info, data), have)
+	seed.Start()
+	waitFor(t, func() bool {
+		peers, _ := leecherNode.GetPeers(ctx, metaInfo.Info.Hash)
+		return len(peers) > 0
+	})
+
+	// The torrent has no trackers and is given no peers
+	download, _ := newTestClient(t, Config{DHT: leecherNode}).AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	download.Start()
+	waitComplete(t, download)
+}
+
+func TestPrivateTorrentsDontUseDHT(t *testing.T) {
+	metaInfo, _ := testTorrent(t, []int{50000})
+	metaInfo.Info.Private = 1
+	node := newTestDHT(t, mock.NewMockPacketNetwork())
+	torrent, _ := newTestClient(t, Config{DHT: node}).AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	if torrent.useDHT() || torrent.handshake().HasReserved(peerwire.RESERVED_DHT) {
+		t.Errorf("Expected a private torrent not to use the DHT")
+	}
+}
+
+func TestPeersDHTPortIsPingedOnce(t *testing.T) {
+	metaInfo, _ := testTorrent(t, []int{50000})
+	network := mock.NewMockPacketNetwork()
+	c := newTestClient(t, Config{DHT: newTestDHT(t, network)})
+	torrent, _ := c.AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	torrent.Start()
+	node, _ := network.Listen("127.0.0.1:0")
+	defer node.Close()
+
+	handshake := &peerwire.Handshake{InfoHash: metaInfo.Info.Hash, PeerId: []byte("-TG0001-remotepeer00")}
+	conn, _, err := peer.Dial(context.Background(), nil, c.Addr().String(), handshake)
+	if err != nil {
+		t.Fatalf("Unexpected error dialling %v", err)
+	}
+	defer conn.Close()
+	writer := peerwire.NewWriter(conn)
+	for i := 0; i < 5; i++ {
+		writer.WriteMessage(&peerwire.Port{Port: uint16(node.LocalAddr().(*net.UDPAddr).Port)})
+	}
+
+	pings := 0
+	buffer := make([]byte, 1500)
+	for {
+		node.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		if _, _, err := node.ReadFrom(buffer); err != nil {
+			break
+		}
+		pings++
+	}
+	if pings != 1 {
+		t.Errorf("Expected one ping for the peer's DHT node but got %v", pings)
+	}
+}
+
+func TestTorrentsFindLocalPeers(t *testing.T) {
+	metaInfo, data := testTorrent(t, []int{50000})
+	network := mock.NewMockPacketNetwork()
+
+	seeder := newTestClient(t, Config{LSD: newTestLSD(t, network)})
+	have := model.NewBitfieldForInfo(metaInfo.Info)
+	have.SetAll()
+	seed, _ := seeder.AddTorrent(metaInfo, seeded(t, metaInfo.Info, data), have)
+
+	// The torrent has no trackers and is given no peers. It is started first, so it hears the
+	// seeder's first announce.
+	download, _ := newTestClient(t, Config{LSD: newTestLSD(t, network)}).AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	download.Start()
+	seed.Start()
+	waitComplete(t, download)
+}
+
+func TestPrivateTorrentsDontUseLSD(t *testing.T) {
+	metaInfo, _ := testTorrent(t, []int{50000})
+	metaInfo.Info.Private = 1
+	torrent, _ := newTestClient(t, Config{LSD: newTestLSD(t, mock.NewMockPacketNetwork())}).AddTorrent(metaInfo, storage.NewMemoryStorage(metaInfo.Info), nil)
+	if torrent.useLSD() {
+		t.Errorf("Expected a private torrent not to use LSD")
+	}
+}
+
+func newTestDHT(t *testing.T, network *mock.MockPacketNetwork) *dht.Server {
+	conn, err := network.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening %v", err)
+	}
+	node, err := dht.NewServer(dht.Config{Conn: conn})
+	if err != nil {
+		t.Fatalf("Unexpected error creating DHT node %v", err)
+	}
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+func newTestLSD(t *testing.T, network *mock.MockPacketNetwork) *lsd.Service {
+	conn, err := network.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unexpected error listening %v", err)
+	}
+	conn.JoinGroup(lsd.IPV4_GROUP)
+	group, _ := net.ResolveUDPAddr("udp", lsd.IPV4_GROUP)
+	service, err := lsd.NewService(lsd.Config{Groups: []*lsd.Group{{Conn: conn, Addr: group}}})
+	if err != nil {
+		t.Fatalf("Unexpected error creating LSD service %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+	return service
+}
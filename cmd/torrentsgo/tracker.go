@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/tracker/server"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+func runTracker(args []string) error {
+	flags := flag.NewFlagSet("tracker", flag.ExitOnError)
+	httpAddr := flags.String("http", ":6969", "address to serve HTTP announce and scrape on, empty to disable")
+	udpAddr := flags.String("udp", ":6969", "address to serve UDP tracker requests on, empty to disable")
+	whitelistPath := flags.String("whitelist", "", "file of hex info hashes to serve, one per line")
+	banned := flags.String("banned", "", "comma separated peer id prefixes of clients to refuse")
+	interval := flags.Duration("interval", server.DEFAULT_INTERVAL, "announce interval given to clients")
+	flags.Parse(args)
+
+	if *httpAddr == "" && *udpAddr == "" {
+		return fmt.Errorf("At least one of -http and -udp must be given")
+	}
+
+	config := server.Config{Interval: *interval}
+	if *banned != "" {
+		config.BannedClients = strings.Split(*banned, ",")
+	}
+	if *whitelistPath != "" {
+		file, err := os.Open(*whitelistPath)
+		if err != nil {
+			return err
+		}
+		whitelist, err := server.LoadWhitelist(file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+		config.Whitelist = whitelist
+	}
+
+	trackerServer := server.NewServer(config)
+	go trackerServer.RunExpiry(context.Background())
+
+	errors := make(chan error, 2)
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Serving UDP tracker on %v\n", conn.LocalAddr())
+		go func() {
+			errors <- trackerServer.ServeUDP(conn)
+		}()
+	}
+	if *httpAddr != "" {
+		httpServer := &http.Server{Addr: *httpAddr, Handler: trackerServer, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+		fmt.Printf("Serving HTTP tracker on %v\n", *httpAddr)
+		go func() {
+			errors <- httpServer.ListenAndServe()
+		}()
+	}
+
+	return <-errors
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/parser"
+	"github.com/onepointsixtwo/torrentsgo/verify"
+	"os"
+)
+
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	workers := flags.Int("workers", 0, "pieces to hash at once, defaulting to the number of CPUs")
+	quiet := flags.Bool("quiet", false, "don't print progress")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: torrentsgo verify [flags] <torrent> <dir>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	metaInfo, err := parser.ParseMetaInfo(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	config := verify.Config{Workers: *workers}
+	if !*quiet {
+		config.Progress = func(progress verify.Progress) {
+			fmt.Printf("\rChecked %v/%v pieces", progress.Checked, progress.Total)
+		}
+	}
+	result, err := verify.Verify(context.Background(), metaInfo, flags.Arg(1), config)
+	if !*quiet {
+		fmt.Println()
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, path := range result.Missing {
+		fmt.Printf("Missing: %v\n", path)
+	}
+	for _, path := range result.Truncated {
+		fmt.Printf("Truncated: %v\n", path)
+	}
+
+	good := result.Good.Count()
+	fmt.Printf("%v of %v pieces good\n", good, result.Good.Len())
+	if good != result.Good.Len() {
+		return fmt.Errorf("%v pieces failed verification", result.Good.Len()-good)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Blocklist holds addresses the DHT server ignores. Nodes at them aren't answered, queried or
+// added to the routing table.
+type Blocklist struct {
+	lock     sync.RWMutex
+	networks []*net.IPNet
+}
+
+// Initialisers
+
+func NewBlocklist() *Blocklist {
+	return &Blocklist{}
+}
+
+// LoadBlocklist reads addresses and CIDR ranges, one per line. Blank lines and lines starting
+// with '#' are ignored.
+func LoadBlocklist(reader io.Reader) (*Blocklist, error) {
+	blocklist := NewBlocklist()
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := blocklist.Add(line); err != nil {
+			return nil, fmt.Errorf("Invalid address on line %v of blocklist", lineNumber)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return blocklist, nil
+}
+
+// Public Methods
+
+// Add blocks an address such as 10.0.0.1, or a range such as 10.0.0.0/8
+func (b *Blocklist) Add(address string) error {
+	_, network, err := net.ParseCIDR(address)
+	if err != nil {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return fmt.Errorf("Invalid address '%v'", address)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.networks = append(b.networks, network)
+	return nil
+}
+
+func (b *Blocklist) Contains(ip net.IP) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, network := range b.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
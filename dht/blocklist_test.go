@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestBlocklistContainsAddressesAndRanges(t *testing.T) {
+	blocklist, err := LoadBlocklist(strings.NewReader("# Comment\n\n1.2.3.4\n10.0.0.0/8\n2001:db8::/32\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for address, blocked := range map[string]bool{
+		"1.2.3.4":     true,
+		"1.2.3.5":     false,
+		"10.200.1.1":  true,
+		"11.0.0.1":    false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	} {
+		if blocklist.Contains(net.ParseIP(address)) != blocked {
+			t.Errorf("Expected %v to be blocked: %v", address, blocked)
+		}
+	}
+
+	if _, err := LoadBlocklist(strings.NewReader("1.2.3.4\nnot an address\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("Expected an error for line 2 but got %v", err)
+	}
+}
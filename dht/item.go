@@ -0,0 +1,351 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"net"
+	"strconv"
+	"sync"
+)
+
+const (
+	// Most bytes an item's bencoded value can take, so puts fit in a packet
+	MAX_ITEM_VALUE_LENGTH = 1000
+	MAX_SALT_LENGTH       = 64
+)
+
+// Types
+
+// Item is a value stored in the DHT (BEP 44). Immutable items are stored under the hash of their
+// value. Mutable items are stored under the hash of a public key and salt, and the holder of the
+// private key can replace the value by signing one with a higher sequence number.
+type Item struct {
+	// V is any bencodable value
+	V interface{}
+	// The rest are only set for mutable items
+	Key  ed25519.PublicKey
+	Salt []byte
+	Seq  int
+	Sig  []byte
+}
+
+var (
+	ErrItemTooBig       = errors.New("DHT item value is too big")
+	ErrSaltTooBig       = errors.New("DHT item salt is too big")
+	ErrInvalidSignature = errors.New("DHT item signature is invalid")
+	ErrItemNotFound     = errors.New("DHT item not found")
+)
+
+// Initialiser
+
+func NewImmutableItem(v interface{}) (*Item, error) {
+	item := &Item{V: v}
+	if err := item.Verify(); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// NewMutableItem signs v with key. Each new value published under the same key and salt needs a
+// higher seq.
+func NewMutableItem(v interface{}, key ed25519.PrivateKey, salt []byte, seq int) (*Item, error) {
+	value, err := bencoding.EncodeValue(v)
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{V: v, Key: key.Public().(ed25519.PublicKey), Salt: salt, Seq: seq}
+	item.Sig = ed25519.Sign(key, signedData(salt, seq, value))
+	if err := item.Verify(); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// Public Methods
+
+// MutableTarget returns the id mutable items with key and salt are stored under
+func MutableTarget(key ed25519.PublicKey, salt []byte) NodeId {
+	return sha1.Sum(append(append([]byte{}, key...), salt...))
+}
+
+func (item *Item) Mutable() bool {
+	return len(item.Key) > 0
+}
+
+// Target returns the id the item is stored under
+func (item *Item) Target() (NodeId, error) {
+	if item.Mutable() {
+		return MutableTarget(item.Key, item.Salt), nil
+	}
+	value, err := bencoding.EncodeValue(item.V)
+	if err != nil {
+		return NodeId{}, err
+	}
+	return sha1.Sum(value), nil
+}
+
+// Verify checks the item's value isn't too big and, for mutable items, that it is signed by its
+// key
+func (item *Item) Verify() error {
+	value, err := bencoding.EncodeValue(item.V)
+	if err != nil {
+		return err
+	}
+	if len(value) > MAX_ITEM_VALUE_LENGTH {
+		return ErrItemTooBig
+	}
+	if !item.Mutable() {
+		return nil
+	}
+	if len(item.Salt) > MAX_SALT_LENGTH {
+		return ErrSaltTooBig
+	}
+	if len(item.Key) != ed25519.PublicKeySize || !ed25519.Verify(item.Key, signedData(item.Salt, item.Seq, value), item.Sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Get looks up the immutable item stored under target
+func (s *Server) Get(ctx context.Context, target NodeId) (*Item, error) {
+	item, _, err := s.getItem(ctx, target, nil)
+	return item, err
+}
+
+// GetMutable looks up the mutable item with the highest sequence number stored under key and salt
+func (s *Server) GetMutable(ctx context.Context, key ed25519.PublicKey, salt []byte) (*Item, error) {
+	item, _, err := s.getItem(ctx, MutableTarget(key, salt), salt)
+	return item, err
+}
+
+// Put stores an item on the nodes closest to its target. It fails if no node accepted it, with
+// the error a node gave if there was one, and a mutable item fails if a newer version is found.
+func (s *Server) Put(ctx context.Context, item *Item) error {
+	return s.put(ctx, item, nil)
+}
+
+// CompareAndPut stores a mutable item like Put, but nodes only accept it while the item they
+// have has sequence number cas
+func (s *Server) CompareAndPut(ctx context.Context, item *Item, cas int) error {
+	return s.put(ctx, item, &cas)
+}
+
+// Query Handlers
+
+// handleGet returns the item stored under the target if we have one, along with the closest
+// nodes to it. A mutable item's value is left out if the querier already has its sequence number.
+func (s *Server) handleGet(addr *net.UDPAddr, args *Body) (*Body, *Error) {
+	target, err := NodeIdFromBytes(args.Target)
+	if err != nil {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Invalid target"}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.config.Clock.Now()
+	response := &Body{Token: s.tokens.token(addr.IP, now), Nodes: s.table.closest(target, K)}
+	item := s.items.get(target, now)
+	if item == nil {
+		return response, nil
+	}
+	if !item.Mutable() {
+		response.V = item.V
+		return response, nil
+	}
+	seq := item.Seq
+	response.Key = item.Key
+	response.Seq = &seq
+	if args.Seq == nil || *args.Seq < item.Seq {
+		response.V = item.V
+		response.Sig = item.Sig
+	}
+	return response, nil
+}
+
+func (s *Server) handlePut(addr *net.UDPAddr, args *Body) (*Body, *Error) {
+	if args.V == nil {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Missing value"}
+	}
+	item := &Item{V: args.V, Key: args.Key, Salt: args.Salt, Sig: args.Sig}
+	if item.Mutable() {
+		if args.Seq == nil {
+			return nil, &Error{Code: ERROR_PROTOCOL, Message: "Missing sequence number"}
+		}
+		item.Seq = *args.Seq
+	}
+	switch err := item.Verify(); err {
+	case nil:
+	case ErrItemTooBig:
+		return nil, &Error{Code: ERROR_MESSAGE_TOO_BIG, Message: "Message too big"}
+	case ErrSaltTooBig:
+		return nil, &Error{Code: ERROR_SALT_TOO_BIG, Message: "Salt too big"}
+	case ErrInvalidSignature:
+		return nil, &Error{Code: ERROR_INVALID_SIGNATURE, Message: "Invalid signature"}
+	default:
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Invalid value"}
+	}
+	target, err := item.Target()
+	if err != nil {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Invalid value"}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.config.Clock.Now()
+	if !s.tokens.valid(args.Token, addr.IP, now) {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Bad token"}
+	}
+	if err := s.items.put(target, item, args.Cas, now); err != nil {
+		return nil, err
+	}
+	return &Body{}, nil
+}
+
+// Helpers
+
+// getItem runs a get lookup, returning the best valid item found and the closest nodes which
+// answered. Mutable items are checked against the salt, which responses don't include.
+func (s *Server) getItem(ctx context.Context, target NodeId, salt []byte) (*Item, []*candidate, error) {
+	l := s.newLookup(target, QUERY_GET, func() *Body { return &Body{Target: target[:]} })
+	closest, err := l.run(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// An item stored on us counts too, as we may be one of the closest nodes
+	s.lock.Lock()
+	best := s.items.get(target, s.config.Clock.Now())
+	s.lock.Unlock()
+	for _, c := range l.candidates {
+		if c.response == nil || c.response.V == nil {
+			continue
+		}
+		item := &Item{V: c.response.V, Key: c.response.Key, Salt: salt, Sig: c.response.Sig}
+		if item.Mutable() {
+			if c.response.Seq == nil {
+				continue
+			}
+			item.Seq = *c.response.Seq
+		}
+		if itemTarget, err := item.Target(); err != nil || itemTarget != target || item.Verify() != nil {
+			continue
+		}
+		if best == nil || item.Seq > best.Seq {
+			best = item
+		}
+	}
+	if best == nil {
+		return nil, closest, ErrItemNotFound
+	}
+	return best, closest, nil
+}
+
+// put stores an item on the closest nodes to its target which gave us tokens. A mutable item
+// fails if a newer version is found, or one other than cas when it is given. Nodes which refuse it
+// only because they missed earlier puts are stale and don't fail the put.
+func (s *Server) put(ctx context.Context, item *Item, cas *int) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+	target, err := item.Target()
+	if err != nil {
+		return err
+	}
+	found, closest, err := s.getItem(ctx, target, item.Salt)
+	if err != nil && err != ErrItemNotFound {
+		return err
+	}
+	if item.Mutable() && found != nil {
+		if cas != nil && found.Seq != *cas {
+			return &Error{Code: ERROR_CAS_MISMATCH, Message: "CAS mismatch"}
+		}
+		// Signatures are deterministic, so a different one with the same sequence number is a
+		// different value
+		if found.Seq > item.Seq || (found.Seq == item.Seq && !bytes.Equal(found.Sig, item.Sig)) {
+			return &Error{Code: ERROR_SEQUENCE_NUMBER_LOW, Message: "Sequence number less than current"}
+		}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	accepted := 0
+	var rejection, conflict *Error
+	// A node's refusal is only a conflict if the item it has is newer than ours or the one we
+	// compare against, as someone else has put over it since
+	reject := func(err *Error, stored *int) {
+		newer := stored != nil && (*stored > item.Seq || (cas != nil && *stored > *cas))
+		if (err.Code == ERROR_CAS_MISMATCH || err.Code == ERROR_SEQUENCE_NUMBER_LOW) && newer {
+			conflict = err
+		} else if rejection == nil {
+			rejection = err
+		}
+	}
+	for _, c := range closest {
+		if c.response.Token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			args := &Body{V: item.V, Token: c.response.Token, Cas: cas}
+			if item.Mutable() {
+				seq := item.Seq
+				args.Key, args.Salt, args.Seq, args.Sig = item.Key, item.Salt, &seq, item.Sig
+			}
+			_, err := s.query(ctx, c.node.Addr, QUERY_PUT, args)
+			lock.Lock()
+			defer lock.Unlock()
+			if err == nil {
+				accepted++
+			} else if krpcErr, ok := err.(*Error); ok {
+				reject(krpcErr, c.response.Seq)
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	// We keep the item too if we are one of the closest nodes to it, as lookups will ask us
+	if self := s.Id(); len(closest) > 0 && (len(closest) < K || target.Closer(self, closest[len(closest)-1].node.Id)) {
+		s.lock.Lock()
+		now := s.config.Clock.Now()
+		var stored *int
+		if current := s.items.get(target, now); current != nil {
+			stored = &current.Seq
+		}
+		if err := s.items.put(target, item, cas, now); err != nil {
+			reject(err, stored)
+		} else {
+			accepted++
+		}
+		s.lock.Unlock()
+	}
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if conflict != nil {
+		return conflict
+	}
+	if accepted == 0 {
+		if rejection != nil {
+			return rejection
+		}
+		return ErrNoNodes
+	}
+	return nil
+}
+
+// signedData returns what a mutable item's signature covers: its salt, sequence number and value
+// as they would be bencoded in a dictionary
+func signedData(salt []byte, seq int, value []byte) []byte {
+	data := []byte{}
+	if len(salt) > 0 {
+		data = append(data, "4:salt"+strconv.Itoa(len(salt))+":"...)
+		data = append(data, salt...)
+	}
+	data = append(data, "3:seqi"+strconv.Itoa(seq)+"e1:v"...)
+	return append(data, value...)
+}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"bytes"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"time"
+)
+
+const (
+	// Items which haven't been put in this long are forgotten
+	ITEM_EXPIRY = 2 * time.Hour
+	// Most items puts can make us store
+	MAX_STORED_ITEMS = 10000
+)
+
+// Types
+
+// itemStore keeps the items put to us (BEP 44). It isn't safe for concurrent use.
+type itemStore struct {
+	items map[NodeId]*storedItem
+}
+
+type storedItem struct {
+	item *Item
+	// value is the bencoded value, to tell whether a put with the same sequence number changes it
+	value []byte
+	seen  time.Time
+}
+
+// Initialiser
+
+func newItemStore() *itemStore {
+	return &itemStore{items: make(map[NodeId]*storedItem)}
+}
+
+// Public Methods
+
+// put stores a verified item under target. A mutable item only replaces one with a lower
+// sequence number, and only when cas, if given, is the stored item's sequence number.
+func (s *itemStore) put(target NodeId, item *Item, cas *int, now time.Time) *Error {
+	value, err := bencoding.EncodeValue(item.V)
+	if err != nil {
+		return &Error{Code: ERROR_PROTOCOL, Message: "Invalid value"}
+	}
+	stored, ok := s.items[target]
+	if ok && now.Sub(stored.seen) >= ITEM_EXPIRY {
+		ok = false
+	}
+	if ok && item.Mutable() {
+		if cas != nil && *cas != stored.item.Seq {
+			return &Error{Code: ERROR_CAS_MISMATCH, Message: "CAS mismatch"}
+		}
+		if item.Seq < stored.item.Seq || (item.Seq == stored.item.Seq && !bytes.Equal(value, stored.value)) {
+			return &Error{Code: ERROR_SEQUENCE_NUMBER_LOW, Message: "Sequence number less than current"}
+		}
+	}
+	if !ok && len(s.items) >= MAX_STORED_ITEMS {
+		return &Error{Code: ERROR_SERVER, Message: "Too many items stored"}
+	}
+	s.items[target] = &storedItem{item: item, value: value, seen: now}
+	return nil
+}
+
+// get returns the item stored under target, or nil if there is none or it has expired
+func (s *itemStore) get(target NodeId, now time.Time) *Item {
+	stored, ok := s.items[target]
+	if !ok || now.Sub(stored.seen) >= ITEM_EXPIRY {
+		return nil
+	}
+	return stored.item
+}
+
+func (s *itemStore) expire(now time.Time) {
+	for target, stored := range s.items {
+		if now.Sub(stored.seen) >= ITEM_EXPIRY {
+			delete(s.items, target)
+		}
+	}
+}
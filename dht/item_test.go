@@ -0,0 +1,202 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"strings"
+	"testing"
+)
+
+func TestItemTargets(t *testing.T) {
+	// Test vectors from BEP 44
+	item, err := NewImmutableItem("Hello World!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, _ := item.Target(); target.String() != "e5f96f6f38320f0f33959cb4d3d656452117aadb" {
+		t.Errorf("Unexpected immutable target %v", target)
+	}
+	key, _ := hex.DecodeString("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+	if target := MutableTarget(key, nil); target.String() != "4a533d47ec9c7d95b1ad75f576cffc641853b750" {
+		t.Errorf("Unexpected mutable target %v", target)
+	}
+	if target := MutableTarget(key, []byte("foobar")); target.String() != "411eba73b6f087ca51a3795d9c8c938d365e32c1" {
+		t.Errorf("Unexpected salted mutable target %v", target)
+	}
+}
+
+func TestSignedData(t *testing.T) {
+	if data := signedData(nil, 1, []byte("12:Hello World!")); string(data) != "3:seqi1e1:v12:Hello World!" {
+		t.Errorf("Unexpected signed data %q", data)
+	}
+	if data := signedData([]byte("foobar"), 1, []byte("12:Hello World!")); string(data) != "4:salt6:foobar3:seqi1e1:v12:Hello World!" {
+		t.Errorf("Unexpected salted signed data %q", data)
+	}
+}
+
+func TestItemVerification(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	item, err := NewMutableItem("value", key, []byte("salt"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := item.Verify(); err != nil {
+		t.Errorf("Unexpected error verifying a signed item %v", err)
+	}
+	for _, tampered := range []Item{
+		{V: "other", Key: item.Key, Salt: item.Salt, Seq: item.Seq, Sig: item.Sig},
+		{V: item.V, Key: item.Key, Salt: item.Salt, Seq: item.Seq + 1, Sig: item.Sig},
+		{V: item.V, Key: item.Key, Salt: []byte("pepper"), Seq: item.Seq, Sig: item.Sig},
+		{V: item.V, Key: item.Key[:16], Salt: item.Salt, Seq: item.Seq, Sig: item.Sig},
+	} {
+		if err := tampered.Verify(); err != ErrInvalidSignature {
+			t.Errorf("Expected an invalid signature for %+v but got %v", tampered, err)
+		}
+	}
+
+	if _, err := NewImmutableItem(strings.Repeat("a", MAX_ITEM_VALUE_LENGTH)); err != ErrItemTooBig {
+		t.Errorf("Expected an oversized value to be refused but got %v", err)
+	}
+	if _, err := NewMutableItem("value", key, make([]byte, MAX_SALT_LENGTH+1), 1); err != ErrSaltTooBig {
+		t.Errorf("Expected an oversized salt to be refused but got %v", err)
+	}
+}
+
+func TestImmutableItemsAreStoredAndFound(t *testing.T) {
+	servers := newTestNetwork(t, mock.NewMockPacketNetwork(), TEST_NETWORK_SIZE)
+	item, _ := NewImmutableItem([]interface{}{"some", 42})
+	if err := servers[3].Put(testContext(t), item); err != nil {
+		t.Fatal(err)
+	}
+	target, _ := item.Target()
+	found, err := servers[TEST_NETWORK_SIZE-1].Get(testContext(t), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, ok := found.V.([]interface{}); !ok || len(list) != 2 || list[0] != "some" || list[1] != 42 {
+		t.Errorf("Unexpected value %v", found.V)
+	}
+
+	if _, err := servers[5].Get(testContext(t), RandomNodeId()); err != ErrItemNotFound {
+		t.Errorf("Expected an item which wasn't put to be missing but got %v", err)
+	}
+}
+
+func TestMutableItemsAreUpdated(t *testing.T) {
+	servers := newTestNetwork(t, mock.NewMockPacketNetwork(), TEST_NETWORK_SIZE)
+	public, key, _ := ed25519.GenerateKey(nil)
+	put := func(s *Server, v string, seq int) error {
+		item, err := NewMutableItem(v, key, []byte("salt"), seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.Put(testContext(t), item)
+	}
+	get := func(s *Server) *Item {
+		item, err := s.GetMutable(testContext(t), public, []byte("salt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return item
+	}
+
+	if err := put(servers[1], "first", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := put(servers[2], "second", 2); err != nil {
+		t.Fatal(err)
+	}
+	if item := get(servers[3]); item.V != "second" || item.Seq != 2 {
+		t.Errorf("Expected the latest value but got %v at %v", item.V, item.Seq)
+	}
+
+	if err, ok := put(servers[4], "stale", 1).(*Error); !ok || err.Code != ERROR_SEQUENCE_NUMBER_LOW {
+		t.Errorf("Expected a lower sequence number to be refused but got %v", err)
+	}
+	if err, ok := put(servers[4], "changed", 2).(*Error); !ok || err.Code != ERROR_SEQUENCE_NUMBER_LOW {
+		t.Errorf("Expected a new value with the same sequence number to be refused but got %v", err)
+	}
+
+	third, _ := NewMutableItem("third", key, []byte("salt"), 3)
+	if err, ok := servers[5].CompareAndPut(testContext(t), third, 1).(*Error); !ok || err.Code != ERROR_CAS_MISMATCH {
+		t.Errorf("Expected a CAS mismatch but got %v", err)
+	}
+	if err := servers[5].CompareAndPut(testContext(t), third, 2); err != nil {
+		t.Errorf("Unexpected error with a matching CAS %v", err)
+	}
+	if item := get(servers[6]); item.V != "third" {
+		t.Errorf("Expected the compared value to be stored but got %v", item.V)
+	}
+}
+
+func TestPutNeedsValidTokenAndSignature(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	s := newTestServer(t, network, Config{})
+	client, _ := network.Listen("127.0.0.1:0")
+	defer client.Close()
+	public, key, _ := ed25519.GenerateKey(nil)
+	item, _ := NewMutableItem("value", key, nil, 1)
+	target := MutableTarget(public, nil)
+
+	get := &Message{TransactionId: "g1", Type: TYPE_QUERY, Query: QUERY_GET, Args: &Body{Id: RandomNodeId(), Target: target[:]}}
+	token := exchange(t, client, s.Addr(), get).Response.Token
+
+	seq := item.Seq
+	for _, test := range []struct {
+		args *Body
+		code int
+	}{
+		{&Body{V: item.V, Key: item.Key, Seq: &seq, Sig: item.Sig, Token: "forged"}, ERROR_PROTOCOL},
+		{&Body{V: "forged", Key: item.Key, Seq: &seq, Sig: item.Sig, Token: token}, ERROR_INVALID_SIGNATURE},
+		{&Body{V: item.V, Key: item.Key, Sig: item.Sig, Token: token}, ERROR_PROTOCOL},
+		{&Body{V: strings.Repeat("a", MAX_ITEM_VALUE_LENGTH), Token: token}, ERROR_MESSAGE_TOO_BIG},
+	} {
+		put := &Message{TransactionId: "p1", Type: TYPE_QUERY, Query: QUERY_PUT, Args: test.args}
+		put.Args.Id = RandomNodeId()
+		if reply := exchange(t, client, s.Addr(), put); reply.Type != TYPE_ERROR || reply.Error.Code != test.code {
+			t.Errorf("Expected error %v for %+v but got %+v", test.code, test.args, reply)
+		}
+	}
+
+	put := &Message{TransactionId: "p2", Type: TYPE_QUERY, Query: QUERY_PUT, Args: &Body{Id: RandomNodeId(), V: item.V, Key: item.Key, Seq: &seq, Sig: item.Sig, Token: token}}
+	if reply := exchange(t, client, s.Addr(), put); reply.Type != TYPE_RESPONSE {
+		t.Fatalf("Expected the put to be accepted but got %+v", reply)
+	}
+
+	// A get giving the sequence number we have leaves the value out
+	get.Args.Seq = &seq
+	reply := exchange(t, client, s.Addr(), get)
+	if reply.Response.V != nil || reply.Response.Seq == nil || *reply.Response.Seq != 1 || !bytes.Equal(reply.Response.Key, public) {
+		t.Errorf("Unexpected response %+v", reply.Response)
+	}
+}
+
+func TestMutableTorrentsResolveToLatestInfoHash(t *testing.T) {
+	servers := newTestNetwork(t, mock.NewMockPacketNetwork(), TEST_NETWORK_SIZE)
+	public, key, _ := ed25519.GenerateKey(nil)
+	for seq, infoHash := range []NodeId{RandomNodeId(), RandomNodeId()} {
+		item, err := NewTorrentItem(key, nil, seq, infoHash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := servers[1].Put(testContext(t), item); err != nil {
+			t.Fatal(err)
+		}
+		resolved, err := servers[2].ResolveTorrent(testContext(t), public, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(resolved, infoHash[:]) {
+			t.Errorf("Expected info hash %v but got %x", infoHash, resolved)
+		}
+	}
+
+	other, otherKey, _ := ed25519.GenerateKey(nil)
+	notTorrent, _ := NewMutableItem("not a torrent", otherKey, nil, 1)
+	servers[1].Put(testContext(t), notTorrent)
+	if _, err := servers[2].ResolveTorrent(testContext(t), other, nil); err != ErrNotMutableTorrent {
+		t.Errorf("Expected an item without an info hash to fail but got %v", err)
+	}
+}
@@ -0,0 +1,318 @@
+package dht
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"net"
+)
+
+// Message types
+const (
+	TYPE_QUERY    = "q"
+	TYPE_RESPONSE = "r"
+	TYPE_ERROR    = "e"
+)
+
+// Queries
+const (
+	QUERY_PING          = "ping"
+	QUERY_FIND_NODE     = "find_node"
+	QUERY_GET_PEERS     = "get_peers"
+	QUERY_ANNOUNCE_PEER = "announce_peer"
+	QUERY_GET           = "get"
+	QUERY_PUT           = "put"
+)
+
+// Error codes
+const (
+	ERROR_GENERIC        = 201
+	ERROR_SERVER         = 202
+	ERROR_PROTOCOL       = 203
+	ERROR_METHOD_UNKNOWN = 204
+	// Errors for put (BEP 44)
+	ERROR_MESSAGE_TOO_BIG     = 205
+	ERROR_INVALID_SIGNATURE   = 206
+	ERROR_SALT_TOO_BIG        = 207
+	ERROR_CAS_MISMATCH        = 301
+	ERROR_SEQUENCE_NUMBER_LOW = 302
+)
+
+const (
+	// Messages longer than this are refused. They must fit in a UDP packet.
+	MAX_MESSAGE_LENGTH = 64 * 1024
+)
+
+// Types
+
+// Message is a KRPC message (BEP 5). Queries have a Query and Args, responses a Response and
+// errors an Error.
+type Message struct {
+	TransactionId string
+	Type          string
+	Query         string
+	Args          *Body
+	Response      *Body
+	Error         *Error
+	// Version is the sender's client and version
+	Version string
+	// IP is the address the sender of a response sees the query coming from (BEP 42)
+	IP *net.UDPAddr
+	// ReadOnly marks queries from nodes which don't answer queries (BEP 43)
+	ReadOnly bool
+}
+
+// Body holds the arguments of a query or the values of a response. Fields left at their zero
+// value aren't sent.
+type Body struct {
+	Id NodeId
+	// Target is the id find_node looks for
+	Target []byte
+	// InfoHash is the torrent get_peers and announce_peer are for
+	InfoHash []byte
+	// Port is the port announce_peer gives, unless ImpliedPort says to use the source port
+	Port        int
+	ImpliedPort bool
+	Token       string
+	// Nodes are sent as nodes and nodes6 by address family. A nil list isn't sent.
+	Nodes []Node
+	// Values are the peers found by get_peers
+	Values []*net.UDPAddr
+	// The rest are for get and put of items (BEP 44). V is any bencodable value, and is nil when
+	// not sent, as are Seq and Cas.
+	V    interface{}
+	Key  []byte
+	Salt []byte
+	Seq  *int
+	Sig  []byte
+	Cas  *int
+}
+
+// Error is a KRPC error, sent in reply to a query which can't be answered
+type Error struct {
+	Code    int
+	Message string
+}
+
+var ErrInvalidMessage = errors.New("Invalid KRPC message")
+
+// Public Methods
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("DHT error %v: %v", e.Code, e.Message)
+}
+
+func (m *Message) Encode() ([]byte, error) {
+	dict := model.NewOrderedMap()
+	if m.Args != nil {
+		dict.Add("a", m.Args.encode())
+	}
+	if m.Error != nil {
+		dict.Add("e", []interface{}{m.Error.Code, m.Error.Message})
+	}
+	if m.IP != nil {
+		if compact := compactAddr(m.IP, m.IP.IP.To4() == nil); compact != nil {
+			dict.Add("ip", string(compact))
+		}
+	}
+	if m.Query != "" {
+		dict.Add("q", m.Query)
+	}
+	if m.Response != nil {
+		dict.Add("r", m.Response.encode())
+	}
+	if m.ReadOnly {
+		dict.Add("ro", 1)
+	}
+	dict.Add("t", m.TransactionId)
+	if m.Version != "" {
+		dict.Add("v", m.Version)
+	}
+	dict.Add("y", m.Type)
+	return bencoding.EncodeBencoding(dict)
+}
+
+// ParseMessage reads a KRPC message, checking it has what its type needs
+func ParseMessage(data []byte) (*Message, error) {
+	if len(data) > MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("KRPC message of %v bytes is too long", len(data))
+	}
+	dict, err := bencoding.DecodeBencodingLimited(bytes.NewReader(data), MAX_MESSAGE_LENGTH)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode KRPC message - %v", err)
+	}
+
+	m := &Message{}
+	var ok bool
+	if m.TransactionId, ok = dict.Get("t").(string); !ok {
+		return nil, ErrInvalidMessage
+	}
+	if m.Type, ok = dict.Get("y").(string); !ok {
+		return nil, ErrInvalidMessage
+	}
+	m.Version, _ = dict.Get("v").(string)
+	if ip, ok := dict.Get("ip").(string); ok && (len(ip) == 6 || len(ip) == 18) {
+		m.IP = parseCompactAddr([]byte(ip))
+	}
+	readOnly, _ := dict.Get("ro").(int)
+	m.ReadOnly = readOnly != 0
+
+	switch m.Type {
+	case TYPE_QUERY:
+		if m.Query, ok = dict.Get("q").(string); !ok {
+			return nil, ErrInvalidMessage
+		}
+		m.Args, err = parseBody(dict.Get("a"))
+	case TYPE_RESPONSE:
+		m.Response, err = parseBody(dict.Get("r"))
+	case TYPE_ERROR:
+		m.Error, err = parseError(dict.Get("e"))
+	default:
+		err = fmt.Errorf("Unknown KRPC message type '%v'", m.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Helpers
+
+func (b *Body) encode() *model.OrderedMap {
+	dict := model.NewOrderedMap()
+	if b.Cas != nil {
+		dict.Add("cas", *b.Cas)
+	}
+	dict.Add("id", string(b.Id[:]))
+	if b.ImpliedPort {
+		dict.Add("implied_port", 1)
+	}
+	if b.InfoHash != nil {
+		dict.Add("info_hash", string(b.InfoHash))
+	}
+	if len(b.Key) > 0 {
+		dict.Add("k", string(b.Key))
+	}
+	if b.Nodes != nil {
+		dict.Add("nodes", string(EncodeNodes(b.Nodes, false)))
+		if nodes6 := EncodeNodes(b.Nodes, true); len(nodes6) > 0 {
+			dict.Add("nodes6", string(nodes6))
+		}
+	}
+	if b.Port > 0 {
+		dict.Add("port", b.Port)
+	}
+	if len(b.Salt) > 0 {
+		dict.Add("salt", string(b.Salt))
+	}
+	if b.Seq != nil {
+		dict.Add("seq", *b.Seq)
+	}
+	if len(b.Sig) > 0 {
+		dict.Add("sig", string(b.Sig))
+	}
+	if b.Target != nil {
+		dict.Add("target", string(b.Target))
+	}
+	if b.Token != "" {
+		dict.Add("token", b.Token)
+	}
+	if b.V != nil {
+		dict.Add("v", b.V)
+	}
+	if b.Values != nil {
+		values := make([]interface{}, 0, len(b.Values))
+		for _, addr := range b.Values {
+			if compact := compactAddr(addr, addr.IP.To4() == nil); compact != nil {
+				values = append(values, string(compact))
+			}
+		}
+		dict.Add("values", values)
+	}
+	return dict
+}
+
+func parseBody(value interface{}) (*Body, error) {
+	dict, ok := value.(*model.OrderedMap)
+	if !ok {
+		return nil, ErrInvalidMessage
+	}
+	id, _ := dict.Get("id").(string)
+	nodeId, err := NodeIdFromBytes([]byte(id))
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Body{Id: nodeId}
+	if target, ok := dict.Get("target").(string); ok {
+		b.Target = []byte(target)
+	}
+	if infoHash, ok := dict.Get("info_hash").(string); ok {
+		b.InfoHash = []byte(infoHash)
+	}
+	b.Port, _ = dict.Get("port").(int)
+	impliedPort, _ := dict.Get("implied_port").(int)
+	b.ImpliedPort = impliedPort != 0
+	b.Token, _ = dict.Get("token").(string)
+	b.V = dict.Get("v")
+	if key, ok := dict.Get("k").(string); ok {
+		b.Key = []byte(key)
+	}
+	if salt, ok := dict.Get("salt").(string); ok {
+		b.Salt = []byte(salt)
+	}
+	if sig, ok := dict.Get("sig").(string); ok {
+		b.Sig = []byte(sig)
+	}
+	if seq, ok := dict.Get("seq").(int); ok {
+		b.Seq = &seq
+	}
+	if cas, ok := dict.Get("cas").(int); ok {
+		b.Cas = &cas
+	}
+
+	for _, family := range []struct {
+		key  string
+		ipv6 bool
+	}{{"nodes", false}, {"nodes6", true}} {
+		value, exists := dict.GetExists(family.key)
+		if !exists {
+			continue
+		}
+		data, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("KRPC '%v' is not a string", family.key)
+		}
+		nodes, err := ParseNodes([]byte(data), family.ipv6)
+		if err != nil {
+			return nil, err
+		}
+		b.Nodes = append(b.Nodes, nodes...)
+	}
+
+	// Peers of an unexpected length are skipped rather than failing the whole response
+	if values, ok := dict.Get("values").([]interface{}); ok {
+		b.Values = make([]*net.UDPAddr, 0, len(values))
+		for _, value := range values {
+			if compact, ok := value.(string); ok && (len(compact) == 6 || len(compact) == 18) {
+				b.Values = append(b.Values, parseCompactAddr([]byte(compact)))
+			}
+		}
+	}
+	return b, nil
+}
+
+func parseError(value interface{}) (*Error, error) {
+	list, ok := value.([]interface{})
+	if !ok || len(list) < 2 {
+		return nil, ErrInvalidMessage
+	}
+	code, codeOk := list[0].(int)
+	message, messageOk := list[1].(string)
+	if !codeOk || !messageOk {
+		return nil, ErrInvalidMessage
+	}
+	return &Error{Code: code, Message: message}, nil
+}
@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestQueryRoundTrip(t *testing.T) {
+	infoHash := RandomNodeId()
+	m := &Message{
+		TransactionId: "aa",
+		Type:          TYPE_QUERY,
+		Query:         QUERY_ANNOUNCE_PEER,
+		Args:          &Body{Id: RandomNodeId(), InfoHash: infoHash[:], Port: 6881, ImpliedPort: true, Token: "token"},
+	}
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Errorf("Expected %+v but got %+v", m, parsed)
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	m := &Message{
+		TransactionId: "bb",
+		Type:          TYPE_RESPONSE,
+		Response: &Body{
+			Id:    RandomNodeId(),
+			Token: "token",
+			Nodes: []Node{{Id: RandomNodeId(), Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 1}}},
+			Values: []*net.UDPAddr{
+				{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 2},
+				{IP: net.ParseIP("2001:db8::2"), Port: 3},
+			},
+		},
+	}
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Errorf("Expected %+v but got %+v", m.Response, parsed.Response)
+	}
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	m := &Message{TransactionId: "cc", Type: TYPE_ERROR, Error: &Error{Code: ERROR_PROTOCOL, Message: "Bad token"}}
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "d1:eli203e9:Bad tokene1:t2:cc1:y1:ee" {
+		t.Errorf("Unexpected encoding %q", data)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Errorf("Expected %+v but got %+v", m, parsed)
+	}
+}
+
+func TestAddressAndReadOnlyRoundTrip(t *testing.T) {
+	m := &Message{TransactionId: "dd", Type: TYPE_QUERY, Query: QUERY_PING, Args: &Body{Id: RandomNodeId()}, ReadOnly: true}
+	reply := &Message{TransactionId: "dd", Type: TYPE_RESPONSE, Response: &Body{Id: RandomNodeId()}, IP: &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 6881}}
+	for _, message := range []*Message{m, reply} {
+		data, err := message.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := ParseMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, message) {
+			t.Errorf("Expected %+v but got %+v", message, parsed)
+		}
+	}
+}
+
+func TestItemRoundTrip(t *testing.T) {
+	seq, cas := 0, 7
+	m := &Message{
+		TransactionId: "ee",
+		Type:          TYPE_QUERY,
+		Query:         QUERY_PUT,
+		Args:          &Body{Id: RandomNodeId(), V: []interface{}{"a", 1}, Key: make([]byte, 32), Salt: []byte("salt"), Seq: &seq, Sig: make([]byte, 64), Cas: &cas, Token: "token"},
+	}
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, m) {
+		t.Errorf("Expected %+v but got %+v", m.Args, parsed.Args)
+	}
+}
+
+func TestParseInvalidMessages(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"le",
+		"d1:y1:qe",
+		"d1:t2:aa1:y1:xe",
+		"d1:ad2:id3:abce1:q4:ping1:t2:aa1:y1:qe",
+		"d1:t2:aa1:y1:ee",
+		"d1:rd2:id20:aaaaaaaaaaaaaaaaaaaa5:nodes3:abce1:t2:aa1:y1:re",
+	} {
+		if _, err := ParseMessage([]byte(data)); err == nil {
+			t.Errorf("Expected %q to fail to parse", data)
+		}
+	}
+}
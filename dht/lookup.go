@@ -0,0 +1,258 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+)
+
+const (
+	// How many queries a lookup has outstanding at once
+	ALPHA = 3
+)
+
+// Types
+
+// lookup walks towards a target, querying the closest nodes it has heard of until the K closest
+// have all answered or failed
+type lookup struct {
+	server *Server
+	self   NodeId
+	target NodeId
+	query  string
+	// newArgs returns the arguments for each query
+	newArgs    func() *Body
+	candidates map[NodeId]*candidate
+}
+
+type candidate struct {
+	node     Node
+	queried  bool
+	failed   bool
+	response *Body
+}
+
+type lookupResult struct {
+	node     Node
+	response *Body
+	err      error
+}
+
+// Public Methods
+
+// Bootstrap joins the DHT through the configured bootstrap nodes and any nodes already in the
+// routing table, by looking up our own id. It fails if no node answers.
+func (s *Server) Bootstrap(ctx context.Context) error {
+	seeds := []Node{}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, address := range s.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", address)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			self := s.Id()
+			response, err := s.query(ctx, addr, QUERY_FIND_NODE, &Body{Target: self[:]})
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			seeds = append(seeds, response.Nodes...)
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if _, err := s.FindNode(ctx, s.Id(), seeds...); err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.table.len() == 0 {
+		return ErrNoNodes
+	}
+	return nil
+}
+
+// FindNode looks up the K nodes closest to target, starting from the routing table and any seeds
+func (s *Server) FindNode(ctx context.Context, target NodeId, seeds ...Node) ([]Node, error) {
+	l := s.newLookup(target, QUERY_FIND_NODE, func() *Body { return &Body{Target: target[:]} })
+	results, err := l.run(ctx, seeds)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(results))
+	for _, c := range results {
+		nodes = append(nodes, c.node)
+	}
+	return nodes, nil
+}
+
+// GetPeers looks up peers for a torrent, returning their addresses as host:port
+func (s *Server) GetPeers(ctx context.Context, infoHash []byte) ([]string, error) {
+	peers, _, err := s.getPeers(ctx, infoHash)
+	return peers, err
+}
+
+// Announce looks up peers for a torrent, and tells the closest nodes to it that we are a peer
+// listening on port. A port of 0 has them use the port our queries come from. It fails if no
+// node accepted the announce.
+func (s *Server) Announce(ctx context.Context, infoHash []byte, port int) ([]string, error) {
+	peers, closest, err := s.getPeers(ctx, infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	accepted := 0
+	for _, c := range closest {
+		if c.response.Token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			args := &Body{InfoHash: infoHash, Port: port, ImpliedPort: port == 0, Token: c.response.Token}
+			if _, err := s.query(ctx, c.node.Addr, QUERY_ANNOUNCE_PEER, args); err == nil {
+				lock.Lock()
+				accepted++
+				lock.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if accepted == 0 {
+		return peers, ErrNoNodes
+	}
+	return peers, nil
+}
+
+// Helpers
+
+// getPeers runs a get_peers lookup, returning the peers found and the closest nodes which
+// answered
+func (s *Server) getPeers(ctx context.Context, infoHash []byte) ([]string, []*candidate, error) {
+	target, err := NodeIdFromBytes(infoHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	l := s.newLookup(target, QUERY_GET_PEERS, func() *Body { return &Body{InfoHash: target[:]} })
+	closest, err := l.run(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Peers which announced to us count too, as we may be one of the closest nodes
+	s.lock.Lock()
+	found := s.peers.get(target, MAX_VALUES, s.config.Clock.Now())
+	s.lock.Unlock()
+	for _, c := range l.candidates {
+		if c.response != nil {
+			found = append(found, c.response.Values...)
+		}
+	}
+
+	seen := make(map[string]bool)
+	peers := []string{}
+	for _, addr := range found {
+		if address := addr.String(); !seen[address] && addr.Port > 0 {
+			seen[address] = true
+			peers = append(peers, address)
+		}
+	}
+	return peers, closest, nil
+}
+
+func (s *Server) newLookup(target NodeId, query string, newArgs func() *Body) *lookup {
+	return &lookup{server: s, self: s.Id(), target: target, query: query, newArgs: newArgs, candidates: make(map[NodeId]*candidate)}
+}
+
+// run queries nodes until the closest K have all been queried, returning those which answered,
+// closest first
+func (l *lookup) run(ctx context.Context, seeds []Node) ([]*candidate, error) {
+	l.server.lock.Lock()
+	known := l.server.table.closest(l.target, K)
+	l.server.lock.Unlock()
+	l.add(known)
+	l.add(seeds)
+
+	results := make(chan lookupResult)
+	outstanding := 0
+	for {
+		for _, c := range l.closest() {
+			if outstanding >= ALPHA || ctx.Err() != nil {
+				break
+			}
+			if c.queried {
+				continue
+			}
+			c.queried = true
+			outstanding++
+			go func(n Node) {
+				response, err := l.server.query(ctx, n.Addr, l.query, l.newArgs())
+				results <- lookupResult{node: n, response: response, err: err}
+			}(c.node)
+		}
+		if outstanding == 0 {
+			break
+		}
+
+		result := <-results
+		outstanding--
+		c := l.candidates[result.node.Id]
+		if result.err != nil {
+			c.failed = true
+			continue
+		}
+		c.response = result.response
+		l.add(result.response.Nodes)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	answered := []*candidate{}
+	for _, c := range l.closest() {
+		if c.response != nil {
+			answered = append(answered, c)
+		}
+	}
+	return answered, nil
+}
+
+func (l *lookup) add(nodes []Node) {
+	for _, n := range nodes {
+		if n.Id == l.self || n.Addr == nil || n.Addr.Port == 0 || l.server.ignored(n.Addr.IP) {
+			continue
+		}
+		if _, known := l.candidates[n.Id]; !known {
+			l.candidates[n.Id] = &candidate{node: n}
+		}
+	}
+}
+
+// closest returns the K closest candidates which haven't failed, closest first
+func (l *lookup) closest() []*candidate {
+	candidates := make([]*candidate, 0, len(l.candidates))
+	for _, c := range l.candidates {
+		if !c.failed {
+			candidates = append(candidates, c)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return l.target.Closer(candidates[i].node.Id, candidates[j].node.Id)
+	})
+	if len(candidates) > K {
+		candidates = candidates[:K]
+	}
+	return candidates
+}
@@ -0,0 +1,38 @@
+package dht
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"github.com/onepointsixtwo/torrentsgo/model"
+)
+
+var ErrNotMutableTorrent = errors.New("DHT item is not a mutable torrent")
+
+// Public Methods
+
+// NewTorrentItem returns the mutable item publishing infoHash as the current version of the
+// mutable torrent with key and salt (BEP 46), to be stored with Put. seq must be higher each time
+// the torrent is updated.
+func NewTorrentItem(key ed25519.PrivateKey, salt []byte, seq int, infoHash []byte) (*Item, error) {
+	v := model.NewOrderedMap()
+	v.Add("ih", string(infoHash))
+	return NewMutableItem(v, key, salt, seq)
+}
+
+// ResolveTorrent looks up the current info hash of the mutable torrent with key and salt
+func (s *Server) ResolveTorrent(ctx context.Context, key ed25519.PublicKey, salt []byte) ([]byte, error) {
+	item, err := s.GetMutable(ctx, key, salt)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := item.V.(*model.OrderedMap)
+	if !ok {
+		return nil, ErrNotMutableTorrent
+	}
+	infoHash, ok := dict.Get("ih").(string)
+	if !ok || len(infoHash) != ID_LENGTH {
+		return nil, ErrNotMutableTorrent
+	}
+	return []byte(infoHash), nil
+}
@@ -0,0 +1,149 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+const (
+	ID_LENGTH = 20
+	// Compact node info is the id followed by a compact IPv4 or IPv6 address and port
+	COMPACT_NODE_LENGTH      = ID_LENGTH + 6
+	COMPACT_NODE_IPV6_LENGTH = ID_LENGTH + 18
+)
+
+// Types
+
+// NodeId identifies a node, and is compared with info hashes by XOR distance
+type NodeId [ID_LENGTH]byte
+
+type Node struct {
+	Id   NodeId
+	Addr *net.UDPAddr
+}
+
+// Initialiser
+
+// RandomNodeId returns an id chosen uniformly at random
+func RandomNodeId() NodeId {
+	var id NodeId
+	rand.Read(id[:])
+	return id
+}
+
+// NodeIdFromBytes returns the id held in b, which must be ID_LENGTH long
+func NodeIdFromBytes(b []byte) (NodeId, error) {
+	var id NodeId
+	if len(b) != ID_LENGTH {
+		return id, fmt.Errorf("Node id must be %v bytes but is %v", ID_LENGTH, len(b))
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// Public Methods
+
+func (id NodeId) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the XOR of the two ids, which orders nodes by closeness to a target
+func (id NodeId) Distance(other NodeId) NodeId {
+	var distance NodeId
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return distance
+}
+
+// Closer reports whether a is closer to id than b is
+func (id NodeId) Closer(a NodeId, b NodeId) bool {
+	da, db := id.Distance(a), id.Distance(b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// CommonPrefixLength returns how many leading bits the ids share, which is ID_LENGTH*8 when they
+// are equal
+func (id NodeId) CommonPrefixLength(other NodeId) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			length := i * 8
+			for x&0x80 == 0 {
+				x <<= 1
+				length++
+			}
+			return length
+		}
+	}
+	return ID_LENGTH * 8
+}
+
+func (n Node) String() string {
+	return fmt.Sprintf("%v@%v", n.Id, n.Addr)
+}
+
+// EncodeNodes returns compact node info for the IPv4 nodes, or the IPv6 nodes when ipv6 is set.
+// Nodes of the other family are left out.
+func EncodeNodes(nodes []Node, ipv6 bool) []byte {
+	compact := []byte{}
+	for _, n := range nodes {
+		addr := compactAddr(n.Addr, ipv6)
+		if addr != nil {
+			compact = append(append(compact, n.Id[:]...), addr...)
+		}
+	}
+	return compact
+}
+
+// ParseNodes reads compact node info of IPv4 nodes, or IPv6 nodes when ipv6 is set
+func ParseNodes(data []byte, ipv6 bool) ([]Node, error) {
+	entryLength := COMPACT_NODE_LENGTH
+	if ipv6 {
+		entryLength = COMPACT_NODE_IPV6_LENGTH
+	}
+	if len(data)%entryLength != 0 {
+		return nil, fmt.Errorf("Compact nodes length %v is not a multiple of %v", len(data), entryLength)
+	}
+
+	nodes := make([]Node, 0, len(data)/entryLength)
+	for offset := 0; offset < len(data); offset += entryLength {
+		n := Node{Addr: parseCompactAddr(data[offset+ID_LENGTH : offset+entryLength])}
+		copy(n.Id[:], data[offset:offset+ID_LENGTH])
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// Helpers
+
+// compactAddr returns the address as a compact IP and port, or nil if it isn't of the family
+// asked for
+func compactAddr(addr *net.UDPAddr, ipv6 bool) []byte {
+	if addr == nil {
+		return nil
+	}
+	ip := addr.IP.To4()
+	if ipv6 {
+		if ip != nil {
+			return nil
+		}
+		ip = addr.IP.To16()
+	}
+	if ip == nil {
+		return nil
+	}
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, uint16(addr.Port))
+	return append(append([]byte{}, ip...), port...)
+}
+
+func parseCompactAddr(data []byte) *net.UDPAddr {
+	ipLength := len(data) - 2
+	ip := make(net.IP, ipLength)
+	copy(ip, data[:ipLength])
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(data[ipLength:]))}
+}
@@ -0,0 +1,67 @@
+package dht
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestCommonPrefixLength(t *testing.T) {
+	var a, b NodeId
+	if length := a.CommonPrefixLength(b); length != ID_LENGTH*8 {
+		t.Errorf("Equal ids should share every bit but share %v", length)
+	}
+	b[0] = 0x80
+	if length := a.CommonPrefixLength(b); length != 0 {
+		t.Errorf("Expected no shared bits but got %v", length)
+	}
+	b[0] = 0
+	b[2] = 0x10
+	if length := a.CommonPrefixLength(b); length != 19 {
+		t.Errorf("Expected 19 shared bits but got %v", length)
+	}
+}
+
+func TestDistanceOrdersByXor(t *testing.T) {
+	var target, near, far NodeId
+	near[19] = 0x01
+	far[0] = 0x01
+	if !target.Closer(near, far) || target.Closer(far, near) {
+		t.Error("The id differing in the last byte should be closer")
+	}
+	if distance := near.Distance(far); distance[0] != 0x01 || distance[19] != 0x01 {
+		t.Errorf("Unexpected distance %v", distance)
+	}
+}
+
+func TestCompactNodesRoundTrip(t *testing.T) {
+	nodes := []Node{
+		{Id: RandomNodeId(), Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}},
+		{Id: RandomNodeId(), Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+		{Id: RandomNodeId(), Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2).To4(), Port: 6883}},
+	}
+
+	compact := EncodeNodes(nodes, false)
+	if len(compact) != 2*COMPACT_NODE_LENGTH {
+		t.Fatalf("Expected two IPv4 nodes but got %v bytes", len(compact))
+	}
+	parsed, err := ParseNodes(compact, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, []Node{nodes[0], nodes[2]}) {
+		t.Errorf("Unexpected IPv4 nodes %v", parsed)
+	}
+
+	parsed, err = ParseNodes(EncodeNodes(nodes, true), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 1 || parsed[0].Id != nodes[1].Id || !parsed[0].Addr.IP.Equal(nodes[1].Addr.IP) || parsed[0].Addr.Port != 6882 {
+		t.Errorf("Unexpected IPv6 nodes %v", parsed)
+	}
+
+	if _, err := ParseNodes(compact[:COMPACT_NODE_LENGTH+1], false); err == nil {
+		t.Error("Nodes of the wrong length should fail to parse")
+	}
+}
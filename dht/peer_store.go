@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// Peers which haven't announced in this long are forgotten
+	PEER_EXPIRY = 30 * time.Minute
+	// Most peers returned by one get_peers response, so it fits in a packet
+	MAX_VALUES = 50
+	// Limits on what announces can make us store
+	MAX_STORED_TORRENTS   = 10000
+	MAX_PEERS_PER_TORRENT = 1000
+)
+
+// Types
+
+// peerStore keeps the peers which have announced to us. It isn't safe for concurrent use.
+type peerStore struct {
+	torrents map[NodeId]map[string]*storedPeer
+}
+
+type storedPeer struct {
+	addr *net.UDPAddr
+	seen time.Time
+}
+
+// Initialiser
+
+func newPeerStore() *peerStore {
+	return &peerStore{torrents: make(map[NodeId]map[string]*storedPeer)}
+}
+
+// Public Methods
+
+// add stores a peer for the torrent, returning false if the store is full
+func (s *peerStore) add(infoHash NodeId, addr *net.UDPAddr, now time.Time) bool {
+	peers, ok := s.torrents[infoHash]
+	if !ok {
+		if len(s.torrents) >= MAX_STORED_TORRENTS {
+			return false
+		}
+		peers = make(map[string]*storedPeer)
+		s.torrents[infoHash] = peers
+	}
+	key := addr.String()
+	if p, ok := peers[key]; ok {
+		p.seen = now
+		return true
+	}
+	if len(peers) >= MAX_PEERS_PER_TORRENT {
+		return false
+	}
+	peers[key] = &storedPeer{addr: addr, seen: now}
+	return true
+}
+
+// get returns up to max of the torrent's peers which haven't expired. Map order makes the choice
+// vary between calls.
+func (s *peerStore) get(infoHash NodeId, max int, now time.Time) []*net.UDPAddr {
+	addrs := []*net.UDPAddr{}
+	for _, p := range s.torrents[infoHash] {
+		if len(addrs) >= max {
+			break
+		}
+		if now.Sub(p.seen) < PEER_EXPIRY {
+			addrs = append(addrs, p.addr)
+		}
+	}
+	return addrs
+}
+
+func (s *peerStore) expire(now time.Time) {
+	for infoHash, peers := range s.torrents {
+		for key, p := range peers {
+			if now.Sub(p.seen) >= PEER_EXPIRY {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.torrents, infoHash)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"io"
+)
+
+const (
+	// Saved state longer than this is refused
+	MAX_STATE_LENGTH = 1024 * 1024
+)
+
+// Types
+
+// State is what Save writes, to be passed back in Config so a restarted node keeps its id and
+// doesn't need to bootstrap from scratch
+type State struct {
+	Id    NodeId
+	Nodes []Node
+}
+
+// Public Methods
+
+// Save writes our id and the nodes in the routing table
+func (s *Server) Save(w io.Writer) error {
+	state := &State{Id: s.Id(), Nodes: s.Nodes()}
+	data, err := state.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (state *State) Encode() ([]byte, error) {
+	dict := model.NewOrderedMap()
+	dict.Add("id", string(state.Id[:]))
+	dict.Add("nodes", string(EncodeNodes(state.Nodes, false)))
+	dict.Add("nodes6", string(EncodeNodes(state.Nodes, true)))
+	return bencoding.EncodeBencoding(dict)
+}
+
+// Load reads the state written by Save
+func Load(r io.Reader) (*State, error) {
+	dict, err := bencoding.DecodeBencodingLimited(r, MAX_STATE_LENGTH)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode DHT state - %v", err)
+	}
+
+	id, _ := dict.Get("id").(string)
+	nodeId, err := NodeIdFromBytes([]byte(id))
+	if err != nil {
+		return nil, err
+	}
+	state := &State{Id: nodeId}
+	for _, family := range []struct {
+		key  string
+		ipv6 bool
+	}{{"nodes", false}, {"nodes6", true}} {
+		data, _ := dict.Get(family.key).(string)
+		nodes, err := ParseNodes([]byte(data), family.ipv6)
+		if err != nil {
+			return nil, err
+		}
+		state.Nodes = append(state.Nodes, nodes...)
+	}
+	return state, nil
+}
@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// Queries answered each second from one address, and how many can come at once
+	DEFAULT_RATE_LIMIT = 20
+	RATE_LIMIT_BURST   = 2 * DEFAULT_RATE_LIMIT
+	// An address with this many queries dropped within RATE_LIMIT_WINDOW is ignored entirely for
+	// RATE_LIMIT_BAN_DURATION
+	RATE_LIMIT_BAN_THRESHOLD = 100
+	RATE_LIMIT_WINDOW        = time.Minute
+	RATE_LIMIT_BAN_DURATION  = 10 * time.Minute
+)
+
+// Types
+
+// rateLimiter keeps a token bucket for each address, and bans addresses which keep going over
+// their limit. It isn't safe for concurrent use.
+type rateLimiter struct {
+	rate      float64
+	burst     float64
+	addresses map[string]*addressLimit
+}
+
+type addressLimit struct {
+	tokens      float64
+	last        time.Time
+	dropped     int
+	windowStart time.Time
+	bannedUntil time.Time
+}
+
+// Initialiser
+
+func newRateLimiter(rate int) *rateLimiter {
+	burst := float64(RATE_LIMIT_BURST)
+	if float64(rate) > burst {
+		burst = float64(rate)
+	}
+	return &rateLimiter{rate: float64(rate), burst: burst, addresses: make(map[string]*addressLimit)}
+}
+
+// Public Methods
+
+// allow reports whether a query from ip should be answered
+func (r *rateLimiter) allow(ip net.IP, now time.Time) bool {
+	key := ip.String()
+	limit, ok := r.addresses[key]
+	if !ok {
+		limit = &addressLimit{tokens: r.burst, last: now, windowStart: now}
+		r.addresses[key] = limit
+	}
+	if now.Before(limit.bannedUntil) {
+		return false
+	}
+
+	limit.tokens += now.Sub(limit.last).Seconds() * r.rate
+	if limit.tokens > r.burst {
+		limit.tokens = r.burst
+	}
+	limit.last = now
+	if limit.tokens >= 1 {
+		limit.tokens--
+		return true
+	}
+
+	if now.Sub(limit.windowStart) >= RATE_LIMIT_WINDOW {
+		limit.windowStart = now
+		limit.dropped = 0
+	}
+	limit.dropped++
+	if limit.dropped >= RATE_LIMIT_BAN_THRESHOLD {
+		limit.bannedUntil = now.Add(RATE_LIMIT_BAN_DURATION)
+		limit.dropped = 0
+	}
+	return false
+}
+
+// banned reports whether ip is being ignored for going over its limit too often
+func (r *rateLimiter) banned(ip net.IP, now time.Time) bool {
+	limit, ok := r.addresses[ip.String()]
+	return ok && now.Before(limit.bannedUntil)
+}
+
+// expire forgets addresses whose buckets have refilled and which aren't banned
+func (r *rateLimiter) expire(now time.Time) {
+	for key, limit := range r.addresses {
+		refilled := limit.tokens+now.Sub(limit.last).Seconds()*r.rate >= r.burst
+		if refilled && !now.Before(limit.bannedUntil) {
+			delete(r.addresses, key)
+		}
+	}
+}
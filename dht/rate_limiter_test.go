@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurstThenRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ip, other := net.IPv4(1, 2, 3, 4), net.IPv4(1, 2, 3, 5)
+	limiter := newRateLimiter(DEFAULT_RATE_LIMIT)
+
+	for i := 0; i < RATE_LIMIT_BURST; i++ {
+		if !limiter.allow(ip, now) {
+			t.Fatalf("Query %v of the burst should be allowed", i)
+		}
+	}
+	if limiter.allow(ip, now) {
+		t.Error("Queries beyond the burst should be dropped")
+	}
+	if !limiter.allow(other, now) {
+		t.Error("Other addresses have their own limit")
+	}
+
+	now = now.Add(time.Second)
+	allowed := 0
+	for limiter.allow(ip, now) {
+		allowed++
+	}
+	if allowed != DEFAULT_RATE_LIMIT {
+		t.Errorf("Expected %v queries to be allowed after a second but got %v", DEFAULT_RATE_LIMIT, allowed)
+	}
+}
+
+func TestRateLimiterBansFloods(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ip := net.IPv4(1, 2, 3, 4)
+	limiter := newRateLimiter(DEFAULT_RATE_LIMIT)
+	for i := 0; i < RATE_LIMIT_BURST+RATE_LIMIT_BAN_THRESHOLD; i++ {
+		limiter.allow(ip, now)
+	}
+	if !limiter.banned(ip, now) {
+		t.Fatal("An address which keeps going over its limit should be banned")
+	}
+
+	// The ban outlasts the bucket refilling
+	now = now.Add(RATE_LIMIT_BAN_DURATION - time.Second)
+	if limiter.allow(ip, now) {
+		t.Error("A banned address shouldn't be allowed")
+	}
+	limiter.expire(now)
+	now = now.Add(time.Second)
+	if limiter.banned(ip, now) || !limiter.allow(ip, now) {
+		t.Error("The ban should have ended")
+	}
+
+	limiter.expire(now.Add(time.Minute))
+	if len(limiter.addresses) != 0 {
+		t.Errorf("Expected idle addresses to be forgotten but have %v", len(limiter.addresses))
+	}
+}
@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"hash/crc32"
+	"net"
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+	// The parts of an address which count towards a secure id. Masking the low bits lets nodes
+	// on the same network pick from a limited set of ids.
+	secureMaskIPv4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	secureMaskIPv6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// Public Methods
+
+// SecureNodeId returns a random id which is valid for a node at ip (BEP 42)
+func SecureNodeId(ip net.IP) NodeId {
+	id := RandomNodeId()
+	crc := securePrefix(ip, id[ID_LENGTH-1])
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	return id
+}
+
+// ValidFor reports whether the id is one a node at ip could have made (BEP 42). Every id is
+// valid for local addresses, as they say nothing about where a node is.
+func (id NodeId) ValidFor(ip net.IP) bool {
+	if isLocal(ip) {
+		return true
+	}
+	crc := securePrefix(ip, id[ID_LENGTH-1])
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+// Helpers
+
+// securePrefix returns the CRC32-C of the masked address, which gives the first 21 bits of a
+// secure id. The low three bits of the id's last byte are mixed in, so each address has eight
+// possible prefixes.
+func securePrefix(ip net.IP, last byte) uint32 {
+	var masked []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		masked = make([]byte, len(secureMaskIPv4))
+		for i, mask := range secureMaskIPv4 {
+			masked[i] = ip4[i] & mask
+		}
+	} else {
+		masked = make([]byte, len(secureMaskIPv6))
+		for i, mask := range secureMaskIPv6 {
+			masked[i] = ip.To16()[i] & mask
+		}
+	}
+	masked[0] |= (last & 0x07) << 5
+	return crc32.Checksum(masked, castagnoli)
+}
+
+func isLocal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
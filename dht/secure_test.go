@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+func TestSecurePrefixMatchesBep42(t *testing.T) {
+	// Test vectors from BEP 42, giving the address, the id's last byte and the id's first bytes
+	for _, vector := range []struct {
+		ip     string
+		last   byte
+		prefix string
+	}{
+		{"124.31.75.21", 1, "5fbfbf"},
+		{"21.75.31.124", 86, "5a3ce9"},
+		{"65.23.51.170", 22, "a5d432"},
+		{"84.124.73.14", 65, "1b0321"},
+		{"43.213.53.83", 90, "e56f6c"},
+	} {
+		expected, _ := hex.DecodeString(vector.prefix)
+		crc := securePrefix(net.ParseIP(vector.ip), vector.last)
+		if byte(crc>>24) != expected[0] || byte(crc>>16) != expected[1] || byte(crc>>8)&0xf8 != expected[2]&0xf8 {
+			t.Errorf("Unexpected prefix %08x for %v", crc, vector.ip)
+		}
+
+		var id NodeId
+		copy(id[:], expected)
+		id[ID_LENGTH-1] = vector.last
+		if !id.ValidFor(net.ParseIP(vector.ip)) {
+			t.Errorf("Expected id %v to be valid for %v", id, vector.ip)
+		}
+	}
+}
+
+func TestSecureNodeIds(t *testing.T) {
+	for _, address := range []string{"124.31.75.21", "2001:db8::1"} {
+		ip := net.ParseIP(address)
+		id := SecureNodeId(ip)
+		if !id.ValidFor(ip) {
+			t.Errorf("Expected generated id %v to be valid for %v", id, ip)
+		}
+		if id.ValidFor(net.ParseIP("8.8.8.8")) {
+			t.Errorf("Expected id %v not to be valid for another address", id)
+		}
+	}
+
+	// Nodes on local networks can have any id
+	for _, address := range []string{"127.0.0.1", "10.1.2.3", "192.168.1.1", "172.16.0.1", "169.254.1.1"} {
+		if !RandomNodeId().ValidFor(net.ParseIP(address)) {
+			t.Errorf("Expected any id to be valid for %v", address)
+		}
+	}
+}
@@ -0,0 +1,524 @@
+package dht
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Queries which haven't been answered in this long fail
+	QUERY_TIMEOUT = 5 * time.Second
+	// How often tokens, stored peers and items and the routing table are tidied
+	MAINTENANCE_INTERVAL = time.Minute
+	// How many nodes at different addresses must agree on our address before we believe it
+	EXTERNAL_IP_VOTES = 4
+	// Most addresses voted for before the votes are thrown away
+	MAX_EXTERNAL_IP_CANDIDATES = 64
+)
+
+// DEFAULT_BOOTSTRAP_NODES are well known nodes which can be used to join the DHT
+var DEFAULT_BOOTSTRAP_NODES = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+var (
+	ErrTimeout      = errors.New("DHT query timed out")
+	ErrServerClosed = errors.New("DHT server is closed")
+	ErrNoNodes      = errors.New("No DHT nodes could be reached")
+	ErrBlocked      = errors.New("DHT node is blocked")
+)
+
+// Types
+
+type Config struct {
+	// Id is the node's id, or a random one when zero. Reusing a saved id keeps our place in the
+	// DHT.
+	Id NodeId
+	// Conn carries the server's KRPC messages. It is closed by Close.
+	Conn net.PacketConn
+	// BootstrapNodes are host:port addresses used to join the DHT, see DEFAULT_BOOTSTRAP_NODES
+	BootstrapNodes []string
+	// Nodes seed the routing table, usually those from a previous run's Save
+	Nodes []Node
+	// ExternalIP is our address as other nodes see it. Without an Id, one valid for it is made
+	// (BEP 42). Otherwise it is learnt from responses, and a random id is replaced once it is.
+	ExternalIP net.IP
+	// ReadOnly nodes make queries but don't answer them (BEP 43), for when other nodes can't
+	// reach us
+	ReadOnly bool
+	// AllowInsecureIds lets nodes whose ids aren't valid for their address into the routing table
+	AllowInsecureIds bool
+	// Blocklist holds addresses to ignore, and may be nil
+	Blocklist *Blocklist
+	// RateLimit is how many queries a second are answered from each address, DEFAULT_RATE_LIMIT
+	// when 0. Addresses which keep going over it are ignored for a while.
+	RateLimit int
+	Clock     util.Clock
+}
+
+// Server is a node in the mainline DHT (BEP 5). It answers other nodes' queries and makes lookups
+// of its own to find peers for torrents without trackers.
+type Server struct {
+	config   Config
+	handlers map[string]queryHandler
+	// fixedId is set when the id was given, so it is kept whatever our address
+	fixedId bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	lock       sync.Mutex
+	id         NodeId
+	externalIP net.IP
+	// votes holds the addresses of the nodes reporting each candidate external address
+	votes           map[string]map[string]bool
+	limiter         *rateLimiter
+	table           *table
+	tokens          *tokens
+	peers           *peerStore
+	items           *itemStore
+	transactions    map[string]*transaction
+	nextTransaction uint16
+	closed          bool
+}
+
+// queryHandler answers a query from addr, returning the response or the error to send back
+type queryHandler func(addr *net.UDPAddr, args *Body) (*Body, *Error)
+
+type transaction struct {
+	addr     *net.UDPAddr
+	response chan *Message
+}
+
+// Initialiser
+
+func NewServer(config Config) (*Server, error) {
+	if config.Conn == nil {
+		return nil, errors.New("DHT server needs a connection")
+	}
+	fixedId := config.Id != (NodeId{})
+	if !fixedId {
+		if config.ExternalIP != nil {
+			config.Id = SecureNodeId(config.ExternalIP)
+		} else {
+			config.Id = RandomNodeId()
+		}
+	}
+	if config.RateLimit <= 0 {
+		config.RateLimit = DEFAULT_RATE_LIMIT
+	}
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	now := config.Clock.Now()
+	s := &Server{
+		config:       config,
+		fixedId:      fixedId,
+		ctx:          ctx,
+		cancel:       cancel,
+		id:           config.Id,
+		externalIP:   config.ExternalIP,
+		votes:        make(map[string]map[string]bool),
+		limiter:      newRateLimiter(config.RateLimit),
+		table:        newTable(config.Id),
+		tokens:       newTokens(now),
+		peers:        newPeerStore(),
+		items:        newItemStore(),
+		transactions: make(map[string]*transaction),
+	}
+	s.handlers = map[string]queryHandler{
+		QUERY_PING:          s.handlePing,
+		QUERY_FIND_NODE:     s.handleFindNode,
+		QUERY_GET_PEERS:     s.handleGetPeers,
+		QUERY_ANNOUNCE_PEER: s.handleAnnouncePeer,
+		QUERY_GET:           s.handleGet,
+		QUERY_PUT:           s.handlePut,
+	}
+	for _, n := range config.Nodes {
+		s.addNode(n, false, now)
+	}
+
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.maintain()
+	return s, nil
+}
+
+// Public Methods
+
+// Id returns our id, which changes if a random id turns out not to be valid for our address
+func (s *Server) Id() NodeId {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.id
+}
+
+// ExternalIP returns our address as other nodes see it, or nil until enough of them agree
+func (s *Server) ExternalIP() net.IP {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.externalIP
+}
+
+func (s *Server) Addr() net.Addr {
+	return s.config.Conn.LocalAddr()
+}
+
+// Nodes returns the nodes in the routing table which aren't bad
+func (s *Server) Nodes() []Node {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.table.nodes()
+}
+
+// Ping queries the node at address, returning its id. A node which answers is added to the
+// routing table.
+func (s *Server) Ping(ctx context.Context, address string) (NodeId, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return NodeId{}, err
+	}
+	response, err := s.query(ctx, addr, QUERY_PING, &Body{})
+	if err != nil {
+		return NodeId{}, err
+	}
+	return response.Id, nil
+}
+
+// Close stops the server and closes its connection, failing any queries in progress
+func (s *Server) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	s.cancel()
+	err := s.config.Conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+// Query Handlers
+
+func (s *Server) handlePing(addr *net.UDPAddr, args *Body) (*Body, *Error) {
+	return &Body{}, nil
+}
+
+func (s *Server) handleFindNode(addr *net.UDPAddr, args *Body) (*Body, *Error) {
+	target, err := NodeIdFromBytes(args.Target)
+	if err != nil {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Invalid target"}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &Body{Nodes: s.table.closest(target, K)}, nil
+}
+
+// handleGetPeers returns the peers we know for the torrent, or the closest nodes to it if we have
+// none
+func (s *Server) handleGetPeers(addr *net.UDPAddr, args *Body) (*Body, *Error) {
+	infoHash, err := NodeIdFromBytes(args.InfoHash)
+	if err != nil {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Invalid info_hash"}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.config.Clock.Now()
+	response := &Body{Token: s.tokens.token(addr.IP, now)}
+	if values := s.peers.get(infoHash, MAX_VALUES, now); len(values) > 0 {
+		response.Values = values
+	} else {
+		response.Nodes = s.table.closest(infoHash, K)
+	}
+	return response, nil
+}
+
+func (s *Server) handleAnnouncePeer(addr *net.UDPAddr, args *Body) (*Body, *Error) {
+	infoHash, err := NodeIdFromBytes(args.InfoHash)
+	if err != nil {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Invalid info_hash"}
+	}
+	port := args.Port
+	if args.ImpliedPort {
+		port = addr.Port
+	}
+	if port <= 0 || port > 65535 {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Invalid port"}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := s.config.Clock.Now()
+	if !s.tokens.valid(args.Token, addr.IP, now) {
+		return nil, &Error{Code: ERROR_PROTOCOL, Message: "Bad token"}
+	}
+	if !s.peers.add(infoHash, &net.UDPAddr{IP: addr.IP, Port: port}, now) {
+		return nil, &Error{Code: ERROR_SERVER, Message: "Too many peers stored"}
+	}
+	return &Body{}, nil
+}
+
+// Helpers
+
+func (s *Server) readLoop() {
+	defer s.wg.Done()
+	buffer := make([]byte, MAX_MESSAGE_LENGTH)
+	for {
+		n, addr, err := s.config.Conn.ReadFrom(buffer)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			// A temporary failure, such as an ICMP error for an earlier packet
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if s.ignored(udpAddr.IP) {
+			continue
+		}
+		m, err := ParseMessage(buffer[:n])
+		if err != nil {
+			continue
+		}
+
+		switch m.Type {
+		case TYPE_QUERY:
+			if !s.config.ReadOnly {
+				s.handleQuery(m, udpAddr)
+			}
+		case TYPE_RESPONSE, TYPE_ERROR:
+			s.handleResponse(m, udpAddr)
+		}
+	}
+}
+
+// handleQuery answers a query, unless its sender has gone over its rate limit. Read only nodes
+// aren't added to the routing table, as they won't answer our queries.
+func (s *Server) handleQuery(m *Message, addr *net.UDPAddr) {
+	s.lock.Lock()
+	now := s.config.Clock.Now()
+	if !s.limiter.allow(addr.IP, now) {
+		s.lock.Unlock()
+		return
+	}
+	if !m.ReadOnly {
+		s.addNode(Node{Id: m.Args.Id, Addr: addr}, false, now)
+	}
+	id := s.id
+	s.lock.Unlock()
+
+	reply := &Message{TransactionId: m.TransactionId, Type: TYPE_RESPONSE, IP: addr}
+	handler, ok := s.handlers[m.Query]
+	if !ok {
+		reply.Type = TYPE_ERROR
+		reply.Error = &Error{Code: ERROR_METHOD_UNKNOWN, Message: "Method Unknown"}
+		s.send(reply, addr)
+		return
+	}
+
+	response, err := handler(addr, m.Args)
+	if err != nil {
+		reply.Type = TYPE_ERROR
+		reply.Error = err
+	} else {
+		response.Id = id
+		reply.Response = response
+	}
+	s.send(reply, addr)
+}
+
+// handleResponse passes a response or error to the query waiting for it. Messages from any
+// address but the one queried are ignored, so replies can't be forged without seeing the query.
+func (s *Server) handleResponse(m *Message, addr *net.UDPAddr) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	t, ok := s.transactions[m.TransactionId]
+	if !ok || !sameAddr(t.addr, addr) {
+		return
+	}
+	delete(s.transactions, m.TransactionId)
+	t.response <- m
+}
+
+// query sends a query to addr and waits for the answer. Nodes which answer are added to the
+// routing table, and those which don't have the failure recorded.
+func (s *Server) query(ctx context.Context, addr *net.UDPAddr, query string, args *Body) (*Body, error) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, ErrServerClosed
+	}
+	if s.blocked(addr.IP, s.config.Clock.Now()) {
+		s.lock.Unlock()
+		return nil, ErrBlocked
+	}
+	args.Id = s.id
+	id := s.newTransactionId()
+	t := &transaction{addr: addr, response: make(chan *Message, 1)}
+	s.transactions[id] = t
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.transactions, id)
+		s.lock.Unlock()
+	}()
+
+	if err := s.send(&Message{TransactionId: id, Type: TYPE_QUERY, Query: query, Args: args, ReadOnly: s.config.ReadOnly}, addr); err != nil {
+		return nil, err
+	}
+
+	timer := s.config.Clock.NewTimer(QUERY_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case m := <-t.response:
+		if m.Type == TYPE_ERROR {
+			return nil, m.Error
+		}
+		s.lock.Lock()
+		s.addNode(Node{Id: m.Response.Id, Addr: addr}, true, s.config.Clock.Now())
+		if m.IP != nil {
+			s.voteExternalIP(m.IP.IP, addr.IP)
+		}
+		s.lock.Unlock()
+		return m.Response, nil
+	case <-timer.C():
+		s.lock.Lock()
+		s.table.failed(addr)
+		s.lock.Unlock()
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, ErrServerClosed
+	}
+}
+
+// addNode passes a node to the routing table, unless it is blocked or its id isn't valid for its
+// address. It must be called with the lock held.
+func (s *Server) addNode(n Node, responded bool, now time.Time) {
+	if n.Addr == nil || s.blocked(n.Addr.IP, now) {
+		return
+	}
+	if !s.config.AllowInsecureIds && !n.Id.ValidFor(n.Addr.IP) {
+		return
+	}
+	s.table.seen(n, responded, now)
+}
+
+// blocked reports whether ip is on the blocklist or banned for going over its rate limit. It
+// must be called with the lock held.
+func (s *Server) blocked(ip net.IP, now time.Time) bool {
+	return (s.config.Blocklist != nil && s.config.Blocklist.Contains(ip)) || s.limiter.banned(ip, now)
+}
+
+// ignored reports whether packets from ip should be dropped
+func (s *Server) ignored(ip net.IP) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.blocked(ip, s.config.Clock.Now())
+}
+
+// voteExternalIP counts a node's report of our address. Once enough nodes at different addresses
+// agree it becomes our external address, and an id which isn't valid for it is replaced unless
+// it was given to us. It must be called with the lock held.
+func (s *Server) voteExternalIP(ip net.IP, voter net.IP) {
+	if ip.Equal(s.externalIP) {
+		return
+	}
+	key := ip.String()
+	voters, ok := s.votes[key]
+	if !ok {
+		if len(s.votes) >= MAX_EXTERNAL_IP_CANDIDATES {
+			s.votes = make(map[string]map[string]bool)
+		}
+		voters = make(map[string]bool)
+		s.votes[key] = voters
+	}
+	voters[voter.String()] = true
+	if len(voters) < EXTERNAL_IP_VOTES {
+		return
+	}
+
+	s.externalIP = ip
+	s.votes = make(map[string]map[string]bool)
+	if !s.fixedId && !s.id.ValidFor(ip) {
+		s.id = SecureNodeId(ip)
+		s.table = s.table.withSelf(s.id)
+	}
+}
+
+// newTransactionId returns a two byte id unused by any outstanding query. It must be called with
+// the lock held.
+func (s *Server) newTransactionId() string {
+	id := make([]byte, 2)
+	for {
+		s.nextTransaction++
+		binary.BigEndian.PutUint16(id, s.nextTransaction)
+		if _, used := s.transactions[string(id)]; !used {
+			return string(id)
+		}
+	}
+}
+
+func (s *Server) send(m *Message, addr *net.UDPAddr) error {
+	data, err := m.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = s.config.Conn.WriteTo(data, addr)
+	return err
+}
+
+// maintain regularly pings questionable nodes, refreshes stale buckets and forgets expired peers
+// and items
+func (s *Server) maintain() {
+	defer s.wg.Done()
+	timer := s.config.Clock.NewTimer(MAINTENANCE_INTERVAL)
+	for {
+		select {
+		case <-timer.C():
+			s.lock.Lock()
+			now := s.config.Clock.Now()
+			s.peers.expire(now)
+			s.items.expire(now)
+			s.limiter.expire(now)
+			questionable := s.table.questionable(now)
+			stale := s.table.stale(now)
+			s.lock.Unlock()
+
+			for _, n := range questionable {
+				s.wg.Add(1)
+				go func(addr *net.UDPAddr) {
+					defer s.wg.Done()
+					s.query(s.ctx, addr, QUERY_PING, &Body{})
+				}(n.Addr)
+			}
+			for _, target := range stale {
+				s.wg.Add(1)
+				go func(target NodeId) {
+					defer s.wg.Done()
+					s.FindNode(s.ctx, target)
+				}(target)
+			}
+			timer = s.config.Clock.NewTimer(MAINTENANCE_INTERVAL)
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"net"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const TEST_NETWORK_SIZE = 40
+
+// testHosts gives each test node its own address, as nodes are rate limited by address
+var testHosts int32
+
+func newTestServer(t *testing.T, network *mock.MockPacketNetwork, config Config) *Server {
+	host := atomic.AddInt32(&testHosts, 1)
+	conn, err := network.Listen(fmt.Sprintf("127.0.%v.%v:0", host/250, host%250+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Conn = conn
+	s, err := NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// newTestNetwork starts count nodes which join the DHT through the first of them
+func newTestNetwork(t *testing.T, network *mock.MockPacketNetwork, count int) []*Server {
+	first := newTestServer(t, network, Config{})
+	servers := []*Server{first}
+	for i := 1; i < count; i++ {
+		s := newTestServer(t, network, Config{BootstrapNodes: []string{first.Addr().String()}})
+		if err := s.Bootstrap(testContext(t)); err != nil {
+			t.Fatalf("Node %v failed to bootstrap: %v", i, err)
+		}
+		servers = append(servers, s)
+	}
+	// Nodes which joined early look themselves up again to learn about those which joined after
+	for i, s := range servers {
+		if _, err := s.FindNode(testContext(t), s.Id()); err != nil {
+			t.Fatalf("Node %v failed to refresh: %v", i, err)
+		}
+	}
+	return servers
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestPing(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	a := newTestServer(t, network, Config{})
+	b := newTestServer(t, network, Config{})
+
+	id, err := a.Ping(testContext(t), b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != b.Id() {
+		t.Errorf("Expected id %v but got %v", b.Id(), id)
+	}
+	if nodes := a.Nodes(); len(nodes) != 1 || nodes[0].Id != b.Id() {
+		t.Errorf("The node which answered should be in the routing table, got %v", nodes)
+	}
+	if nodes := b.Nodes(); len(nodes) != 1 || nodes[0].Id != a.Id() {
+		t.Errorf("The node which queried should be in the routing table, got %v", nodes)
+	}
+}
+
+func TestQueriesTimeOut(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	network := mock.NewMockPacketNetwork()
+	a := newTestServer(t, network, Config{Clock: clock})
+	silent, _ := network.Listen("127.0.0.1:0")
+	defer silent.Close()
+
+	errs := make(chan error)
+	go func() {
+		_, err := a.Ping(context.Background(), silent.LocalAddr().String())
+		errs <- err
+	}()
+	// The maintenance timer and the query's timer
+	clock.BlockUntil(2)
+	clock.Advance(QUERY_TIMEOUT)
+	if err := <-errs; err != ErrTimeout {
+		t.Errorf("Expected a timeout but got %v", err)
+	}
+}
+
+func TestUnknownQueriesGetAnError(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	s := newTestServer(t, network, Config{})
+	client, _ := network.Listen("127.0.0.1:0")
+	defer client.Close()
+
+	query := &Message{TransactionId: "xy", Type: TYPE_QUERY, Query: "unknown", Args: &Body{Id: RandomNodeId()}}
+	reply := exchange(t, client, s.Addr(), query)
+	if reply.Type != TYPE_ERROR || reply.Error.Code != ERROR_METHOD_UNKNOWN || reply.TransactionId != "xy" {
+		t.Errorf("Unexpected reply %+v", reply)
+	}
+}
+
+func TestAnnounceNeedsValidToken(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	s := newTestServer(t, network, Config{})
+	client, _ := network.Listen("127.0.0.1:0")
+	defer client.Close()
+	infoHash := RandomNodeId()
+
+	announce := &Message{TransactionId: "a1", Type: TYPE_QUERY, Query: QUERY_ANNOUNCE_PEER, Args: &Body{Id: RandomNodeId(), InfoHash: infoHash[:], Port: 6881, Token: "forged"}}
+	if reply := exchange(t, client, s.Addr(), announce); reply.Type != TYPE_ERROR || reply.Error.Code != ERROR_PROTOCOL {
+		t.Errorf("A forged token should be refused, got %+v", reply)
+	}
+
+	getPeers := &Message{TransactionId: "g1", Type: TYPE_QUERY, Query: QUERY_GET_PEERS, Args: &Body{Id: RandomNodeId(), InfoHash: infoHash[:]}}
+	reply := exchange(t, client, s.Addr(), getPeers)
+	if reply.Type != TYPE_RESPONSE || reply.Response.Token == "" || reply.Response.Values != nil {
+		t.Fatalf("Unexpected get_peers reply %+v", reply)
+	}
+
+	announce.Args.Token = reply.Response.Token
+	if reply := exchange(t, client, s.Addr(), announce); reply.Type != TYPE_RESPONSE {
+		t.Errorf("A valid token should be accepted, got %+v", reply)
+	}
+	reply = exchange(t, client, s.Addr(), getPeers)
+	if values := reply.Response.Values; len(values) != 1 || values[0].Port != 6881 {
+		t.Errorf("Expected the announced peer but got %v", values)
+	}
+}
+
+func TestLookupsFindClosestNodes(t *testing.T) {
+	servers := newTestNetwork(t, mock.NewMockPacketNetwork(), TEST_NETWORK_SIZE)
+	target := RandomNodeId()
+
+	nodes, err := servers[TEST_NETWORK_SIZE-1].FindNode(testContext(t), target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The lookup doesn't include the node making it
+	ids := []NodeId{}
+	for _, s := range servers[:TEST_NETWORK_SIZE-1] {
+		ids = append(ids, s.Id())
+	}
+	sort.Slice(ids, func(i, j int) bool { return target.Closer(ids[i], ids[j]) })
+	if len(nodes) != K {
+		t.Fatalf("Expected %v nodes but got %v", K, len(nodes))
+	}
+	// Routing tables only hold a few of the nodes far from their own ids, so a lookup isn't sure
+	// to find exactly the closest K, but it gets close
+	if nodes[0].Id != ids[0] {
+		t.Errorf("Expected the closest node %v but got %v", ids[0], nodes[0].Id)
+	}
+	nearby := map[NodeId]bool{}
+	for _, id := range ids[:2*K] {
+		nearby[id] = true
+	}
+	for i, n := range nodes {
+		if !nearby[n.Id] {
+			t.Errorf("Node %v is %v, which isn't among the %v closest", i, n.Id, 2*K)
+		}
+	}
+}
+
+func TestAnnouncedPeersAreFound(t *testing.T) {
+	servers := newTestNetwork(t, mock.NewMockPacketNetwork(), TEST_NETWORK_SIZE)
+	infoHash := RandomNodeId()
+
+	if _, err := servers[5].Announce(testContext(t), infoHash[:], 6881); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := servers[9].Announce(testContext(t), infoHash[:], 0); err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := servers[20].GetPeers(testContext(t), infoHash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(peers)
+	announced := servers[5].Addr().(*net.UDPAddr)
+	expected := []string{fmt.Sprintf("%v:6881", announced.IP), servers[9].Addr().String()}
+	sort.Strings(expected)
+	if len(peers) != 2 || peers[0] != expected[0] || peers[1] != expected[1] {
+		t.Errorf("Expected peers %v but got %v", expected, peers)
+	}
+
+	other := RandomNodeId()
+	if peers, err := servers[20].GetPeers(testContext(t), other[:]); err != nil || len(peers) != 0 {
+		t.Errorf("Expected no peers for another torrent but got %v, %v", peers, err)
+	}
+}
+
+func TestBootstrapFailsWithoutNodes(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	network := mock.NewMockPacketNetwork()
+	s := newTestServer(t, network, Config{Clock: clock, BootstrapNodes: []string{"127.0.0.1:1"}})
+
+	errs := make(chan error)
+	go func() { errs <- s.Bootstrap(context.Background()) }()
+	clock.BlockUntil(2)
+	clock.Advance(QUERY_TIMEOUT)
+	if err := <-errs; err != ErrNoNodes {
+		t.Errorf("Expected ErrNoNodes but got %v", err)
+	}
+}
+
+func TestSavedNodesSeedTheRoutingTable(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	servers := newTestNetwork(t, network, 10)
+	var saved bytes.Buffer
+	if err := servers[3].Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	state, err := Load(&saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Id != servers[3].Id() || len(state.Nodes) != len(servers[3].Nodes()) {
+		t.Fatalf("Unexpected state %v with %v nodes", state.Id, len(state.Nodes))
+	}
+
+	// A restarted node needs no bootstrap nodes to find the others
+	servers[3].Close()
+	restarted := newTestServer(t, network, Config{Id: state.Id, Nodes: state.Nodes})
+	if restarted.Id() != state.Id || len(restarted.Nodes()) != len(state.Nodes) {
+		t.Errorf("Expected the saved id and %v nodes but got %v and %v", len(state.Nodes), restarted.Id(), len(restarted.Nodes()))
+	}
+	if nodes, err := restarted.FindNode(testContext(t), RandomNodeId()); err != nil || len(nodes) != K {
+		t.Errorf("Expected the restarted node to find %v nodes but got %v, %v", K, len(nodes), err)
+	}
+
+	if _, err := Load(bytes.NewReader([]byte("d2:id3:abce"))); err == nil {
+		t.Error("State with an invalid id should fail to load")
+	}
+}
+
+// exchange sends a message from conn and returns the reply
+func exchange(t *testing.T, conn net.PacketConn, to net.Addr, m *Message) *Message {
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteTo(data, to)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, MAX_MESSAGE_LENGTH)
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := ParseMessage(buffer[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestInsecureIdsAreKeptOutOfRoutingTable(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	s := newTestServer(t, network, Config{})
+	client, _ := network.Listen("5.6.7.8:0")
+	defer client.Close()
+
+	ping := &Message{TransactionId: "p1", Type: TYPE_QUERY, Query: QUERY_PING, Args: &Body{Id: RandomNodeId()}}
+	for ping.Args.Id.ValidFor(net.ParseIP("5.6.7.8")) {
+		ping.Args.Id = RandomNodeId()
+	}
+	if reply := exchange(t, client, s.Addr(), ping); reply.Type != TYPE_RESPONSE || reply.IP.String() != client.LocalAddr().String() {
+		t.Errorf("Expected a response giving our address but got %+v", reply)
+	}
+	if nodes := s.Nodes(); len(nodes) != 0 {
+		t.Errorf("Expected a node with an insecure id to be left out but have %v", nodes)
+	}
+
+	ping.Args.Id = SecureNodeId(net.ParseIP("5.6.7.8"))
+	exchange(t, client, s.Addr(), ping)
+	if nodes := s.Nodes(); len(nodes) != 1 || nodes[0].Id != ping.Args.Id {
+		t.Errorf("Expected the node with a secure id to be added but have %v", nodes)
+	}
+}
+
+func TestExternalIPIsLearntFromResponses(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	conn, _ := network.Listen("124.31.75.21:0")
+	s, err := NewServer(Config{Conn: conn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	initial := s.Id()
+
+	for i := 0; i < EXTERNAL_IP_VOTES; i++ {
+		if s.ExternalIP() != nil {
+			t.Fatalf("The external address shouldn't be believed after %v votes", i)
+		}
+		other := newTestServer(t, network, Config{})
+		if _, err := s.Ping(testContext(t), other.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	external := net.ParseIP("124.31.75.21")
+	if !s.ExternalIP().Equal(external) {
+		t.Fatalf("Expected external address %v but got %v", external, s.ExternalIP())
+	}
+	if id := s.Id(); id == initial || !id.ValidFor(external) {
+		t.Errorf("Expected a new id valid for %v but got %v", external, id)
+	}
+	if nodes := s.Nodes(); len(nodes) != EXTERNAL_IP_VOTES {
+		t.Errorf("Expected the routing table to be kept but have %v nodes", len(nodes))
+	}
+}
+
+func TestGivenIdsAreKept(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	conn, _ := network.Listen("124.31.75.21:0")
+	id := RandomNodeId()
+	s, _ := NewServer(Config{Conn: conn, Id: id})
+	defer s.Close()
+	for i := 0; i < EXTERNAL_IP_VOTES; i++ {
+		s.Ping(testContext(t), newTestServer(t, network, Config{}).Addr().String())
+	}
+	if s.ExternalIP() == nil || s.Id() != id {
+		t.Errorf("Expected the external address to be learnt and the id kept, got %v and %v", s.ExternalIP(), s.Id())
+	}
+
+	secure, _ := NewServer(Config{Conn: mustListen(t, network, "124.31.75.22:0"), ExternalIP: net.ParseIP("124.31.75.22")})
+	defer secure.Close()
+	if !secure.Id().ValidFor(net.ParseIP("124.31.75.22")) {
+		t.Errorf("Expected an id valid for the given external address")
+	}
+}
+
+func TestReadOnlyNodesOnlyQuery(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	readOnly := newTestServer(t, network, Config{ReadOnly: true})
+	s := newTestServer(t, network, Config{})
+
+	if _, err := readOnly.Ping(testContext(t), s.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if nodes := readOnly.Nodes(); len(nodes) != 1 {
+		t.Errorf("The read only node should add the nodes it queries, have %v", nodes)
+	}
+	if nodes := s.Nodes(); len(nodes) != 0 {
+		t.Errorf("Read only nodes shouldn't be added to the routing table, have %v", nodes)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := s.Ping(ctx, readOnly.Addr().String()); err != context.DeadlineExceeded {
+		t.Errorf("Read only nodes shouldn't answer queries, got %v", err)
+	}
+}
+
+func TestBlockedAddressesAreIgnored(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	blocklist := NewBlocklist()
+	blocklist.Add("5.6.7.0/24")
+	s := newTestServer(t, network, Config{Blocklist: blocklist})
+	client := mustListen(t, network, "5.6.7.8:0")
+
+	data, _ := (&Message{TransactionId: "p1", Type: TYPE_QUERY, Query: QUERY_PING, Args: &Body{Id: RandomNodeId()}}).Encode()
+	client.WriteTo(data, s.Addr())
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := client.ReadFrom(make([]byte, MAX_MESSAGE_LENGTH)); err == nil {
+		t.Error("Expected no reply to a blocked address")
+	}
+	if _, err := s.Ping(testContext(t), client.LocalAddr().String()); err != ErrBlocked {
+		t.Errorf("Expected blocked addresses not to be queried, got %v", err)
+	}
+}
+
+func TestFloodingAddressesAreBanned(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	network := mock.NewMockPacketNetwork()
+	s := newTestServer(t, network, Config{Clock: clock})
+	client := mustListen(t, network, "5.6.7.8:0")
+
+	countReplies := func(queries int) int {
+		data, _ := (&Message{TransactionId: "p1", Type: TYPE_QUERY, Query: QUERY_PING, Args: &Body{Id: RandomNodeId()}}).Encode()
+		for i := 0; i < queries; i++ {
+			client.WriteTo(data, s.Addr())
+		}
+		replies := 0
+		buffer := make([]byte, MAX_MESSAGE_LENGTH)
+		for {
+			client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, _, err := client.ReadFrom(buffer); err != nil {
+				return replies
+			}
+			replies++
+		}
+	}
+
+	if replies := countReplies(RATE_LIMIT_BURST + RATE_LIMIT_BAN_THRESHOLD); replies != RATE_LIMIT_BURST {
+		t.Errorf("Expected only the burst of %v to be answered but got %v", RATE_LIMIT_BURST, replies)
+	}
+	clock.Advance(time.Minute)
+	if replies := countReplies(1); replies != 0 {
+		t.Errorf("Expected the flooding address to be banned but got %v replies", replies)
+	}
+	clock.Advance(RATE_LIMIT_BAN_DURATION)
+	if replies := countReplies(1); replies != 1 {
+		t.Errorf("Expected the ban to end but got %v replies", replies)
+	}
+}
+
+func mustListen(t *testing.T, network *mock.MockPacketNetwork, address string) *mock.MockPacketConn {
+	conn, err := network.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
@@ -0,0 +1,257 @@
+package dht
+
+import (
+	"crypto/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// Each bucket holds at most K nodes, and lookups return the K closest nodes
+	K = 8
+	// Nodes which haven't been heard from in this long are questionable, and are pinged
+	NODE_GOOD_DURATION = 15 * time.Minute
+	// A node which fails to answer this many queries in a row is bad, and can be replaced
+	MAX_NODE_FAILURES = 2
+	// Buckets which haven't changed in this long are refreshed with a lookup
+	BUCKET_REFRESH_INTERVAL = 15 * time.Minute
+)
+
+// Types
+
+// table is the Kademlia routing table. Bucket i holds the nodes whose ids share exactly i
+// leading bits with ours, so buckets cover less of the id space the closer they are to us.
+// It isn't safe for concurrent use.
+type table struct {
+	self    NodeId
+	buckets [ID_LENGTH * 8]bucket
+}
+
+type bucket struct {
+	// nodes are in the order they were added
+	nodes []*entry
+	// replacements are nodes seen while the bucket was full, most recently seen last. They take
+	// the place of nodes which go bad.
+	replacements []*entry
+	lastChanged  time.Time
+}
+
+type entry struct {
+	node Node
+	// lastResponse is zero until the node answers one of our queries
+	lastResponse time.Time
+	lastQuery    time.Time
+	failures     int
+}
+
+// Initialiser
+
+func newTable(self NodeId) *table {
+	return &table{self: self}
+}
+
+// Public Methods
+
+// withSelf returns a table for a new id of ours, holding as many of the nodes as fit
+func (t *table) withSelf(self NodeId) *table {
+	moved := newTable(self)
+	for i := range t.buckets {
+		for _, e := range t.buckets[i].nodes {
+			b := moved.bucket(e.node.Id)
+			if e.node.Id != self && len(b.nodes) < K {
+				b.nodes = append(b.nodes, e)
+				b.lastChanged = t.buckets[i].lastChanged
+			}
+		}
+	}
+	return moved
+}
+
+// seen records that a node answered one of our queries, or queried us when responded is false.
+// It is added to its bucket if there is room or a bad node to replace, and otherwise becomes a
+// replacement.
+func (t *table) seen(n Node, responded bool, now time.Time) {
+	if n.Id == t.self || n.Addr == nil {
+		return
+	}
+	b := t.bucket(n.Id)
+	e := b.find(n.Id)
+	if e == nil {
+		e = &entry{node: n}
+		if len(b.nodes) < K {
+			b.nodes = append(b.nodes, e)
+			b.lastChanged = now
+		} else if i := b.bad(); i >= 0 {
+			b.nodes[i] = e
+			b.lastChanged = now
+		} else {
+			e = b.addReplacement(e)
+		}
+	} else if !sameAddr(e.node.Addr, n.Addr) {
+		// A node claiming a known id from elsewhere is ignored until the known one goes bad
+		return
+	}
+
+	if responded {
+		e.lastResponse = now
+		e.failures = 0
+		b.lastChanged = now
+	} else {
+		e.lastQuery = now
+	}
+}
+
+// failed records that the node at addr didn't answer a query. Once it is bad it is replaced by
+// the most recently seen replacement.
+func (t *table) failed(addr *net.UDPAddr) {
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		for j, e := range b.nodes {
+			if !sameAddr(e.node.Addr, addr) {
+				continue
+			}
+			e.failures++
+			if e.failures >= MAX_NODE_FAILURES && len(b.replacements) > 0 {
+				last := len(b.replacements) - 1
+				b.nodes[j] = b.replacements[last]
+				b.replacements = b.replacements[:last]
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to count nodes which aren't bad, closest to target first
+func (t *table) closest(target NodeId, count int) []Node {
+	nodes := []Node{}
+	for i := range t.buckets {
+		for _, e := range t.buckets[i].nodes {
+			if !e.bad() {
+				nodes = append(nodes, e.node)
+			}
+		}
+	}
+	sortNodes(nodes, target)
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// questionable returns the nodes which haven't been heard from recently and should be pinged
+func (t *table) questionable(now time.Time) []Node {
+	nodes := []Node{}
+	for i := range t.buckets {
+		for _, e := range t.buckets[i].nodes {
+			if !e.good(now) && !e.bad() {
+				nodes = append(nodes, e.node)
+			}
+		}
+	}
+	return nodes
+}
+
+// stale returns a random id in each bucket which hasn't changed recently, to look up so the
+// bucket is refreshed. The buckets are treated as changed so they aren't refreshed again at once.
+func (t *table) stale(now time.Time) []NodeId {
+	targets := []NodeId{}
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if len(b.nodes) > 0 && now.Sub(b.lastChanged) >= BUCKET_REFRESH_INTERVAL {
+			targets = append(targets, t.randomIdInBucket(i))
+			b.lastChanged = now
+		}
+	}
+	return targets
+}
+
+// nodes returns every node in the table which isn't bad
+func (t *table) nodes() []Node {
+	return t.closest(t.self, len(t.buckets)*K)
+}
+
+func (t *table) len() int {
+	count := 0
+	for i := range t.buckets {
+		count += len(t.buckets[i].nodes)
+	}
+	return count
+}
+
+// Helpers
+
+func (t *table) bucket(id NodeId) *bucket {
+	return &t.buckets[t.self.CommonPrefixLength(id)]
+}
+
+// randomIdInBucket returns an id sharing exactly index leading bits with ours
+func (t *table) randomIdInBucket(index int) NodeId {
+	var id NodeId
+	rand.Read(id[:])
+	for bit := 0; bit <= index; bit++ {
+		mask := byte(0x80) >> uint(bit%8)
+		own := t.self[bit/8] & mask
+		if bit == index {
+			own ^= mask
+		}
+		id[bit/8] = id[bit/8]&^mask | own
+	}
+	return id
+}
+
+func (b *bucket) find(id NodeId) *entry {
+	for _, e := range b.nodes {
+		if e.node.Id == id {
+			return e
+		}
+	}
+	for _, e := range b.replacements {
+		if e.node.Id == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// bad returns the index of a bad node, or -1 if there are none
+func (b *bucket) bad() int {
+	for i, e := range b.nodes {
+		if e.bad() {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *bucket) addReplacement(e *entry) *entry {
+	if len(b.replacements) >= K {
+		b.replacements = b.replacements[1:]
+	}
+	b.replacements = append(b.replacements, e)
+	return e
+}
+
+// good reports whether the node has answered us recently, or has ever answered us and has
+// queried us recently
+func (e *entry) good(now time.Time) bool {
+	if e.lastResponse.IsZero() || e.bad() {
+		return false
+	}
+	return now.Sub(e.lastResponse) < NODE_GOOD_DURATION || now.Sub(e.lastQuery) < NODE_GOOD_DURATION
+}
+
+func (e *entry) bad() bool {
+	return e.failures >= MAX_NODE_FAILURES
+}
+
+// sortNodes orders nodes by distance from target, closest first
+func sortNodes(nodes []Node, target NodeId) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return target.Closer(nodes[i].Id, nodes[j].Id)
+	})
+}
+
+func sameAddr(a *net.UDPAddr, b *net.UDPAddr) bool {
+	return a.IP.Equal(b.IP) && a.Port == b.Port
+}
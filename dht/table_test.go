@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// nodeInBucket returns a node which falls in the given bucket of a table for self
+func nodeInBucket(self NodeId, index int, port int) Node {
+	t := newTable(self)
+	return Node{Id: t.randomIdInBucket(index), Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port}}
+}
+
+func TestRandomIdInBucket(t *testing.T) {
+	self := RandomNodeId()
+	table := newTable(self)
+	for _, index := range []int{0, 7, 8, 100, ID_LENGTH*8 - 1} {
+		if length := self.CommonPrefixLength(table.randomIdInBucket(index)); length != index {
+			t.Errorf("Id for bucket %v shares %v bits", index, length)
+		}
+	}
+}
+
+func TestFullBucketKeepsReplacements(t *testing.T) {
+	now := time.Unix(1000, 0)
+	self := RandomNodeId()
+	table := newTable(self)
+	for i := 0; i < K+1; i++ {
+		table.seen(nodeInBucket(self, 0, 1000+i), true, now)
+	}
+	if table.len() != K {
+		t.Fatalf("Expected a full bucket of %v but got %v", K, table.len())
+	}
+	if len(table.buckets[0].replacements) != 1 {
+		t.Fatalf("Expected the extra node to be a replacement")
+	}
+	replacement := table.buckets[0].replacements[0].node
+
+	// The first node goes bad and is replaced
+	first := table.buckets[0].nodes[0].node
+	for i := 0; i < MAX_NODE_FAILURES; i++ {
+		table.failed(first.Addr)
+	}
+	if table.buckets[0].find(first.Id) != nil || table.buckets[0].nodes[0].node.Id != replacement.Id {
+		t.Error("The bad node should have been replaced")
+	}
+}
+
+func TestBadNodesAreReplacedWithoutReplacements(t *testing.T) {
+	now := time.Unix(1000, 0)
+	self := RandomNodeId()
+	table := newTable(self)
+	for i := 0; i < K; i++ {
+		table.seen(nodeInBucket(self, 3, 1000+i), true, now)
+	}
+	bad := table.buckets[3].nodes[2].node
+	for i := 0; i < MAX_NODE_FAILURES; i++ {
+		table.failed(bad.Addr)
+	}
+	for _, n := range table.closest(self, 2*K) {
+		if n.Id == bad.Id {
+			t.Error("Bad nodes shouldn't be returned")
+		}
+	}
+
+	fresh := nodeInBucket(self, 3, 2000)
+	table.seen(fresh, false, now)
+	if table.buckets[3].nodes[2].node.Id != fresh.Id {
+		t.Error("A new node should take the bad node's place")
+	}
+}
+
+func TestNodesMovingAddressAreIgnored(t *testing.T) {
+	now := time.Unix(1000, 0)
+	self := RandomNodeId()
+	table := newTable(self)
+	n := nodeInBucket(self, 1, 1000)
+	table.seen(n, true, now)
+	table.seen(Node{Id: n.Id, Addr: &net.UDPAddr{IP: net.IPv4(10, 9, 9, 9), Port: 1000}}, true, now)
+	if closest := table.closest(self, K); len(closest) != 1 || !sameAddr(closest[0].Addr, n.Addr) {
+		t.Errorf("Expected the node to keep its first address but got %v", closest)
+	}
+}
+
+func TestQuestionableAndStaleNodes(t *testing.T) {
+	now := time.Unix(1000, 0)
+	self := RandomNodeId()
+	table := newTable(self)
+	answered := nodeInBucket(self, 5, 1000)
+	unanswered := nodeInBucket(self, 5, 1001)
+	table.seen(answered, true, now)
+	table.seen(unanswered, false, now)
+
+	if questionable := table.questionable(now); len(questionable) != 1 || questionable[0].Id != unanswered.Id {
+		t.Errorf("Only the node which never answered should be questionable, got %v", questionable)
+	}
+	if stale := table.stale(now); len(stale) != 0 {
+		t.Errorf("No bucket should be stale yet, got %v", stale)
+	}
+
+	later := now.Add(NODE_GOOD_DURATION)
+	if questionable := table.questionable(later); len(questionable) != 2 {
+		t.Errorf("Both nodes should be questionable, got %v", questionable)
+	}
+	stale := table.stale(later)
+	if len(stale) != 1 || self.CommonPrefixLength(stale[0]) != 5 {
+		t.Errorf("Expected bucket 5 to be refreshed but got %v", stale)
+	}
+	if stale := table.stale(later); len(stale) != 0 {
+		t.Errorf("A refreshed bucket shouldn't be stale again at once, got %v", stale)
+	}
+}
+
+func TestClosestOrdersByDistance(t *testing.T) {
+	now := time.Unix(1000, 0)
+	self := RandomNodeId()
+	table := newTable(self)
+	for i := 0; i < 40; i++ {
+		table.seen(Node{Id: RandomNodeId(), Addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000 + i}}, true, now)
+	}
+
+	target := RandomNodeId()
+	closest := table.closest(target, K)
+	if len(closest) != K {
+		t.Fatalf("Expected %v nodes but got %v", K, len(closest))
+	}
+	for i := 1; i < len(closest); i++ {
+		if target.Closer(closest[i].Id, closest[i-1].Id) {
+			t.Fatalf("Nodes aren't in order of distance: %v", closest)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"time"
+)
+
+const (
+	// The token secret changes this often. Tokens made with the previous secret are still
+	// accepted, so a token lasts between one and two rotations.
+	TOKEN_ROTATION      = 5 * time.Minute
+	TOKEN_SECRET_LENGTH = 20
+	TOKEN_LENGTH        = 8
+)
+
+// Types
+
+// tokens hands out the tokens get_peers returns and announce_peer must give back, which prove
+// the announcing node can receive packets at its address. It isn't safe for concurrent use.
+type tokens struct {
+	secret   []byte
+	previous []byte
+	rotated  time.Time
+}
+
+// Initialiser
+
+func newTokens(now time.Time) *tokens {
+	return &tokens{secret: newSecret(), previous: newSecret(), rotated: now}
+}
+
+// Public Methods
+
+// token returns the token for a node at ip
+func (t *tokens) token(ip net.IP, now time.Time) string {
+	t.rotate(now)
+	return makeToken(t.secret, ip)
+}
+
+// valid reports whether the token was given to a node at ip within the last two rotations
+func (t *tokens) valid(token string, ip net.IP, now time.Time) bool {
+	t.rotate(now)
+	return token == makeToken(t.secret, ip) || token == makeToken(t.previous, ip)
+}
+
+// Helpers
+
+func (t *tokens) rotate(now time.Time) {
+	elapsed := now.Sub(t.rotated)
+	if elapsed < TOKEN_ROTATION {
+		return
+	}
+	if elapsed >= 2*TOKEN_ROTATION {
+		// Both secrets are too old for their tokens to be accepted
+		t.previous = newSecret()
+	} else {
+		t.previous = t.secret
+	}
+	t.secret = newSecret()
+	t.rotated = now
+}
+
+func makeToken(secret []byte, ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	hash := sha1.Sum(append(append([]byte{}, secret...), ip...))
+	return string(hash[:TOKEN_LENGTH])
+}
+
+func newSecret() []byte {
+	secret := make([]byte, TOKEN_SECRET_LENGTH)
+	rand.Read(secret)
+	return secret
+}
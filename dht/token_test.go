@@ -0,0 +1,41 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokensExpireAfterTwoRotations(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ip := net.IPv4(10, 0, 0, 1)
+	tokens := newTokens(now)
+
+	token := tokens.token(ip, now)
+	if len(token) != TOKEN_LENGTH {
+		t.Errorf("Expected a token of %v bytes but got %v", TOKEN_LENGTH, len(token))
+	}
+	if !tokens.valid(token, ip, now) {
+		t.Error("A new token should be valid")
+	}
+	if tokens.valid(token, net.IPv4(10, 0, 0, 2), now) {
+		t.Error("A token should only be valid for the address it was given to")
+	}
+
+	if !tokens.valid(token, ip, now.Add(TOKEN_ROTATION)) {
+		t.Error("A token should survive one rotation")
+	}
+	if tokens.valid(token, ip, now.Add(2*TOKEN_ROTATION)) {
+		t.Error("A token shouldn't survive two rotations")
+	}
+}
+
+func TestTokensExpireAfterLongIdle(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ip := net.IPv4(10, 0, 0, 1)
+	tokens := newTokens(now)
+	token := tokens.token(ip, now)
+	if tokens.valid(token, ip, now.Add(3*TOKEN_ROTATION)) {
+		t.Error("A token should expire even when no tokens were made in between")
+	}
+}
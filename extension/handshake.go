@@ -0,0 +1,124 @@
+package extension
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"net"
+	"sort"
+)
+
+const (
+	// The extended message id of the extension handshake
+	HANDSHAKE_ID = 0
+	// Handshakes longer than this are refused
+	MAX_HANDSHAKE_LENGTH = 64 * 1024
+)
+
+// Types
+
+// Handshake is the extension handshake (BEP 10), which says which extensions a peer supports and
+// the ids it wants their messages sent with. Fields left at their zero value aren't sent.
+type Handshake struct {
+	// Extensions maps extension names to the sender's ids for them
+	Extensions map[string]byte
+	// Version is the client name and version, e.g. "torrentsgo 0.0.0.1"
+	Version string
+	// Port is the sender's listen port
+	Port int
+	// YourIP is the address the sender sees the receiver connecting from
+	YourIP net.IP
+	// Reqq is how many outstanding requests the sender will queue
+	Reqq int
+	// MetadataSize is the length of the info dictionary (BEP 9)
+	MetadataSize int
+}
+
+// Public Methods
+
+func (h *Handshake) Encode() ([]byte, error) {
+	names := make([]string, 0, len(h.Extensions))
+	for name := range h.Extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	extensions := model.NewOrderedMap()
+	for _, name := range names {
+		extensions.Add(name, int(h.Extensions[name]))
+	}
+
+	dict := model.NewOrderedMap()
+	dict.Add("m", extensions)
+	if h.MetadataSize > 0 {
+		dict.Add("metadata_size", h.MetadataSize)
+	}
+	if h.Port > 0 {
+		dict.Add("p", h.Port)
+	}
+	if h.Reqq > 0 {
+		dict.Add("reqq", h.Reqq)
+	}
+	if h.Version != "" {
+		dict.Add("v", h.Version)
+	}
+	if ip := compactIP(h.YourIP); ip != nil {
+		dict.Add("yourip", string(ip))
+	}
+	return bencoding.EncodeBencoding(dict)
+}
+
+// ParseHandshake reads an extension handshake. Extensions given id 0 have been disabled by the
+// sender and are left out. Optional fields which are malformed are ignored, as BEP 10 allows.
+func ParseHandshake(data []byte) (*Handshake, error) {
+	if len(data) > MAX_HANDSHAKE_LENGTH {
+		return nil, fmt.Errorf("Extension handshake of %v bytes is too long", len(data))
+	}
+	dict, err := bencoding.DecodeBencodingLimited(bytes.NewReader(data), MAX_HANDSHAKE_LENGTH)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode extension handshake - %v", err)
+	}
+
+	h := &Handshake{Extensions: make(map[string]byte)}
+	if value, exists := dict.GetExists("m"); exists {
+		extensions, ok := value.(*model.OrderedMap)
+		if !ok {
+			return nil, fmt.Errorf("Extension handshake 'm' is not a dictionary")
+		}
+		extensions.Iterate(func(name string, value interface{}) {
+			if id, ok := value.(int); ok && id > 0 && id <= 255 {
+				h.Extensions[name] = byte(id)
+			}
+		})
+	}
+
+	if version, ok := dict.Get("v").(string); ok {
+		h.Version = version
+	}
+	if port, ok := dict.Get("p").(int); ok && port > 0 && port <= 65535 {
+		h.Port = port
+	}
+	if ip, ok := dict.Get("yourip").(string); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+		h.YourIP = net.IP(ip)
+	}
+	if reqq, ok := dict.Get("reqq").(int); ok && reqq > 0 {
+		h.Reqq = reqq
+	}
+	if size, ok := dict.Get("metadata_size").(int); ok && size > 0 {
+		h.MetadataSize = size
+	}
+	return h, nil
+}
+
+// Helpers
+
+// compactIP returns an address as 4 bytes for IPv4 or 16 for IPv6
+func compactIP(ip net.IP) []byte {
+	if ip == nil {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
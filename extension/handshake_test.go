@@ -0,0 +1,68 @@
+package extension
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHandshakeEncodesInBencodingOrder(t *testing.T) {
+	h := &Handshake{
+		Extensions:   map[string]byte{"ut_pex": 2, "ut_metadata": 1},
+		Version:      "torrentsgo 0.0.0.1",
+		Port:         6881,
+		YourIP:       net.ParseIP("10.0.0.2"),
+		Reqq:         250,
+		MetadataSize: 31235,
+	}
+	data, err := h.Encode()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding handshake %v", err)
+	}
+
+	expected := "d1:md11:ut_metadatai1e6:ut_pexi2ee13:metadata_sizei31235e1:pi6881e4:reqqi250e1:v18:torrentsgo 0.0.0.16:yourip4:\x0a\x00\x00\x02e"
+	if string(data) != expected {
+		t.Errorf("Expected %q but was %q", expected, data)
+	}
+
+	parsed, err := ParseHandshake(data)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing handshake %v", err)
+	}
+	if !reflect.DeepEqual(parsed.Extensions, h.Extensions) || parsed.Version != h.Version || parsed.Port != h.Port ||
+		!parsed.YourIP.Equal(h.YourIP) || parsed.Reqq != h.Reqq || parsed.MetadataSize != h.MetadataSize {
+		t.Errorf("Expected %+v but was %+v", h, parsed)
+	}
+}
+
+func TestHandshakeLeavesOutZeroFields(t *testing.T) {
+	data, err := (&Handshake{}).Encode()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding handshake %v", err)
+	}
+	if string(data) != "d1:mdee" {
+		t.Errorf("Expected only an empty 'm' but was %q", data)
+	}
+}
+
+func TestParseHandshakeIgnoresDisabledAndMalformedFields(t *testing.T) {
+	data := "d1:md11:ut_metadatai0e6:ut_pexi3e3:badi300ee1:p5:hello6:yourip3:abc1:v3:abce"
+	h, err := ParseHandshake([]byte(data))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing handshake %v", err)
+	}
+	if expected := map[string]byte{"ut_pex": 3}; !reflect.DeepEqual(h.Extensions, expected) {
+		t.Errorf("Expected %v but was %v", expected, h.Extensions)
+	}
+	if h.Port != 0 || h.YourIP != nil || h.Version != "abc" {
+		t.Errorf("Expected malformed fields to be ignored but was %+v", h)
+	}
+}
+
+func TestParseHandshakeErrors(t *testing.T) {
+	for _, data := range []string{"", "i1e", "d1:mi1ee"} {
+		if _, err := ParseHandshake([]byte(data)); err == nil {
+			t.Errorf("Expected an error parsing %q", data)
+		}
+	}
+}
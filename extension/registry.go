@@ -0,0 +1,221 @@
+package extension
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+const (
+	// Extended ids are a single byte, and 0 is the handshake
+	MAX_EXTENSIONS = 255
+)
+
+var (
+	ErrUnsupported = errors.New("Peer doesn't support the extension")
+)
+
+// Types
+
+// Extension is a protocol extension negotiated with the extension handshake, such as ut_metadata
+// or ut_pex
+type Extension interface {
+	// Name is what the extension is called in the handshake's "m" dictionary
+	Name() string
+	// NewHandler is called for each connection, with the session its messages are sent through
+	NewHandler(session *Session) Handler
+}
+
+// Handler runs an extension on one connection
+type Handler interface {
+	// Handshake is called whenever the peer sends an extension handshake, whether or not it
+	// supports this extension. Peers may send more than one to change what they support.
+	Handshake(remote *Handshake)
+	// Message handles a message for the extension. An error closes the connection.
+	Message(payload []byte) error
+}
+
+// Extender is implemented by handlers which add to our extension handshake, such as ut_metadata
+// giving the size of the metadata
+type Extender interface {
+	ExtendHandshake(h *Handshake)
+}
+
+// Closer is implemented by handlers which need to know when their connection has ended
+type Closer interface {
+	Close()
+}
+
+// Registry holds the extensions we support. Each is given an id by the order it was registered.
+type Registry struct {
+	lock       sync.Mutex
+	extensions []Extension
+}
+
+type SessionConfig struct {
+	// Version, Port and Reqq are sent in our handshake
+	Version string
+	Port    int
+	Reqq    int
+	// RemoteIP is the peer's address, sent back to it as yourip
+	RemoteIP net.IP
+}
+
+// Session runs the extension protocol on one connection, dispatching messages to the handler for
+// each extension. It is not safe for concurrent use.
+type Session struct {
+	config   SessionConfig
+	send     func(id byte, payload []byte)
+	names    []string
+	handlers []Handler
+	remote   *Handshake
+}
+
+// Initialiser
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Public Methods
+
+// Register adds an extension. Sessions already created don't see it.
+func (r *Registry) Register(extension Extension) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if len(r.extensions) >= MAX_EXTENSIONS {
+		return fmt.Errorf("Unable to register more than %v extensions", MAX_EXTENSIONS)
+	}
+	for _, registered := range r.extensions {
+		if registered.Name() == extension.Name() {
+			return fmt.Errorf("Extension %v is already registered", extension.Name())
+		}
+	}
+	r.extensions = append(r.extensions, extension)
+	return nil
+}
+
+// Names returns the registered extensions in the order of their ids
+func (r *Registry) Names() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	names := make([]string, len(r.extensions))
+	for i, extension := range r.extensions {
+		names[i] = extension.Name()
+	}
+	return names
+}
+
+// NewSession starts the extension protocol for a connection, where send delivers an extended
+// message to the peer. A handler is created for every registered extension.
+func (r *Registry) NewSession(config SessionConfig, send func(id byte, payload []byte)) *Session {
+	r.lock.Lock()
+	extensions := append([]Extension{}, r.extensions...)
+	r.lock.Unlock()
+
+	s := &Session{config: config, send: send, names: make([]string, len(extensions)), handlers: make([]Handler, len(extensions))}
+	for i, extension := range extensions {
+		s.names[i] = extension.Name()
+		s.handlers[i] = extension.NewHandler(s)
+	}
+	return s
+}
+
+// SendHandshake sends our extension handshake, which should be done as soon as the connection
+// starts
+func (s *Session) SendHandshake() error {
+	h := &Handshake{
+		Extensions: make(map[string]byte, len(s.names)),
+		Version:    s.config.Version,
+		Port:       s.config.Port,
+		YourIP:     s.config.RemoteIP,
+		Reqq:       s.config.Reqq,
+	}
+	for i, name := range s.names {
+		h.Extensions[name] = byte(i + 1)
+	}
+	for _, handler := range s.handlers {
+		if extender, ok := handler.(Extender); ok {
+			extender.ExtendHandshake(h)
+		}
+	}
+
+	payload, err := h.Encode()
+	if err != nil {
+		return err
+	}
+	s.send(HANDSHAKE_ID, payload)
+	return nil
+}
+
+// Handle dispatches an extended message from the peer. Messages for ids we didn't give out are
+// ignored.
+func (s *Session) Handle(id byte, payload []byte) error {
+	if id == HANDSHAKE_ID {
+		remote, err := ParseHandshake(payload)
+		if err != nil {
+			return err
+		}
+		s.remote = remote
+		for _, handler := range s.handlers {
+			handler.Handshake(remote)
+		}
+		return nil
+	}
+
+	if int(id) > len(s.handlers) {
+		return nil
+	}
+	return s.handlers[id-1].Message(payload)
+}
+
+// Send sends a message for an extension, using the id the peer gave it. It returns
+// ErrUnsupported if the peer hasn't said it supports the extension.
+func (s *Session) Send(name string, payload []byte) error {
+	if !s.Supports(name) {
+		return ErrUnsupported
+	}
+	s.send(s.remote.Extensions[name], payload)
+	return nil
+}
+
+// Supports reports whether the peer's latest handshake included an extension
+func (s *Session) Supports(name string) bool {
+	if s.remote == nil {
+		return false
+	}
+	_, ok := s.remote.Extensions[name]
+	return ok
+}
+
+// Remote returns the peer's latest extension handshake, or nil if none has arrived
+func (s *Session) Remote() *Handshake {
+	return s.remote
+}
+
+// RemoteIP returns the peer's address, as given in the session's config
+func (s *Session) RemoteIP() net.IP {
+	return s.config.RemoteIP
+}
+
+// Close tells the handlers which implement Closer that the connection has ended
+func (s *Session) Close() {
+	for _, handler := range s.handlers {
+		if closer, ok := handler.(Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// Handler returns this connection's handler for an extension, or nil if it isn't registered
+func (s *Session) Handler(name string) Handler {
+	for i, registered := range s.names {
+		if registered == name {
+			return s.handlers[i]
+		}
+	}
+	return nil
+}
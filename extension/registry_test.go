@@ -0,0 +1,169 @@
+package extension
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type fakeExtension struct {
+	name     string
+	handlers []*fakeHandler
+}
+
+func (e *fakeExtension) Name() string { return e.name }
+
+func (e *fakeExtension) NewHandler(session *Session) Handler {
+	handler := &fakeHandler{session: session}
+	e.handlers = append(e.handlers, handler)
+	return handler
+}
+
+type fakeHandler struct {
+	session    *Session
+	handshakes []*Handshake
+	messages   [][]byte
+	err        error
+}
+
+func (h *fakeHandler) Handshake(remote *Handshake) { h.handshakes = append(h.handshakes, remote) }
+
+func (h *fakeHandler) Message(payload []byte) error {
+	h.messages = append(h.messages, payload)
+	return h.err
+}
+
+type sizedHandler struct {
+	fakeHandler
+	closed bool
+}
+
+func (h *sizedHandler) ExtendHandshake(handshake *Handshake) { handshake.MetadataSize = 1234 }
+
+func (h *sizedHandler) Close() { h.closed = true }
+
+type sizedExtension struct{}
+
+func (sizedExtension) Name() string                        { return "ut_metadata" }
+func (sizedExtension) NewHandler(session *Session) Handler { return &sizedHandler{} }
+
+type sent struct {
+	id      byte
+	payload []byte
+}
+
+func TestRegisterRejectsDuplicates(t *testing.T) {
+	r := NewRegistry()
+	if err := r.Register(&fakeExtension{name: "ut_pex"}); err != nil {
+		t.Fatalf("Unexpected error registering %v", err)
+	}
+	if err := r.Register(&fakeExtension{name: "ut_holepunch"}); err != nil {
+		t.Fatalf("Unexpected error registering %v", err)
+	}
+	if err := r.Register(&fakeExtension{name: "ut_pex"}); err == nil {
+		t.Errorf("Expected an error registering an extension twice")
+	}
+	if names := r.Names(); !reflect.DeepEqual(names, []string{"ut_pex", "ut_holepunch"}) {
+		t.Errorf("Expected extensions in registration order but was %v", names)
+	}
+}
+
+func TestSessionAdvertisesRegisteredExtensions(t *testing.T) {
+	r := NewRegistry()
+	r.Register(&fakeExtension{name: "ut_pex"})
+	r.Register(sizedExtension{})
+
+	var messages []sent
+	s := r.NewSession(SessionConfig{Version: "torrentsgo 0.0.0.1", Port: 6881, Reqq: 250, RemoteIP: net.ParseIP("10.0.0.2")},
+		func(id byte, payload []byte) { messages = append(messages, sent{id, payload}) })
+	if err := s.SendHandshake(); err != nil {
+		t.Fatalf("Unexpected error sending handshake %v", err)
+	}
+	if len(messages) != 1 || messages[0].id != HANDSHAKE_ID {
+		t.Fatalf("Expected a single handshake but was %v", messages)
+	}
+
+	h, err := ParseHandshake(messages[0].payload)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing handshake %v", err)
+	}
+	if expected := map[string]byte{"ut_pex": 1, "ut_metadata": 2}; !reflect.DeepEqual(h.Extensions, expected) {
+		t.Errorf("Expected %v but was %v", expected, h.Extensions)
+	}
+	if h.Version != "torrentsgo 0.0.0.1" || h.Port != 6881 || h.Reqq != 250 || h.MetadataSize != 1234 ||
+		!h.YourIP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Unexpected handshake %+v", h)
+	}
+
+	s.Close()
+	if !s.Handler("ut_metadata").(*sizedHandler).closed {
+		t.Errorf("Expected closing the session to close the handler")
+	}
+}
+
+func TestSessionDispatchesByLocalId(t *testing.T) {
+	pex := &fakeExtension{name: "ut_pex"}
+	holepunch := &fakeExtension{name: "ut_holepunch"}
+	r := NewRegistry()
+	r.Register(pex)
+	r.Register(holepunch)
+
+	var messages []sent
+	s := r.NewSession(SessionConfig{}, func(id byte, payload []byte) { messages = append(messages, sent{id, payload}) })
+
+	if err := s.Send("ut_pex", []byte("early")); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported before the remote handshake but was %v", err)
+	}
+
+	remote, _ := (&Handshake{Extensions: map[string]byte{"ut_pex": 7}}).Encode()
+	if err := s.Handle(HANDSHAKE_ID, remote); err != nil {
+		t.Fatalf("Unexpected error handling handshake %v", err)
+	}
+	if len(pex.handlers[0].handshakes) != 1 || len(holepunch.handlers[0].handshakes) != 1 {
+		t.Errorf("Expected every handler to see the handshake")
+	}
+	if !s.Supports("ut_pex") || s.Supports("ut_holepunch") {
+		t.Errorf("Expected only ut_pex to be supported")
+	}
+
+	// Messages we send use the remote's ids, messages we receive use ours
+	if err := s.Send("ut_pex", []byte("out")); err != nil || messages[0].id != 7 {
+		t.Errorf("Expected message sent with the remote id but was %v %v", messages, err)
+	}
+	if err := s.Send("ut_holepunch", []byte("out")); err != ErrUnsupported {
+		t.Errorf("Expected ErrUnsupported but was %v", err)
+	}
+	s.Handle(2, []byte("in"))
+	if len(holepunch.handlers[0].messages) != 1 || len(pex.handlers[0].messages) != 0 {
+		t.Errorf("Expected the message to go to ut_holepunch")
+	}
+	if err := s.Handle(9, []byte("unknown")); err != nil {
+		t.Errorf("Expected unknown ids to be ignored but was %v", err)
+	}
+
+	pex.handlers[0].err = errors.New("Bad message")
+	if err := s.Handle(1, []byte("in")); err == nil {
+		t.Errorf("Expected the handler error to be returned")
+	}
+	if s.Handler("ut_pex") != pex.handlers[0] || s.Handler("ut_metadata") != nil {
+		t.Errorf("Expected handlers to be found by name")
+	}
+}
+
+func TestSessionFollowsLaterHandshakes(t *testing.T) {
+	r := NewRegistry()
+	r.Register(&fakeExtension{name: "ut_pex"})
+	s := r.NewSession(SessionConfig{}, func(id byte, payload []byte) {})
+
+	first, _ := (&Handshake{Extensions: map[string]byte{"ut_pex": 1}}).Encode()
+	s.Handle(HANDSHAKE_ID, first)
+	disabled, _ := (&Handshake{}).Encode()
+	s.Handle(HANDSHAKE_ID, disabled)
+	if s.Supports("ut_pex") {
+		t.Errorf("Expected a later handshake to disable the extension")
+	}
+	if err := s.Handle(HANDSHAKE_ID, []byte("garbage")); err == nil {
+		t.Errorf("Expected an error for a bad handshake")
+	}
+}
@@ -0,0 +1,85 @@
+package lsd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	SEARCH_REQUEST_LINE = "BT-SEARCH * HTTP/1.1"
+	// Announces longer than this are refused, and those we send are split to fit
+	MAX_MESSAGE_LENGTH = 1400
+	// Most info hashes we send in one announce, so it fits in MAX_MESSAGE_LENGTH
+	MAX_INFO_HASHES  = 20
+	INFO_HASH_LENGTH = 20
+)
+
+// Types
+
+// Announce is a BT-SEARCH message (BEP 14), telling peers on the local network which torrents we
+// have and the port to connect to us on
+type Announce struct {
+	Port       int
+	InfoHashes [][]byte
+	// Cookie lets us recognise our own announces when multicast loops them back
+	Cookie string
+}
+
+var ErrInvalidAnnounce = errors.New("Invalid BT-SEARCH announce")
+
+// Public Methods
+
+// Encode writes the announce as sent to the multicast group at host
+func (a *Announce) Encode(host string) []byte {
+	buffer := bytes.NewBuffer(nil)
+	buffer.WriteString(SEARCH_REQUEST_LINE + "\r\n")
+	buffer.WriteString("Host: " + host + "\r\n")
+	buffer.WriteString("Port: " + strconv.Itoa(a.Port) + "\r\n")
+	for _, infoHash := range a.InfoHashes {
+		buffer.WriteString("Infohash: " + hex.EncodeToString(infoHash) + "\r\n")
+	}
+	if a.Cookie != "" {
+		buffer.WriteString("cookie: " + a.Cookie + "\r\n")
+	}
+	buffer.WriteString("\r\n\r\n")
+	return buffer.Bytes()
+}
+
+// ParseAnnounce reads a BT-SEARCH message. Header names are matched ignoring case, and info hashes
+// which aren't valid are skipped, but there must be a valid port and at least one info hash.
+func ParseAnnounce(data []byte) (*Announce, error) {
+	if len(data) > MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("BT-SEARCH announce of %v bytes is too long", len(data))
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if strings.TrimSpace(lines[0]) != SEARCH_REQUEST_LINE {
+		return nil, ErrInvalidAnnounce
+	}
+
+	a := &Announce{}
+	for _, line := range lines[1:] {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[colon+1:])
+		switch strings.ToLower(strings.TrimSpace(line[:colon])) {
+		case "port":
+			a.Port, _ = strconv.Atoi(value)
+		case "infohash":
+			if infoHash, err := hex.DecodeString(value); err == nil && len(infoHash) == INFO_HASH_LENGTH {
+				a.InfoHashes = append(a.InfoHashes, infoHash)
+			}
+		case "cookie":
+			a.Cookie = value
+		}
+	}
+	if a.Port <= 0 || a.Port > 65535 || len(a.InfoHashes) == 0 {
+		return nil, ErrInvalidAnnounce
+	}
+	return a, nil
+}
@@ -0,0 +1,62 @@
+package lsd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAnnounceRoundTrip(t *testing.T) {
+	a := &Announce{Port: 6881, InfoHashes: [][]byte{bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{0xab}, 20)}, Cookie: "c00k1e"}
+	data := a.Encode(IPV4_GROUP)
+	expected := "BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nPort: 6881\r\n" +
+		"Infohash: 0101010101010101010101010101010101010101\r\n" +
+		"Infohash: abababababababababababababababababababab\r\n" +
+		"cookie: c00k1e\r\n\r\n\r\n"
+	if string(data) != expected {
+		t.Errorf("Unexpected encoding %q", data)
+	}
+	parsed, err := ParseAnnounce(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, a) {
+		t.Errorf("Expected %+v but got %+v", a, parsed)
+	}
+}
+
+func TestParseAnnounceIsLenient(t *testing.T) {
+	data := "BT-SEARCH * HTTP/1.1\nHOST: [ff15::efc0:988f]:6771\nport:51413\n" +
+		"infohash: ABABABABABABABABABABABABABABABABABABABAB\ninfohash: tooshort\n\n"
+	a, err := ParseAnnounce([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Port != 51413 || len(a.InfoHashes) != 1 || a.InfoHashes[0][0] != 0xab || a.Cookie != "" {
+		t.Errorf("Unexpected announce %+v", a)
+	}
+}
+
+func TestParseInvalidAnnounces(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"GET / HTTP/1.1\r\nPort: 6881\r\nInfohash: 0101010101010101010101010101010101010101\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nInfohash: 0101010101010101010101010101010101010101\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: 0101010101010101010101010101010101010101\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+	} {
+		if _, err := ParseAnnounce([]byte(data)); err == nil {
+			t.Errorf("Expected %q to fail to parse", data)
+		}
+	}
+}
+
+func TestFullAnnouncesFit(t *testing.T) {
+	a := &Announce{Port: 65535, Cookie: "0123456789abcdef"}
+	for i := 0; i < MAX_INFO_HASHES; i++ {
+		a.InfoHashes = append(a.InfoHashes, make([]byte, INFO_HASH_LENGTH))
+	}
+	if length := len(a.Encode(IPV6_GROUP)); length > MAX_MESSAGE_LENGTH {
+		t.Errorf("Announce of %v bytes is over the limit", length)
+	}
+}
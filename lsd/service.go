@@ -0,0 +1,286 @@
+package lsd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// The multicast groups of BEP 14
+	IPV4_GROUP = "239.192.152.143:6771"
+	IPV6_GROUP = "[ff15::efc0:988f]:6771"
+	// Each torrent is announced this often
+	ANNOUNCE_INTERVAL = 5 * time.Minute
+	// Announces are sent at most this often, so adding torrents doesn't flood the network
+	MIN_SEND_INTERVAL = time.Minute
+	// Each address can send this many announces in a RATE_LIMIT_WINDOW before the rest are ignored
+	RATE_LIMIT        = 10
+	RATE_LIMIT_WINDOW = time.Minute
+	COOKIE_LENGTH     = 8
+)
+
+var ErrServiceClosed = errors.New("Local service discovery is closed")
+
+// Types
+
+// Group is a connection joined to a multicast group, which announces are sent to
+type Group struct {
+	Conn net.PacketConn
+	Addr net.Addr
+}
+
+type Config struct {
+	// Groups carry the announces, usually from ListenGroup with IPV4_GROUP and IPV6_GROUP. Their
+	// connections are closed by Close.
+	Groups []*Group
+	Clock  util.Clock
+}
+
+// Service finds peers on the local network by multicasting announces of the torrents added to it
+// (BEP 14), and passes on the peers announcing the same torrents
+type Service struct {
+	config Config
+	cookie string
+	wake   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock     sync.Mutex
+	torrents map[string]*torrent
+	lastSent time.Time
+	// received counts the announces from each address since windowStart
+	received    map[string]int
+	windowStart time.Time
+	closed      bool
+}
+
+type torrent struct {
+	infoHash []byte
+	port     int
+	addPeers func(addresses []string)
+	// announced is zero until the torrent is first announced
+	announced time.Time
+}
+
+// Initialiser
+
+func NewService(config Config) (*Service, error) {
+	if len(config.Groups) == 0 {
+		return nil, errors.New("Local service discovery needs a multicast group")
+	}
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+	cookie := make([]byte, COOKIE_LENGTH)
+	if _, err := rand.Read(cookie); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Service{
+		config:   config,
+		cookie:   hex.EncodeToString(cookie),
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		torrents: make(map[string]*torrent),
+		received: make(map[string]int),
+	}
+	s.wg.Add(1 + len(config.Groups))
+	go s.announceLoop()
+	for _, group := range config.Groups {
+		go s.readLoop(group.Conn)
+	}
+	return s, nil
+}
+
+// ListenGroup joins the multicast group at address on the system's default interface
+func ListenGroup(address string) (*Group, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenMulticastUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Group{Conn: conn, Addr: addr}, nil
+}
+
+// Public Methods
+
+// Add announces a torrent with the port we accept connections on, and passes addPeers the
+// addresses of local peers announcing it. A port of 0 only listens for peers.
+func (s *Service) Add(infoHash []byte, port int, addPeers func(addresses []string)) {
+	s.lock.Lock()
+	s.torrents[string(infoHash)] = &torrent{infoHash: infoHash, port: port, addPeers: addPeers}
+	s.lock.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Remove stops announcing a torrent and passing on its peers
+func (s *Service) Remove(infoHash []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.torrents, string(infoHash))
+}
+
+// Close stops the service and closes the groups' connections
+func (s *Service) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.lock.Unlock()
+
+	s.cancel()
+	var err error
+	for _, group := range s.config.Groups {
+		if closeErr := group.Conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	s.wg.Wait()
+	return err
+}
+
+// Helpers
+
+func (s *Service) readLoop(conn net.PacketConn) {
+	defer s.wg.Done()
+	buffer := make([]byte, MAX_MESSAGE_LENGTH)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if announce, err := ParseAnnounce(buffer[:n]); err == nil {
+			s.receive(announce, udpAddr.IP)
+		}
+	}
+}
+
+// receive passes the peer announcing to the torrents it has, unless the announce is our own or
+// its address has gone over its rate limit
+func (s *Service) receive(announce *Announce, ip net.IP) {
+	s.lock.Lock()
+	if announce.Cookie == s.cookie {
+		s.lock.Unlock()
+		return
+	}
+	now := s.config.Clock.Now()
+	if now.Sub(s.windowStart) >= RATE_LIMIT_WINDOW {
+		s.received = make(map[string]int)
+		s.windowStart = now
+	}
+	s.received[ip.String()]++
+	if s.received[ip.String()] > RATE_LIMIT {
+		s.lock.Unlock()
+		return
+	}
+	callbacks := []func([]string){}
+	for _, infoHash := range announce.InfoHashes {
+		if t, ok := s.torrents[string(infoHash)]; ok {
+			callbacks = append(callbacks, t.addPeers)
+		}
+	}
+	s.lock.Unlock()
+
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(announce.Port))
+	for _, addPeers := range callbacks {
+		addPeers([]string{address})
+	}
+}
+
+// announceLoop sends announces for the torrents which are due, waiting at least
+// MIN_SEND_INTERVAL between sends
+func (s *Service) announceLoop() {
+	defer s.wg.Done()
+	for {
+		s.lock.Lock()
+		now := s.config.Clock.Now()
+		wait, announces := s.due(now)
+		s.lock.Unlock()
+
+		for _, announce := range announces {
+			for _, group := range s.config.Groups {
+				group.Conn.WriteTo(announce.Encode(group.Addr.String()), group.Addr)
+			}
+		}
+
+		timer := s.config.Clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-s.wake:
+			timer.Stop()
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// due returns the announces to send now, and how long to wait before checking again. It must be
+// called with the lock held.
+func (s *Service) due(now time.Time) (time.Duration, []*Announce) {
+	if !s.lastSent.IsZero() && now.Sub(s.lastSent) < MIN_SEND_INTERVAL {
+		return s.lastSent.Add(MIN_SEND_INTERVAL).Sub(now), nil
+	}
+
+	wait := ANNOUNCE_INTERVAL
+	byPort := make(map[int][]*torrent)
+	for _, t := range s.torrents {
+		if t.port == 0 {
+			continue
+		}
+		if next := t.announced.Add(ANNOUNCE_INTERVAL); !t.announced.IsZero() && next.After(now) {
+			if next.Sub(now) < wait {
+				wait = next.Sub(now)
+			}
+			continue
+		}
+		byPort[t.port] = append(byPort[t.port], t)
+	}
+	if len(byPort) == 0 {
+		return wait, nil
+	}
+
+	announces := []*Announce{}
+	for port, torrents := range byPort {
+		// Sorted so announces are the same whatever the map order
+		sort.Slice(torrents, func(i, j int) bool { return string(torrents[i].infoHash) < string(torrents[j].infoHash) })
+		announce := &Announce{Port: port, Cookie: s.cookie}
+		for _, t := range torrents {
+			if len(announce.InfoHashes) >= MAX_INFO_HASHES {
+				announces = append(announces, announce)
+				announce = &Announce{Port: port, Cookie: s.cookie}
+			}
+			announce.InfoHashes = append(announce.InfoHashes, t.infoHash)
+			t.announced = now
+		}
+		announces = append(announces, announce)
+	}
+	s.lastSent = now
+	return MIN_SEND_INTERVAL, announces
+}
@@ -0,0 +1,143 @@
+package lsd
+
+import (
+	"bytes"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"net"
+	"testing"
+	"time"
+)
+
+const TEST_TIMEOUT = 5 * time.Second
+
+func newTestGroupConn(t *testing.T, network *mock.MockPacketNetwork, address string) *mock.MockPacketConn {
+	conn, err := network.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.JoinGroup(IPV4_GROUP); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func newTestService(t *testing.T, network *mock.MockPacketNetwork, address string, config Config) *Service {
+	group, _ := net.ResolveUDPAddr("udp", IPV4_GROUP)
+	config.Groups = []*Group{{Conn: newTestGroupConn(t, network, address), Addr: group}}
+	s, err := NewService(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// collector returns an addPeers func and the channel it passes peers on
+func collector() (func([]string), chan string) {
+	found := make(chan string, 100)
+	return func(addresses []string) {
+		for _, address := range addresses {
+			found <- address
+		}
+	}, found
+}
+
+func expectPeer(t *testing.T, found chan string, expected string) {
+	t.Helper()
+	select {
+	case address := <-found:
+		if address != expected {
+			t.Errorf("Expected peer %v but got %v", expected, address)
+		}
+	case <-time.After(TEST_TIMEOUT):
+		t.Fatalf("Timed out waiting for peer %v", expected)
+	}
+}
+
+func TestPeersAreFoundOnTheLocalNetwork(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	a := newTestService(t, network, "192.168.1.10:6771", Config{})
+	b := newTestService(t, network, "192.168.1.11:6771", Config{})
+	infoHash := bytes.Repeat([]byte{7}, 20)
+
+	addPeersA, foundA := collector()
+	addPeersB, foundB := collector()
+	b.Add(infoHash, 0, addPeersB)
+	a.Add(infoHash, 6881, addPeersA)
+	expectPeer(t, foundB, "192.168.1.10:6881")
+
+	// b only listens, and a ignores its own announce
+	time.Sleep(50 * time.Millisecond)
+	if len(foundA) != 0 {
+		t.Errorf("Expected no peers for a but got %v", <-foundA)
+	}
+	b.Remove(infoHash)
+}
+
+func TestAnnouncesAreRateLimited(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	network := mock.NewMockPacketNetwork()
+	s := newTestService(t, network, "192.168.1.10:6771", Config{Clock: clock})
+	observer := newTestGroupConn(t, network, "192.168.1.20:6771")
+	read := func() *Announce {
+		t.Helper()
+		observer.SetReadDeadline(time.Now().Add(TEST_TIMEOUT))
+		buffer := make([]byte, MAX_MESSAGE_LENGTH)
+		n, _, err := observer.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := ParseAnnounce(buffer[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+
+	s.Add(bytes.Repeat([]byte{1}, 20), 6881, func([]string) {})
+	if a := read(); len(a.InfoHashes) != 1 || a.Port != 6881 {
+		t.Errorf("Unexpected announce %+v", a)
+	}
+
+	// A torrent added straight after waits for the next send
+	s.Add(bytes.Repeat([]byte{2}, 20), 6881, func([]string) {})
+	clock.BlockUntil(1)
+	observer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := observer.ReadFrom(make([]byte, MAX_MESSAGE_LENGTH)); err == nil {
+		t.Errorf("Expected nothing to be sent within MIN_SEND_INTERVAL")
+	}
+	clock.Advance(MIN_SEND_INTERVAL)
+	if a := read(); len(a.InfoHashes) != 1 || a.InfoHashes[0][0] != 2 {
+		t.Errorf("Expected only the new torrent to be announced but got %+v", a)
+	}
+
+	// Both are announced again once ANNOUNCE_INTERVAL has passed
+	clock.BlockUntil(1)
+	clock.Advance(ANNOUNCE_INTERVAL)
+	if a := read(); len(a.InfoHashes) != 2 {
+		t.Errorf("Expected both torrents to be announced but got %+v", a)
+	}
+}
+
+func TestFloodingAddressesAreIgnored(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	s := newTestService(t, network, "192.168.1.10:6771", Config{})
+	flooder := newTestGroupConn(t, network, "192.168.1.66:6771")
+	other := newTestGroupConn(t, network, "192.168.1.67:6771")
+	infoHash := bytes.Repeat([]byte{9}, 20)
+	addPeers, found := collector()
+	s.Add(infoHash, 0, addPeers)
+
+	group, _ := net.ResolveUDPAddr("udp", IPV4_GROUP)
+	announce := &Announce{Port: 6881, InfoHashes: [][]byte{infoHash}}
+	for i := 0; i < RATE_LIMIT+5; i++ {
+		flooder.WriteTo(announce.Encode(IPV4_GROUP), group)
+	}
+	// Announces are handled in order, so once this one arrives the flood has been
+	other.WriteTo(announce.Encode(IPV4_GROUP), group)
+	for i := 0; i < RATE_LIMIT; i++ {
+		expectPeer(t, found, "192.168.1.66:6881")
+	}
+	expectPeer(t, found, "192.168.1.67:6881")
+}
@@ -0,0 +1,294 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/extension"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/parser"
+	"sync"
+)
+
+const (
+	EXTENSION_NAME = "ut_metadata"
+	// Metadata is sent in pieces of this length, with only the last being shorter
+	PIECE_LENGTH = 16 * 1024
+	// Peers claiming metadata larger than this aren't fetched from
+	MAX_METADATA_SIZE = 8 * 1024 * 1024
+	// How many pieces are requested from one peer at a time
+	MAX_OUTSTANDING_REQUESTS = 2
+)
+
+// Types
+
+// Exchange is the ut_metadata extension (BEP 9) for one torrent. It serves the metadata to peers
+// once it has it, and until then fetches it from peers which do, checking it against the info
+// hash. Its handlers must all be run from one goroutine, as a torrent's sessions are.
+type Exchange struct {
+	infoHash []byte
+	done     chan struct{}
+
+	lock      sync.Mutex
+	info      *model.Info
+	size      int
+	pieces    [][]byte
+	requested map[int]*handler
+	senders   map[int]*handler
+	handlers  []*handler
+}
+
+type handler struct {
+	exchange *Exchange
+	session  *extension.Session
+	// size is the metadata size the peer gave, or 0 if it has none to give
+	size int
+	// unusable is set once the peer rejects a request or sends metadata which fails the hash
+	// check, so it isn't asked again
+	unusable bool
+	pending  int
+}
+
+// Initialiser
+
+// NewExchange creates an exchange which fetches the metadata for infoHash
+func NewExchange(infoHash []byte) *Exchange {
+	return &Exchange{
+		infoHash:  infoHash,
+		done:      make(chan struct{}),
+		requested: make(map[int]*handler),
+		senders:   make(map[int]*handler),
+	}
+}
+
+// NewExchangeForInfo creates an exchange which serves info's raw bytes, so info must have been
+// parsed
+func NewExchangeForInfo(info *model.Info) *Exchange {
+	e := NewExchange(info.Hash)
+	e.info = info
+	close(e.done)
+	return e
+}
+
+// Public Methods
+
+func (e *Exchange) Name() string {
+	return EXTENSION_NAME
+}
+
+func (e *Exchange) NewHandler(session *extension.Session) extension.Handler {
+	h := &handler{exchange: e, session: session}
+	e.lock.Lock()
+	e.handlers = append(e.handlers, h)
+	e.lock.Unlock()
+	return h
+}
+
+// Done is closed once the exchange has the metadata
+func (e *Exchange) Done() <-chan struct{} {
+	return e.done
+}
+
+// Info returns the info parsed from the metadata, or nil until Done is closed
+func (e *Exchange) Info() *model.Info {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.info
+}
+
+// Handler
+
+func (h *handler) ExtendHandshake(handshake *extension.Handshake) {
+	if info := h.exchange.Info(); info != nil {
+		handshake.MetadataSize = len(info.Raw)
+	}
+}
+
+func (h *handler) Handshake(remote *extension.Handshake) {
+	h.exchange.lock.Lock()
+	h.size = 0
+	if h.session.Supports(EXTENSION_NAME) {
+		h.size = remote.MetadataSize
+	}
+	h.exchange.lock.Unlock()
+	h.exchange.request()
+}
+
+func (h *handler) Message(payload []byte) error {
+	m, err := ParseMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	switch m.Type {
+	case MESSAGE_REQUEST:
+		h.exchange.serve(h, m.Piece)
+	case MESSAGE_DATA:
+		if err := h.exchange.receive(h, m); err != nil {
+			return err
+		}
+		h.exchange.request()
+	case MESSAGE_REJECT:
+		h.exchange.rejected(h, m.Piece)
+		h.exchange.request()
+	}
+	return nil
+}
+
+func (h *handler) Close() {
+	h.exchange.remove(h)
+	h.exchange.request()
+}
+
+// Helpers
+
+func (e *Exchange) serve(h *handler, piece int) {
+	info := e.Info()
+	response := &Message{Type: MESSAGE_REJECT, Piece: piece}
+	if info != nil && piece < numPieces(len(info.Raw)) {
+		begin := piece * PIECE_LENGTH
+		response = &Message{Type: MESSAGE_DATA, Piece: piece, TotalSize: len(info.Raw), Data: info.Raw[begin : begin+pieceSize(len(info.Raw), piece)]}
+	}
+	h.send(response)
+}
+
+// receive stores a piece of metadata, checking the whole once every piece has arrived.
+// Pieces we didn't ask the peer for are ignored.
+func (e *Exchange) receive(h *handler, m *Message) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.info != nil || e.requested[m.Piece] != h {
+		return nil
+	}
+	if m.TotalSize != e.size || len(m.Data) != pieceSize(e.size, m.Piece) {
+		return fmt.Errorf("Metadata piece %v has length %v of %v, expected %v of %v", m.Piece, len(m.Data), m.TotalSize, pieceSize(e.size, m.Piece), e.size)
+	}
+	delete(e.requested, m.Piece)
+	h.pending--
+	e.pieces[m.Piece] = m.Data
+	e.senders[m.Piece] = h
+
+	for _, piece := range e.pieces {
+		if piece == nil {
+			return nil
+		}
+	}
+	raw := bytes.Join(e.pieces, nil)
+	hash := sha1.Sum(raw)
+	if bytes.Equal(hash[:], e.infoHash) {
+		// The metadata is what the info hash was made from, so it can't be any other way
+		if info, err := parser.ParseInfo(raw); err == nil {
+			e.info = info
+			close(e.done)
+			return nil
+		}
+	}
+
+	// Any of the peers which sent pieces could be at fault, so none of them are asked again
+	for _, sender := range e.senders {
+		sender.unusable = true
+	}
+	e.reset()
+	return nil
+}
+
+func (e *Exchange) rejected(h *handler, piece int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.requested[piece] == h {
+		delete(e.requested, piece)
+		h.pending--
+		h.unusable = true
+	}
+}
+
+func (e *Exchange) remove(h *handler) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for i, other := range e.handlers {
+		if other == h {
+			e.handlers = append(e.handlers[:i], e.handlers[i+1:]...)
+			break
+		}
+	}
+	for piece, requested := range e.requested {
+		if requested == h {
+			delete(e.requested, piece)
+		}
+	}
+}
+
+// request asks peers for the pieces of metadata which are neither here nor on their way. The
+// size of the metadata is taken from the first usable peer, and only peers agreeing with it are
+// asked.
+func (e *Exchange) request() {
+	type request struct {
+		handler *handler
+		piece   int
+	}
+	requests := []request{}
+
+	e.lock.Lock()
+	if e.info != nil {
+		e.lock.Unlock()
+		return
+	}
+	for _, h := range e.handlers {
+		if h.unusable || h.size <= 0 || h.size > MAX_METADATA_SIZE {
+			continue
+		}
+		if e.size == 0 {
+			e.size = h.size
+			e.pieces = make([][]byte, numPieces(e.size))
+		}
+		if h.size != e.size {
+			continue
+		}
+		for piece := range e.pieces {
+			if h.pending >= MAX_OUTSTANDING_REQUESTS {
+				break
+			}
+			if e.pieces[piece] == nil && e.requested[piece] == nil {
+				e.requested[piece] = h
+				h.pending++
+				requests = append(requests, request{h, piece})
+			}
+		}
+	}
+	e.lock.Unlock()
+
+	for _, r := range requests {
+		r.handler.send(&Message{Type: MESSAGE_REQUEST, Piece: r.piece})
+	}
+}
+
+// reset throws away the metadata fetched so far
+func (e *Exchange) reset() {
+	e.size = 0
+	e.pieces = nil
+	e.requested = make(map[int]*handler)
+	e.senders = make(map[int]*handler)
+	for _, h := range e.handlers {
+		h.pending = 0
+	}
+}
+
+func (h *handler) send(m *Message) {
+	if payload, err := m.Encode(); err == nil {
+		h.session.Send(EXTENSION_NAME, payload)
+	}
+}
+
+func numPieces(size int) int {
+	return (size + PIECE_LENGTH - 1) / PIECE_LENGTH
+}
+
+func pieceSize(size int, piece int) int {
+	if remaining := size - piece*PIECE_LENGTH; remaining < PIECE_LENGTH {
+		return remaining
+	}
+	return PIECE_LENGTH
+}
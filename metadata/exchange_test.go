@@ -0,0 +1,226 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/extension"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/parser"
+	"strings"
+	"testing"
+)
+
+// network passes extended messages between sessions in the order they were sent
+type network struct {
+	queue []func() error
+}
+
+type peer struct {
+	session *extension.Session
+	// requests counts the requests the peer has been sent
+	requests int
+}
+
+func TestFetchFromSeveralPeers(t *testing.T) {
+	info := testInfo(t, 40000)
+	n := &network{}
+	fetcher := NewExchange(info.Hash)
+	seeds := []*peer{}
+	for i := 0; i < 3; i++ {
+		local, remote := n.connect(fetcher, NewExchangeForInfo(info))
+		seeds = append(seeds, remote)
+		local.session.SendHandshake()
+		remote.session.SendHandshake()
+	}
+	n.run(t)
+
+	select {
+	case <-fetcher.Done():
+	default:
+		t.Fatalf("Expected metadata to be fetched")
+	}
+	fetched := fetcher.Info()
+	if fetched == nil || !bytes.Equal(fetched.Raw, info.Raw) || !bytes.Equal(fetched.Hash, info.Hash) || fetched.PieceLength != info.PieceLength {
+		t.Fatalf("Expected fetched info to match")
+	}
+
+	// The pieces were spread over the peers rather than all asked of one
+	total := 0
+	for _, seed := range seeds {
+		total += seed.requests
+	}
+	if total != numPieces(len(info.Raw)) || seeds[0].requests == total {
+		t.Errorf("Expected each piece requested once across the peers but was %v %v %v", seeds[0].requests, seeds[1].requests, seeds[2].requests)
+	}
+
+	// The fetched metadata is served in turn
+	again := NewExchange(info.Hash)
+	local, remote := n.connect(again, fetcher)
+	local.session.SendHandshake()
+	remote.session.SendHandshake()
+	n.run(t)
+	if again.Info() == nil {
+		t.Errorf("Expected metadata to be fetched from a peer which fetched it")
+	}
+}
+
+func TestRejectsMoveRequestsToOtherPeers(t *testing.T) {
+	info := testInfo(t, 20000)
+	n := &network{}
+	fetcher := NewExchange(info.Hash)
+
+	// A peer which claims the metadata but doesn't have it rejects every request
+	local, remote := n.connect(fetcher, NewExchange(info.Hash))
+	local.session.SendHandshake()
+	local.session.Handle(extension.HANDSHAKE_ID, handshake(t, len(info.Raw)))
+	n.run(t)
+	if remote.requests == 0 || fetcher.Info() != nil {
+		t.Fatalf("Expected requests to the empty peer to be rejected")
+	}
+
+	local, seed := n.connect(fetcher, NewExchangeForInfo(info))
+	local.session.SendHandshake()
+	seed.session.SendHandshake()
+	n.run(t)
+	if fetcher.Info() == nil {
+		t.Fatalf("Expected metadata to be fetched from the seed")
+	}
+}
+
+func TestBadMetadataIsRefetched(t *testing.T) {
+	info := testInfo(t, 20000)
+	n := &network{}
+	fetcher := NewExchange(info.Hash)
+
+	// Metadata for another torrent of the same size fails the hash check
+	other := testInfo(t, 20000)
+	other.Raw = bytes.Replace(other.Raw, []byte("4:test"), []byte("4:tset"), 1)
+	local, bad := n.connect(fetcher, NewExchangeForInfo(other))
+	local.session.SendHandshake()
+	bad.session.SendHandshake()
+	n.run(t)
+	if fetcher.Info() != nil {
+		t.Fatalf("Expected metadata failing the hash check to be thrown away")
+	}
+
+	local, seed := n.connect(fetcher, NewExchangeForInfo(info))
+	local.session.SendHandshake()
+	seed.session.SendHandshake()
+	n.run(t)
+	if fetcher.Info() == nil || bad.requests != numPieces(len(info.Raw)) {
+		t.Errorf("Expected metadata fetched from the good peer alone, bad peer had %v requests", bad.requests)
+	}
+}
+
+func TestClosedPeersReleaseRequests(t *testing.T) {
+	info := testInfo(t, 20000)
+	n := &network{}
+	fetcher := NewExchange(info.Hash)
+
+	// The first peer goes before answering
+	local, remote := n.connect(fetcher, NewExchangeForInfo(info))
+	local.session.SendHandshake()
+	remote.session.SendHandshake()
+	n.step(t)
+	n.step(t)
+	n.queue = nil
+	local.session.Close()
+
+	local, seed := n.connect(fetcher, NewExchangeForInfo(info))
+	local.session.SendHandshake()
+	seed.session.SendHandshake()
+	n.run(t)
+	if fetcher.Info() == nil {
+		t.Errorf("Expected the requests to pass to the next peer")
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+	info := testInfo(t, 20000)
+	n := &network{}
+	fetcher := NewExchange(info.Hash)
+	local, remote := n.connect(fetcher, NewExchangeForInfo(info))
+	local.session.SendHandshake()
+	remote.session.SendHandshake()
+	n.step(t)
+	n.step(t)
+	n.queue = nil
+
+	// Data of the wrong length for a piece we asked for closes the connection
+	handler := local.session.Handler(EXTENSION_NAME)
+	short, _ := (&Message{Type: MESSAGE_DATA, Piece: 0, TotalSize: len(info.Raw), Data: []byte("short")}).Encode()
+	if err := handler.Message(short); err == nil {
+		t.Errorf("Expected an error for a short piece")
+	}
+	if err := handler.Message([]byte("garbage")); err == nil {
+		t.Errorf("Expected an error for a malformed message")
+	}
+	// Pieces we didn't ask for are ignored
+	unasked, _ := (&Message{Type: MESSAGE_DATA, Piece: 5, TotalSize: len(info.Raw), Data: []byte("x")}).Encode()
+	if err := handler.Message(unasked); err != nil {
+		t.Errorf("Expected unrequested data to be ignored but was %v", err)
+	}
+}
+
+// Helpers
+
+func testInfo(t *testing.T, fileLength int) *model.Info {
+	// Tiny pieces make the metadata span several metadata pieces
+	pieces := strings.Repeat("p", 20*((fileLength+15)/16))
+	raw := fmt.Sprintf("d6:lengthi%ve4:name4:test12:piece lengthi16e6:pieces%v:%ve", fileLength, len(pieces), pieces)
+	info, err := parser.ParseInfo([]byte(raw))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing test info %v", err)
+	}
+	if hash := sha1.Sum([]byte(raw)); !bytes.Equal(info.Hash, hash[:]) {
+		t.Fatalf("Expected the info hash to be the hash of the raw info")
+	}
+	return info
+}
+
+func handshake(t *testing.T, size int) []byte {
+	data, err := (&extension.Handshake{Extensions: map[string]byte{EXTENSION_NAME: 1}, MetadataSize: size}).Encode()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding handshake %v", err)
+	}
+	return data
+}
+
+// connect joins two exchanges, returning each end
+func (n *network) connect(a *Exchange, b *Exchange) (*peer, *peer) {
+	left, right := &peer{}, &peer{}
+	left.session = registry(a).NewSession(extension.SessionConfig{}, n.deliver(right))
+	right.session = registry(b).NewSession(extension.SessionConfig{}, n.deliver(left))
+	return left, right
+}
+
+// deliver returns a send func for messages to a peer, counting the requests it is sent
+func (n *network) deliver(to *peer) func(id byte, payload []byte) {
+	return func(id byte, payload []byte) {
+		if m, err := ParseMessage(payload); id != extension.HANDSHAKE_ID && err == nil && m.Type == MESSAGE_REQUEST {
+			to.requests++
+		}
+		n.queue = append(n.queue, func() error { return to.session.Handle(id, payload) })
+	}
+}
+
+func (n *network) step(t *testing.T) {
+	next := n.queue[0]
+	n.queue = n.queue[1:]
+	if err := next(); err != nil {
+		t.Fatalf("Unexpected error handling message %v", err)
+	}
+}
+
+func (n *network) run(t *testing.T) {
+	for len(n.queue) > 0 {
+		n.step(t)
+	}
+}
+
+func registry(e *Exchange) *extension.Registry {
+	r := extension.NewRegistry()
+	r.Register(e)
+	return r
+}
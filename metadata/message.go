@@ -0,0 +1,80 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/model"
+)
+
+type MessageType int
+
+const (
+	MESSAGE_REQUEST MessageType = 0
+	MESSAGE_DATA    MessageType = 1
+	MESSAGE_REJECT  MessageType = 2
+)
+
+const (
+	// Longest dictionary at the start of a message we'll decode
+	MAX_HEADER_LENGTH = 1024
+)
+
+// Types
+
+// Message is a ut_metadata message. Data messages carry a piece of the metadata after their
+// bencoded dictionary.
+type Message struct {
+	Type  MessageType
+	Piece int
+	// TotalSize is the length of the whole metadata, and is only sent with data
+	TotalSize int
+	Data      []byte
+}
+
+// Public Methods
+
+func (m *Message) Encode() ([]byte, error) {
+	dict := model.NewOrderedMap()
+	dict.Add("msg_type", int(m.Type))
+	dict.Add("piece", m.Piece)
+	if m.Type == MESSAGE_DATA {
+		dict.Add("total_size", m.TotalSize)
+	}
+	header, err := bencoding.EncodeBencoding(dict)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != MESSAGE_DATA {
+		return header, nil
+	}
+	return append(header, m.Data...), nil
+}
+
+// ParseMessage reads a ut_metadata message. Unknown message types aren't an error, so that
+// they can be ignored as BEP 9 requires.
+func ParseMessage(payload []byte) (*Message, error) {
+	reader := bytes.NewReader(payload)
+	dict, err := bencoding.DecodeBencodingLimited(reader, MAX_HEADER_LENGTH)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode metadata message - %v", err)
+	}
+
+	msgType, ok := dict.Get("msg_type").(int)
+	if !ok {
+		return nil, fmt.Errorf("Metadata message has no type")
+	}
+	piece, ok := dict.Get("piece").(int)
+	if !ok || piece < 0 {
+		return nil, fmt.Errorf("Metadata message has no valid piece")
+	}
+
+	m := &Message{Type: MessageType(msgType), Piece: piece}
+	if m.Type == MESSAGE_DATA {
+		if m.TotalSize, ok = dict.Get("total_size").(int); !ok {
+			return nil, fmt.Errorf("Metadata data message has no total size")
+		}
+		m.Data = payload[len(payload)-reader.Len():]
+	}
+	return m, nil
+}
@@ -0,0 +1,37 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	tests := map[string]*Message{
+		"d8:msg_typei0e5:piecei0ee":                       {Type: MESSAGE_REQUEST, Piece: 0},
+		"d8:msg_typei1e5:piecei2e10:total_sizei34256eexx": {Type: MESSAGE_DATA, Piece: 2, TotalSize: 34256, Data: []byte("xx")},
+		"d8:msg_typei2e5:piecei1ee":                       {Type: MESSAGE_REJECT, Piece: 1},
+	}
+	for encoded, m := range tests {
+		data, err := m.Encode()
+		if err != nil || string(data) != encoded {
+			t.Errorf("Expected %q but was %q %v", encoded, data, err)
+		}
+		parsed, err := ParseMessage([]byte(encoded))
+		if err != nil || !reflect.DeepEqual(parsed, m) {
+			t.Errorf("Expected %+v but was %+v %v", m, parsed, err)
+		}
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, payload := range []string{"", "le", "d5:piecei0ee", "d8:msg_typei0e5:piecei-1ee", "d8:msg_typei1e5:piecei0ee"} {
+		if _, err := ParseMessage([]byte(payload)); err == nil {
+			t.Errorf("Expected an error parsing %q", payload)
+		}
+	}
+
+	// Unknown types are left to be ignored
+	if m, err := ParseMessage([]byte("d8:msg_typei9e5:piecei0ee")); err != nil || m.Type != 9 {
+		t.Errorf("Expected unknown message type to parse but was %v %v", m, err)
+	}
+}
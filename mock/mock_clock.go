@@ -0,0 +1,98 @@
+package mock
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"sync"
+	"time"
+)
+
+// MockClock implements util.Clock. Time only moves when Advance is called.
+type MockClock struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*mockTimer
+}
+
+type mockTimer struct {
+	clock    *MockClock
+	deadline time.Time
+	c        chan time.Time
+}
+
+func NewMockClock(now time.Time) *MockClock {
+	clock := &MockClock{now: now}
+	clock.cond = sync.NewCond(&clock.lock)
+	return clock
+}
+
+func (clock *MockClock) Now() time.Time {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return clock.now
+}
+
+func (clock *MockClock) NewTimer(d time.Duration) util.Timer {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	timer := &mockTimer{clock: clock, deadline: clock.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		timer.c <- clock.now
+	} else {
+		clock.timers = append(clock.timers, timer)
+		clock.cond.Broadcast()
+	}
+	return timer
+}
+
+// Advance moves the clock forwards, firing any timers which become due
+func (clock *MockClock) Advance(d time.Duration) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	clock.now = clock.now.Add(d)
+	pending := make([]*mockTimer, 0, len(clock.timers))
+	for _, timer := range clock.timers {
+		if timer.deadline.After(clock.now) {
+			pending = append(pending, timer)
+		} else {
+			timer.c <- clock.now
+		}
+	}
+	clock.timers = pending
+}
+
+// BlockUntil waits until at least count timers are waiting to fire
+func (clock *MockClock) BlockUntil(count int) {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	for len(clock.timers) < count {
+		clock.cond.Wait()
+	}
+}
+
+func (clock *MockClock) Timers() int {
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+	return len(clock.timers)
+}
+
+func (timer *mockTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *mockTimer) Stop() bool {
+	clock := timer.clock
+	clock.lock.Lock()
+	defer clock.lock.Unlock()
+
+	for i, pending := range clock.timers {
+		if pending == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package mock
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"testing"
+	"time"
+)
+
+func TestMockClockFiresTimersWhenAdvanced(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var clock util.Clock
+	mockClock := NewMockClock(start)
+	clock = mockClock
+
+	timer := clock.NewTimer(10 * time.Second)
+	mockClock.Advance(5 * time.Second)
+	select {
+	case <-timer.C():
+		t.Fatal("Timer should not fire before its deadline")
+	default:
+	}
+
+	mockClock.Advance(5 * time.Second)
+	select {
+	case fired := <-timer.C():
+		if !fired.Equal(start.Add(10 * time.Second)) {
+			t.Errorf("Unexpected fire time %v", fired)
+		}
+	default:
+		t.Fatal("Timer should have fired at its deadline")
+	}
+
+	if !clock.Now().Equal(start.Add(10 * time.Second)) {
+		t.Errorf("Unexpected clock time %v", clock.Now())
+	}
+}
+
+func TestMockClockStoppedTimer(t *testing.T) {
+	clock := NewMockClock(time.Unix(0, 0))
+	timer := clock.NewTimer(time.Second)
+	if clock.Timers() != 1 {
+		t.Errorf("Expected one pending timer but was %v", clock.Timers())
+	}
+	if !timer.Stop() {
+		t.Errorf("Expected stopping a pending timer to return true")
+	}
+
+	clock.Advance(time.Minute)
+	select {
+	case <-timer.C():
+		t.Error("Stopped timer should not fire")
+	default:
+	}
+	if timer.Stop() {
+		t.Errorf("Expected stopping a stopped timer to return false")
+	}
+}
+
+func TestMockClockBlockUntil(t *testing.T) {
+	clock := NewMockClock(time.Unix(0, 0))
+	go clock.NewTimer(time.Second)
+	clock.BlockUntil(1)
+}
@@ -0,0 +1,192 @@
+package mock
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Packets sent to a connection with this many unread are dropped, as UDP would
+	MOCK_PACKET_QUEUE_LENGTH = 1024
+	MOCK_FIRST_PORT          = 10000
+)
+
+// MockPacketNetwork delivers packets between MockPacketConns in memory. It can drop packets at
+// random to stand in for a lossy link, and packets sent to a multicast group reach every
+// connection which joined it.
+type MockPacketNetwork struct {
+	lock     sync.Mutex
+	conns    map[string]*MockPacketConn
+	groups   map[string][]*MockPacketConn
+	nextPort int
+	loss     float64
+	random   *rand.Rand
+}
+
+// MockPacketConn implements net.PacketConn on a MockPacketNetwork
+type MockPacketConn struct {
+	network *MockPacketNetwork
+	addr    *net.UDPAddr
+	packets chan mockPacket
+	closed  chan struct{}
+	once    sync.Once
+
+	lock         sync.Mutex
+	readDeadline time.Time
+}
+
+type mockPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+func NewMockPacketNetwork() *MockPacketNetwork {
+	return &MockPacketNetwork{conns: make(map[string]*MockPacketConn), groups: make(map[string][]*MockPacketConn), nextPort: MOCK_FIRST_PORT, random: rand.New(rand.NewSource(1))}
+}
+
+// SetLoss drops each packet sent from now on with the given probability. The same packets are
+// dropped on every run.
+func (network *MockPacketNetwork) SetLoss(probability float64) {
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.loss = probability
+}
+
+// Listen returns a connection at address, given as ip:port. Port 0 picks an unused port.
+func (network *MockPacketNetwork) Listen(address string) (*MockPacketConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	if addr.Port == 0 {
+		for addr.Port == 0 || network.conns[addr.String()] != nil {
+			addr.Port = network.nextPort
+			network.nextPort++
+		}
+	}
+	if network.conns[addr.String()] != nil {
+		return nil, fmt.Errorf("Address %v is already in use", addr)
+	}
+
+	conn := &MockPacketConn{network: network, addr: addr, packets: make(chan mockPacket, MOCK_PACKET_QUEUE_LENGTH), closed: make(chan struct{})}
+	network.conns[addr.String()] = conn
+	return conn, nil
+}
+
+// JoinGroup has the connection receive packets sent to the multicast group at address, including
+// its own, as multicast loopback would
+func (conn *MockPacketConn) JoinGroup(address string) error {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return err
+	}
+	network := conn.network
+	network.lock.Lock()
+	defer network.lock.Unlock()
+	network.groups[addr.String()] = append(network.groups[addr.String()], conn)
+	return nil
+}
+
+func (conn *MockPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	default:
+	}
+
+	conn.lock.Lock()
+	deadline := conn.readDeadline
+	conn.lock.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-conn.packets:
+		return copy(b, packet.data), packet.from, nil
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+// WriteTo delivers the packet to the connection or group members at addr, unless it is lost
+func (conn *MockPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	network := conn.network
+	network.lock.Lock()
+	targets := append([]*MockPacketConn(nil), network.groups[addr.String()]...)
+	if target := network.conns[addr.String()]; target != nil {
+		targets = append(targets, target)
+	}
+	delivered := []*MockPacketConn{}
+	for _, target := range targets {
+		if network.loss == 0 || network.random.Float64() >= network.loss {
+			delivered = append(delivered, target)
+		}
+	}
+	network.lock.Unlock()
+
+	for _, target := range delivered {
+		select {
+		case target.packets <- mockPacket{data: append([]byte(nil), b...), from: conn.addr}:
+		default:
+		}
+	}
+	return len(b), nil
+}
+
+func (conn *MockPacketConn) Close() error {
+	conn.once.Do(func() {
+		network := conn.network
+		network.lock.Lock()
+		delete(network.conns, conn.addr.String())
+		for group, members := range network.groups {
+			for i, member := range members {
+				if member == conn {
+					network.groups[group] = append(members[:i:i], members[i+1:]...)
+					break
+				}
+			}
+		}
+		network.lock.Unlock()
+		close(conn.closed)
+	})
+	return nil
+}
+
+func (conn *MockPacketConn) LocalAddr() net.Addr {
+	return conn.addr
+}
+
+func (conn *MockPacketConn) SetDeadline(t time.Time) error {
+	return conn.SetReadDeadline(t)
+}
+
+func (conn *MockPacketConn) SetReadDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.readDeadline = t
+	return nil
+}
+
+func (conn *MockPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,87 @@
+package mock
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMockPacketNetworkDeliversPackets(t *testing.T) {
+	network := NewMockPacketNetwork()
+	a, err := network.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := network.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.LocalAddr().String() == b.LocalAddr().String() {
+		t.Fatalf("Connections share the address %v", a.LocalAddr())
+	}
+	if _, err := network.Listen(a.LocalAddr().String()); err == nil {
+		t.Error("Listening on an address in use should fail")
+	}
+
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+	buffer := make([]byte, 16)
+	n, from, err := b.ReadFrom(buffer)
+	if err != nil || string(buffer[:n]) != "hello" || from.String() != a.LocalAddr().String() {
+		t.Errorf("Unexpected read %q from %v, error %v", buffer[:n], from, err)
+	}
+
+	// Nothing is listening here, so the packet is silently lost
+	if _, err := a.WriteTo([]byte("lost"), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := b.ReadFrom(buffer); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected a deadline error but got %v", err)
+	}
+
+	b.Close()
+	if _, _, err := b.ReadFrom(buffer); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected a closed error but got %v", err)
+	}
+}
+
+func TestMockPacketNetworkDropsPackets(t *testing.T) {
+	network := NewMockPacketNetwork()
+	network.SetLoss(0.5)
+	a, _ := network.Listen("127.0.0.1:0")
+	b, _ := network.Listen("127.0.0.1:0")
+
+	for i := 0; i < 100; i++ {
+		a.WriteTo([]byte{byte(i)}, b.LocalAddr())
+	}
+	received := len(b.packets)
+	if received == 0 || received == 100 {
+		t.Errorf("Expected some of the packets to be lost but %v of 100 arrived", received)
+	}
+}
+
+func TestMockPacketNetworkMulticast(t *testing.T) {
+	network := NewMockPacketNetwork()
+	a, _ := network.Listen("127.0.0.1:0")
+	b, _ := network.Listen("127.0.0.2:0")
+	outsider, _ := network.Listen("127.0.0.3:0")
+	for _, conn := range []*MockPacketConn{a, b} {
+		if err := conn.JoinGroup("239.0.0.1:7000"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.WriteTo([]byte("hello"), &net.UDPAddr{IP: net.IPv4(239, 0, 0, 1), Port: 7000})
+	if len(a.packets) != 1 || len(b.packets) != 1 || len(outsider.packets) != 0 {
+		t.Errorf("Expected both members and only them to receive the packet")
+	}
+
+	b.Close()
+	a.WriteTo([]byte("again"), &net.UDPAddr{IP: net.IPv4(239, 0, 0, 1), Port: 7000})
+	if len(a.packets) != 2 {
+		t.Errorf("Expected the remaining member to receive the packet")
+	}
+}
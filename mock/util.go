@@ -10,5 +10,5 @@ func PrettyPrint(anything interface{}) string {
 	if err != nil {
 		fmt.Println("error:", err)
 	}
-	return fmt.Sprintf(string(b))
+	return string(b)
 }
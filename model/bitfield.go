@@ -0,0 +1,290 @@
+package model
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+var (
+	ErrBitfieldLength = errors.New("Bitfield is the wrong length for the number of pieces")
+	ErrBitfieldSpare  = errors.New("Bitfield has spare bits set")
+)
+
+// Types
+
+// Bitfield holds one bit per piece. Bits are kept in 64 bit words, most significant bit first, so
+// that the words written out big endian are the wire format.
+type Bitfield struct {
+	words  []uint64
+	length int
+}
+
+// Initialiser
+
+func NewBitfield(length int) *Bitfield {
+	return &Bitfield{words: make([]uint64, (length+63)/64), length: length}
+}
+
+// NewBitfieldForInfo returns an empty bitfield with a bit for each piece of a torrent
+func NewBitfieldForInfo(info *Info) *Bitfield {
+	return NewBitfield(info.NumPieces())
+}
+
+// ParseBitfield reads a bitfield in the wire format, which must have exactly enough bytes for the
+// pieces and none of the spare bits at the end set
+func ParseBitfield(data []byte, length int) (*Bitfield, error) {
+	if len(data) != (length+7)/8 {
+		return nil, ErrBitfieldLength
+	}
+
+	b := NewBitfield(length)
+	for i, value := range data {
+		b.words[i/8] |= uint64(value) << uint(56-8*(i%8))
+	}
+	if len(b.words) > 0 && b.words[len(b.words)-1]&^b.lastWordMask() != 0 {
+		return nil, ErrBitfieldSpare
+	}
+	return b, nil
+}
+
+// Public Methods
+
+func (b *Bitfield) Len() int {
+	return b.length
+}
+
+func (b *Bitfield) Set(index int) {
+	b.check(index)
+	b.words[index/64] |= 1 << uint(63-index%64)
+}
+
+func (b *Bitfield) Clear(index int) {
+	b.check(index)
+	b.words[index/64] &^= 1 << uint(63-index%64)
+}
+
+// Test reports whether a bit is set. Indexes outside the bitfield are never set.
+func (b *Bitfield) Test(index int) bool {
+	if index < 0 || index >= b.length {
+		return false
+	}
+	return b.words[index/64]&(1<<uint(63-index%64)) != 0
+}
+
+func (b *Bitfield) SetAll() {
+	for i := range b.words {
+		b.words[i] = ^uint64(0)
+	}
+	b.trim()
+}
+
+func (b *Bitfield) ClearAll() {
+	for i := range b.words {
+		b.words[i] = 0
+	}
+}
+
+// Count returns how many bits are set
+func (b *Bitfield) Count() int {
+	count := 0
+	for _, word := range b.words {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+func (b *Bitfield) All() bool {
+	return b.Count() == b.length
+}
+
+func (b *Bitfield) None() bool {
+	for _, word := range b.words {
+		if word != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// NextSet returns the first set bit at or after index, or -1 if there are none. Iterate over set
+// bits with:
+//
+//	for i := b.NextSet(0); i >= 0; i = b.NextSet(i + 1) {}
+func (b *Bitfield) NextSet(index int) int {
+	return b.next(index, 0)
+}
+
+// NextClear returns the first clear bit at or after index, or -1 if there are none
+func (b *Bitfield) NextClear(index int) int {
+	return b.next(index, ^uint64(0))
+}
+
+// And clears every bit which isn't also set in other
+func (b *Bitfield) And(other *Bitfield) {
+	b.checkLength(other)
+	for i := range b.words {
+		b.words[i] &= other.words[i]
+	}
+}
+
+// AndNot clears every bit which is set in other
+func (b *Bitfield) AndNot(other *Bitfield) {
+	b.checkLength(other)
+	for i := range b.words {
+		b.words[i] &^= other.words[i]
+	}
+}
+
+// Or sets every bit which is set in other
+func (b *Bitfield) Or(other *Bitfield) {
+	b.checkLength(other)
+	for i := range b.words {
+		b.words[i] |= other.words[i]
+	}
+}
+
+func (b *Bitfield) Equal(other *Bitfield) bool {
+	if b.length != other.length {
+		return false
+	}
+	for i := range b.words {
+		if b.words[i] != other.words[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Bitfield) Copy() *Bitfield {
+	return &Bitfield{words: append([]uint64{}, b.words...), length: b.length}
+}
+
+// Bytes returns the bitfield in the wire format
+func (b *Bitfield) Bytes() []byte {
+	data := make([]byte, len(b.words)*8)
+	for i, word := range b.words {
+		binary.BigEndian.PutUint64(data[i*8:], word)
+	}
+	return data[:(b.length+7)/8]
+}
+
+// EncodeRuns returns the bitfield as the lengths of alternating runs of clear and set bits,
+// starting with clear, each as a varint. Resume data is mostly long runs so this is far smaller
+// than the bitfield itself.
+func (b *Bitfield) EncodeRuns() []byte {
+	data := make([]byte, 0, 16)
+	set := false
+	for index := 0; index < b.length; {
+		var end int
+		if set {
+			end = b.NextClear(index)
+		} else {
+			end = b.NextSet(index)
+		}
+		if end < 0 {
+			end = b.length
+		}
+		data = binary.AppendUvarint(data, uint64(end-index))
+		index = end
+		set = !set
+	}
+	return data
+}
+
+// DecodeRuns reads a bitfield written by EncodeRuns
+func DecodeRuns(data []byte, length int) (*Bitfield, error) {
+	b := NewBitfield(length)
+	set := false
+	index := 0
+	for len(data) > 0 {
+		run, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, fmt.Errorf("Bitfield runs are malformed")
+		}
+		data = data[n:]
+		if run > uint64(length-index) {
+			return nil, ErrBitfieldLength
+		}
+		if set {
+			b.setRange(index, index+int(run))
+		}
+		index += int(run)
+		set = !set
+	}
+	if index != length {
+		return nil, ErrBitfieldLength
+	}
+	return b, nil
+}
+
+func (b *Bitfield) String() string {
+	return fmt.Sprintf("%v/%v %x", b.Count(), b.length, b.Bytes())
+}
+
+// Helpers
+
+// next finds the first bit at or after index which differs from the bits in flip
+func (b *Bitfield) next(index int, flip uint64) int {
+	if index < 0 {
+		index = 0
+	}
+	if index >= b.length {
+		return -1
+	}
+
+	i := index / 64
+	word := (b.words[i] ^ flip) & (^uint64(0) >> uint(index%64))
+	for {
+		if i == len(b.words)-1 {
+			word &= b.lastWordMask()
+		}
+		if word != 0 {
+			return i*64 + bits.LeadingZeros64(word)
+		}
+		i++
+		if i == len(b.words) {
+			return -1
+		}
+		word = b.words[i] ^ flip
+	}
+}
+
+func (b *Bitfield) setRange(begin int, end int) {
+	for index := begin; index < end; {
+		if index%64 == 0 && end-index >= 64 {
+			b.words[index/64] = ^uint64(0)
+			index += 64
+			continue
+		}
+		b.Set(index)
+		index++
+	}
+}
+
+// lastWordMask has the bits of the final word which are in use
+func (b *Bitfield) lastWordMask() uint64 {
+	if b.length%64 == 0 {
+		return ^uint64(0)
+	}
+	return ^(^uint64(0) >> uint(b.length%64))
+}
+
+func (b *Bitfield) trim() {
+	if len(b.words) > 0 {
+		b.words[len(b.words)-1] &= b.lastWordMask()
+	}
+}
+
+func (b *Bitfield) check(index int) {
+	if index < 0 || index >= b.length {
+		panic(fmt.Sprintf("Bitfield index %v out of range for length %v", index, b.length))
+	}
+}
+
+func (b *Bitfield) checkLength(other *Bitfield) {
+	if b.length != other.length {
+		panic(fmt.Sprintf("Bitfield lengths %v and %v differ", b.length, other.length))
+	}
+}
@@ -0,0 +1,260 @@
+package model
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+const (
+	benchmarkPieces = 500000
+)
+
+func TestBitfieldSetClearTest(t *testing.T) {
+	b := NewBitfield(70)
+	b.Set(0)
+	b.Set(63)
+	b.Set(64)
+	b.Set(69)
+	b.Set(10)
+	b.Clear(10)
+
+	for index := 0; index < 70; index++ {
+		expected := index == 0 || index == 63 || index == 64 || index == 69
+		if b.Test(index) != expected {
+			t.Errorf("Expected bit %v to be %v", index, expected)
+		}
+	}
+	if b.Test(-1) || b.Test(70) {
+		t.Errorf("Expected bits out of range not to be set")
+	}
+	if b.Count() != 4 || b.Len() != 70 || b.All() || b.None() {
+		t.Errorf("Unexpected count %v of %v", b.Count(), b.Len())
+	}
+
+	b.SetAll()
+	if !b.All() || b.Count() != 70 {
+		t.Errorf("Expected all 70 bits set but was %v", b.Count())
+	}
+	b.ClearAll()
+	if !b.None() {
+		t.Errorf("Expected no bits set")
+	}
+}
+
+func TestBitfieldSetOutOfRangePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected setting a bit out of range to panic")
+		}
+	}()
+	NewBitfield(8).Set(8)
+}
+
+func TestBitfieldIteration(t *testing.T) {
+	b := NewBitfield(200)
+	expected := []int{3, 64, 65, 127, 199}
+	for _, index := range expected {
+		b.Set(index)
+	}
+
+	set := make([]int, 0)
+	for i := b.NextSet(0); i >= 0; i = b.NextSet(i + 1) {
+		set = append(set, i)
+	}
+	if !equalInts(set, expected) {
+		t.Errorf("Expected set bits %v but was %v", expected, set)
+	}
+
+	clear := 0
+	for i := b.NextClear(0); i >= 0; i = b.NextClear(i + 1) {
+		if b.Test(i) {
+			t.Errorf("Expected bit %v to be clear", i)
+		}
+		clear++
+	}
+	if clear != 195 {
+		t.Errorf("Expected 195 clear bits but was %v", clear)
+	}
+
+	b.SetAll()
+	if b.NextClear(0) != -1 || b.NextSet(200) != -1 {
+		t.Errorf("Expected no clear bits in a full bitfield")
+	}
+}
+
+func TestBitfieldSetOperations(t *testing.T) {
+	a := bitfieldOf(10, 1, 2, 3)
+	b := bitfieldOf(10, 2, 3, 4)
+
+	and := a.Copy()
+	and.And(b)
+	if !and.Equal(bitfieldOf(10, 2, 3)) {
+		t.Errorf("Unexpected and %v", and)
+	}
+
+	andNot := a.Copy()
+	andNot.AndNot(b)
+	if !andNot.Equal(bitfieldOf(10, 1)) {
+		t.Errorf("Unexpected and not %v", andNot)
+	}
+
+	or := a.Copy()
+	or.Or(b)
+	if !or.Equal(bitfieldOf(10, 1, 2, 3, 4)) {
+		t.Errorf("Unexpected or %v", or)
+	}
+	if !a.Equal(bitfieldOf(10, 1, 2, 3)) {
+		t.Errorf("Expected copy to leave the original alone")
+	}
+}
+
+func TestBitfieldWireFormat(t *testing.T) {
+	b := bitfieldOf(20, 0, 15, 19)
+	if !bytes.Equal(b.Bytes(), []byte{0x80, 0x01, 0x10}) {
+		t.Errorf("Unexpected wire format %x", b.Bytes())
+	}
+
+	parsed, err := ParseBitfield([]byte{0x80, 0x01, 0x10}, 20)
+	if err != nil || !parsed.Equal(b) {
+		t.Errorf("Expected parsed bitfield to match but was %v %v", parsed, err)
+	}
+
+	if _, err := ParseBitfield([]byte{0, 0, 0x08}, 20); err != ErrBitfieldSpare {
+		t.Errorf("Expected spare bit error but was %v", err)
+	}
+	if _, err := ParseBitfield([]byte{0, 0}, 20); err != ErrBitfieldLength {
+		t.Errorf("Expected length error but was %v", err)
+	}
+	if _, err := ParseBitfield([]byte{0, 0, 0, 0}, 20); err != ErrBitfieldLength {
+		t.Errorf("Expected length error but was %v", err)
+	}
+
+	large := NewBitfield(1000)
+	large.Set(999)
+	if parsed, err := ParseBitfield(large.Bytes(), 1000); err != nil || !parsed.Equal(large) {
+		t.Errorf("Expected large bitfield to round trip %v", err)
+	}
+}
+
+func TestBitfieldRuns(t *testing.T) {
+	b := NewBitfield(1000)
+	for index := 100; index < 900; index++ {
+		b.Set(index)
+	}
+	b.Clear(500)
+
+	runs := b.EncodeRuns()
+	if len(runs) > 10 {
+		t.Errorf("Expected a handful of bytes for long runs but was %v", len(runs))
+	}
+	decoded, err := DecodeRuns(runs, 1000)
+	if err != nil || !decoded.Equal(b) {
+		t.Errorf("Expected runs to decode to the same bitfield %v", err)
+	}
+
+	full := NewBitfield(130)
+	full.SetAll()
+	if decoded, err := DecodeRuns(full.EncodeRuns(), 130); err != nil || !decoded.All() {
+		t.Errorf("Expected full bitfield to round trip %v", err)
+	}
+	if decoded, err := DecodeRuns(NewBitfield(0).EncodeRuns(), 0); err != nil || decoded.Len() != 0 {
+		t.Errorf("Expected empty bitfield to round trip %v", err)
+	}
+
+	if _, err := DecodeRuns(runs, 999); err != ErrBitfieldLength {
+		t.Errorf("Expected runs for a longer bitfield to fail but was %v", err)
+	}
+	if _, err := DecodeRuns(runs, 1001); err != ErrBitfieldLength {
+		t.Errorf("Expected runs for a shorter bitfield to fail but was %v", err)
+	}
+	if _, err := DecodeRuns([]byte{0x80}, 10); err == nil {
+		t.Errorf("Expected truncated varint to fail")
+	}
+}
+
+func TestBitfieldForInfo(t *testing.T) {
+	info := NewInfo(10, make([]byte, 20*7), 0, []*File{NewFile("a", 70, "")}, "", nil)
+	if NewBitfieldForInfo(info).Len() != 7 {
+		t.Errorf("Expected a bit per piece")
+	}
+}
+
+func BenchmarkBitfieldCount(b *testing.B) {
+	bitfield := randomBitfield()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bitfield.Count()
+	}
+}
+
+func BenchmarkBitfieldIterateSet(b *testing.B) {
+	bitfield := randomBitfield()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for index := bitfield.NextSet(0); index >= 0; index = bitfield.NextSet(index + 1) {
+		}
+	}
+}
+
+func BenchmarkBitfieldAndNot(b *testing.B) {
+	bitfield := randomBitfield()
+	other := randomBitfield()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bitfield.AndNot(other)
+	}
+}
+
+func BenchmarkBitfieldParse(b *testing.B) {
+	data := randomBitfield().Bytes()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ParseBitfield(data, benchmarkPieces)
+	}
+}
+
+func BenchmarkBitfieldEncodeRuns(b *testing.B) {
+	bitfield := NewBitfield(benchmarkPieces)
+	random := rand.New(rand.NewSource(1))
+	for index := 0; index < benchmarkPieces; index += random.Intn(5000) + 1 {
+		bitfield.setRange(index, min(benchmarkPieces, index+random.Intn(5000)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bitfield.EncodeRuns()
+	}
+}
+
+// Helpers
+
+func bitfieldOf(length int, indexes ...int) *Bitfield {
+	b := NewBitfield(length)
+	for _, index := range indexes {
+		b.Set(index)
+	}
+	return b
+}
+
+func randomBitfield() *Bitfield {
+	random := rand.New(rand.NewSource(1))
+	b := NewBitfield(benchmarkPieces)
+	for index := 0; index < benchmarkPieces; index++ {
+		if random.Intn(2) == 0 {
+			b.Set(index)
+		}
+	}
+	return b
+}
+
+func equalInts(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,31 @@
+package model
+
+import (
+	"net/url"
+)
+
+// TYPES
+
+// Magnet is a magnet link (BEP 9), which identifies a torrent by its info hash. The info has to
+// be fetched from peers before the torrent can be downloaded.
+type Magnet struct {
+	// InfoHash is nil for links to mutable torrents until it is looked up in the DHT
+	InfoHash []byte
+	// PublicKey and Salt identify a mutable torrent (BEP 46), whose current info hash is published
+	// in the DHT
+	PublicKey []byte
+	Salt      []byte
+	// Name is the display name suggested by the link, which may be empty
+	Name     string
+	Trackers []*url.URL
+	// Peers are addresses of peers given by the link to fetch the info from
+	Peers []string
+}
+
+// PUBLIC METHODS
+
+// MetaInfo returns the meta info for the magnet's torrent once its info has been fetched, with the
+// magnet's trackers as a single announce tier
+func (magnet *Magnet) MetaInfo(info *Info) *MetaInfo {
+	return &MetaInfo{AnnounceUrls: magnet.Trackers, Info: info}
+}
@@ -1,7 +1,10 @@
 package model
 
 import (
+	"fmt"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
@@ -9,6 +12,7 @@ import (
 
 type MetaInfo struct {
 	AnnounceUrls []*url.URL
+	AnnounceList [][]*url.URL
 	CreationDate time.Time
 	Comment      string
 	CreatedBy    string
@@ -29,6 +33,9 @@ type Info struct {
 	Files         []*File
 	DirectoryName string
 	Hash          []byte
+	// Raw is the bencoded info dictionary the info was parsed from, which is what peers fetching
+	// the metadata are sent (BEP 9). It is nil for infos which weren't parsed.
+	Raw []byte
 }
 
 type File struct {
@@ -40,12 +47,13 @@ type File struct {
 // INITIALISATION
 
 func NewMetaInfo(announceUrls []*url.URL,
+	announceList [][]*url.URL,
 	creationDate time.Time,
 	comment string,
 	createdBy string,
 	encoding string,
 	info *Info) *MetaInfo {
-	return &MetaInfo{announceUrls, creationDate, comment, createdBy, encoding, info}
+	return &MetaInfo{announceUrls, announceList, creationDate, comment, createdBy, encoding, info}
 }
 
 func NewInfo(pieceLength int,
@@ -54,9 +62,114 @@ func NewInfo(pieceLength int,
 	files []*File,
 	directoryName string,
 	hash []byte) *Info {
-	return &Info{pieceLength, pieces, private, files, directoryName, hash}
+	return &Info{PieceLength: pieceLength, Pieces: pieces, Private: private, Files: files, DirectoryName: directoryName, Hash: hash}
 }
 
 func NewFile(path string, length int, md5Sum string) *File {
 	return &File{path, length, md5Sum}
 }
+
+// PUBLIC METHODS
+
+// AnnounceTiers returns the BEP 12 announce-list tiers, or a single tier holding the announce URLs
+// when the torrent has no announce-list.
+func (metaInfo *MetaInfo) AnnounceTiers() [][]*url.URL {
+	if len(metaInfo.AnnounceList) > 0 {
+		return metaInfo.AnnounceList
+	}
+	return [][]*url.URL{metaInfo.AnnounceUrls}
+}
+
+// IsPrivate reports whether the torrent is private (BEP 27). Peers for private torrents must only
+// come from their trackers, so DHT, peer exchange and local service discovery are not used.
+func (info *Info) IsPrivate() bool {
+	return info.Private == 1
+}
+
+// NumPieces returns how many pieces the torrent is split into
+func (info *Info) NumPieces() int {
+	return len(info.Pieces) / 20
+}
+
+// TotalLength returns the length of all the files together
+func (info *Info) TotalLength() int64 {
+	total := int64(0)
+	for _, file := range info.Files {
+		total += int64(file.Length)
+	}
+	return total
+}
+
+// Validate checks the piece geometry is consistent: a positive piece length, whole piece hashes,
+// no negative file lengths and exactly enough pieces for the files
+func (info *Info) Validate() error {
+	if info.PieceLength <= 0 {
+		return fmt.Errorf("Piece length %v is not positive", info.PieceLength)
+	}
+	if len(info.Pieces)%20 != 0 {
+		return fmt.Errorf("Pieces length %v is not a multiple of 20", len(info.Pieces))
+	}
+	for _, file := range info.Files {
+		if file.Length < 0 {
+			return fmt.Errorf("File %v has negative length %v", file.Path, file.Length)
+		}
+	}
+	pieceLength := int64(info.PieceLength)
+	if expected := (info.TotalLength() + pieceLength - 1) / pieceLength; int64(info.NumPieces()) != expected {
+		return fmt.Errorf("Torrent has %v pieces but its length needs %v", info.NumPieces(), expected)
+	}
+	return nil
+}
+
+// PieceSize returns the length of a piece, which is PieceLength for all but the last piece. It is
+// never negative, even for an info which fails Validate.
+func (info *Info) PieceSize(index int) int {
+	if index < 0 || index >= info.NumPieces() {
+		return 0
+	}
+	if index < info.NumPieces()-1 {
+		return info.PieceLength
+	}
+	return int(max(info.TotalLength()-int64(index)*int64(info.PieceLength), 0))
+}
+
+// PieceHash returns the SHA-1 hash a piece must match
+func (info *Info) PieceHash(index int) []byte {
+	return info.Pieces[index*20 : (index+1)*20]
+}
+
+// FilePieces returns the range of pieces [begin, end) which hold some of a file. The range is
+// empty for files with no length.
+func (info *Info) FilePieces(file int) (int, int) {
+	offset := info.FileOffset(file)
+	length := int64(info.Files[file].Length)
+	begin := int(offset / int64(info.PieceLength))
+	if length == 0 {
+		return begin, begin
+	}
+	return begin, int((offset+length-1)/int64(info.PieceLength)) + 1
+}
+
+// FileOffset returns where a file starts in the torrent's data
+func (info *Info) FileOffset(file int) int64 {
+	offset := int64(0)
+	for i := 0; i < file; i++ {
+		offset += int64(info.Files[i].Length)
+	}
+	return offset
+}
+
+// FilePath returns where a file is stored relative to the download directory. Paths which would
+// escape the download directory are refused.
+func (info *Info) FilePath(file int) (string, error) {
+	parts := strings.Split(info.Files[file].Path, "/")
+	if info.DirectoryName != "" {
+		parts = append([]string{info.DirectoryName}, parts...)
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+			return "", fmt.Errorf("Unsafe file path %q in torrent", info.Files[file].Path)
+		}
+	}
+	return filepath.Join(parts...), nil
+}
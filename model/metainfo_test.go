@@ -0,0 +1,86 @@
+package model
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestInfoGeometry(t *testing.T) {
+	files := []*File{NewFile("a", 100, ""), NewFile("empty", 0, ""), NewFile("b", 60, ""), NewFile("c", 50, "")}
+	pieces := bytes.Repeat([]byte{1}, 20*5)
+	copy(pieces[40:60], bytes.Repeat([]byte{3}, 20))
+	info := NewInfo(50, pieces, 0, files, "dir", nil)
+
+	if info.NumPieces() != 5 {
+		t.Errorf("Expected 5 pieces but was %v", info.NumPieces())
+	}
+	if info.TotalLength() != 210 {
+		t.Errorf("Expected total length 210 but was %v", info.TotalLength())
+	}
+	if info.PieceSize(0) != 50 || info.PieceSize(4) != 10 || info.PieceSize(5) != 0 {
+		t.Errorf("Unexpected piece sizes %v %v %v", info.PieceSize(0), info.PieceSize(4), info.PieceSize(5))
+	}
+	if !bytes.Equal(info.PieceHash(2), bytes.Repeat([]byte{3}, 20)) {
+		t.Errorf("Unexpected hash for piece 2 %x", info.PieceHash(2))
+	}
+
+	expected := [][2]int{{0, 2}, {2, 2}, {2, 4}, {3, 5}}
+	for file, pieceRange := range expected {
+		begin, end := info.FilePieces(file)
+		if begin != pieceRange[0] || end != pieceRange[1] {
+			t.Errorf("Expected file %v to cover pieces %v but was [%v, %v)", file, pieceRange, begin, end)
+		}
+	}
+}
+
+func TestInfoValidate(t *testing.T) {
+	hashes := func(count int) []byte { return make([]byte, 20*count) }
+	valid := NewInfo(50, hashes(3), 0, []*File{NewFile("a", 100, ""), NewFile("b", 1, "")}, "dir", nil)
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Unexpected error validating info %v", err)
+	}
+	if err := NewInfo(50, nil, 0, []*File{NewFile("empty", 0, "")}, "", nil).Validate(); err != nil {
+		t.Errorf("Unexpected error validating an empty torrent %v", err)
+	}
+
+	for name, info := range map[string]*Info{
+		"zero piece length": NewInfo(0, hashes(1), 0, []*File{NewFile("a", 10, "")}, "", nil),
+		"partial hash":      NewInfo(16, make([]byte, 30), 0, []*File{NewFile("a", 10, "")}, "", nil),
+		"negative length":   NewInfo(16, hashes(1), 0, []*File{NewFile("a", 20, ""), NewFile("b", -10, "")}, "", nil),
+		"too many pieces":   NewInfo(16384, hashes(2), 0, []*File{NewFile("a", 10, "")}, "", nil),
+		"too few pieces":    NewInfo(16, hashes(1), 0, []*File{NewFile("a", 17, "")}, "", nil),
+	} {
+		if err := info.Validate(); err == nil {
+			t.Errorf("Expected an error validating an info with %v", name)
+		}
+	}
+
+	tooMany := NewInfo(16384, hashes(2), 0, []*File{NewFile("a", 10, "")}, "", nil)
+	if size := tooMany.PieceSize(1); size != 0 {
+		t.Errorf("Expected a piece past the data to be empty but was %v", size)
+	}
+}
+
+func TestInfoFilePaths(t *testing.T) {
+	files := []*File{NewFile("a/b.txt", 10, ""), NewFile("c", 5, ""), NewFile("../escape", 1, ""), NewFile("d//e", 1, "")}
+	info := NewInfo(16, make([]byte, 20), 0, files, "dir", nil)
+
+	if path, err := info.FilePath(0); err != nil || path != filepath.Join("dir", "a", "b.txt") {
+		t.Errorf("Unexpected path %v %v", path, err)
+	}
+	if info.FileOffset(1) != 10 || info.FileOffset(0) != 0 {
+		t.Errorf("Unexpected file offsets %v %v", info.FileOffset(0), info.FileOffset(1))
+	}
+	if _, err := info.FilePath(2); err == nil {
+		t.Errorf("Expected path escaping the directory to be refused")
+	}
+	if _, err := info.FilePath(3); err == nil {
+		t.Errorf("Expected path with an empty part to be refused")
+	}
+
+	single := NewInfo(16, make([]byte, 20), 0, []*File{NewFile("single.iso", 10, "")}, "", nil)
+	if path, err := single.FilePath(0); err != nil || path != "single.iso" {
+		t.Errorf("Unexpected single file path %v %v", path, err)
+	}
+}
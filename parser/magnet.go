@@ -0,0 +1,97 @@
+package parser
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"net/url"
+	"strings"
+)
+
+const (
+	MAGNET_SCHEME = "magnet"
+	// The exact topic prefix of BitTorrent info hashes
+	BTIH_PREFIX = "urn:btih:"
+	// The exact source prefix of mutable torrents' public keys (BEP 46)
+	BTPK_PREFIX = "urn:btpk:"
+)
+
+// Public parser func
+
+// ParseMagnet parses a magnet link (BEP 9). The info hash may be given in hex or base32. Links to
+// mutable torrents give a public key and salt instead (BEP 46). Trackers which aren't valid URLs
+// are skipped.
+func ParseMagnet(link string) (*model.Magnet, error) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse magnet link - %v", err)
+	}
+	if parsed.Scheme != MAGNET_SCHEME {
+		return nil, fmt.Errorf("Expected magnet link but scheme was '%v'", parsed.Scheme)
+	}
+	query, err := url.ParseQuery(parsed.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse magnet link - %v", err)
+	}
+
+	magnet := &model.Magnet{Name: query.Get("dn"), Peers: query["x.pe"]}
+	for _, topic := range query["xt"] {
+		if strings.HasPrefix(topic, BTIH_PREFIX) {
+			magnet.InfoHash, err = parseInfoHash(strings.TrimPrefix(topic, BTIH_PREFIX))
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	for _, source := range query["xs"] {
+		if strings.HasPrefix(source, BTPK_PREFIX) {
+			magnet.PublicKey, err = parsePublicKey(strings.TrimPrefix(source, BTPK_PREFIX))
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	if salt := query.Get("s"); salt != "" {
+		if magnet.Salt, err = hex.DecodeString(salt); err != nil {
+			return nil, fmt.Errorf("Invalid salt '%v' in magnet link", salt)
+		}
+	}
+	if magnet.InfoHash == nil && magnet.PublicKey == nil {
+		return nil, fmt.Errorf("Magnet link has no BitTorrent info hash or public key")
+	}
+
+	for _, tracker := range query["tr"] {
+		if trackerUrl, err := url.Parse(tracker); err == nil && trackerUrl.Scheme != "" {
+			magnet.Trackers = append(magnet.Trackers, trackerUrl)
+		}
+	}
+	return magnet, nil
+}
+
+// Helpers
+
+func parseInfoHash(hash string) ([]byte, error) {
+	switch len(hash) {
+	case 40:
+		if decoded, err := hex.DecodeString(hash); err == nil {
+			return decoded, nil
+		}
+	case 32:
+		if decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(hash)); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid info hash '%v' in magnet link", hash)
+}
+
+// parsePublicKey reads a mutable torrent's ed25519 public key, given in hex
+func parsePublicKey(key string) ([]byte, error) {
+	decoded, err := hex.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return nil, fmt.Errorf("Invalid public key '%v' in magnet link", key)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,76 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	link := "magnet:?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a&dn=Example+Torrent" +
+		"&tr=udp%3A%2F%2Ftracker.example.com%3A80&tr=http%3A%2F%2Ftracker.example.org%2Fannounce&tr=%3Ajunk" +
+		"&x.pe=10.0.0.1%3A6881"
+	magnet, err := ParseMagnet(link)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing magnet link %v", err)
+	}
+
+	expectedHash, _ := hex.DecodeString("c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	if !bytes.Equal(magnet.InfoHash, expectedHash) {
+		t.Errorf("Expected info hash %x but was %x", expectedHash, magnet.InfoHash)
+	}
+	if magnet.Name != "Example Torrent" {
+		t.Errorf("Expected name 'Example Torrent' but was '%v'", magnet.Name)
+	}
+	if len(magnet.Trackers) != 2 || magnet.Trackers[0].String() != "udp://tracker.example.com:80" || magnet.Trackers[1].String() != "http://tracker.example.org/announce" {
+		t.Errorf("Unexpected trackers %v", magnet.Trackers)
+	}
+	if !reflect.DeepEqual(magnet.Peers, []string{"10.0.0.1:6881"}) {
+		t.Errorf("Unexpected peers %v", magnet.Peers)
+	}
+
+	tiers := magnet.MetaInfo(nil).AnnounceTiers()
+	if len(tiers) != 1 || len(tiers[0]) != 2 {
+		t.Errorf("Expected the trackers to be a single announce tier but was %v", tiers)
+	}
+}
+
+func TestParseMagnetBase32InfoHash(t *testing.T) {
+	magnet, err := ParseMagnet("magnet:?xt=urn:btih:YEX6DQDLXISUVHOJ6UM3GNNKPQJWPKEK")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing magnet link %v", err)
+	}
+	expectedHash, _ := hex.DecodeString("c12fe1c06bba254a9dc9f519b335aa7c1367a88a")
+	if !bytes.Equal(magnet.InfoHash, expectedHash) {
+		t.Errorf("Expected info hash %x but was %x", expectedHash, magnet.InfoHash)
+	}
+}
+
+func TestParseMutableTorrentMagnet(t *testing.T) {
+	key := "8543d3e6115f0f98c944077a4493dcd543e49c739fd998550a1f614ab36ed63e"
+	magnet, err := ParseMagnet("magnet:?xs=urn:btpk:" + key + "&s=6e")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing magnet link %v", err)
+	}
+	expectedKey, _ := hex.DecodeString(key)
+	if magnet.InfoHash != nil || !bytes.Equal(magnet.PublicKey, expectedKey) || !bytes.Equal(magnet.Salt, []byte("n")) {
+		t.Errorf("Unexpected info hash %x, public key %x or salt %x", magnet.InfoHash, magnet.PublicKey, magnet.Salt)
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	links := []string{
+		"http://example.com/?xt=urn:btih:c12fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?dn=nohash",
+		"magnet:?xt=urn:btih:c12fe1",
+		"magnet:?xt=urn:btih:zz2fe1c06bba254a9dc9f519b335aa7c1367a88a",
+		"magnet:?xs=urn:btpk:8543d3e6115f0f98",
+		"magnet:?xs=urn:btpk:8543d3e6115f0f98c944077a4493dcd543e49c739fd998550a1f614ab36ed63e&s=zz",
+	}
+	for _, link := range links {
+		if _, err := ParseMagnet(link); err == nil {
+			t.Errorf("Expected an error parsing %v", link)
+		}
+	}
+}
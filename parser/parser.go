@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"github.com/onepointsixtwo/torrentsgo/bencoding"
@@ -27,6 +28,17 @@ func ParseMetaInfo(reader io.Reader) (*model.MetaInfo, error) {
 	return parseMetaInfoFromDecodedData(decoded)
 }
 
+// ParseInfo parses a bencoded info dictionary on its own, such as metadata fetched from peers for
+// a magnet link. The info hash is the hash of data as given.
+func ParseInfo(data []byte) (*model.Info, error) {
+	infoData, err := bencoding.DecodeBencoding(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode bencoded info - %v", err)
+	}
+
+	return parseInfoDictionary(infoData, data)
+}
+
 // MetaInfo parsing
 
 func parseMetaInfoFromDecodedData(data *model.OrderedMap) (*model.MetaInfo, error) {
@@ -34,6 +46,7 @@ func parseMetaInfoFromDecodedData(data *model.OrderedMap) (*model.MetaInfo, erro
 	if announceUrlsError != nil {
 		return nil, announceUrlsError
 	}
+	announceList := parseAnnounceListFromDecodedData(data)
 	creationDate := parseCreationDateFromDecodedData(data)
 	comment := parseCommentFromDecodedData(data)
 	createdBy := parseCreatedByFromDecodedData(data)
@@ -43,12 +56,12 @@ func parseMetaInfoFromDecodedData(data *model.OrderedMap) (*model.MetaInfo, erro
 		return nil, err
 	}
 
-	return model.NewMetaInfo(announceUrls, creationDate, comment, createdBy, encoding, info), nil
+	return model.NewMetaInfo(announceUrls, announceList, creationDate, comment, createdBy, encoding, info), nil
 }
 
 func parseAnnounceUrlsFromDecodedData(data *model.OrderedMap) ([]*url.URL, error) {
-	// NOTE: this is currently not supporting the newer file extension of 'announce-list' in addition to announce,
-	// but intentionally returns array of URLs so this can easily be supported later
+	// NOTE: the tiers from the newer 'announce-list' extension are parsed separately, see
+	// parseAnnounceListFromDecodedData
 	announce, err := readStringValueFromMap(data, "announce")
 	if err != nil {
 		return nil, err
@@ -64,6 +77,38 @@ func parseAnnounceUrlsFromDecodedData(data *model.OrderedMap) ([]*url.URL, error
 	return urls, nil
 }
 
+func parseAnnounceListFromDecodedData(data *model.OrderedMap) [][]*url.URL {
+	tiersList, err := readListFromMap(data, "announce-list")
+	if err != nil {
+		return nil
+	}
+
+	tiers := make([][]*url.URL, 0)
+	for _, maybeTier := range tiersList {
+		tierList, ok := maybeTier.([]interface{})
+		if !ok {
+			continue
+		}
+
+		tier := make([]*url.URL, 0)
+		for _, maybeUrl := range tierList {
+			str, ok := maybeUrl.(string)
+			if !ok {
+				continue
+			}
+			u, err := url.Parse(str)
+			if err == nil {
+				tier = append(tier, u)
+			}
+		}
+
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	return tiers
+}
+
 func parseCreationDateFromDecodedData(data *model.OrderedMap) time.Time {
 	timestamp, _ := readIntValueFromMap(data, "creation date")
 	return time.Unix(int64(timestamp), 0)
@@ -92,11 +137,16 @@ func parseInfoFromDecodedData(data *model.OrderedMap) (*model.Info, error) {
 		return nil, err
 	}
 
-	hash, hashErr := hashFromInfoDictionary(infoData)
-	if hashErr != nil {
-		return nil, hashErr
+	raw, encodingErr := bencoding.EncodeBencoding(infoData)
+	if encodingErr != nil {
+		return nil, encodingErr
 	}
 
+	return parseInfoDictionary(infoData, raw)
+}
+
+// parseInfoDictionary parses the decoded info dictionary, where raw is its bencoded form
+func parseInfoDictionary(infoData *model.OrderedMap, raw []byte) (*model.Info, error) {
 	pieceLength, errPieceLength := parsePieceLengthFromDecodedInfoData(infoData)
 	if errPieceLength != nil {
 		return nil, errPieceLength
@@ -115,18 +165,13 @@ func parseInfoFromDecodedData(data *model.OrderedMap) (*model.Info, error) {
 		return nil, directoryNameError
 	}
 
-	return model.NewInfo(pieceLength, pieces, private, files, directoryName, hash), nil
-}
-
-func hashFromInfoDictionary(data *model.OrderedMap) ([]byte, error) {
-	bytes, encodingErr := bencoding.EncodeBencoding(data)
-	if encodingErr != nil {
-		return nil, encodingErr
+	hash := sha1.Sum(raw)
+	info := model.NewInfo(pieceLength, pieces, private, files, directoryName, hash[:])
+	info.Raw = raw
+	if err := info.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid info dictionary - %v", err)
 	}
-
-	hash := sha1.New()
-	hash.Write(bytes)
-	return hash.Sum(nil), nil
+	return info, nil
 }
 
 func parsePieceLengthFromDecodedInfoData(infoData *model.OrderedMap) (int, error) {
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -24,6 +25,11 @@ func TestWithSingleFileTorrentFile(t *testing.T) {
 		t.Errorf("Unexpected announce URL found for single file torrent announce: %v", announce)
 	}
 
+	tiers := metaInfo.AnnounceTiers()
+	if len(tiers) != 1 || len(tiers[0]) != 1 || tiers[0][0] != announce {
+		t.Errorf("Expected single announce tier holding the announce URL but was %v", tiers)
+	}
+
 	creationDate := metaInfo.CreationDate.Unix()
 	if creationDate != 1537299287 {
 		t.Errorf("Expected creation date to be 1537299287 but was %v", creationDate)
@@ -47,6 +53,9 @@ func TestWithSingleFileTorrentFile(t *testing.T) {
 	if private != 1 {
 		t.Errorf("Expected private to be 1 but was %v", private)
 	}
+	if !info.IsPrivate() {
+		t.Errorf("Expected single file torrent to be private")
+	}
 
 	directoryName := info.DirectoryName
 	if directoryName != "" {
@@ -90,6 +99,13 @@ func TestWithMultiFileTorrentFile(t *testing.T) {
 		t.Errorf("Unexpected announce URL found for multi file torrent announce: %v", announce)
 	}
 
+	tiers := metaInfo.AnnounceTiers()
+	if len(tiers) != 5 {
+		t.Errorf("Expected 5 announce tiers but was %v", len(tiers))
+	} else if tiers[1][0].String() != "udp://9.rarbg.to:2710/announce" {
+		t.Errorf("Unexpected second announce tier %v", tiers[1])
+	}
+
 	creationDate := metaInfo.CreationDate.Unix()
 	if creationDate != 1536553238 {
 		t.Errorf("Expected creation date to be 1536553238 but was %v", creationDate)
@@ -113,6 +129,9 @@ func TestWithMultiFileTorrentFile(t *testing.T) {
 	if private != 0 {
 		t.Errorf("Expected private to be 0 but was %v", private)
 	}
+	if info.IsPrivate() {
+		t.Errorf("Expected multi file torrent not to be private")
+	}
 
 	directoryName := info.DirectoryName
 	if directoryName != "KJV" {
@@ -137,3 +156,30 @@ func TestWithMultiFileTorrentFile(t *testing.T) {
 		t.Errorf("Expected third filepath to be 'Recordings/1 Chronicles 1.mp3' but was '%v'", thirdFilePath)
 	}
 }
+
+func TestParseInfoFromRawInfo(t *testing.T) {
+	reader, fileErr := os.Open("../testresources/multi-file.torrent")
+	if fileErr != nil {
+		t.Fatalf("Cannot run test - failed to read file %v", fileErr)
+	}
+	metaInfo, err := ParseMetaInfo(reader)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing meta info file %v", err)
+	}
+
+	info, err := ParseInfo(metaInfo.Info.Raw)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing raw info %v", err)
+	}
+	if !reflect.DeepEqual(info, metaInfo.Info) {
+		t.Errorf("Expected the raw info to parse to the same info")
+	}
+
+	if _, err := ParseInfo([]byte("d4:name1:ae")); err == nil {
+		t.Errorf("Expected an error parsing an info without pieces")
+	}
+	// Peers can send any info which matches the hash, so its geometry is checked too
+	if _, err := ParseInfo([]byte("d6:lengthi10e4:name1:a12:piece lengthi0e6:pieces20:aaaaaaaaaaaaaaaaaaaae")); err == nil {
+		t.Errorf("Expected an error parsing an info with piece length 0")
+	}
+}
@@ -0,0 +1,943 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/peerwire"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	BLOCK_LENGTH                  = 16 * 1024
+	DEFAULT_PIPELINE_LENGTH       = 16
+	DEFAULT_REQUEST_TIMEOUT       = 2 * time.Minute
+	DEFAULT_SNUB_TIMEOUT          = time.Minute
+	DEFAULT_KEEP_ALIVE_INTERVAL   = 2 * time.Minute
+	DEFAULT_IDLE_TIMEOUT          = 3 * time.Minute
+	DEFAULT_MAX_INCOMING_REQUESTS = 256
+	WRITE_TIMEOUT                 = time.Minute
+	TICK_INTERVAL                 = time.Second
+	EVENT_BUFFER                  = 64
+)
+
+var (
+	ErrIdle = errors.New("Peer sent nothing before the idle timeout")
+)
+
+// Types
+
+type Config struct {
+	NumPieces int
+	// PipelineLength is how many block requests are kept outstanding at once
+	PipelineLength    int
+	RequestTimeout    time.Duration
+	SnubTimeout       time.Duration
+	KeepAliveInterval time.Duration
+	IdleTimeout       time.Duration
+	// Fast is whether our handshake offered the Fast extension (BEP 6). It is used when the remote
+	// handshake offered it too.
+	Fast bool
+	// Extensions is whether our handshake offered the extension protocol (BEP 10)
+	Extensions bool
+	Clock      util.Clock
+}
+
+// Block identifies part of a piece
+type Block struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+type EventType int
+
+const (
+	// The remote peer choked or unchoked us. Requests outstanding when choked go back in the queue.
+	EVENT_CHOKED EventType = iota
+	EVENT_UNCHOKED
+	// The remote peer became interested or not interested in us
+	EVENT_INTERESTED
+	EVENT_NOT_INTERESTED
+	// The remote bitfield changed, Index holds the piece for EVENT_HAVE
+	EVENT_HAVE
+	EVENT_BITFIELD
+	// The remote peer asked for a block, which should be answered with SendBlock
+	EVENT_REQUEST
+	// A requested block arrived, with the data in Data
+	EVENT_BLOCK
+	// A request was outstanding for too long and has been cancelled
+	EVENT_REQUEST_TIMEOUT
+	// No data arrived for the snub timeout, the pipeline is cut to one request until it does
+	EVENT_SNUBBED
+	EVENT_UNSNUBBED
+	// The remote peer's DHT port, in Port
+	EVENT_PORT
+	// The remote peer won't answer a request, given in Block, so it can be made elsewhere
+	EVENT_REJECTED
+	// The remote peer suggested downloading piece Index
+	EVENT_SUGGEST
+	// The remote peer will answer requests for piece Index even while choking us
+	EVENT_ALLOWED_FAST
+	// An extension protocol message arrived, for ExtendedId with the payload in Data
+	EVENT_EXTENDED
+)
+
+type Event struct {
+	Type       EventType
+	Index      uint32
+	Block      Block
+	Data       []byte
+	Port       uint16
+	ExtendedId byte
+}
+
+// Conn runs the peer wire protocol over a connection which has completed its handshake. State
+// changes from the remote peer are delivered on the Events channel, which is closed once the
+// connection has shut down.
+type Conn struct {
+	conn   net.Conn
+	remote *peerwire.Handshake
+	config Config
+	reader *peerwire.Reader
+	writer *peerwire.Writer
+	events chan Event
+	wake   chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock     sync.Mutex
+	err      error
+	started  bool
+	shutdown bool
+
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	snubbed        bool
+	bitfield       *model.Bitfield
+	receivedFirst  bool
+	fast           bool
+	extended       bool
+	// allowedFast holds the pieces the peer lets us request while choked, and granted those we let
+	// the peer request
+	allowedFast *model.Bitfield
+	granted     *model.Bitfield
+
+	queue       []Block
+	outstanding []*outstandingRequest
+	incoming    []Block
+	outbox      []peerwire.Message
+
+	lastRead    time.Time
+	lastWrite   time.Time
+	lastBlockAt time.Time
+	downloaded  int64
+	uploaded    int64
+}
+
+type outstandingRequest struct {
+	block  Block
+	sentAt time.Time
+}
+
+// Stats are the payload bytes transferred, not counting protocol overhead
+type Stats struct {
+	Downloaded int64
+	Uploaded   int64
+}
+
+// Initialiser
+
+func NewConn(conn net.Conn, remote *peerwire.Handshake, config Config) *Conn {
+	if config.PipelineLength <= 0 {
+		config.PipelineLength = DEFAULT_PIPELINE_LENGTH
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = DEFAULT_REQUEST_TIMEOUT
+	}
+	if config.SnubTimeout <= 0 {
+		config.SnubTimeout = DEFAULT_SNUB_TIMEOUT
+	}
+	if config.KeepAliveInterval <= 0 {
+		config.KeepAliveInterval = DEFAULT_KEEP_ALIVE_INTERVAL
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DEFAULT_IDLE_TIMEOUT
+	}
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+
+	reader := peerwire.NewReader(conn)
+	if bitfieldLength := 1 + (config.NumPieces+7)/8; bitfieldLength > reader.MaxMessageLength {
+		reader.MaxMessageLength = bitfieldLength
+	}
+
+	now := config.Clock.Now()
+	return &Conn{
+		conn:        conn,
+		remote:      remote,
+		config:      config,
+		reader:      reader,
+		writer:      peerwire.NewWriter(conn),
+		events:      make(chan Event, EVENT_BUFFER),
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		amChoking:   true,
+		peerChoking: true,
+		bitfield:    model.NewBitfield(config.NumPieces),
+		fast:        config.Fast && remote.HasReserved(peerwire.RESERVED_FAST),
+		extended:    config.Extensions && remote.HasReserved(peerwire.RESERVED_EXTENSION_PROTOCOL),
+		allowedFast: model.NewBitfield(config.NumPieces),
+		granted:     model.NewBitfield(config.NumPieces),
+		lastRead:    now,
+		lastWrite:   now,
+	}
+}
+
+// Public Methods
+
+// Start runs the read and write goroutines until the context is done, the connection fails
+// or Close is called
+func (c *Conn) Start(ctx context.Context) {
+	c.lock.Lock()
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.started = true
+	if c.shutdown {
+		c.cancel()
+	}
+	c.lock.Unlock()
+
+	c.wg.Add(2)
+	go c.readLoop(ctx)
+	go c.writeLoop(ctx)
+
+	go func() {
+		<-ctx.Done()
+		c.conn.Close()
+		c.wg.Wait()
+		close(c.events)
+		close(c.done)
+	}()
+}
+
+func (c *Conn) Events() <-chan Event {
+	return c.events
+}
+
+// Done is closed once the connection has shut down
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection shut down, or nil if it was closed deliberately
+func (c *Conn) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *Conn) Close() error {
+	c.fail(nil)
+
+	c.lock.Lock()
+	started := c.started
+	c.lock.Unlock()
+	if started {
+		<-c.done
+	}
+	return nil
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) PeerId() []byte {
+	return c.remote.PeerId
+}
+
+func (c *Conn) Handshake() *peerwire.Handshake {
+	return c.remote
+}
+
+// SendBitfield announces the pieces we have. It must come before any other message. With the
+// Fast extension it is sent as have all or have none where it can be, and it must be sent even
+// when empty. Without it an empty bitfield is left out.
+func (c *Conn) SendBitfield(bits *model.Bitfield) {
+	switch {
+	case c.fast && bits.All():
+		c.send(&peerwire.HaveAll{})
+	case c.fast && bits.None():
+		c.send(&peerwire.HaveNone{})
+	case !bits.None():
+		c.send(&peerwire.Bitfield{Bits: bits.Bytes()})
+	}
+}
+
+func (c *Conn) SendHave(index uint32) {
+	c.send(&peerwire.Have{Index: index})
+}
+
+// SendPort tells the peer the port our DHT node listens on (BEP 5)
+func (c *Conn) SendPort(port uint16) {
+	c.send(&peerwire.Port{Port: port})
+}
+
+// Choke stops the remote peer downloading from us, discarding requests it has made. With the
+// Fast extension each discarded request is rejected, and requests for pieces it is allowed fast
+// are kept.
+func (c *Conn) Choke() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.amChoking {
+		return
+	}
+	c.amChoking = true
+
+	var rejected []Block
+	kept := c.incoming[:0]
+	for _, block := range c.incoming {
+		if c.fast && c.granted.Test(int(block.Index)) {
+			kept = append(kept, block)
+		} else {
+			rejected = append(rejected, block)
+		}
+	}
+	c.incoming = kept
+	dropped := c.dropQueuedPieces(func(piece *peerwire.Piece) bool {
+		return !c.fast || !c.granted.Test(int(piece.Index))
+	})
+	for _, piece := range dropped {
+		rejected = append(rejected, Block{Index: piece.Index, Begin: piece.Begin, Length: uint32(len(piece.Block))})
+	}
+
+	c.queueMessage(&peerwire.Choke{})
+	for _, block := range rejected {
+		c.reject(block)
+	}
+}
+
+func (c *Conn) Unchoke() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.amChoking {
+		return
+	}
+	c.amChoking = false
+	c.queueMessage(&peerwire.Unchoke{})
+}
+
+// SetInterested tells the remote peer whether we want pieces from it. Queued requests are only
+// sent while interested.
+func (c *Conn) SetInterested(interested bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.amInterested == interested {
+		return
+	}
+	c.amInterested = interested
+	if interested {
+		c.queueMessage(&peerwire.Interested{})
+		c.fillPipeline()
+	} else {
+		c.queueMessage(&peerwire.NotInterested{})
+	}
+}
+
+// Request queues blocks to download. They are sent as the pipeline has room while we are
+// interested and unchoked, or while choked for pieces we are allowed fast.
+func (c *Conn) Request(blocks ...Block) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queue = append(c.queue, blocks...)
+	c.fillPipeline()
+}
+
+// Cancel withdraws a block request, whether or not it has been sent yet
+func (c *Conn) Cancel(block Block) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, queued := range c.queue {
+		if queued == block {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return
+		}
+	}
+	for i, request := range c.outstanding {
+		if request.block == block {
+			c.outstanding = append(c.outstanding[:i], c.outstanding[i+1:]...)
+			c.queueMessage(&peerwire.Cancel{Index: block.Index, Begin: block.Begin, Length: block.Length})
+			c.fillPipeline()
+			return
+		}
+	}
+}
+
+// Pending returns the blocks requested from the peer which haven't arrived yet
+func (c *Conn) Pending() []Block {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pending := make([]Block, 0, len(c.outstanding)+len(c.queue))
+	for _, request := range c.outstanding {
+		pending = append(pending, request.block)
+	}
+	return append(pending, c.queue...)
+}
+
+// SendBlock answers a request from the peer. It returns false if the request has since been
+// cancelled or the peer choked.
+func (c *Conn) SendBlock(index uint32, begin uint32, data []byte) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	block := Block{Index: index, Begin: begin, Length: uint32(len(data))}
+	for i, request := range c.incoming {
+		if request == block {
+			c.incoming = append(c.incoming[:i], c.incoming[i+1:]...)
+			c.queueMessage(&peerwire.Piece{Index: index, Begin: begin, Block: data})
+			return true
+		}
+	}
+	return false
+}
+
+// Reject refuses a request from the peer, such as one for a piece we can't read. The peer is only
+// told with the Fast extension.
+func (c *Conn) Reject(block Block) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, request := range c.incoming {
+		if request == block {
+			c.incoming = append(c.incoming[:i], c.incoming[i+1:]...)
+			c.reject(block)
+			return
+		}
+	}
+}
+
+// SuggestPiece advises the peer to download a piece, with the Fast extension
+func (c *Conn) SuggestPiece(index uint32) {
+	if c.fast {
+		c.send(&peerwire.SuggestPiece{Index: index})
+	}
+}
+
+// AllowFast lets the peer request pieces while we are choking it, with the Fast extension
+func (c *Conn) AllowFast(indexes ...uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.fast {
+		return
+	}
+	for _, index := range indexes {
+		if int(index) < c.config.NumPieces && !c.granted.Test(int(index)) {
+			c.granted.Set(int(index))
+			c.queueMessage(&peerwire.AllowedFast{Index: index})
+		}
+	}
+}
+
+// SupportsFast reports whether both sides offered the Fast extension
+func (c *Conn) SupportsFast() bool {
+	return c.fast
+}
+
+// SupportsExtensions reports whether both sides offered the extension protocol
+func (c *Conn) SupportsExtensions() bool {
+	return c.extended
+}
+
+// SendExtended sends an extension protocol message, where id is the peer's id for the extension
+// or 0 for the extension handshake
+func (c *Conn) SendExtended(id byte, payload []byte) {
+	if c.extended {
+		c.send(&peerwire.Extended{ExtendedId: id, Payload: payload})
+	}
+}
+
+// AllowedFast returns a copy of the pieces the peer lets us request while choked
+func (c *Conn) AllowedFast() *model.Bitfield {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.allowedFast.Copy()
+}
+
+// HasPiece reports whether the remote peer has said it has a piece
+func (c *Conn) HasPiece(index int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.bitfield.Test(index)
+}
+
+// Bitfield returns a copy of the remote peer's bitfield
+func (c *Conn) Bitfield() *model.Bitfield {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.bitfield.Copy()
+}
+
+func (c *Conn) AmChoking() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.amChoking
+}
+
+func (c *Conn) AmInterested() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.amInterested
+}
+
+func (c *Conn) PeerChoking() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.peerChoking
+}
+
+func (c *Conn) PeerInterested() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.peerInterested
+}
+
+func (c *Conn) IsSnubbed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.snubbed
+}
+
+func (c *Conn) Stats() Stats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return Stats{Downloaded: c.downloaded, Uploaded: c.uploaded}
+}
+
+// Reading
+
+func (c *Conn) readLoop(ctx context.Context) {
+	defer c.wg.Done()
+
+	for {
+		message, err := c.reader.ReadMessage()
+		if err != nil {
+			c.abort(ctx, err)
+			return
+		}
+
+		events, err := c.handle(message)
+		if err != nil {
+			c.abort(ctx, err)
+			return
+		}
+		if !c.emit(ctx, events) {
+			return
+		}
+	}
+}
+
+// handle applies a message from the peer, returning the events it causes
+func (c *Conn) handle(message peerwire.Message) ([]Event, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lastRead = c.config.Clock.Now()
+	first := !c.receivedFirst
+	if _, ok := message.(*peerwire.KeepAlive); !ok {
+		c.receivedFirst = true
+	}
+
+	switch m := message.(type) {
+	case *peerwire.KeepAlive:
+		return nil, nil
+	case *peerwire.Choke:
+		if c.peerChoking {
+			return nil, nil
+		}
+		c.peerChoking = true
+		// With the Fast extension the peer rejects each request it won't answer
+		if c.fast {
+			return []Event{{Type: EVENT_CHOKED}}, nil
+		}
+		// Otherwise the peer discards our requests when it chokes us, so they go back to be sent again
+		requeued := make([]Block, 0, len(c.outstanding)+len(c.queue))
+		for _, request := range c.outstanding {
+			requeued = append(requeued, request.block)
+		}
+		c.queue = append(requeued, c.queue...)
+		c.outstanding = nil
+		return []Event{{Type: EVENT_CHOKED}}, nil
+	case *peerwire.Unchoke:
+		if !c.peerChoking {
+			return nil, nil
+		}
+		c.peerChoking = false
+		c.fillPipeline()
+		return []Event{{Type: EVENT_UNCHOKED}}, nil
+	case *peerwire.Interested:
+		if c.peerInterested {
+			return nil, nil
+		}
+		c.peerInterested = true
+		return []Event{{Type: EVENT_INTERESTED}}, nil
+	case *peerwire.NotInterested:
+		if !c.peerInterested {
+			return nil, nil
+		}
+		c.peerInterested = false
+		return []Event{{Type: EVENT_NOT_INTERESTED}}, nil
+	case *peerwire.Have:
+		if int(m.Index) >= c.config.NumPieces {
+			return nil, fmt.Errorf("Peer has piece %v but there are only %v", m.Index, c.config.NumPieces)
+		}
+		if c.bitfield.Test(int(m.Index)) {
+			return nil, nil
+		}
+		c.bitfield.Set(int(m.Index))
+		return []Event{{Type: EVENT_HAVE, Index: m.Index}}, nil
+	case *peerwire.Bitfield:
+		if !first {
+			return nil, fmt.Errorf("Peer sent bitfield after other messages")
+		}
+		bitfield, err := model.ParseBitfield(m.Bits, c.config.NumPieces)
+		if err != nil {
+			return nil, err
+		}
+		c.bitfield = bitfield
+		return []Event{{Type: EVENT_BITFIELD}}, nil
+	case *peerwire.HaveAll, *peerwire.HaveNone:
+		if !c.fast {
+			return nil, fmt.Errorf("Peer sent %v without the Fast extension", m.Id())
+		}
+		if !first {
+			return nil, fmt.Errorf("Peer sent %v after other messages", m.Id())
+		}
+		if _, ok := m.(*peerwire.HaveAll); ok {
+			c.bitfield.SetAll()
+		}
+		return []Event{{Type: EVENT_BITFIELD}}, nil
+	case *peerwire.Request:
+		return c.handleRequest(m)
+	case *peerwire.Cancel:
+		block := Block{Index: m.Index, Begin: m.Begin, Length: m.Length}
+		cancelled := false
+		for i, request := range c.incoming {
+			if request == block {
+				c.incoming = append(c.incoming[:i], c.incoming[i+1:]...)
+				cancelled = true
+				break
+			}
+		}
+		dropped := c.dropQueuedPieces(func(piece *peerwire.Piece) bool {
+			return piece.Index == m.Index && piece.Begin == m.Begin && uint32(len(piece.Block)) == m.Length
+		})
+		// With the Fast extension a cancelled request is still answered, with a reject
+		if cancelled || len(dropped) > 0 {
+			c.reject(block)
+		}
+		return nil, nil
+	case *peerwire.Piece:
+		return c.handlePiece(m), nil
+	case *peerwire.Port:
+		return []Event{{Type: EVENT_PORT, Port: m.Port}}, nil
+	case *peerwire.RejectRequest:
+		if !c.fast {
+			return nil, fmt.Errorf("Peer sent %v without the Fast extension", m.Id())
+		}
+		return c.handleReject(m), nil
+	case *peerwire.SuggestPiece:
+		if !c.fast {
+			return nil, fmt.Errorf("Peer sent %v without the Fast extension", m.Id())
+		}
+		if int(m.Index) >= c.config.NumPieces {
+			return nil, fmt.Errorf("Peer suggested piece %v but there are only %v", m.Index, c.config.NumPieces)
+		}
+		return []Event{{Type: EVENT_SUGGEST, Index: m.Index}}, nil
+	case *peerwire.AllowedFast:
+		if !c.fast {
+			return nil, fmt.Errorf("Peer sent %v without the Fast extension", m.Id())
+		}
+		// Peers may offer pieces beyond the end, which are just ignored
+		if int(m.Index) >= c.config.NumPieces || c.allowedFast.Test(int(m.Index)) {
+			return nil, nil
+		}
+		c.allowedFast.Set(int(m.Index))
+		c.fillPipeline()
+		return []Event{{Type: EVENT_ALLOWED_FAST, Index: m.Index}}, nil
+	case *peerwire.Extended:
+		if !c.extended {
+			return nil, nil
+		}
+		return []Event{{Type: EVENT_EXTENDED, ExtendedId: m.ExtendedId, Data: m.Payload}}, nil
+	default:
+		// Messages from extensions we didn't offer are ignored
+		return nil, nil
+	}
+}
+
+func (c *Conn) handleRequest(m *peerwire.Request) ([]Event, error) {
+	if int(m.Index) >= c.config.NumPieces || m.Length == 0 || m.Length > peerwire.MAX_BLOCK_LENGTH {
+		return nil, fmt.Errorf("Peer made invalid request for %v bytes of piece %v", m.Length, m.Index)
+	}
+	block := Block{Index: m.Index, Begin: m.Begin, Length: m.Length}
+	// Requests made while choked are ones we've already discarded, unless the piece is allowed fast
+	if (c.amChoking && !(c.fast && c.granted.Test(int(m.Index)))) || len(c.incoming) >= DEFAULT_MAX_INCOMING_REQUESTS {
+		c.reject(block)
+		return nil, nil
+	}
+	for _, request := range c.incoming {
+		if request == block {
+			return nil, nil
+		}
+	}
+	c.incoming = append(c.incoming, block)
+	return []Event{{Type: EVENT_REQUEST, Block: block}}, nil
+}
+
+func (c *Conn) handlePiece(m *peerwire.Piece) []Event {
+	block := Block{Index: m.Index, Begin: m.Begin, Length: uint32(len(m.Block))}
+	for i, request := range c.outstanding {
+		if request.block != block {
+			continue
+		}
+
+		c.outstanding = append(c.outstanding[:i], c.outstanding[i+1:]...)
+		c.downloaded += int64(len(m.Block))
+		c.lastBlockAt = c.config.Clock.Now()
+
+		events := make([]Event, 0, 2)
+		if c.snubbed {
+			c.snubbed = false
+			events = append(events, Event{Type: EVENT_UNSNUBBED})
+		}
+		c.fillPipeline()
+		return append(events, Event{Type: EVENT_BLOCK, Block: block, Data: m.Block})
+	}
+
+	// Blocks we didn't ask for, or have since cancelled, are dropped
+	return nil
+}
+
+func (c *Conn) handleReject(m *peerwire.RejectRequest) []Event {
+	block := Block{Index: m.Index, Begin: m.Begin, Length: m.Length}
+	for i, request := range c.outstanding {
+		if request.block == block {
+			c.outstanding = append(c.outstanding[:i], c.outstanding[i+1:]...)
+			c.fillPipeline()
+			return []Event{{Type: EVENT_REJECTED, Block: block}}
+		}
+	}
+	// Rejects for requests we've since cancelled need nothing doing
+	return nil
+}
+
+// Writing
+
+func (c *Conn) writeLoop(ctx context.Context) {
+	defer c.wg.Done()
+
+	timer := c.config.Clock.NewTimer(TICK_INTERVAL)
+	defer func() { timer.Stop() }()
+
+	for {
+		var events []Event
+		select {
+		case <-c.wake:
+		case <-timer.C():
+			var err error
+			events, err = c.tick()
+			if err != nil {
+				c.abort(ctx, err)
+				return
+			}
+			timer = c.config.Clock.NewTimer(TICK_INTERVAL)
+		case <-ctx.Done():
+			return
+		}
+
+		if err := c.flush(); err != nil {
+			c.abort(ctx, err)
+			return
+		}
+		if !c.emit(ctx, events) {
+			return
+		}
+	}
+}
+
+func (c *Conn) flush() error {
+	for {
+		c.lock.Lock()
+		if len(c.outbox) == 0 {
+			c.lock.Unlock()
+			return nil
+		}
+		message := c.outbox[0]
+		c.outbox = c.outbox[1:]
+		if piece, ok := message.(*peerwire.Piece); ok {
+			c.uploaded += int64(len(piece.Block))
+		}
+		c.lastWrite = c.config.Clock.Now()
+		c.lock.Unlock()
+
+		c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+		if err := c.writer.WriteMessage(message); err != nil {
+			return err
+		}
+	}
+}
+
+// tick handles everything driven by time - request timeouts, snubbing, keep-alives and idle peers
+func (c *Conn) tick() ([]Event, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.config.Clock.Now()
+	if now.Sub(c.lastRead) >= c.config.IdleTimeout {
+		return nil, ErrIdle
+	}
+
+	events := make([]Event, 0)
+	remaining := c.outstanding[:0]
+	for _, request := range c.outstanding {
+		if now.Sub(request.sentAt) < c.config.RequestTimeout {
+			remaining = append(remaining, request)
+			continue
+		}
+		block := request.block
+		c.queueMessage(&peerwire.Cancel{Index: block.Index, Begin: block.Begin, Length: block.Length})
+		events = append(events, Event{Type: EVENT_REQUEST_TIMEOUT, Block: block})
+	}
+	c.outstanding = remaining
+
+	if !c.snubbed && len(c.outstanding) > 0 && now.Sub(c.lastBlockAt) >= c.config.SnubTimeout {
+		c.snubbed = true
+		events = append(events, Event{Type: EVENT_SNUBBED})
+	}
+
+	if now.Sub(c.lastWrite) >= c.config.KeepAliveInterval && len(c.outbox) == 0 {
+		c.outbox = append(c.outbox, &peerwire.KeepAlive{})
+	}
+	c.fillPipeline()
+	return events, nil
+}
+
+// Helpers
+
+func (c *Conn) send(message peerwire.Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.queueMessage(message)
+}
+
+// queueMessage adds a message for the write goroutine. Must be called with the lock held.
+func (c *Conn) queueMessage(message peerwire.Message) {
+	c.outbox = append(c.outbox, message)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fillPipeline sends queued requests while there is room. While choked only requests for pieces
+// allowed fast are sent. Must be called with the lock held.
+func (c *Conn) fillPipeline() {
+	if !c.amInterested || (c.peerChoking && !c.fast) {
+		return
+	}
+
+	limit := c.config.PipelineLength
+	if c.snubbed {
+		limit = 1
+	}
+	now := c.config.Clock.Now()
+	remaining := c.queue[:0]
+	for i, block := range c.queue {
+		if len(c.outstanding) >= limit {
+			remaining = append(remaining, c.queue[i:]...)
+			break
+		}
+		if c.peerChoking && !c.allowedFast.Test(int(block.Index)) {
+			remaining = append(remaining, block)
+			continue
+		}
+		// The snub timer starts when requests start going out, not from the last block
+		if len(c.outstanding) == 0 && !c.snubbed {
+			c.lastBlockAt = now
+		}
+		c.outstanding = append(c.outstanding, &outstandingRequest{block: block, sentAt: now})
+		c.queueMessage(&peerwire.Request{Index: block.Index, Begin: block.Begin, Length: block.Length})
+	}
+	c.queue = remaining
+}
+
+// reject tells the peer a request won't be answered, with the Fast extension. Must be called with
+// the lock held.
+func (c *Conn) reject(block Block) {
+	if c.fast {
+		c.queueMessage(&peerwire.RejectRequest{Index: block.Index, Begin: block.Begin, Length: block.Length})
+	}
+}
+
+// dropQueuedPieces removes unsent pieces from the outbox, returning them. Must be called with the
+// lock held.
+func (c *Conn) dropQueuedPieces(matches func(*peerwire.Piece) bool) []*peerwire.Piece {
+	var dropped []*peerwire.Piece
+	kept := c.outbox[:0]
+	for _, message := range c.outbox {
+		if piece, ok := message.(*peerwire.Piece); ok && matches(piece) {
+			dropped = append(dropped, piece)
+			continue
+		}
+		kept = append(kept, message)
+	}
+	c.outbox = kept
+	return dropped
+}
+
+func (c *Conn) emit(ctx context.Context, events []Event) bool {
+	for _, event := range events {
+		select {
+		case c.events <- event:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// fail shuts the connection down, keeping the first error. Errors after shutdown has begun are
+// only a consequence of it.
+func (c *Conn) fail(err error) {
+	c.lock.Lock()
+	if !c.shutdown {
+		c.shutdown = true
+		c.err = err
+	}
+	cancel := c.cancel
+	c.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	} else {
+		c.conn.Close()
+	}
+}
+
+// abort shuts down after a read or write fails. Once the context is done the failure is just the
+// connection being closed under the goroutine.
+func (c *Conn) abort(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		err = nil
+	}
+	c.fail(err)
+}
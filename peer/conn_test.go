@@ -0,0 +1,654 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/peerwire"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	testNumPieces = 20
+	testTimeout   = 5 * time.Second
+)
+
+var (
+	testInfoHash    = []byte("aaaaaaaaaaaaaaaaaaaa")
+	testPeerId      = []byte("-GT0001-111111111111")
+	testOtherPeerId = []byte("-GT0001-222222222222")
+)
+
+func TestInterestAndChokeStateBothWays(t *testing.T) {
+	a, b := newConnPair(t, Config{NumPieces: testNumPieces})
+
+	a.SetInterested(true)
+	expectEvent(t, b, EVENT_INTERESTED)
+	if !a.AmInterested() || !b.PeerInterested() {
+		t.Errorf("Expected a to be interested in b")
+	}
+
+	b.Unchoke()
+	expectEvent(t, a, EVENT_UNCHOKED)
+	if a.PeerChoking() || b.AmChoking() {
+		t.Errorf("Expected b to have unchoked a")
+	}
+	if !a.AmChoking() || !b.PeerChoking() {
+		t.Errorf("Expected a to still be choking b")
+	}
+
+	b.Choke()
+	expectEvent(t, a, EVENT_CHOKED)
+	a.SetInterested(false)
+	expectEvent(t, b, EVENT_NOT_INTERESTED)
+	if !a.PeerChoking() || b.PeerInterested() {
+		t.Errorf("Expected a to be choked and b not to be wanted")
+	}
+}
+
+func TestBlocksTransferBetweenConns(t *testing.T) {
+	a, b := newConnPair(t, Config{NumPieces: testNumPieces})
+
+	b.Unchoke()
+	expectEvent(t, a, EVENT_UNCHOKED)
+	a.SetInterested(true)
+	blocks := []Block{{Index: 3, Begin: 0, Length: BLOCK_LENGTH}, {Index: 3, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH}}
+	a.Request(blocks...)
+
+	for _, block := range blocks {
+		event := expectEvent(t, b, EVENT_REQUEST)
+		if event.Block != block {
+			t.Fatalf("Expected request for %+v but was %+v", block, event.Block)
+		}
+		if !b.SendBlock(block.Index, block.Begin, bytes.Repeat([]byte{byte(block.Begin >> 14)}, int(block.Length))) {
+			t.Fatalf("Expected block to be sent")
+		}
+	}
+
+	for i, block := range blocks {
+		event := expectEvent(t, a, EVENT_BLOCK)
+		if event.Block != block || len(event.Data) != BLOCK_LENGTH || event.Data[0] != byte(i) {
+			t.Errorf("Unexpected block event %+v", event.Block)
+		}
+	}
+
+	if len(a.Pending()) != 0 {
+		t.Errorf("Expected nothing to be pending but was %v", a.Pending())
+	}
+	if stats := a.Stats(); stats.Downloaded != 2*BLOCK_LENGTH {
+		t.Errorf("Expected %v bytes downloaded but was %v", 2*BLOCK_LENGTH, stats.Downloaded)
+	}
+	waitFor(t, func() bool { return b.Stats().Uploaded == 2*BLOCK_LENGTH })
+}
+
+func TestPipelineLimitsOutstandingRequests(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces, PipelineLength: 2})
+
+	conn.SetInterested(true)
+	conn.Request(testBlocks(5)...)
+	expectMessage(t, raw, &peerwire.Interested{})
+	raw.send(t, &peerwire.Unchoke{})
+
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH})
+	expectNoMessage(t, raw)
+
+	raw.send(t, &peerwire.Piece{Index: 0, Begin: 0, Block: make([]byte, BLOCK_LENGTH)})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 2 * BLOCK_LENGTH, Length: BLOCK_LENGTH})
+	expectNoMessage(t, raw)
+
+	if pending := conn.Pending(); len(pending) != 4 {
+		t.Errorf("Expected 4 pending blocks but was %v", pending)
+	}
+}
+
+func TestChokeRequeuesOutstandingRequests(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces, PipelineLength: 2})
+
+	conn.SetInterested(true)
+	conn.Request(testBlocks(3)...)
+	expectMessage(t, raw, &peerwire.Interested{})
+	raw.send(t, &peerwire.Unchoke{})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH})
+
+	raw.send(t, &peerwire.Choke{})
+	expectEvent(t, conn, EVENT_CHOKED)
+	if pending := conn.Pending(); !reflect.DeepEqual(pending, testBlocks(3)) {
+		t.Errorf("Expected all blocks still pending in order but were %v", pending)
+	}
+
+	// A block arriving after the choke was for a request the peer has already dropped
+	raw.send(t, &peerwire.Piece{Index: 0, Begin: 0, Block: make([]byte, BLOCK_LENGTH)})
+	raw.send(t, &peerwire.Unchoke{})
+	expectEvent(t, conn, EVENT_UNCHOKED)
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH})
+	if conn.Stats().Downloaded != 0 {
+		t.Errorf("Expected unrequested block to be ignored")
+	}
+}
+
+func TestCancelWithdrawsRequests(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces, PipelineLength: 1})
+
+	conn.SetInterested(true)
+	blocks := testBlocks(3)
+	conn.Request(blocks...)
+	expectMessage(t, raw, &peerwire.Interested{})
+	raw.send(t, &peerwire.Unchoke{})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+
+	conn.Cancel(blocks[1])
+	conn.Cancel(blocks[0])
+	expectMessage(t, raw, &peerwire.Cancel{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 2 * BLOCK_LENGTH, Length: BLOCK_LENGTH})
+	if pending := conn.Pending(); !reflect.DeepEqual(pending, blocks[2:]) {
+		t.Errorf("Expected only the last block pending but was %v", pending)
+	}
+}
+
+func TestRequestsFromPeer(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces})
+
+	// Requests while choked are dropped
+	raw.send(t, &peerwire.Request{Index: 1, Begin: 0, Length: BLOCK_LENGTH})
+	raw.send(t, &peerwire.Have{Index: 0})
+	expectEvent(t, conn, EVENT_HAVE)
+	conn.Unchoke()
+	expectMessage(t, raw, &peerwire.Unchoke{})
+	if conn.SendBlock(1, 0, make([]byte, BLOCK_LENGTH)) {
+		t.Errorf("Expected request made while choked to be dropped")
+	}
+
+	raw.send(t, &peerwire.Request{Index: 1, Begin: 0, Length: BLOCK_LENGTH})
+	raw.send(t, &peerwire.Cancel{Index: 1, Begin: 0, Length: BLOCK_LENGTH})
+	raw.send(t, &peerwire.Request{Index: 2, Begin: 0, Length: BLOCK_LENGTH})
+	expectEvent(t, conn, EVENT_REQUEST)
+	if event := expectEvent(t, conn, EVENT_REQUEST); event.Block.Index != 2 {
+		t.Fatalf("Expected request for piece 2 but was %+v", event.Block)
+	}
+	if conn.SendBlock(1, 0, make([]byte, BLOCK_LENGTH)) {
+		t.Errorf("Expected cancelled request not to be sent")
+	}
+
+	data := bytes.Repeat([]byte{7}, BLOCK_LENGTH)
+	if !conn.SendBlock(2, 0, data) {
+		t.Fatalf("Expected block to be sent")
+	}
+	expectMessage(t, raw, &peerwire.Piece{Index: 2, Begin: 0, Block: data})
+
+	raw.send(t, &peerwire.Request{Index: 3, Begin: 0, Length: BLOCK_LENGTH})
+	expectEvent(t, conn, EVENT_REQUEST)
+	conn.Choke()
+	expectMessage(t, raw, &peerwire.Choke{})
+	if conn.SendBlock(3, 0, data) {
+		t.Errorf("Expected requests to be discarded when choking")
+	}
+}
+
+func TestRemoteBitfieldAndHave(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces})
+
+	raw.send(t, &peerwire.Bitfield{Bits: []byte{0x80, 0x01, 0x00}})
+	expectEvent(t, conn, EVENT_BITFIELD)
+	raw.send(t, &peerwire.Have{Index: 19})
+	event := expectEvent(t, conn, EVENT_HAVE)
+	if event.Index != 19 {
+		t.Errorf("Expected have for piece 19 but was %v", event.Index)
+	}
+
+	for index := 0; index < testNumPieces; index++ {
+		expected := index == 0 || index == 15 || index == 19
+		if conn.HasPiece(index) != expected {
+			t.Errorf("Expected HasPiece(%v) to be %v", index, expected)
+		}
+	}
+	if !bytes.Equal(conn.Bitfield().Bytes(), []byte{0x80, 0x01, 0x10}) {
+		t.Errorf("Unexpected bitfield %v", conn.Bitfield())
+	}
+}
+
+func TestInvalidMessagesCloseConnection(t *testing.T) {
+	tests := map[string][]peerwire.Message{
+		"spare bits set":        {&peerwire.Bitfield{Bits: []byte{0, 0, 0x01}}},
+		"bitfield too short":    {&peerwire.Bitfield{Bits: []byte{0, 0}}},
+		"late bitfield":         {&peerwire.Have{Index: 1}, &peerwire.Bitfield{Bits: []byte{0, 0, 0}}},
+		"have out of range":     {&peerwire.Have{Index: testNumPieces}},
+		"request beyond end":    {&peerwire.Request{Index: testNumPieces, Begin: 0, Length: BLOCK_LENGTH}},
+		"request too long":      {&peerwire.Request{Index: 0, Begin: 0, Length: peerwire.MAX_BLOCK_LENGTH + 1}},
+		"zero length request":   {&peerwire.Request{Index: 0, Begin: 0, Length: 0}},
+		"have all without fast": {&peerwire.HaveAll{}},
+		"reject without fast":   {&peerwire.RejectRequest{Index: 0, Begin: 0, Length: BLOCK_LENGTH}},
+	}
+
+	for name, messages := range tests {
+		conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces})
+		for _, message := range messages {
+			raw.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+			raw.writer.WriteMessage(message)
+		}
+		expectDone(t, conn)
+		if conn.Err() == nil {
+			t.Errorf("Expected %v to close the connection with an error", name)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces, PipelineLength: 1, RequestTimeout: 30 * time.Second, Clock: clock})
+
+	conn.SetInterested(true)
+	conn.Request(testBlocks(2)...)
+	expectMessage(t, raw, &peerwire.Interested{})
+	raw.send(t, &peerwire.Unchoke{})
+	expectEvent(t, conn, EVENT_UNCHOKED)
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+
+	clock.BlockUntil(1)
+	clock.Advance(31 * time.Second)
+
+	expectMessage(t, raw, &peerwire.Cancel{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH})
+	event := expectEvent(t, conn, EVENT_REQUEST_TIMEOUT)
+	if event.Block != testBlocks(1)[0] {
+		t.Errorf("Expected first block to time out but was %+v", event.Block)
+	}
+}
+
+func TestSnubbing(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces, PipelineLength: 2, SnubTimeout: 10 * time.Second, Clock: clock})
+
+	conn.SetInterested(true)
+	conn.Request(testBlocks(4)...)
+	expectMessage(t, raw, &peerwire.Interested{})
+	raw.send(t, &peerwire.Unchoke{})
+	expectEvent(t, conn, EVENT_UNCHOKED)
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH})
+
+	clock.BlockUntil(1)
+	clock.Advance(11 * time.Second)
+	expectEvent(t, conn, EVENT_SNUBBED)
+	if !conn.IsSnubbed() {
+		t.Errorf("Expected peer to be snubbed")
+	}
+
+	// The block ends the snub, so the pipeline opens back up to two requests
+	raw.send(t, &peerwire.Piece{Index: 0, Begin: 0, Block: make([]byte, BLOCK_LENGTH)})
+	expectEvent(t, conn, EVENT_UNSNUBBED)
+	expectEvent(t, conn, EVENT_BLOCK)
+	if conn.IsSnubbed() {
+		t.Errorf("Expected peer not to be snubbed after sending a block")
+	}
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 2 * BLOCK_LENGTH, Length: BLOCK_LENGTH})
+}
+
+func TestKeepAliveAndIdleTimeout(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces, KeepAliveInterval: 10 * time.Second, IdleTimeout: 30 * time.Second, Clock: clock})
+
+	clock.BlockUntil(1)
+	clock.Advance(11 * time.Second)
+	expectMessage(t, raw, &peerwire.KeepAlive{})
+
+	clock.BlockUntil(1)
+	clock.Advance(20 * time.Second)
+	expectDone(t, conn)
+	if conn.Err() != ErrIdle {
+		t.Errorf("Expected idle error but was %v", conn.Err())
+	}
+}
+
+func TestContextCancelShutsDown(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn := NewConn(local, &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testOtherPeerId}, Config{NumPieces: testNumPieces})
+	conn.Start(ctx)
+
+	cancel()
+	expectDone(t, conn)
+	if _, ok := <-conn.Events(); ok {
+		t.Errorf("Expected events channel to be closed")
+	}
+	if conn.Err() != nil {
+		t.Errorf("Expected no error on cancel but was %v", conn.Err())
+	}
+	if _, err := remote.Write([]byte{0}); err == nil {
+		t.Errorf("Expected underlying connection to be closed")
+	}
+}
+
+func TestSendBitfieldGoesFirst(t *testing.T) {
+	local, remote := net.Pipe()
+	conn := NewConn(local, &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testOtherPeerId}, Config{NumPieces: testNumPieces})
+	bits := model.NewBitfield(testNumPieces)
+	bits.SetAll()
+	conn.SendBitfield(bits)
+	conn.Unchoke()
+	conn.Start(context.Background())
+	defer conn.Close()
+
+	raw := &rawPeer{conn: remote, reader: peerwire.NewReader(remote), writer: peerwire.NewWriter(remote)}
+	defer remote.Close()
+	expectMessage(t, raw, &peerwire.Bitfield{Bits: []byte{0xff, 0xff, 0xf0}})
+	expectMessage(t, raw, &peerwire.Unchoke{})
+}
+
+func TestFastHaveAllAndHaveNone(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(peerwire.RESERVED_FAST), Config{NumPieces: testNumPieces, Fast: true})
+	if !conn.SupportsFast() {
+		t.Fatalf("Expected fast extension to be negotiated")
+	}
+
+	all := model.NewBitfield(testNumPieces)
+	all.SetAll()
+	conn.SendBitfield(all)
+	expectMessage(t, raw, &peerwire.HaveAll{})
+	raw.send(t, &peerwire.HaveAll{})
+	expectEvent(t, conn, EVENT_BITFIELD)
+	if !conn.Bitfield().All() {
+		t.Errorf("Expected have all to set every piece")
+	}
+
+	other, otherRaw := newRawPair(t, testRemoteHandshake(peerwire.RESERVED_FAST), Config{NumPieces: testNumPieces, Fast: true})
+	other.SendBitfield(model.NewBitfield(testNumPieces))
+	expectMessage(t, otherRaw, &peerwire.HaveNone{})
+	otherRaw.send(t, &peerwire.HaveNone{})
+	expectEvent(t, other, EVENT_BITFIELD)
+	if !other.Bitfield().None() {
+		t.Errorf("Expected have none to leave every piece clear")
+	}
+}
+
+func TestFastNeedsBothSides(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	handshake := &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testOtherPeerId}
+	if NewConn(local, handshake, Config{NumPieces: testNumPieces, Fast: true}).SupportsFast() {
+		t.Errorf("Expected no fast extension when the remote didn't offer it")
+	}
+	handshake.SetReserved(peerwire.RESERVED_FAST)
+	if NewConn(local, handshake, Config{NumPieces: testNumPieces}).SupportsFast() {
+		t.Errorf("Expected no fast extension when we didn't offer it")
+	}
+}
+
+func TestInvalidFastMessagesCloseConnection(t *testing.T) {
+	tests := map[string][]peerwire.Message{
+		"late have all":         {&peerwire.Have{Index: 1}, &peerwire.HaveAll{}},
+		"have none after field": {&peerwire.Bitfield{Bits: []byte{0, 0, 0}}, &peerwire.HaveNone{}},
+		"suggest out of range":  {&peerwire.SuggestPiece{Index: testNumPieces}},
+	}
+	for name, messages := range tests {
+		conn, raw := newRawPair(t, testRemoteHandshake(peerwire.RESERVED_FAST), Config{NumPieces: testNumPieces, Fast: true})
+		for _, message := range messages {
+			raw.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+			raw.writer.WriteMessage(message)
+		}
+		expectDone(t, conn)
+		if conn.Err() == nil {
+			t.Errorf("Expected %v to close the connection with an error", name)
+		}
+	}
+}
+
+func TestRejectsFreeRequestSlots(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(peerwire.RESERVED_FAST), Config{NumPieces: testNumPieces, Fast: true, PipelineLength: 1})
+	blocks := testBlocks(3)
+
+	conn.SetInterested(true)
+	conn.Request(blocks...)
+	expectMessage(t, raw, &peerwire.Interested{})
+	raw.send(t, &peerwire.Unchoke{})
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+
+	raw.send(t, &peerwire.RejectRequest{Index: 0, Begin: 0, Length: BLOCK_LENGTH})
+	if event := expectEvent(t, conn, EVENT_REJECTED); event.Block != blocks[0] {
+		t.Errorf("Expected rejected block %+v but was %+v", blocks[0], event.Block)
+	}
+	expectMessage(t, raw, &peerwire.Request{Index: 0, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH})
+
+	// Being choked leaves requests outstanding, for the peer to reject
+	raw.send(t, &peerwire.Choke{})
+	expectEvent(t, conn, EVENT_CHOKED)
+	if pending := conn.Pending(); !reflect.DeepEqual(pending, blocks[1:]) {
+		t.Errorf("Expected the rest still pending but was %v", pending)
+	}
+	raw.send(t, &peerwire.RejectRequest{Index: 0, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH})
+	expectEvent(t, conn, EVENT_REJECTED)
+	expectNoMessage(t, raw)
+	if pending := conn.Pending(); !reflect.DeepEqual(pending, blocks[2:]) {
+		t.Errorf("Expected only the unsent block pending but was %v", pending)
+	}
+}
+
+func TestAllowedFastRequestsWhileChoked(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(peerwire.RESERVED_FAST), Config{NumPieces: testNumPieces, Fast: true})
+
+	conn.SetInterested(true)
+	expectMessage(t, raw, &peerwire.Interested{})
+	conn.Request(Block{Index: 0, Begin: 0, Length: BLOCK_LENGTH}, Block{Index: 1, Begin: 0, Length: BLOCK_LENGTH})
+	expectNoMessage(t, raw)
+
+	raw.send(t, &peerwire.AllowedFast{Index: 1})
+	raw.send(t, &peerwire.AllowedFast{Index: testNumPieces + 5})
+	if event := expectEvent(t, conn, EVENT_ALLOWED_FAST); event.Index != 1 {
+		t.Errorf("Expected piece 1 allowed fast but was %v", event.Index)
+	}
+	expectMessage(t, raw, &peerwire.Request{Index: 1, Begin: 0, Length: BLOCK_LENGTH})
+	expectNoMessage(t, raw)
+	if allowed := conn.AllowedFast(); allowed.Count() != 1 || !allowed.Test(1) {
+		t.Errorf("Unexpected allowed fast set %v", allowed)
+	}
+
+	raw.send(t, &peerwire.SuggestPiece{Index: 4})
+	if event := expectEvent(t, conn, EVENT_SUGGEST); event.Index != 4 {
+		t.Errorf("Expected suggestion of piece 4 but was %v", event.Index)
+	}
+	conn.SuggestPiece(3)
+	expectMessage(t, raw, &peerwire.SuggestPiece{Index: 3})
+}
+
+func TestFastRejectsDiscardedRequests(t *testing.T) {
+	conn, raw := newRawPair(t, testRemoteHandshake(peerwire.RESERVED_FAST), Config{NumPieces: testNumPieces, Fast: true})
+	data := make([]byte, BLOCK_LENGTH)
+
+	// Requests while choked are rejected unless the piece is allowed fast
+	raw.send(t, &peerwire.Request{Index: 1, Begin: 0, Length: BLOCK_LENGTH})
+	expectMessage(t, raw, &peerwire.RejectRequest{Index: 1, Begin: 0, Length: BLOCK_LENGTH})
+	conn.AllowFast(2)
+	expectMessage(t, raw, &peerwire.AllowedFast{Index: 2})
+	raw.send(t, &peerwire.Request{Index: 2, Begin: 0, Length: BLOCK_LENGTH})
+	expectEvent(t, conn, EVENT_REQUEST)
+	if !conn.SendBlock(2, 0, data) {
+		t.Fatalf("Expected allowed fast block to be sent while choking")
+	}
+	expectMessage(t, raw, &peerwire.Piece{Index: 2, Begin: 0, Block: data})
+
+	// Cancelled requests are answered with a reject
+	conn.Unchoke()
+	expectMessage(t, raw, &peerwire.Unchoke{})
+	raw.send(t, &peerwire.Request{Index: 3, Begin: 0, Length: BLOCK_LENGTH})
+	expectEvent(t, conn, EVENT_REQUEST)
+	raw.send(t, &peerwire.Cancel{Index: 3, Begin: 0, Length: BLOCK_LENGTH})
+	expectMessage(t, raw, &peerwire.RejectRequest{Index: 3, Begin: 0, Length: BLOCK_LENGTH})
+
+	// As are requests we can't serve
+	raw.send(t, &peerwire.Request{Index: 4, Begin: 0, Length: BLOCK_LENGTH})
+	event := expectEvent(t, conn, EVENT_REQUEST)
+	conn.Reject(event.Block)
+	expectMessage(t, raw, &peerwire.RejectRequest{Index: 4, Begin: 0, Length: BLOCK_LENGTH})
+
+	// And those discarded by choking, except for allowed fast pieces
+	raw.send(t, &peerwire.Request{Index: 5, Begin: 0, Length: BLOCK_LENGTH})
+	raw.send(t, &peerwire.Request{Index: 2, Begin: BLOCK_LENGTH, Length: BLOCK_LENGTH})
+	expectEvent(t, conn, EVENT_REQUEST)
+	expectEvent(t, conn, EVENT_REQUEST)
+	conn.Choke()
+	expectMessage(t, raw, &peerwire.Choke{})
+	expectMessage(t, raw, &peerwire.RejectRequest{Index: 5, Begin: 0, Length: BLOCK_LENGTH})
+	if !conn.SendBlock(2, BLOCK_LENGTH, data) {
+		t.Errorf("Expected allowed fast request to survive choking")
+	}
+}
+
+func TestExtendedMessages(t *testing.T) {
+	// Without the remote offering the extension protocol nothing is sent or received
+	conn, raw := newRawPair(t, testRemoteHandshake(), Config{NumPieces: testNumPieces, Extensions: true})
+	conn.SendExtended(0, []byte("d1:mdee"))
+	expectNoMessage(t, raw)
+	raw.send(t, &peerwire.Extended{ExtendedId: 1, Payload: []byte("ignored")})
+	raw.send(t, &peerwire.Interested{})
+	// The connection survives the extended message it didn't negotiate
+	expectEvent(t, conn, EVENT_INTERESTED)
+
+	local, remote := net.Pipe()
+	handshake := &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testOtherPeerId}
+	handshake.SetReserved(peerwire.RESERVED_EXTENSION_PROTOCOL)
+	conn = NewConn(local, handshake, Config{NumPieces: testNumPieces, Extensions: true})
+	conn.Start(context.Background())
+	defer conn.Close()
+	defer remote.Close()
+	raw = &rawPeer{conn: remote, reader: peerwire.NewReader(remote), writer: peerwire.NewWriter(remote)}
+	if !conn.SupportsExtensions() {
+		t.Fatalf("Expected extensions when both sides offered them")
+	}
+
+	conn.SendExtended(0, []byte("d1:mdee"))
+	expectMessage(t, raw, &peerwire.Extended{ExtendedId: 0, Payload: []byte("d1:mdee")})
+	raw.send(t, &peerwire.Extended{ExtendedId: 3, Payload: []byte("payload")})
+	event := expectEvent(t, conn, EVENT_EXTENDED)
+	if event.ExtendedId != 3 || string(event.Data) != "payload" {
+		t.Errorf("Expected extended event for id 3 but was %+v", event)
+	}
+}
+
+// Helpers
+
+type rawPeer struct {
+	conn   net.Conn
+	reader *peerwire.Reader
+	writer *peerwire.Writer
+}
+
+func (raw *rawPeer) send(t *testing.T, message peerwire.Message) {
+	raw.conn.SetWriteDeadline(time.Now().Add(testTimeout))
+	if err := raw.writer.WriteMessage(message); err != nil {
+		t.Fatalf("Unexpected error writing %v message %v", message.Id(), err)
+	}
+}
+
+func newConnPair(t *testing.T, config Config) (*Conn, *Conn) {
+	left, right := net.Pipe()
+	a := NewConn(left, &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testOtherPeerId}, config)
+	b := NewConn(right, &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testPeerId}, config)
+	a.Start(context.Background())
+	b.Start(context.Background())
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func newRawPair(t *testing.T, remote *peerwire.Handshake, config Config) (*Conn, *rawPeer) {
+	local, raw := net.Pipe()
+	conn := NewConn(local, remote, config)
+	conn.Start(context.Background())
+	t.Cleanup(func() {
+		raw.Close()
+		conn.Close()
+	})
+	return conn, &rawPeer{conn: raw, reader: peerwire.NewReader(raw), writer: peerwire.NewWriter(raw)}
+}
+
+// testRemoteHandshake is the handshake of the raw peer, offering the given reserved bits
+func testRemoteHandshake(reserved ...int) *peerwire.Handshake {
+	handshake := &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testOtherPeerId}
+	for _, bit := range reserved {
+		handshake.SetReserved(bit)
+	}
+	return handshake
+}
+
+func testBlocks(count int) []Block {
+	blocks := make([]Block, count)
+	for i := range blocks {
+		blocks[i] = Block{Index: 0, Begin: uint32(i * BLOCK_LENGTH), Length: BLOCK_LENGTH}
+	}
+	return blocks
+}
+
+// expectEvent waits for an event of a type, skipping any others
+func expectEvent(t *testing.T, conn *Conn, eventType EventType) Event {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event, ok := <-conn.Events():
+			if !ok {
+				t.Fatalf("Connection closed waiting for event %v: %v", eventType, conn.Err())
+			}
+			if event.Type == eventType {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for event %v", eventType)
+		}
+	}
+}
+
+func expectMessage(t *testing.T, raw *rawPeer, expected peerwire.Message) {
+	t.Helper()
+	raw.conn.SetReadDeadline(time.Now().Add(testTimeout))
+	message, err := raw.reader.ReadMessage()
+	if err != nil {
+		t.Fatalf("Unexpected error waiting for %v message %v", expected.Id(), err)
+	}
+	if !reflect.DeepEqual(message, expected) {
+		t.Fatalf("Expected message %+v but was %+v", expected, message)
+	}
+}
+
+func expectNoMessage(t *testing.T, raw *rawPeer) {
+	t.Helper()
+	raw.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	message, err := raw.reader.ReadMessage()
+	if err == nil {
+		t.Fatalf("Expected no message but got %+v", message)
+	}
+}
+
+func expectDone(t *testing.T, conn *Conn) {
+	t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case <-conn.Done():
+			return
+		case <-conn.Events():
+		case <-timeout:
+			t.Fatalf("Timed out waiting for connection to close")
+		}
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
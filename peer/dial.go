@@ -0,0 +1,135 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/peerwire"
+	"github.com/onepointsixtwo/torrentsgo/proxy"
+	"net"
+	"time"
+)
+
+const (
+	DEFAULT_HANDSHAKE_TIMEOUT = 20 * time.Second
+)
+
+var (
+	ErrSelfConnection = errors.New("Connected to ourselves")
+	ErrUnknownTorrent = errors.New("Peer handshake is for a torrent we aren't serving")
+)
+
+// Public Methods
+
+// Dial connects to a peer and exchanges handshakes, returning the connection and the remote
+// handshake. Peers which answer for a different torrent are disconnected.
+func Dial(ctx context.Context, dialer proxy.Dialer, address string, local *peerwire.Handshake) (net.Conn, *peerwire.Handshake, error) {
+	if dialer == nil {
+		dialer = proxy.Direct()
+	}
+	ctx, cancel := withHandshakeTimeout(ctx)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remote, err := handshake(ctx, conn, func() (*peerwire.Handshake, error) {
+		if err := peerwire.WriteHandshake(conn, local); err != nil {
+			return nil, err
+		}
+		remote, err := peerwire.ReadHandshake(conn)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(remote.InfoHash, local.InfoHash) {
+			return nil, fmt.Errorf("Peer answered with info hash %x instead of %x", remote.InfoHash, local.InfoHash)
+		}
+		if bytes.Equal(remote.PeerId, local.PeerId) {
+			return nil, ErrSelfConnection
+		}
+		return remote, nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, remote, nil
+}
+
+// Accept reads the handshake from an incoming connection and answers it with the handshake lookup
+// returns for the info hash. The connection is closed if the torrent isn't known.
+func Accept(ctx context.Context, conn net.Conn, lookup func(infoHash []byte) (*peerwire.Handshake, bool)) (*peerwire.Handshake, *peerwire.Handshake, error) {
+	ctx, cancel := withHandshakeTimeout(ctx)
+	defer cancel()
+
+	var local *peerwire.Handshake
+	remote, err := handshake(ctx, conn, func() (*peerwire.Handshake, error) {
+		remote, err := peerwire.ReadHandshake(conn)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if local, ok = lookup(remote.InfoHash); !ok {
+			return nil, ErrUnknownTorrent
+		}
+		if bytes.Equal(remote.PeerId, local.PeerId) {
+			return nil, ErrSelfConnection
+		}
+		if err := peerwire.WriteHandshake(conn, local); err != nil {
+			return nil, err
+		}
+		return remote, nil
+	})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return local, remote, nil
+}
+
+// Helpers
+
+func withHandshakeTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DEFAULT_HANDSHAKE_TIMEOUT)
+}
+
+// handshake runs the exchange with the connection's deadline taken from the context, and closes
+// the connection early if the context is cancelled
+func handshake(ctx context.Context, conn net.Conn, run func() (*peerwire.Handshake, error)) (*peerwire.Handshake, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	remote, err := run()
+	close(stop)
+	<-stopped
+
+	// Once the context is done the watcher may have closed the connection, even if the exchange
+	// finished first
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	// The connection deadline can fire just before the context's
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return nil, context.DeadlineExceeded
+	}
+	conn.SetDeadline(time.Time{})
+	return remote, err
+}
@@ -0,0 +1,156 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"github.com/onepointsixtwo/torrentsgo/peerwire"
+	"github.com/onepointsixtwo/torrentsgo/proxy"
+	"github.com/onepointsixtwo/torrentsgo/utp"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialAndAcceptExchangeHandshakes(t *testing.T) {
+	testDialAndAccept(t, listen(t), nil)
+}
+
+func TestDialAndAcceptOverUTP(t *testing.T) {
+	socket, err := utp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen %v", err)
+	}
+	t.Cleanup(func() { socket.Close() })
+	testDialAndAccept(t, socket, socket)
+}
+
+// testDialAndAccept exchanges handshakes over connections from the listener and dialer, which
+// may be nil for TCP
+func testDialAndAccept(t *testing.T, listener net.Listener, dialer proxy.Dialer) {
+	server := &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testOtherPeerId}
+	server.SetReserved(peerwire.RESERVED_FAST)
+
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		defer conn.Close()
+		local, remote, err := Accept(context.Background(), conn, func(infoHash []byte) (*peerwire.Handshake, bool) {
+			return server, bytes.Equal(infoHash, testInfoHash)
+		})
+		if err == nil && (local != server || !bytes.Equal(remote.PeerId, testPeerId)) {
+			t.Errorf("Unexpected handshakes from accept %+v %+v", local, remote)
+		}
+		accepted <- err
+	}()
+
+	conn, remote, err := Dial(context.Background(), dialer, listener.Addr().String(), &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testPeerId})
+	if err != nil {
+		t.Fatalf("Unexpected error dialling %v", err)
+	}
+	defer conn.Close()
+	if !bytes.Equal(remote.PeerId, testOtherPeerId) || !remote.HasReserved(peerwire.RESERVED_FAST) {
+		t.Errorf("Unexpected remote handshake %+v", remote)
+	}
+	if err := <-accepted; err != nil {
+		t.Errorf("Unexpected error accepting %v", err)
+	}
+}
+
+func TestAcceptRejectsUnknownTorrentAndSelf(t *testing.T) {
+	tests := map[string]struct {
+		infoHash []byte
+		peerId   []byte
+		expected error
+	}{
+		"unknown torrent": {infoHash: []byte("bbbbbbbbbbbbbbbbbbbb"), peerId: testPeerId, expected: ErrUnknownTorrent},
+		"self connection": {infoHash: testInfoHash, peerId: testOtherPeerId, expected: ErrSelfConnection},
+	}
+
+	for name, test := range tests {
+		local, remote := net.Pipe()
+		go peerwire.WriteHandshake(remote, &peerwire.Handshake{InfoHash: test.infoHash, PeerId: test.peerId})
+
+		_, _, err := Accept(context.Background(), local, func(infoHash []byte) (*peerwire.Handshake, bool) {
+			return &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testOtherPeerId}, bytes.Equal(infoHash, testInfoHash)
+		})
+		if err != test.expected {
+			t.Errorf("Expected %v error for %v but was %v", test.expected, name, err)
+		}
+		if _, err := remote.Write([]byte{0}); err == nil {
+			t.Errorf("Expected connection to be closed for %v", name)
+		}
+	}
+}
+
+func TestDialRejectsWrongInfoHash(t *testing.T) {
+	listener := listen(t)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		peerwire.ReadHandshake(conn)
+		peerwire.WriteHandshake(conn, &peerwire.Handshake{InfoHash: []byte("bbbbbbbbbbbbbbbbbbbb"), PeerId: testOtherPeerId})
+		conn.Read(make([]byte, 1))
+	}()
+
+	_, _, err := Dial(context.Background(), nil, listener.Addr().String(), &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testPeerId})
+	if err == nil {
+		t.Errorf("Expected error when peer answers for another torrent")
+	}
+}
+
+func TestDialHonoursContextDeadline(t *testing.T) {
+	listener := listen(t)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Never answer the handshake
+		ioutil.ReadAll(conn)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := Dial(ctx, nil, listener.Addr().String(), &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testPeerId})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded error but was %v", err)
+	}
+	if time.Since(start) > testTimeout {
+		t.Errorf("Expected dial to give up at the deadline")
+	}
+}
+
+func TestHandshakeFailsWhenCancelledAsItFinishes(t *testing.T) {
+	conn, other := net.Pipe()
+	defer other.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	remote, err := handshake(ctx, conn, func() (*peerwire.Handshake, error) {
+		// The exchange succeeds, but the context ends before the watcher is stopped
+		cancel()
+		return &peerwire.Handshake{InfoHash: testInfoHash, PeerId: testPeerId}, nil
+	})
+	if err != context.Canceled || remote != nil {
+		t.Errorf("Expected the cancellation rather than a handshake on a closed connection but was %v", err)
+	}
+}
+
+// Helpers
+
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
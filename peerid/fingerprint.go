@@ -0,0 +1,318 @@
+package peerid
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Types
+
+type Style int
+
+const (
+	STYLE_UNKNOWN Style = iota
+	STYLE_AZUREUS
+	STYLE_SHADOW
+	STYLE_MAINLINE
+	STYLE_OTHER
+)
+
+// Client describes the software a remote peer id belongs to
+type Client struct {
+	Name    string
+	Version string
+	Style   Style
+}
+
+const SHADOW_ALPHABET = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+var azureusClients = map[string]string{
+	"7T": "aTorrent",
+	"AB": "AnyEvent::BitTorrent",
+	"AG": "Ares",
+	"A~": "Ares",
+	"AR": "Arctic",
+	"AV": "Avicora",
+	"AT": "Artemis",
+	"AX": "BitPump",
+	"AZ": "Azureus",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BE": "Baretorrent",
+	"BF": "Bitflu",
+	"BG": "BTG",
+	"BI": "BiglyBT",
+	"BL": "BitCometLite",
+	"BP": "BitTorrent Pro",
+	"BR": "BitRocket",
+	"BS": "BTSlave",
+	"BT": "BitTorrent",
+	"Bt": "Bt",
+	"BW": "BitWombat",
+	"BX": "BittorrentX",
+	"CD": "Enhanced CTorrent",
+	"CT": "CTorrent",
+	"DE": "Deluge",
+	"DP": "Propagate Data Client",
+	"EB": "EBit",
+	"ES": "electric sheep",
+	"FC": "FileCroc",
+	"FD": "Free Download Manager",
+	"FT": "FoxTorrent",
+	"FX": "Freebox BitTorrent",
+	"GS": "GSTorrent",
+	"GT": "torrentsgo",
+	"HK": "Hekate",
+	"HL": "Halite",
+	"HM": "hMule",
+	"HN": "Hydranode",
+	"IL": "iLivid",
+	"JS": "Justseed.it client",
+	"JT": "JavaTorrent",
+	"KG": "KGet",
+	"KT": "KTorrent",
+	"LC": "LeechCraft",
+	"LH": "LH-ABC",
+	"LP": "Lphant",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"LW": "LimeWire",
+	"MK": "Meerkat",
+	"MO": "MonoTorrent",
+	"MP": "MooPolice",
+	"MR": "Miro",
+	"MT": "MoonlightTorrent",
+	"NB": "Net::BitTorrent",
+	"NX": "Net Transport",
+	"OS": "OneSwarm",
+	"OT": "OmegaTorrent",
+	"PB": "Protocol::BitTorrent",
+	"PD": "Pando",
+	"PI": "PicoTorrent",
+	"PT": "PHPTracker",
+	"qB": "qBittorrent",
+	"QD": "QQDownload",
+	"QT": "Qt 4 Torrent example",
+	"RT": "Retriever",
+	"RZ": "RezTorrent",
+	"S~": "Shareaza alpha/beta",
+	"SB": "Swiftbit",
+	"SD": "Thunder",
+	"SM": "SoMud",
+	"SP": "BitSpirit",
+	"SS": "SwarmScope",
+	"ST": "SymTorrent",
+	"st": "sharktorrent",
+	"SZ": "Shareaza",
+	"TB": "Torch",
+	"TE": "terasaur Seed Bank",
+	"TL": "Tribler",
+	"TN": "TorrentDotNET",
+	"TR": "Transmission",
+	"TS": "Torrentstorm",
+	"TT": "TuoTu",
+	"UL": "uLeecher!",
+	"UM": "µTorrent for Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"VG": "Vagaa",
+	"WD": "WebTorrent Desktop",
+	"WT": "BitLet",
+	"WW": "WebTorrent",
+	"WY": "FireTorrent",
+	"XF": "Xfplay",
+	"XL": "Xunlei",
+	"XS": "XSwifter",
+	"XT": "XanTorrent",
+	"XX": "Xtorrent",
+	"ZT": "ZipTorrent",
+	"A2": "aria2",
+	"BD": "BDownloader",
+}
+
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+var (
+	azureusPattern  = regexp.MustCompile(`^-([A-Za-z0-9~]{2})([A-Za-z0-9.]{4})-`)
+	mainlinePattern = regexp.MustCompile(`^([MQ])(\d{1,2})-(\d{1,2})-?(\d{1,2})-`)
+	xbtPattern      = regexp.MustCompile(`^XBT(\d)(\d)(\d)`)
+	operaPattern    = regexp.MustCompile(`^OP(\d{4})`)
+	mldonkeyPattern = regexp.MustCompile(`^-ML(\d+\.\d+\.\d+)`)
+)
+
+// Public Methods
+
+// Parse identifies the client which generated a peer id. Unrecognised ids give a client named
+// "Unknown" with STYLE_UNKNOWN.
+func Parse(peerId []byte) *Client {
+	id := string(peerId)
+
+	if client := parseOddStyle(id); client != nil {
+		return client
+	}
+	if match := azureusPattern.FindStringSubmatch(id); match != nil {
+		if name, ok := azureusClients[match[1]]; ok {
+			return &Client{Name: name, Version: azureusVersion(match[1], match[2]), Style: STYLE_AZUREUS}
+		}
+	}
+	if match := mainlinePattern.FindStringSubmatch(id); match != nil {
+		name := "BitTorrent"
+		if match[1] == "Q" {
+			name = "Queen Bee"
+		}
+		return &Client{Name: name, Version: match[2] + "." + match[3] + "." + match[4], Style: STYLE_MAINLINE}
+	}
+	if client := parseShadowStyle(id); client != nil {
+		return client
+	}
+	return &Client{Name: "Unknown", Style: STYLE_UNKNOWN}
+}
+
+func (client *Client) String() string {
+	if client.Version == "" {
+		return client.Name
+	}
+	return client.Name + " " + client.Version
+}
+
+// Azureus style, e.g. -UT3550-
+
+func azureusVersion(code string, version string) string {
+	switch code {
+	case "TR":
+		return transmissionVersion(version)
+	case "BC":
+		// BitComet uses -BC0152- for 1.52
+		major, _ := strconv.Atoi(version[0:2])
+		return fmt.Sprintf("%v.%v", major, version[2:4])
+	}
+
+	if strings.Contains(version, ".") {
+		return strings.Trim(version, ".")
+	}
+
+	digits := make([]string, 0, 4)
+	for i := 0; i < len(version); i++ {
+		digits = append(digits, strconv.Itoa(versionDigit(version[i])))
+	}
+	// The last character is usually a build number which is rarely anything but zero
+	for len(digits) > 2 && digits[len(digits)-1] == "0" {
+		digits = digits[:len(digits)-1]
+	}
+	return strings.Join(digits, ".")
+}
+
+// transmissionVersion handles 0.72 being sent as 0072, 2.94 as 2940 and, from 4.0, 4.0.5 as 4050.
+// A trailing Z or X marks a development build.
+func transmissionVersion(version string) string {
+	suffix := ""
+	if last := version[3]; last == 'Z' || last == 'X' {
+		suffix = "+"
+	}
+
+	major := versionDigit(version[0])
+	switch {
+	case major == 0:
+		minor, _ := strconv.Atoi(version[2:4])
+		return fmt.Sprintf("0.%v%v", minor, suffix)
+	case major < 4:
+		return fmt.Sprintf("%v.%v%v", major, version[1:3], suffix)
+	default:
+		return fmt.Sprintf("%v.%v.%v%v", major, versionDigit(version[1]), versionDigit(version[2]), suffix)
+	}
+}
+
+// Shadow style, e.g. S58B-----
+
+func parseShadowStyle(id string) *Client {
+	if len(id) < 6 {
+		return nil
+	}
+	name, ok := shadowClients[id[0]]
+	if !ok {
+		return nil
+	}
+
+	digits := make([]string, 0, 4)
+	for i := 1; i < 5; i++ {
+		if id[i] == '-' {
+			break
+		}
+		value := strings.IndexByte(SHADOW_ALPHABET, id[i])
+		if value < 0 {
+			return nil
+		}
+		digits = append(digits, strconv.Itoa(value))
+	}
+	// The version is padded with dashes to fill the first six characters
+	if len(digits) == 0 || strings.Trim(id[1+len(digits):6], "-") != "" {
+		return nil
+	}
+	return &Client{Name: name, Version: strings.Join(digits, "."), Style: STYLE_SHADOW}
+}
+
+// Other one-off styles
+
+func parseOddStyle(id string) *Client {
+	switch {
+	case strings.HasPrefix(id, "exbc") && len(id) >= 10:
+		name := "BitComet"
+		if id[6:10] == "LORD" {
+			name = "BitLord"
+		}
+		return &Client{Name: name, Version: fmt.Sprintf("%v.%02d", id[4], id[5]), Style: STYLE_OTHER}
+	case strings.HasPrefix(id, "FUTB"):
+		return &Client{Name: "BitComet", Style: STYLE_OTHER}
+	case strings.HasPrefix(id, "AZ2500BT"):
+		return &Client{Name: "BitTyrant", Style: STYLE_OTHER}
+	case strings.HasPrefix(id, "Deadman Walking-"):
+		return &Client{Name: "Deadman", Style: STYLE_OTHER}
+	case strings.HasPrefix(id, "Plus"):
+		return &Client{Name: "Plus!", Style: STYLE_OTHER}
+	case strings.HasPrefix(id, "turbobt") && len(id) >= 12:
+		return &Client{Name: "TurboBT", Version: strings.TrimRight(id[7:12], "\x00-"), Style: STYLE_OTHER}
+	case strings.HasPrefix(id, "btpd"):
+		return &Client{Name: "BT Protocol Daemon", Style: STYLE_OTHER}
+	case strings.HasPrefix(id, "LIME"):
+		return &Client{Name: "LimeWire", Style: STYLE_OTHER}
+	case len(id) >= 4 && id[2:4] == "BS" && id[0] == 0:
+		return &Client{Name: "BitSpirit", Style: STYLE_OTHER}
+	}
+
+	if match := xbtPattern.FindStringSubmatch(id); match != nil {
+		return &Client{Name: "XBT Client", Version: match[1] + "." + match[2] + "." + match[3], Style: STYLE_OTHER}
+	}
+	if match := operaPattern.FindStringSubmatch(id); match != nil {
+		return &Client{Name: "Opera", Version: match[1], Style: STYLE_OTHER}
+	}
+	if match := mldonkeyPattern.FindStringSubmatch(id); match != nil {
+		return &Client{Name: "MLDonkey", Version: match[1], Style: STYLE_OTHER}
+	}
+	return nil
+}
+
+// Helpers
+
+// versionDigit reads 0-9 as themselves and letters as 10 upwards, as used by Deluge's -DE13F0-
+func versionDigit(c byte) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 36
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,63 @@
+package peerid
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		peerId  string
+		name    string
+		version string
+		style   Style
+	}{
+		// Azureus style
+		{"-UT3550-abcdefghijkl", "µTorrent", "3.5.5", STYLE_AZUREUS},
+		{"-qB4250-abcdefghijkl", "qBittorrent", "4.2.5", STYLE_AZUREUS},
+		{"-LT1210-abcdefghijkl", "libtorrent", "1.2.1", STYLE_AZUREUS},
+		{"-DE13F0-abcdefghijkl", "Deluge", "1.3.15", STYLE_AZUREUS},
+		{"-AZ5770-abcdefghijkl", "Azureus", "5.7.7", STYLE_AZUREUS},
+		{"-TR2940-abcdefghijkl", "Transmission", "2.94", STYLE_AZUREUS},
+		{"-TR0072-abcdefghijkl", "Transmission", "0.72", STYLE_AZUREUS},
+		{"-TR4050-abcdefghijkl", "Transmission", "4.0.5", STYLE_AZUREUS},
+		{"-TR300Z-abcdefghijkl", "Transmission", "3.00+", STYLE_AZUREUS},
+		{"-BC0152-abcdefghijkl", "BitComet", "1.52", STYLE_AZUREUS},
+		{"-A2.2.3-abcdefghijkl", "aria2", "2.3", STYLE_AZUREUS},
+		// Shadow style
+		{"S58B-----abcdefghijk", "Shadow's client", "5.8.11", STYLE_SHADOW},
+		{"T03I--00abcdefghijkl", "BitTornado", "0.3.18", STYLE_SHADOW},
+		{"A310--abcdefghijklmn", "ABC", "3.1.0", STYLE_SHADOW},
+		// Mainline style
+		{"M4-3-6--abcdefghijkl", "BitTorrent", "4.3.6", STYLE_MAINLINE},
+		{"M4-20-8-abcdefghijkl", "BitTorrent", "4.20.8", STYLE_MAINLINE},
+		{"Q1-10-0-abcdefghijkl", "Queen Bee", "1.10.0", STYLE_MAINLINE},
+		// Others
+		{"exbc\x00\x38LORDabcdefghij", "BitLord", "0.56", STYLE_OTHER},
+		{"exbc\x00\x38abcdefghijklmn", "BitComet", "0.56", STYLE_OTHER},
+		{"XBT054d-abcdefghijkl", "XBT Client", "0.5.4", STYLE_OTHER},
+		{"OP7560abcdefghijklmn", "Opera", "7560", STYLE_OTHER},
+		{"-ML2.7.2-kgjjfkd1234", "MLDonkey", "2.7.2", STYLE_OTHER},
+		{"AZ2500BTabcdefghijkl", "BitTyrant", "", STYLE_OTHER},
+		{"\x00\x03BSabcdefghijklmnop", "BitSpirit", "", STYLE_OTHER},
+		// Unknown
+		{"abcdefghijklmnopqrst", "Unknown", "", STYLE_UNKNOWN},
+		{"-ZZ1234-abcdefghijkl", "Unknown", "", STYLE_UNKNOWN},
+		{"", "Unknown", "", STYLE_UNKNOWN},
+	}
+
+	for _, c := range cases {
+		client := Parse([]byte(c.peerId))
+		if client.Name != c.name || client.Version != c.version || client.Style != c.style {
+			t.Errorf("Expected %q to parse as %v %v (style %v) but was %+v", c.peerId, c.name, c.version, c.style, client)
+		}
+	}
+}
+
+func TestClientString(t *testing.T) {
+	if s := Parse([]byte("-UT3550-abcdefghijkl")).String(); s != "µTorrent 3.5.5" {
+		t.Errorf("Unexpected client string %v", s)
+	}
+	if s := Parse([]byte("abcdefghijklmnopqrst")).String(); s != "Unknown" {
+		t.Errorf("Unexpected client string %v", s)
+	}
+}
@@ -0,0 +1,48 @@
+package peerid
+
+import (
+	"crypto/rand"
+	"fmt"
+)
+
+const (
+	PEER_ID_LENGTH      = 20
+	DEFAULT_CLIENT_CODE = "GT"
+	DEFAULT_VERSION     = "0001"
+	SUFFIX_CHARACTERS   = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+)
+
+// New returns a peer id for this client, such as -GT0001-k2Gx0pQz81aB
+func New() []byte {
+	peerId, _ := Generate(DEFAULT_CLIENT_CODE, DEFAULT_VERSION)
+	return peerId
+}
+
+// Generate returns an Azureus style peer id with a random suffix. The client code must be two
+// characters and the version four, e.g. Generate("GT", "0102") for version 0.1.0.2.
+func Generate(clientCode string, version string) ([]byte, error) {
+	if len(clientCode) != 2 {
+		return nil, fmt.Errorf("Client code must be 2 characters but was '%v'", clientCode)
+	}
+	if len(version) != 4 {
+		return nil, fmt.Errorf("Client version must be 4 characters but was '%v'", version)
+	}
+	for _, c := range version {
+		if versionDigit(byte(c)) < 0 {
+			return nil, fmt.Errorf("Client version '%v' must only contain digits and letters", version)
+		}
+	}
+
+	prefix := "-" + clientCode + version + "-"
+	peerId := make([]byte, PEER_ID_LENGTH)
+	copy(peerId, prefix)
+
+	random := make([]byte, PEER_ID_LENGTH-len(prefix))
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	for i, b := range random {
+		peerId[len(prefix)+i] = SUFFIX_CHARACTERS[int(b)%len(SUFFIX_CHARACTERS)]
+	}
+	return peerId, nil
+}
@@ -0,0 +1,48 @@
+package peerid
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	peerId := New()
+	if len(peerId) != PEER_ID_LENGTH {
+		t.Fatalf("Expected peer id of %v bytes but was %v", PEER_ID_LENGTH, len(peerId))
+	}
+	if !bytes.HasPrefix(peerId, []byte("-GT0001-")) {
+		t.Errorf("Unexpected peer id prefix %v", string(peerId))
+	}
+	if bytes.Equal(peerId, New()) {
+		t.Errorf("Expected peer ids to have random suffixes")
+	}
+
+	client := Parse(peerId)
+	if client.Name != "torrentsgo" || client.Version != "0.0.0.1" || client.Style != STYLE_AZUREUS {
+		t.Errorf("Unexpected client parsed from our own peer id %+v", client)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	peerId, err := Generate("XY", "1020")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !bytes.HasPrefix(peerId, []byte("-XY1020-")) || len(peerId) != PEER_ID_LENGTH {
+		t.Errorf("Unexpected peer id %v", string(peerId))
+	}
+	for _, c := range peerId[8:] {
+		if !bytes.ContainsRune([]byte(SUFFIX_CHARACTERS), rune(c)) {
+			t.Errorf("Unexpected character %q in random suffix", c)
+		}
+	}
+}
+
+func TestGenerateInvalid(t *testing.T) {
+	cases := [][]string{{"X", "0001"}, {"XYZ", "0001"}, {"XY", "001"}, {"XY", "00-1"}}
+	for _, c := range cases {
+		if _, err := Generate(c[0], c[1]); err == nil {
+			t.Errorf("Expected error generating peer id with client code '%v' and version '%v'", c[0], c[1])
+		}
+	}
+}
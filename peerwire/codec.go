@@ -0,0 +1,82 @@
+package peerwire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// Blocks are normally 16KiB, though some clients request up to 128KiB
+	MAX_BLOCK_LENGTH = 128 * 1024
+	// The largest piece message, which also allows a bitfield for a million pieces
+	DEFAULT_MAX_MESSAGE_LENGTH = 1 + 8 + MAX_BLOCK_LENGTH
+)
+
+// Types
+
+// Reader reads length-prefixed messages. Messages longer than MaxMessageLength are refused
+// before anything is allocated for them.
+type Reader struct {
+	reader           io.Reader
+	MaxMessageLength int
+}
+
+// Writer writes messages, each with a single write. It is not safe for concurrent use.
+type Writer struct {
+	writer io.Writer
+}
+
+// Initialiser
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{reader: reader, MaxMessageLength: DEFAULT_MAX_MESSAGE_LENGTH}
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{writer: writer}
+}
+
+// Public Methods
+
+func (r *Reader) ReadMessage() (Message, error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r.reader, prefix); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix)
+	if length == 0 {
+		return &KeepAlive{}, nil
+	}
+	if length > uint32(r.MaxMessageLength) {
+		return nil, fmt.Errorf("Peer message of %v bytes exceeds maximum length of %v", length, r.MaxMessageLength)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return decodeMessage(MessageId(data[0]), data[1:])
+}
+
+func (w *Writer) WriteMessage(message Message) error {
+	_, err := w.writer.Write(Encode(message))
+	return err
+}
+
+// Encode returns the message with its length prefix, as sent on the wire
+func Encode(message Message) []byte {
+	if _, ok := message.(*KeepAlive); ok {
+		return []byte{0, 0, 0, 0}
+	}
+
+	buffer := make([]byte, 5, 64)
+	buffer[4] = byte(message.Id())
+	buffer = message.appendPayload(buffer)
+	binary.BigEndian.PutUint32(buffer, uint32(len(buffer)-4))
+	return buffer
+}
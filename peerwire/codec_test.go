@@ -0,0 +1,66 @@
+package peerwire
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestReaderReadsSequence(t *testing.T) {
+	buffer := bytes.NewBuffer(nil)
+	writer := NewWriter(buffer)
+	messages := []Message{&Interested{}, &KeepAlive{}, &Have{Index: 3}, &Piece{Index: 3, Begin: 0, Block: make([]byte, 16384)}}
+	for _, message := range messages {
+		if err := writer.WriteMessage(message); err != nil {
+			t.Fatalf("Unexpected write error %v", err)
+		}
+	}
+
+	reader := NewReader(buffer)
+	for _, expected := range messages {
+		message, err := reader.ReadMessage()
+		if err != nil {
+			t.Fatalf("Unexpected read error %v", err)
+		}
+		if message.Id() != expected.Id() {
+			t.Errorf("Expected %v but read %v", expected.Id(), message.Id())
+		}
+	}
+	if _, err := reader.ReadMessage(); err != io.EOF {
+		t.Errorf("Expected EOF after last message but got %v", err)
+	}
+}
+
+func TestReaderLimits(t *testing.T) {
+	cases := []struct {
+		name      string
+		maxLength int
+		data      []byte
+		expectErr bool
+	}{
+		{"at limit", 13, Encode(&Request{Index: 1, Length: 16384}), false},
+		{"over limit", 12, Encode(&Request{Index: 1, Length: 16384}), true},
+		{"huge length prefix", DEFAULT_MAX_MESSAGE_LENGTH, []byte{0xFF, 0xFF, 0xFF, 0xFF, 7}, true},
+		{"largest piece", DEFAULT_MAX_MESSAGE_LENGTH, Encode(&Piece{Block: make([]byte, MAX_BLOCK_LENGTH)}), false},
+		{"piece over block limit", DEFAULT_MAX_MESSAGE_LENGTH, Encode(&Piece{Block: make([]byte, MAX_BLOCK_LENGTH+1)}), true},
+	}
+
+	for _, c := range cases {
+		reader := NewReader(bytes.NewReader(c.data))
+		reader.MaxMessageLength = c.maxLength
+		_, err := reader.ReadMessage()
+		if (err != nil) != c.expectErr {
+			t.Errorf("Reading %v expected error %v but got %v", c.name, c.expectErr, err)
+		}
+	}
+}
+
+func TestReaderTruncatedMessage(t *testing.T) {
+	encoded := Encode(&Have{Index: 1})
+	for length := 1; length < len(encoded); length++ {
+		_, err := NewReader(bytes.NewReader(encoded[:length])).ReadMessage()
+		if err == nil || err == io.EOF {
+			t.Errorf("Expected unexpected EOF reading %v of %v bytes but got %v", length, len(encoded), err)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package peerwire
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+const (
+	// How many pieces a peer may request while choked, the number suggested by BEP 6
+	ALLOWED_FAST_COUNT = 10
+)
+
+// Public Methods
+
+// AllowedFastSet generates the pieces a peer at ip may request while choked, using the canonical
+// algorithm from BEP 6. The set only depends on the /24 network of the peer so peers can't get
+// more pieces by connecting from several addresses. BEP 6 only defines the set for IPv4, so IPv6
+// peers get none.
+func AllowedFastSet(k int, numPieces int, infoHash []byte, ip net.IP) []uint32 {
+	ip = ip.To4()
+	if ip == nil || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 4+len(infoHash))
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash...)
+
+	set := make([]uint32, 0, k)
+	chosen := make(map[uint32]bool, k)
+	for len(set) < k {
+		hash := sha1.Sum(x)
+		x = hash[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces)
+			if !chosen[index] {
+				chosen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
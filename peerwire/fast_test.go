@@ -0,0 +1,40 @@
+package peerwire
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSetMatchesSpecification(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, HASH_LENGTH)
+	ip := net.ParseIP("80.4.4.200")
+
+	// The examples given in BEP 6
+	seven := AllowedFastSet(7, 1313, infoHash, ip)
+	if expected := []uint32{1059, 431, 808, 1217, 287, 376, 1188}; !reflect.DeepEqual(seven, expected) {
+		t.Errorf("Expected %v but was %v", expected, seven)
+	}
+	nine := AllowedFastSet(9, 1313, infoHash, ip)
+	if expected := []uint32{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}; !reflect.DeepEqual(nine, expected) {
+		t.Errorf("Expected %v but was %v", expected, nine)
+	}
+
+	// Only the /24 network matters
+	if other := AllowedFastSet(7, 1313, infoHash, net.ParseIP("80.4.4.1")); !reflect.DeepEqual(other, seven) {
+		t.Errorf("Expected the same set for the same network but was %v", other)
+	}
+}
+
+func TestAllowedFastSetLimits(t *testing.T) {
+	infoHash := bytes.Repeat([]byte{0xaa}, HASH_LENGTH)
+
+	set := AllowedFastSet(ALLOWED_FAST_COUNT, 4, infoHash, net.ParseIP("10.0.0.1"))
+	if len(set) != 4 {
+		t.Errorf("Expected the set to be limited to every piece but was %v", set)
+	}
+	if set := AllowedFastSet(ALLOWED_FAST_COUNT, 100, infoHash, net.ParseIP("2001:db8::1")); set != nil {
+		t.Errorf("Expected no set for IPv6 but was %v", set)
+	}
+}
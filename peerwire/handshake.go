@@ -0,0 +1,79 @@
+package peerwire
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"io"
+)
+
+const (
+	PROTOCOL         = "BitTorrent protocol"
+	HANDSHAKE_LENGTH = 1 + len(PROTOCOL) + 8 + 20 + 20
+	HASH_LENGTH      = 20
+	PEER_ID_LENGTH   = 20
+)
+
+// Reserved bits, numbered from the most significant bit of the first reserved byte (BEP 4)
+const (
+	RESERVED_EXTENSION_PROTOCOL = 43
+	RESERVED_FAST               = 61
+	RESERVED_DHT                = 63
+)
+
+// Types
+
+// Handshake is the first thing each side sends on a connection
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash []byte
+	PeerId   []byte
+}
+
+// Initialiser
+
+func NewHandshake(info *model.Info, peerId []byte) *Handshake {
+	return &Handshake{InfoHash: info.Hash, PeerId: peerId}
+}
+
+// Public Methods
+
+func (h *Handshake) SetReserved(bit int) {
+	h.Reserved[bit/8] |= 0x80 >> uint(bit%8)
+}
+
+func (h *Handshake) HasReserved(bit int) bool {
+	return h.Reserved[bit/8]&(0x80>>uint(bit%8)) != 0
+}
+
+func WriteHandshake(writer io.Writer, h *Handshake) error {
+	if len(h.InfoHash) != HASH_LENGTH || len(h.PeerId) != PEER_ID_LENGTH {
+		return fmt.Errorf("Handshake info hash and peer id must both be 20 bytes")
+	}
+
+	buffer := make([]byte, 0, HANDSHAKE_LENGTH)
+	buffer = append(buffer, byte(len(PROTOCOL)))
+	buffer = append(buffer, PROTOCOL...)
+	buffer = append(buffer, h.Reserved[:]...)
+	buffer = append(buffer, h.InfoHash...)
+	buffer = append(buffer, h.PeerId...)
+	_, err := writer.Write(buffer)
+	return err
+}
+
+func ReadHandshake(reader io.Reader) (*Handshake, error) {
+	buffer := make([]byte, HANDSHAKE_LENGTH)
+	if _, err := io.ReadFull(reader, buffer); err != nil {
+		return nil, err
+	}
+	if int(buffer[0]) != len(PROTOCOL) || !bytes.Equal(buffer[1:1+len(PROTOCOL)], []byte(PROTOCOL)) {
+		return nil, fmt.Errorf("Peer handshake is not for the BitTorrent protocol")
+	}
+
+	h := &Handshake{}
+	offset := 1 + len(PROTOCOL)
+	copy(h.Reserved[:], buffer[offset:offset+8])
+	h.InfoHash = buffer[offset+8 : offset+8+HASH_LENGTH]
+	h.PeerId = buffer[offset+8+HASH_LENGTH:]
+	return h, nil
+}
@@ -0,0 +1,80 @@
+package peerwire
+
+import (
+	"bytes"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"io"
+	"testing"
+)
+
+var (
+	testInfoHash = []byte("aaaaaaaaaaaaaaaaaaaa")
+	testPeerId   = []byte("-GT0001-123456789012")
+)
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	info := &model.Info{Hash: testInfoHash}
+	h := NewHandshake(info, testPeerId)
+	h.SetReserved(RESERVED_EXTENSION_PROTOCOL)
+	h.SetReserved(RESERVED_FAST)
+	h.SetReserved(RESERVED_DHT)
+
+	buffer := bytes.NewBuffer(nil)
+	if err := WriteHandshake(buffer, h); err != nil {
+		t.Fatalf("Unexpected error writing handshake %v", err)
+	}
+	if buffer.Len() != HANDSHAKE_LENGTH || HANDSHAKE_LENGTH != 68 {
+		t.Errorf("Expected handshake of 68 bytes but was %v", buffer.Len())
+	}
+
+	expectedReserved := []byte{0, 0, 0, 0, 0, 0x10, 0, 0x05}
+	if !bytes.Equal(buffer.Bytes()[20:28], expectedReserved) {
+		t.Errorf("Expected reserved bytes %v but were %v", expectedReserved, buffer.Bytes()[20:28])
+	}
+
+	read, err := ReadHandshake(buffer)
+	if err != nil {
+		t.Fatalf("Unexpected error reading handshake %v", err)
+	}
+	if !bytes.Equal(read.InfoHash, testInfoHash) || !bytes.Equal(read.PeerId, testPeerId) {
+		t.Errorf("Unexpected handshake %+v", read)
+	}
+	if !read.HasReserved(RESERVED_EXTENSION_PROTOCOL) || !read.HasReserved(RESERVED_FAST) || !read.HasReserved(RESERVED_DHT) || read.HasReserved(0) {
+		t.Errorf("Unexpected reserved bits %v", read.Reserved)
+	}
+}
+
+func TestReadHandshakeErrors(t *testing.T) {
+	valid := bytes.NewBuffer(nil)
+	WriteHandshake(valid, &Handshake{InfoHash: testInfoHash, PeerId: testPeerId})
+
+	wrongProtocol := append([]byte{}, valid.Bytes()...)
+	wrongProtocol[1] = 'b'
+	wrongLength := append([]byte{}, valid.Bytes()...)
+	wrongLength[0] = 18
+
+	cases := map[string][]byte{
+		"truncated":      valid.Bytes()[:60],
+		"wrong protocol": wrongProtocol,
+		"wrong length":   wrongLength,
+		"empty":          {},
+	}
+	for name, data := range cases {
+		if _, err := ReadHandshake(bytes.NewReader(data)); err == nil {
+			t.Errorf("Expected error reading %v handshake", name)
+		}
+	}
+
+	if _, err := ReadHandshake(bytes.NewReader(nil)); err != io.EOF {
+		t.Errorf("Expected EOF reading from closed connection but got %v", err)
+	}
+}
+
+func TestWriteHandshakeValidatesLengths(t *testing.T) {
+	if err := WriteHandshake(bytes.NewBuffer(nil), &Handshake{InfoHash: testInfoHash[:19], PeerId: testPeerId}); err == nil {
+		t.Errorf("Expected error writing handshake with short info hash")
+	}
+	if err := WriteHandshake(bytes.NewBuffer(nil), &Handshake{InfoHash: testInfoHash, PeerId: nil}); err == nil {
+		t.Errorf("Expected error writing handshake without peer id")
+	}
+}
@@ -0,0 +1,322 @@
+package peerwire
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Types
+
+type MessageId byte
+
+const (
+	MESSAGE_CHOKE          MessageId = 0
+	MESSAGE_UNCHOKE        MessageId = 1
+	MESSAGE_INTERESTED     MessageId = 2
+	MESSAGE_NOT_INTERESTED MessageId = 3
+	MESSAGE_HAVE           MessageId = 4
+	MESSAGE_BITFIELD       MessageId = 5
+	MESSAGE_REQUEST        MessageId = 6
+	MESSAGE_PIECE          MessageId = 7
+	MESSAGE_CANCEL         MessageId = 8
+	MESSAGE_PORT           MessageId = 9
+
+	// Fast extension (BEP 6)
+	MESSAGE_SUGGEST_PIECE  MessageId = 0x0D
+	MESSAGE_HAVE_ALL       MessageId = 0x0E
+	MESSAGE_HAVE_NONE      MessageId = 0x0F
+	MESSAGE_REJECT_REQUEST MessageId = 0x10
+	MESSAGE_ALLOWED_FAST   MessageId = 0x11
+
+	// Extension protocol (BEP 10)
+	MESSAGE_EXTENDED MessageId = 20
+
+	// Keep-alives are sent as an empty message with no id, this value never appears on the wire
+	MESSAGE_KEEP_ALIVE MessageId = 0xFF
+)
+
+// Message is implemented by each message type. Messages with ids this package doesn't know are
+// read as *Unknown.
+type Message interface {
+	Id() MessageId
+	appendPayload(buffer []byte) []byte
+}
+
+type KeepAlive struct{}
+
+type Choke struct{}
+
+type Unchoke struct{}
+
+type Interested struct{}
+
+type NotInterested struct{}
+
+type Have struct {
+	Index uint32
+}
+
+// Bitfield holds one bit per piece, most significant bit first
+type Bitfield struct {
+	Bits []byte
+}
+
+type Request struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+type Piece struct {
+	Index uint32
+	Begin uint32
+	Block []byte
+}
+
+type Cancel struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// Port gives the peer's DHT port (BEP 5)
+type Port struct {
+	Port uint16
+}
+
+// SuggestPiece advises downloading a piece, usually one the peer has cached (BEP 6)
+type SuggestPiece struct {
+	Index uint32
+}
+
+// HaveAll and HaveNone replace the bitfield for peers with every piece or none (BEP 6)
+type HaveAll struct{}
+
+type HaveNone struct{}
+
+// RejectRequest tells the peer a request won't be answered (BEP 6)
+type RejectRequest struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+// AllowedFast lets the peer request a piece even while choked (BEP 6)
+type AllowedFast struct {
+	Index uint32
+}
+
+// Extended carries a message for an extension negotiated with the extension protocol (BEP 10).
+// ExtendedId 0 is the extension handshake.
+type Extended struct {
+	ExtendedId byte
+	Payload    []byte
+}
+
+type Unknown struct {
+	MessageId MessageId
+	Payload   []byte
+}
+
+// Public Methods
+
+func (*KeepAlive) Id() MessageId     { return MESSAGE_KEEP_ALIVE }
+func (*Choke) Id() MessageId         { return MESSAGE_CHOKE }
+func (*Unchoke) Id() MessageId       { return MESSAGE_UNCHOKE }
+func (*Interested) Id() MessageId    { return MESSAGE_INTERESTED }
+func (*NotInterested) Id() MessageId { return MESSAGE_NOT_INTERESTED }
+func (*Have) Id() MessageId          { return MESSAGE_HAVE }
+func (*Bitfield) Id() MessageId      { return MESSAGE_BITFIELD }
+func (*Request) Id() MessageId       { return MESSAGE_REQUEST }
+func (*Piece) Id() MessageId         { return MESSAGE_PIECE }
+func (*Cancel) Id() MessageId        { return MESSAGE_CANCEL }
+func (*Port) Id() MessageId          { return MESSAGE_PORT }
+func (*SuggestPiece) Id() MessageId  { return MESSAGE_SUGGEST_PIECE }
+func (*HaveAll) Id() MessageId       { return MESSAGE_HAVE_ALL }
+func (*HaveNone) Id() MessageId      { return MESSAGE_HAVE_NONE }
+func (*RejectRequest) Id() MessageId { return MESSAGE_REJECT_REQUEST }
+func (*AllowedFast) Id() MessageId   { return MESSAGE_ALLOWED_FAST }
+func (*Extended) Id() MessageId      { return MESSAGE_EXTENDED }
+func (m *Unknown) Id() MessageId     { return m.MessageId }
+
+func (id MessageId) String() string {
+	switch id {
+	case MESSAGE_CHOKE:
+		return "choke"
+	case MESSAGE_UNCHOKE:
+		return "unchoke"
+	case MESSAGE_INTERESTED:
+		return "interested"
+	case MESSAGE_NOT_INTERESTED:
+		return "not interested"
+	case MESSAGE_HAVE:
+		return "have"
+	case MESSAGE_BITFIELD:
+		return "bitfield"
+	case MESSAGE_REQUEST:
+		return "request"
+	case MESSAGE_PIECE:
+		return "piece"
+	case MESSAGE_CANCEL:
+		return "cancel"
+	case MESSAGE_PORT:
+		return "port"
+	case MESSAGE_SUGGEST_PIECE:
+		return "suggest piece"
+	case MESSAGE_HAVE_ALL:
+		return "have all"
+	case MESSAGE_HAVE_NONE:
+		return "have none"
+	case MESSAGE_REJECT_REQUEST:
+		return "reject request"
+	case MESSAGE_ALLOWED_FAST:
+		return "allowed fast"
+	case MESSAGE_EXTENDED:
+		return "extended"
+	case MESSAGE_KEEP_ALIVE:
+		return "keep-alive"
+	default:
+		return fmt.Sprintf("unknown (%v)", byte(id))
+	}
+}
+
+// Encoding
+
+func (*KeepAlive) appendPayload(buffer []byte) []byte     { return buffer }
+func (*Choke) appendPayload(buffer []byte) []byte         { return buffer }
+func (*Unchoke) appendPayload(buffer []byte) []byte       { return buffer }
+func (*Interested) appendPayload(buffer []byte) []byte    { return buffer }
+func (*NotInterested) appendPayload(buffer []byte) []byte { return buffer }
+func (*HaveAll) appendPayload(buffer []byte) []byte       { return buffer }
+func (*HaveNone) appendPayload(buffer []byte) []byte      { return buffer }
+
+func (m *Have) appendPayload(buffer []byte) []byte {
+	return appendUint32(buffer, m.Index)
+}
+
+func (m *Bitfield) appendPayload(buffer []byte) []byte {
+	return append(buffer, m.Bits...)
+}
+
+func (m *Request) appendPayload(buffer []byte) []byte {
+	return appendUint32(appendUint32(appendUint32(buffer, m.Index), m.Begin), m.Length)
+}
+
+func (m *Piece) appendPayload(buffer []byte) []byte {
+	return append(appendUint32(appendUint32(buffer, m.Index), m.Begin), m.Block...)
+}
+
+func (m *Cancel) appendPayload(buffer []byte) []byte {
+	return appendUint32(appendUint32(appendUint32(buffer, m.Index), m.Begin), m.Length)
+}
+
+func (m *Port) appendPayload(buffer []byte) []byte {
+	return append(buffer, byte(m.Port>>8), byte(m.Port))
+}
+
+func (m *SuggestPiece) appendPayload(buffer []byte) []byte {
+	return appendUint32(buffer, m.Index)
+}
+
+func (m *RejectRequest) appendPayload(buffer []byte) []byte {
+	return appendUint32(appendUint32(appendUint32(buffer, m.Index), m.Begin), m.Length)
+}
+
+func (m *AllowedFast) appendPayload(buffer []byte) []byte {
+	return appendUint32(buffer, m.Index)
+}
+
+func (m *Extended) appendPayload(buffer []byte) []byte {
+	return append(append(buffer, m.ExtendedId), m.Payload...)
+}
+
+func (m *Unknown) appendPayload(buffer []byte) []byte {
+	return append(buffer, m.Payload...)
+}
+
+// Decoding
+
+// decodeMessage builds the message for an id and payload. Fixed length messages must be
+// exactly the right length.
+func decodeMessage(id MessageId, payload []byte) (Message, error) {
+	switch id {
+	case MESSAGE_CHOKE, MESSAGE_UNCHOKE, MESSAGE_INTERESTED, MESSAGE_NOT_INTERESTED, MESSAGE_HAVE_ALL, MESSAGE_HAVE_NONE:
+		if err := expectLength(id, payload, 0); err != nil {
+			return nil, err
+		}
+		switch id {
+		case MESSAGE_CHOKE:
+			return &Choke{}, nil
+		case MESSAGE_UNCHOKE:
+			return &Unchoke{}, nil
+		case MESSAGE_INTERESTED:
+			return &Interested{}, nil
+		case MESSAGE_HAVE_ALL:
+			return &HaveAll{}, nil
+		case MESSAGE_HAVE_NONE:
+			return &HaveNone{}, nil
+		default:
+			return &NotInterested{}, nil
+		}
+	case MESSAGE_HAVE, MESSAGE_SUGGEST_PIECE, MESSAGE_ALLOWED_FAST:
+		if err := expectLength(id, payload, 4); err != nil {
+			return nil, err
+		}
+		index := binary.BigEndian.Uint32(payload)
+		switch id {
+		case MESSAGE_HAVE:
+			return &Have{Index: index}, nil
+		case MESSAGE_SUGGEST_PIECE:
+			return &SuggestPiece{Index: index}, nil
+		default:
+			return &AllowedFast{Index: index}, nil
+		}
+	case MESSAGE_BITFIELD:
+		return &Bitfield{Bits: payload}, nil
+	case MESSAGE_REQUEST, MESSAGE_CANCEL, MESSAGE_REJECT_REQUEST:
+		if err := expectLength(id, payload, 12); err != nil {
+			return nil, err
+		}
+		index := binary.BigEndian.Uint32(payload[0:4])
+		begin := binary.BigEndian.Uint32(payload[4:8])
+		length := binary.BigEndian.Uint32(payload[8:12])
+		switch id {
+		case MESSAGE_REQUEST:
+			return &Request{Index: index, Begin: begin, Length: length}, nil
+		case MESSAGE_CANCEL:
+			return &Cancel{Index: index, Begin: begin, Length: length}, nil
+		default:
+			return &RejectRequest{Index: index, Begin: begin, Length: length}, nil
+		}
+	case MESSAGE_PIECE:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("Piece message too short (%v bytes)", len(payload))
+		}
+		return &Piece{Index: binary.BigEndian.Uint32(payload[0:4]), Begin: binary.BigEndian.Uint32(payload[4:8]), Block: payload[8:]}, nil
+	case MESSAGE_PORT:
+		if err := expectLength(id, payload, 2); err != nil {
+			return nil, err
+		}
+		return &Port{Port: binary.BigEndian.Uint16(payload)}, nil
+	case MESSAGE_EXTENDED:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("Extended message has no extended id")
+		}
+		return &Extended{ExtendedId: payload[0], Payload: payload[1:]}, nil
+	default:
+		return &Unknown{MessageId: id, Payload: payload}, nil
+	}
+}
+
+// Helpers
+
+func expectLength(id MessageId, payload []byte, length int) error {
+	if len(payload) != length {
+		return fmt.Errorf("Expected %v message payload of %v bytes but was %v", id, length, len(payload))
+	}
+	return nil
+}
+
+func appendUint32(buffer []byte, value uint32) []byte {
+	return append(buffer, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
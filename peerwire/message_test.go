@@ -0,0 +1,90 @@
+package peerwire
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	cases := []struct {
+		name    string
+		message Message
+		encoded []byte
+	}{
+		{"keep-alive", &KeepAlive{}, []byte{0, 0, 0, 0}},
+		{"choke", &Choke{}, []byte{0, 0, 0, 1, 0}},
+		{"unchoke", &Unchoke{}, []byte{0, 0, 0, 1, 1}},
+		{"interested", &Interested{}, []byte{0, 0, 0, 1, 2}},
+		{"not interested", &NotInterested{}, []byte{0, 0, 0, 1, 3}},
+		{"have", &Have{Index: 0x01020304}, []byte{0, 0, 0, 5, 4, 1, 2, 3, 4}},
+		{"bitfield", &Bitfield{Bits: []byte{0xF0, 0x01}}, []byte{0, 0, 0, 3, 5, 0xF0, 0x01}},
+		{"request", &Request{Index: 1, Begin: 0x4000, Length: 0x4000}, []byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0}},
+		{"piece", &Piece{Index: 2, Begin: 16, Block: []byte("data")}, []byte{0, 0, 0, 13, 7, 0, 0, 0, 2, 0, 0, 0, 16, 'd', 'a', 't', 'a'}},
+		{"cancel", &Cancel{Index: 1, Begin: 0, Length: 0x4000}, []byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0}},
+		{"port", &Port{Port: 6881}, []byte{0, 0, 0, 3, 9, 0x1a, 0xe1}},
+		{"suggest piece", &SuggestPiece{Index: 3}, []byte{0, 0, 0, 5, 0x0D, 0, 0, 0, 3}},
+		{"have all", &HaveAll{}, []byte{0, 0, 0, 1, 0x0E}},
+		{"have none", &HaveNone{}, []byte{0, 0, 0, 1, 0x0F}},
+		{"reject request", &RejectRequest{Index: 1, Begin: 0x4000, Length: 0x4000}, []byte{0, 0, 0, 13, 0x10, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0}},
+		{"allowed fast", &AllowedFast{Index: 0x0102}, []byte{0, 0, 0, 5, 0x11, 0, 0, 1, 2}},
+		{"extended", &Extended{ExtendedId: 3, Payload: []byte("d1:xi1ee")}, []byte{0, 0, 0, 10, 20, 3, 'd', '1', ':', 'x', 'i', '1', 'e', 'e'}},
+		{"unknown", &Unknown{MessageId: 30, Payload: []byte{0, 'x'}}, []byte{0, 0, 0, 3, 30, 0, 'x'}},
+	}
+
+	for _, c := range cases {
+		encoded := Encode(c.message)
+		if !bytes.Equal(encoded, c.encoded) {
+			t.Errorf("Unexpected encoding of %v: %v", c.name, encoded)
+			continue
+		}
+
+		decoded, err := NewReader(bytes.NewReader(encoded)).ReadMessage()
+		if err != nil {
+			t.Errorf("Unexpected error decoding %v: %v", c.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(decoded, c.message) {
+			t.Errorf("Decoded %v as %#v", c.name, decoded)
+		}
+	}
+}
+
+func TestMessageWrongLengths(t *testing.T) {
+	cases := map[string][]byte{
+		"choke with payload":    {0, 0, 0, 2, 0, 1},
+		"short have":            {0, 0, 0, 4, 4, 0, 0, 1},
+		"long have":             {0, 0, 0, 6, 4, 0, 0, 0, 1, 0},
+		"short request":         {0, 0, 0, 12, 6, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0},
+		"short piece":           {0, 0, 0, 8, 7, 0, 0, 0, 1, 0, 0, 0},
+		"long cancel":           {0, 0, 0, 14, 8, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0, 0},
+		"short port":            {0, 0, 0, 2, 9, 1},
+		"not interested byte":   {0, 0, 0, 2, 3, 0},
+		"have all with payload": {0, 0, 0, 2, 0x0E, 1},
+		"short suggest":         {0, 0, 0, 3, 0x0D, 0, 1},
+		"short reject":          {0, 0, 0, 5, 0x10, 0, 0, 0, 1},
+		"long allowed fast":     {0, 0, 0, 6, 0x11, 0, 0, 0, 1, 0},
+		"empty extended":        {0, 0, 0, 1, 20},
+	}
+	for name, data := range cases {
+		if _, err := NewReader(bytes.NewReader(data)).ReadMessage(); err == nil {
+			t.Errorf("Expected error reading %v", name)
+		}
+	}
+}
+
+func TestMessageIdString(t *testing.T) {
+	cases := map[MessageId]string{
+		MESSAGE_CHOKE:          "choke",
+		MESSAGE_NOT_INTERESTED: "not interested",
+		MESSAGE_PORT:           "port",
+		MESSAGE_REJECT_REQUEST: "reject request",
+		MESSAGE_KEEP_ALIVE:     "keep-alive",
+		MessageId(42):          "unknown (42)",
+	}
+	for id, expected := range cases {
+		if id.String() != expected {
+			t.Errorf("Expected %v but was %v", expected, id.String())
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package pex
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/extension"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"time"
+)
+
+const (
+	EXTENSION_NAME = "ut_pex"
+	// Each peer is sent a message at most once in this interval
+	INTERVAL = time.Minute
+	// Messages from a peer arriving closer together than this are ignored
+	MIN_RECEIVE_INTERVAL = INTERVAL / 2
+	// Most peers added or dropped in one message, as BEP 11 recommends. Any more wait for the
+	// next message.
+	MAX_PEERS = 50
+)
+
+// Types
+
+type Config struct {
+	// AddPeers is given the addresses of peers we're told about
+	AddPeers func(addresses []string)
+	Clock    util.Clock
+}
+
+// Exchange is the ut_pex extension (BEP 11) for one torrent. It tells each peer which peers have
+// joined and left the swarm, and passes on the peers it is told about. It must only be used from
+// the goroutine running the torrent's sessions.
+type Exchange struct {
+	config   Config
+	handlers []*handler
+}
+
+type handler struct {
+	exchange *Exchange
+	session  *extension.Session
+	// sent holds the peers the remote has been told are in the swarm, by address
+	sent         map[string]Peer
+	lastSent     time.Time
+	lastReceived time.Time
+}
+
+// Initialiser
+
+func NewExchange(config Config) *Exchange {
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+	return &Exchange{config: config}
+}
+
+// Public Methods
+
+func (e *Exchange) Name() string {
+	return EXTENSION_NAME
+}
+
+func (e *Exchange) NewHandler(session *extension.Session) extension.Handler {
+	h := &handler{exchange: e, session: session, sent: make(map[string]Peer)}
+	e.handlers = append(e.handlers, h)
+	return h
+}
+
+// Tick sends peers the changes to the swarm since their last message, given the peers we're
+// connected to which accept connections. It should be called regularly, and sends to each peer
+// at most once per INTERVAL.
+func (e *Exchange) Tick(peers []Peer) {
+	now := e.config.Clock.Now()
+	current := make(map[string]Peer, len(peers))
+	for _, p := range peers {
+		current[p.Address()] = p
+	}
+
+	for _, h := range e.handlers {
+		if !h.session.Supports(EXTENSION_NAME) || (!h.lastSent.IsZero() && now.Sub(h.lastSent) < INTERVAL) {
+			continue
+		}
+		h.sendChanges(current, now)
+	}
+}
+
+// Handler
+
+func (h *handler) Handshake(remote *extension.Handshake) {}
+
+func (h *handler) Message(payload []byte) error {
+	m, err := ParseMessage(payload)
+	if err != nil {
+		return err
+	}
+
+	now := h.exchange.config.Clock.Now()
+	if !h.lastReceived.IsZero() && now.Sub(h.lastReceived) < MIN_RECEIVE_INTERVAL {
+		return nil
+	}
+	h.lastReceived = now
+
+	added := m.Added
+	if len(added) > MAX_PEERS {
+		added = added[:MAX_PEERS]
+	}
+	addresses := make([]string, 0, len(added))
+	for _, p := range added {
+		if p.Port > 0 && !p.IP.IsUnspecified() {
+			addresses = append(addresses, p.Address())
+		}
+	}
+	if len(addresses) > 0 && h.exchange.config.AddPeers != nil {
+		h.exchange.config.AddPeers(addresses)
+	}
+	return nil
+}
+
+func (h *handler) Close() {
+	handlers := h.exchange.handlers
+	for i, other := range handlers {
+		if other == h {
+			h.exchange.handlers = append(handlers[:i], handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+// Helpers
+
+func (h *handler) sendChanges(current map[string]Peer, now time.Time) {
+	m := &Message{}
+	for address, p := range current {
+		if len(m.Added) >= MAX_PEERS {
+			break
+		}
+		if _, sent := h.sent[address]; !sent && !h.isRemote(p) {
+			m.Added = append(m.Added, p)
+		}
+	}
+	for address, p := range h.sent {
+		if len(m.Dropped) >= MAX_PEERS {
+			break
+		}
+		if _, ok := current[address]; !ok {
+			m.Dropped = append(m.Dropped, p)
+		}
+	}
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		return
+	}
+
+	payload, err := m.Encode()
+	if err != nil || h.session.Send(EXTENSION_NAME, payload) != nil {
+		return
+	}
+	for _, p := range m.Added {
+		h.sent[p.Address()] = p
+	}
+	for _, p := range m.Dropped {
+		delete(h.sent, p.Address())
+	}
+	h.lastSent = now
+}
+
+// isRemote reports whether p is the peer the handler is talking to
+func (h *handler) isRemote(p Peer) bool {
+	remote := h.session.Remote()
+	return remote != nil && p.IP.Equal(h.session.RemoteIP()) && p.Port == remote.Port
+}
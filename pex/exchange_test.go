@@ -0,0 +1,145 @@
+package pex
+
+import (
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/extension"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"net"
+	"testing"
+	"time"
+)
+
+type pair struct {
+	local  *Exchange
+	clock  *mock.MockClock
+	sent   []*Message
+	added  [][]string
+	handle func(payload []byte) error
+}
+
+func TestSendsSwarmChangesOncePerInterval(t *testing.T) {
+	p := newPair(t)
+	peers := testPeers(3)
+
+	p.local.Tick(peers)
+	if len(p.sent) != 1 || len(p.sent[0].Added) != 3 || len(p.sent[0].Dropped) != 0 {
+		t.Fatalf("Expected the whole swarm to be sent first but was %+v", p.sent)
+	}
+
+	// Changes wait for the interval
+	p.clock.Advance(INTERVAL / 2)
+	p.local.Tick(peers[1:])
+	if len(p.sent) != 1 {
+		t.Fatalf("Expected no message before the interval was up")
+	}
+	p.clock.Advance(INTERVAL / 2)
+	p.local.Tick(append(peers[1:], testPeers(4)[3]))
+	if len(p.sent) != 2 || len(p.sent[1].Added) != 1 || len(p.sent[1].Dropped) != 1 || p.sent[1].Dropped[0].Address() != peers[0].Address() {
+		t.Fatalf("Expected one added and one dropped but was %+v", p.sent[1])
+	}
+
+	// Nothing is sent when nothing has changed
+	p.clock.Advance(INTERVAL)
+	p.local.Tick(append(peers[1:], testPeers(4)[3]))
+	if len(p.sent) != 2 {
+		t.Errorf("Expected no message without changes")
+	}
+}
+
+func TestPeersAreNotSentThemselves(t *testing.T) {
+	p := newPair(t)
+	peers := append(testPeers(2), Peer{IP: net.ParseIP("192.168.1.2"), Port: 6881})
+	p.local.Tick(peers)
+	if len(p.sent) != 1 || len(p.sent[0].Added) != 2 {
+		t.Errorf("Expected the peer to be left out of its own message but was %+v", p.sent)
+	}
+}
+
+func TestMessagesAreCapped(t *testing.T) {
+	p := newPair(t)
+	peers := testPeers(MAX_PEERS + 10)
+
+	p.local.Tick(peers)
+	p.clock.Advance(INTERVAL)
+	p.local.Tick(peers)
+	if len(p.sent) != 2 || len(p.sent[0].Added) != MAX_PEERS || len(p.sent[1].Added) != 10 {
+		t.Errorf("Expected the rest of the swarm in the next message")
+	}
+}
+
+func TestReceivedPeersAreAdded(t *testing.T) {
+	p := newPair(t)
+	payload, _ := (&Message{Added: append(testPeers(MAX_PEERS+5), Peer{IP: net.IPv4zero, Port: 1})}).Encode()
+	if err := p.handle(payload); err != nil {
+		t.Fatalf("Unexpected error handling message %v", err)
+	}
+	if len(p.added) != 1 || len(p.added[0]) != MAX_PEERS {
+		t.Fatalf("Expected %v peers to be added but was %v", MAX_PEERS, p.added)
+	}
+
+	// Peers sending too often are ignored
+	p.clock.Advance(time.Second)
+	p.handle(payload)
+	if len(p.added) != 1 {
+		t.Errorf("Expected a message soon after the last to be ignored")
+	}
+	p.clock.Advance(INTERVAL)
+	p.handle(payload)
+	if len(p.added) != 2 {
+		t.Errorf("Expected a message after the interval to be used")
+	}
+
+	if err := p.handle([]byte("garbage")); err == nil {
+		t.Errorf("Expected an error for a malformed message")
+	}
+}
+
+func TestPeersWithoutPexAreSkipped(t *testing.T) {
+	clock := mock.NewMockClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	e := NewExchange(Config{Clock: clock})
+	sent := 0
+	r := extension.NewRegistry()
+	r.Register(e)
+	session := r.NewSession(extension.SessionConfig{}, func(id byte, payload []byte) { sent++ })
+	remote, _ := (&extension.Handshake{Extensions: map[string]byte{"ut_metadata": 1}}).Encode()
+	session.Handle(extension.HANDSHAKE_ID, remote)
+
+	e.Tick(testPeers(2))
+	if sent != 0 {
+		t.Errorf("Expected nothing sent to a peer without ut_pex")
+	}
+	session.Close()
+	if len(e.handlers) != 0 {
+		t.Errorf("Expected closed handlers to be removed")
+	}
+}
+
+// Helpers
+
+// newPair connects an exchange to a peer supporting ut_pex, recording what it is sent
+func newPair(t *testing.T) *pair {
+	p := &pair{clock: mock.NewMockClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))}
+	p.local = NewExchange(Config{Clock: p.clock, AddPeers: func(addresses []string) { p.added = append(p.added, addresses) }})
+	r := extension.NewRegistry()
+	r.Register(p.local)
+	session := r.NewSession(extension.SessionConfig{RemoteIP: net.ParseIP("192.168.1.2")}, func(id byte, payload []byte) {
+		m, err := ParseMessage(payload)
+		if id != extension.HANDSHAKE_ID && err == nil {
+			p.sent = append(p.sent, m)
+		}
+	})
+	remote, _ := (&extension.Handshake{Extensions: map[string]byte{EXTENSION_NAME: 3}, Port: 6881}).Encode()
+	if err := session.Handle(extension.HANDSHAKE_ID, remote); err != nil {
+		t.Fatalf("Unexpected error handling handshake %v", err)
+	}
+	p.handle = func(payload []byte) error { return session.Handle(1, payload) }
+	return p
+}
+
+func testPeers(count int) []Peer {
+	peers := make([]Peer, count)
+	for i := range peers {
+		peers[i] = Peer{IP: net.ParseIP(fmt.Sprintf("10.0.%v.%v", i/200, i%200+1)), Port: 6881}
+	}
+	return peers
+}
@@ -0,0 +1,148 @@
+package pex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"net"
+	"strconv"
+)
+
+type Flags byte
+
+// Flags describing a peer in an added list
+const (
+	FLAG_ENCRYPTION Flags = 0x01
+	FLAG_SEED       Flags = 0x02
+	FLAG_UTP        Flags = 0x04
+	FLAG_HOLEPUNCH  Flags = 0x08
+	// The sender connected out to the peer, so it accepts connections
+	FLAG_OUTGOING Flags = 0x10
+)
+
+const (
+	COMPACT_IPV4_LENGTH = 6
+	COMPACT_IPV6_LENGTH = 18
+	// Messages longer than this are refused
+	MAX_MESSAGE_LENGTH = 64 * 1024
+)
+
+// Types
+
+type Peer struct {
+	IP    net.IP
+	Port  int
+	Flags Flags
+}
+
+// Message is a ut_pex message (BEP 11), listing peers which have joined and left the sender's
+// swarm since its last message
+type Message struct {
+	Added   []Peer
+	Dropped []Peer
+}
+
+// Public Methods
+
+// Address returns the peer as host:port
+func (p Peer) Address() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+}
+
+// Encode writes IPv4 peers to added, added.f and dropped, and IPv6 peers to added6, added6.f and
+// dropped6
+func (m *Message) Encode() ([]byte, error) {
+	added, addedFlags := compactPeers(m.Added, false)
+	added6, added6Flags := compactPeers(m.Added, true)
+	dropped, _ := compactPeers(m.Dropped, false)
+	dropped6, _ := compactPeers(m.Dropped, true)
+
+	dict := model.NewOrderedMap()
+	dict.Add("added", string(added))
+	dict.Add("added.f", string(addedFlags))
+	dict.Add("added6", string(added6))
+	dict.Add("added6.f", string(added6Flags))
+	dict.Add("dropped", string(dropped))
+	dict.Add("dropped6", string(dropped6))
+	return bencoding.EncodeBencoding(dict)
+}
+
+// ParseMessage reads a ut_pex message. Missing lists are empty, and flags are optional.
+func ParseMessage(payload []byte) (*Message, error) {
+	if len(payload) > MAX_MESSAGE_LENGTH {
+		return nil, fmt.Errorf("Peer exchange message of %v bytes is too long", len(payload))
+	}
+	dict, err := bencoding.DecodeBencodingLimited(bytes.NewReader(payload), MAX_MESSAGE_LENGTH)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode peer exchange message - %v", err)
+	}
+
+	m := &Message{}
+	for _, family := range []struct {
+		suffix string
+		length int
+	}{{"", COMPACT_IPV4_LENGTH}, {"6", COMPACT_IPV6_LENGTH}} {
+		added, err := parsePeers(dict, "added"+family.suffix, family.length)
+		if err != nil {
+			return nil, err
+		}
+		if flags, ok := dict.Get("added" + family.suffix + ".f").(string); ok && len(flags) == len(added) {
+			for i := range added {
+				added[i].Flags = Flags(flags[i])
+			}
+		}
+		dropped, err := parsePeers(dict, "dropped"+family.suffix, family.length)
+		if err != nil {
+			return nil, err
+		}
+		m.Added = append(m.Added, added...)
+		m.Dropped = append(m.Dropped, dropped...)
+	}
+	return m, nil
+}
+
+// Helpers
+
+// compactPeers encodes either the IPv4 or IPv6 peers, with a byte of flags for each
+func compactPeers(peers []Peer, ipv6 bool) ([]byte, []byte) {
+	compact, flags := []byte{}, []byte{}
+	for _, p := range peers {
+		ip := p.IP.To4()
+		if ipv6 {
+			if ip != nil {
+				continue
+			}
+			ip = p.IP.To16()
+		}
+		if ip == nil {
+			continue
+		}
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, uint16(p.Port))
+		compact = append(append(compact, ip...), port...)
+		flags = append(flags, byte(p.Flags))
+	}
+	return compact, flags
+}
+
+func parsePeers(dict *model.OrderedMap, key string, entryLength int) ([]Peer, error) {
+	value, exists := dict.GetExists(key)
+	if !exists {
+		return nil, nil
+	}
+	data, ok := value.(string)
+	if !ok || len(data)%entryLength != 0 {
+		return nil, fmt.Errorf("Peer exchange '%v' is not a list of compact peers", key)
+	}
+
+	ipLength := entryLength - 2
+	peers := make([]Peer, 0, len(data)/entryLength)
+	for offset := 0; offset < len(data); offset += entryLength {
+		ip := make(net.IP, ipLength)
+		copy(ip, data[offset:offset+ipLength])
+		peers = append(peers, Peer{IP: ip, Port: int(binary.BigEndian.Uint16([]byte(data[offset+ipLength:])))})
+	}
+	return peers, nil
+}
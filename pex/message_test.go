@@ -0,0 +1,56 @@
+package pex
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	m := &Message{
+		Added: []Peer{
+			{IP: net.ParseIP("10.0.0.1"), Port: 6881, Flags: FLAG_SEED | FLAG_OUTGOING},
+			{IP: net.ParseIP("2001:db8::1"), Port: 51413, Flags: FLAG_UTP},
+		},
+		Dropped: []Peer{{IP: net.ParseIP("10.0.0.2"), Port: 1}},
+	}
+	data, err := m.Encode()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding message %v", err)
+	}
+	expected := "d5:added6:\x0a\x00\x00\x01\x1a\xe17:added.f1:\x126:added618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\xc8\xd5" +
+		"8:added6.f1:\x047:dropped6:\x0a\x00\x00\x02\x00\x018:dropped60:e"
+	if string(data) != expected {
+		t.Errorf("Expected %q but was %q", expected, data)
+	}
+
+	parsed, err := ParseMessage(data)
+	if err != nil {
+		t.Fatalf("Unexpected error parsing message %v", err)
+	}
+	if len(parsed.Added) != 2 || len(parsed.Dropped) != 1 {
+		t.Fatalf("Unexpected message %+v", parsed)
+	}
+	for i, p := range parsed.Added {
+		if !p.IP.Equal(m.Added[i].IP) || p.Port != m.Added[i].Port || p.Flags != m.Added[i].Flags {
+			t.Errorf("Expected %+v but was %+v", m.Added[i], p)
+		}
+	}
+	if parsed.Dropped[0].Address() != "10.0.0.2:1" {
+		t.Errorf("Unexpected dropped peer %v", parsed.Dropped[0].Address())
+	}
+}
+
+func TestParseMessageWithoutFlags(t *testing.T) {
+	m, err := ParseMessage([]byte("d5:added6:\x0a\x00\x00\x01\x1a\xe1e"))
+	if err != nil || len(m.Added) != 1 || m.Added[0].Flags != 0 || m.Added[0].Address() != "10.0.0.1:6881" {
+		t.Errorf("Expected a peer without flags but was %+v %v", m, err)
+	}
+}
+
+func TestParseMessageErrors(t *testing.T) {
+	for _, payload := range []string{"", "le", "d5:added5:12345e", "d7:droppedi1ee", "d6:added67:1234567e"} {
+		if _, err := ParseMessage([]byte(payload)); err == nil {
+			t.Errorf("Expected an error parsing %q", payload)
+		}
+	}
+}
@@ -0,0 +1,404 @@
+package picker
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/peer"
+	"math/rand"
+	"sort"
+)
+
+const (
+	// Pieces picked at random before switching to rarest first, so there is something to trade quickly
+	DEFAULT_RANDOM_FIRST_PIECES = 4
+)
+
+// Priority of a file. Pieces take the highest priority of the files they overlap.
+type Priority int
+
+const (
+	PRIORITY_SKIP   Priority = 0
+	PRIORITY_LOW    Priority = 1
+	PRIORITY_NORMAL Priority = 4
+	PRIORITY_HIGH   Priority = 7
+)
+
+// Types
+
+// Picker chooses which blocks to request from which peers. Peers are identified by any comparable
+// value, such as their connection. It is not safe for concurrent use.
+type Picker struct {
+	info         *model.Info
+	rand         *rand.Rand
+	numPieces    int
+	have         *model.Bitfield
+	availability []int
+	priorities   []Priority
+	files        []Priority
+	progress     map[int]*pieceProgress
+	endgame      bool
+	// rarity holds the pieces we want, kept in order as availability changes
+	rarity *rarity
+
+	// RandomFirstPieces is how many pieces are picked at random before rarest first takes over
+	RandomFirstPieces int
+}
+
+// pieceProgress tracks the blocks of a piece being downloaded
+type pieceProgress struct {
+	received    []bool
+	requesters  [][]interface{}
+	numReceived int
+}
+
+// Initialiser
+
+// NewPicker creates a picker for a torrent, given the pieces we already have (which may be nil)
+func NewPicker(info *model.Info, have *model.Bitfield, random *rand.Rand) *Picker {
+	numPieces := info.NumPieces()
+	p := &Picker{
+		info:              info,
+		rand:              random,
+		numPieces:         numPieces,
+		have:              model.NewBitfield(numPieces),
+		availability:      make([]int, numPieces),
+		priorities:        make([]Priority, numPieces),
+		files:             make([]Priority, len(info.Files)),
+		progress:          make(map[int]*pieceProgress),
+		RandomFirstPieces: DEFAULT_RANDOM_FIRST_PIECES,
+	}
+	if have != nil {
+		p.have.Or(have)
+	}
+	for file := range p.files {
+		p.files[file] = PRIORITY_NORMAL
+	}
+	p.updatePriorities()
+	return p
+}
+
+// Public Methods
+
+// PeerHave records a peer announcing a piece
+func (p *Picker) PeerHave(index int) {
+	if index >= 0 && index < p.numPieces {
+		p.changeAvailability(index, 1)
+	}
+}
+
+// PeerBitfield records every piece in a peer's bitfield
+func (p *Picker) PeerBitfield(bits *model.Bitfield) {
+	for index := bits.NextSet(0); index >= 0; index = bits.NextSet(index + 1) {
+		p.changeAvailability(index, 1)
+	}
+}
+
+// PeerLeft forgets a peer's pieces and returns its outstanding requests to be picked again
+func (p *Picker) PeerLeft(requester interface{}, bits *model.Bitfield) {
+	for index := bits.NextSet(0); index >= 0; index = bits.NextSet(index + 1) {
+		if p.availability[index] > 0 {
+			p.changeAvailability(index, -1)
+		}
+	}
+	for _, progress := range p.progress {
+		for block := range progress.requesters {
+			progress.requesters[block] = without(progress.requesters[block], requester)
+		}
+	}
+}
+
+// Availability returns how many peers have a piece
+func (p *Picker) Availability(index int) int {
+	return p.availability[index]
+}
+
+// SetFilePriority changes the priority of a file. Pieces only in skipped files are never picked.
+func (p *Picker) SetFilePriority(file int, priority Priority) {
+	p.files[file] = priority
+	p.updatePriorities()
+}
+
+func (p *Picker) FilePriority(file int) Priority {
+	return p.files[file]
+}
+
+// Pick chooses up to count blocks to request from a peer with the given bitfield. Pieces already
+// started are finished first, then the first few pieces are chosen at random and after that the
+// rarest pieces of the highest priority, breaking ties at random. Once every block wanted has been
+// requested the picker is in endgame and hands out blocks already requested from other peers.
+func (p *Picker) Pick(requester interface{}, bits *model.Bitfield, count int) []peer.Block {
+	picked := make([]peer.Block, 0, count)
+	if count == 0 {
+		return picked
+	}
+	p.eachCandidate(bits, func(index int) bool {
+		progress := p.progressFor(index)
+		for block := range progress.received {
+			if len(picked) == count {
+				break
+			}
+			if !progress.received[block] && len(progress.requesters[block]) == 0 {
+				progress.requesters[block] = append(progress.requesters[block], requester)
+				picked = append(picked, p.block(index, block))
+			}
+		}
+		return len(picked) < count
+	})
+
+	if len(picked) < count && !p.endgame && p.allRequested() {
+		p.endgame = true
+	}
+	if p.endgame {
+		picked = p.pickEndgame(requester, bits, picked, count)
+	}
+	return picked
+}
+
+// InEndgame reports whether every wanted block has been requested, so blocks are being
+// requested from more than one peer
+func (p *Picker) InEndgame() bool {
+	return p.endgame
+}
+
+// BlockReceived records a block arriving. It returns the other peers the block was requested from,
+// which should be sent cancels, and whether this completes the piece. Blocks that weren't wanted,
+// or already arrived from another peer, return false for accepted.
+func (p *Picker) BlockReceived(requester interface{}, block peer.Block) (cancels []interface{}, complete bool, accepted bool) {
+	progress, ok := p.progress[int(block.Index)]
+	blockIndex := int(block.Begin / peer.BLOCK_LENGTH)
+	if !ok || block.Begin%peer.BLOCK_LENGTH != 0 || blockIndex >= len(progress.received) || progress.received[blockIndex] {
+		return nil, false, false
+	}
+
+	progress.received[blockIndex] = true
+	progress.numReceived++
+	cancels = without(progress.requesters[blockIndex], requester)
+	progress.requesters[blockIndex] = nil
+	return cancels, progress.numReceived == len(progress.received), true
+}
+
+// Abort returns a block to be picked again, after a request was cancelled, rejected or timed out
+func (p *Picker) Abort(requester interface{}, block peer.Block) {
+	if progress, ok := p.progress[int(block.Index)]; ok {
+		blockIndex := int(block.Begin / peer.BLOCK_LENGTH)
+		if blockIndex < len(progress.requesters) {
+			progress.requesters[blockIndex] = without(progress.requesters[blockIndex], requester)
+		}
+	}
+}
+
+// PieceVerified marks a complete piece as one we have
+func (p *Picker) PieceVerified(index int) {
+	delete(p.progress, index)
+	if p.wanted(index) {
+		p.rarity.remove(index, p.priorities[index], p.availability[index])
+	}
+	p.have.Set(index)
+}
+
+// PieceFailed throws away the blocks of a piece which failed its hash check so it is downloaded again
+func (p *Picker) PieceFailed(index int) {
+	delete(p.progress, index)
+	p.endgame = false
+}
+
+func (p *Picker) Have(index int) bool {
+	return p.have.Test(index)
+}
+
+// Done reports whether we have every piece that isn't skipped
+func (p *Picker) Done() bool {
+	for index := p.have.NextClear(0); index >= 0; index = p.have.NextClear(index + 1) {
+		if p.priorities[index] != PRIORITY_SKIP {
+			return false
+		}
+	}
+	return true
+}
+
+// Helpers
+
+// eachCandidate visits the pieces the peer has which we want, in order of preference, until visit
+// returns false
+func (p *Picker) eachCandidate(bits *model.Bitfield, visit func(index int) bool) {
+	randomFirst := p.have.Count() < p.RandomFirstPieces
+
+	// Started pieces are few, so they can be sorted. Shuffling first and then sorting stably leaves
+	// equally good pieces in random order.
+	started := make([]int, 0, len(p.progress))
+	for index := range p.progress {
+		if bits.Test(index) && p.wanted(index) {
+			started = append(started, index)
+		}
+	}
+	sort.Ints(started)
+	p.rand.Shuffle(len(started), func(i, j int) {
+		started[i], started[j] = started[j], started[i]
+	})
+	sort.SliceStable(started, func(i, j int) bool {
+		a, b := started[i], started[j]
+		if p.priorities[a] != p.priorities[b] {
+			return p.priorities[a] > p.priorities[b]
+		}
+		if randomFirst {
+			return false
+		}
+		return p.availability[a] < p.availability[b]
+	})
+	for _, index := range started {
+		if !visit(index) {
+			return
+		}
+	}
+
+	// Other pieces are visited from a random place in each group, so equally good pieces are
+	// picked at random
+	unstarted := func(index int) bool {
+		if _, ok := p.progress[index]; ok || !bits.Test(index) {
+			return true
+		}
+		return visit(index)
+	}
+	for _, priority := range p.rarity.levels {
+		sets := []*pieceSet{p.rarity.wanted[priority]}
+		if !randomFirst {
+			sets = p.rarity.byAvailability[priority]
+		}
+		for _, set := range sets {
+			if set.count > 0 && !set.each(p.rand.Intn(p.numPieces), unstarted) {
+				return
+			}
+		}
+	}
+}
+
+// pickEndgame adds blocks which are requested but haven't arrived, fewest requesters first
+func (p *Picker) pickEndgame(requester interface{}, bits *model.Bitfield, picked []peer.Block, count int) []peer.Block {
+	type duplicate struct {
+		index      int
+		block      int
+		requesters int
+	}
+
+	duplicates := make([]duplicate, 0)
+	for index, progress := range p.progress {
+		if !bits.Test(index) || p.priorities[index] == PRIORITY_SKIP {
+			continue
+		}
+		for block, requesters := range progress.requesters {
+			if !progress.received[block] && !contains(requesters, requester) {
+				duplicates = append(duplicates, duplicate{index, block, len(requesters)})
+			}
+		}
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		a, b := duplicates[i], duplicates[j]
+		if a.requesters != b.requesters {
+			return a.requesters < b.requesters
+		}
+		if a.index != b.index {
+			return a.index < b.index
+		}
+		return a.block < b.block
+	})
+
+	for _, d := range duplicates {
+		if len(picked) == count {
+			break
+		}
+		progress := p.progress[d.index]
+		progress.requesters[d.block] = append(progress.requesters[d.block], requester)
+		picked = append(picked, p.block(d.index, d.block))
+	}
+	return picked
+}
+
+// allRequested reports whether there are no wanted blocks left which haven't been requested
+func (p *Picker) allRequested() bool {
+	for index := 0; index < p.numPieces; index++ {
+		if p.have.Test(index) || p.priorities[index] == PRIORITY_SKIP {
+			continue
+		}
+		progress, ok := p.progress[index]
+		if !ok {
+			return false
+		}
+		for block, requesters := range progress.requesters {
+			if !progress.received[block] && len(requesters) == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (p *Picker) progressFor(index int) *pieceProgress {
+	progress, ok := p.progress[index]
+	if !ok {
+		numBlocks := (p.info.PieceSize(index) + peer.BLOCK_LENGTH - 1) / peer.BLOCK_LENGTH
+		progress = &pieceProgress{received: make([]bool, numBlocks), requesters: make([][]interface{}, numBlocks)}
+		p.progress[index] = progress
+	}
+	return progress
+}
+
+func (p *Picker) block(index int, block int) peer.Block {
+	begin := block * peer.BLOCK_LENGTH
+	length := p.info.PieceSize(index) - begin
+	if length > peer.BLOCK_LENGTH {
+		length = peer.BLOCK_LENGTH
+	}
+	return peer.Block{Index: uint32(index), Begin: uint32(begin), Length: uint32(length)}
+}
+
+func (p *Picker) updatePriorities() {
+	for index := range p.priorities {
+		p.priorities[index] = PRIORITY_SKIP
+	}
+	for file, priority := range p.files {
+		begin, end := p.info.FilePieces(file)
+		for index := begin; index < end; index++ {
+			if priority > p.priorities[index] {
+				p.priorities[index] = priority
+			}
+		}
+	}
+	p.rarity = newRarity(p.numPieces)
+	for index := range p.priorities {
+		if p.wanted(index) {
+			p.rarity.add(index, p.priorities[index], p.availability[index])
+		}
+	}
+}
+
+// wanted reports whether we want a piece, which is one we don't have that isn't skipped
+func (p *Picker) wanted(index int) bool {
+	return !p.have.Test(index) && p.priorities[index] != PRIORITY_SKIP
+}
+
+func (p *Picker) changeAvailability(index int, change int) {
+	if p.wanted(index) {
+		p.rarity.remove(index, p.priorities[index], p.availability[index])
+		p.rarity.add(index, p.priorities[index], p.availability[index]+change)
+	}
+	p.availability[index] += change
+}
+
+func contains(requesters []interface{}, requester interface{}) bool {
+	for _, r := range requesters {
+		if r == requester {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns the requesters other than one
+func without(requesters []interface{}, requester interface{}) []interface{} {
+	remaining := make([]interface{}, 0, len(requesters))
+	for _, r := range requesters {
+		if r != requester {
+			remaining = append(remaining, r)
+		}
+	}
+	return remaining
+}
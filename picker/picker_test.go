@@ -0,0 +1,278 @@
+package picker
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/peer"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+const (
+	testPieceLength = 2 * peer.BLOCK_LENGTH
+)
+
+func TestPicksRarestFirst(t *testing.T) {
+	p := NewPicker(testInfo(8*testPieceLength), nil, rand.New(rand.NewSource(1)))
+	p.RandomFirstPieces = 0
+	addPeers(p, map[int]int{0: 5, 1: 4, 2: 1, 3: 3, 4: 2, 5: 5, 6: 5, 7: 5})
+
+	var order []uint32
+	for i := 0; i < 4; i++ {
+		blocks := p.Pick("a", allPieces(8), 2)
+		if len(blocks) != 2 || blocks[0].Index != blocks[1].Index {
+			t.Fatalf("Expected both blocks of one piece but was %+v", blocks)
+		}
+		order = append(order, blocks[0].Index)
+	}
+	if !reflect.DeepEqual(order, []uint32{2, 4, 3, 1}) {
+		t.Errorf("Expected pieces in rarest first order but was %v", order)
+	}
+}
+
+func TestRarestFirstBreaksTiesAtRandom(t *testing.T) {
+	firstPicks := make(map[uint32]bool)
+	for seed := int64(0); seed < 20; seed++ {
+		p := NewPicker(testInfo(8*testPieceLength), nil, rand.New(rand.NewSource(seed)))
+		p.RandomFirstPieces = 0
+		addPeers(p, map[int]int{0: 3, 1: 1, 2: 3, 3: 1, 4: 1, 5: 3, 6: 3, 7: 3})
+
+		blocks := p.Pick("a", allPieces(8), 1)
+		if index := blocks[0].Index; index != 1 && index != 3 && index != 4 {
+			t.Fatalf("Expected one of the rarest pieces but was %v", index)
+		}
+		firstPicks[blocks[0].Index] = true
+
+		again := NewPicker(testInfo(8*testPieceLength), nil, rand.New(rand.NewSource(seed)))
+		again.RandomFirstPieces = 0
+		addPeers(again, map[int]int{0: 3, 1: 1, 2: 3, 3: 1, 4: 1, 5: 3, 6: 3, 7: 3})
+		if !reflect.DeepEqual(again.Pick("a", allPieces(8), 1), blocks) {
+			t.Errorf("Expected the same seed to pick the same piece")
+		}
+	}
+	if len(firstPicks) != 3 {
+		t.Errorf("Expected every tied piece to be picked for some seed but was %v", firstPicks)
+	}
+}
+
+func TestRarestFirstFollowsAvailabilityChanges(t *testing.T) {
+	p := NewPicker(testInfo(4*testPieceLength), nil, rand.New(rand.NewSource(1)))
+	p.RandomFirstPieces = 0
+	addPeers(p, map[int]int{0: 2, 1: 3, 2: 3, 3: 3})
+	if index := p.Pick("a", allPieces(4), 1)[0].Index; index != 0 {
+		t.Fatalf("Expected the rarest piece 0 but was %v", index)
+	}
+
+	// Piece 3 becomes the rarest once two peers with it leave
+	p.PeerLeft("b", piecesOf(4, 3))
+	p.PeerLeft("c", piecesOf(4, 1, 3))
+	if index := p.Pick("a", allPieces(4), 3)[2].Index; index != 3 {
+		t.Errorf("Expected piece 3 after finishing piece 0 but was %v", index)
+	}
+
+	// Piece 1 is next rarest, but isn't wanted once we have it
+	p.PieceVerified(1)
+	if index := p.Pick("a", allPieces(4), 1)[0].Index; index != 2 {
+		t.Errorf("Expected piece 2 once piece 1 was verified but was %v", index)
+	}
+}
+
+func TestFirstPiecesArePickedAtRandom(t *testing.T) {
+	rarest := 0
+	for seed := int64(0); seed < 20; seed++ {
+		p := NewPicker(testInfo(8*testPieceLength), nil, rand.New(rand.NewSource(seed)))
+		addPeers(p, map[int]int{0: 8, 1: 7, 2: 6, 3: 5, 4: 4, 5: 3, 6: 2, 7: 1})
+
+		if p.Pick("a", allPieces(8), 1)[0].Index == 7 {
+			rarest++
+		}
+	}
+	if rarest == 20 {
+		t.Errorf("Expected first pieces not to always be the rarest")
+	}
+
+	// Once enough pieces are complete rarest first takes over
+	p := NewPicker(testInfo(8*testPieceLength), piecesOf(8, 0, 1, 2, 3), rand.New(rand.NewSource(1)))
+	addPeers(p, map[int]int{0: 8, 1: 7, 2: 6, 3: 5, 4: 4, 5: 3, 6: 2, 7: 1})
+	if index := p.Pick("a", allPieces(8), 1)[0].Index; index != 7 {
+		t.Errorf("Expected rarest piece after random first pieces but was %v", index)
+	}
+}
+
+func TestStartedPiecesAreFinishedFirst(t *testing.T) {
+	p := NewPicker(testInfo(8*testPieceLength), nil, rand.New(rand.NewSource(1)))
+	p.RandomFirstPieces = 0
+	addPeers(p, map[int]int{0: 1, 1: 2, 2: 3, 3: 3, 4: 3, 5: 3, 6: 3, 7: 3})
+
+	first := p.Pick("a", allPieces(8), 1)
+	if first[0] != (peer.Block{Index: 0, Begin: 0, Length: peer.BLOCK_LENGTH}) {
+		t.Fatalf("Unexpected first block %+v", first)
+	}
+	second := p.Pick("b", allPieces(8), 2)
+	expected := []peer.Block{{Index: 0, Begin: peer.BLOCK_LENGTH, Length: peer.BLOCK_LENGTH}, {Index: 1, Begin: 0, Length: peer.BLOCK_LENGTH}}
+	if !reflect.DeepEqual(second, expected) {
+		t.Errorf("Expected started piece to be finished before the next but was %+v", second)
+	}
+}
+
+func TestOnlyPicksPiecesThePeerHas(t *testing.T) {
+	p := NewPicker(testInfo(8*testPieceLength), nil, rand.New(rand.NewSource(1)))
+	blocks := p.Pick("a", piecesOf(8, 2), 10)
+	for _, block := range blocks {
+		if block.Index != 2 {
+			t.Errorf("Expected only piece 2 but picked %+v", block)
+		}
+	}
+	if len(blocks) != 2 {
+		t.Errorf("Expected both blocks of piece 2 but was %v", blocks)
+	}
+	if p.InEndgame() {
+		t.Errorf("Expected not to be in endgame with other pieces unrequested")
+	}
+}
+
+func TestLastBlockIsShort(t *testing.T) {
+	p := NewPicker(testInfo(testPieceLength+peer.BLOCK_LENGTH+100), nil, rand.New(rand.NewSource(1)))
+	blocks := p.Pick("a", piecesOf(2, 1), 10)
+	expected := []peer.Block{{Index: 1, Begin: 0, Length: peer.BLOCK_LENGTH}, {Index: 1, Begin: peer.BLOCK_LENGTH, Length: 100}}
+	if !reflect.DeepEqual(blocks, expected) {
+		t.Errorf("Expected %+v but was %+v", expected, blocks)
+	}
+}
+
+func TestFilePriorities(t *testing.T) {
+	info := testInfo(0)
+	info.Files = []*model.File{
+		model.NewFile("a", 2*testPieceLength, ""),
+		model.NewFile("b", 2*testPieceLength, ""),
+		model.NewFile("c", 2*testPieceLength, ""),
+	}
+	info.Pieces = make([]byte, 6*20)
+	p := NewPicker(info, nil, rand.New(rand.NewSource(1)))
+	p.RandomFirstPieces = 0
+	addPeers(p, map[int]int{0: 1, 1: 1, 2: 5, 3: 5, 4: 3, 5: 3})
+
+	p.SetFilePriority(0, PRIORITY_SKIP)
+	p.SetFilePriority(1, PRIORITY_HIGH)
+
+	var order []uint32
+	for {
+		blocks := p.Pick("a", allPieces(6), 2)
+		if len(blocks) == 0 || p.InEndgame() {
+			break
+		}
+		order = append(order, blocks[0].Index)
+	}
+	if len(order) != 4 || order[0] < 2 || order[0] > 3 || order[1] < 2 || order[1] > 3 || order[2] < 4 || order[3] < 4 {
+		t.Errorf("Expected high priority pieces, then normal, and no skipped ones but was %v", order)
+	}
+
+	for index := 2; index < 6; index++ {
+		p.PieceVerified(index)
+	}
+	if !p.Done() {
+		t.Errorf("Expected to be done without the skipped file")
+	}
+	p.SetFilePriority(0, PRIORITY_LOW)
+	if p.Done() {
+		t.Errorf("Expected not to be done once the skipped file is wanted")
+	}
+}
+
+func TestEndgameRequestsDuplicatesAndCancels(t *testing.T) {
+	p := NewPicker(testInfo(2*testPieceLength), piecesOf(2, 0), rand.New(rand.NewSource(1)))
+	bits := allPieces(2)
+
+	blocks := p.Pick("a", bits, 2)
+	if len(blocks) != 2 || p.InEndgame() {
+		t.Fatalf("Expected the two remaining blocks without endgame but was %+v", blocks)
+	}
+
+	duplicates := p.Pick("b", bits, 10)
+	if !p.InEndgame() || !reflect.DeepEqual(duplicates, blocks) {
+		t.Fatalf("Expected endgame to request the same blocks again but was %+v", duplicates)
+	}
+	if again := p.Pick("b", bits, 10); len(again) != 0 {
+		t.Errorf("Expected no block to be requested twice from the same peer but was %+v", again)
+	}
+
+	cancels, complete, accepted := p.BlockReceived("a", blocks[0])
+	if !accepted || complete || !reflect.DeepEqual(cancels, []interface{}{"b"}) {
+		t.Errorf("Expected to cancel the duplicate from b but was %v %v %v", cancels, complete, accepted)
+	}
+	if _, _, accepted := p.BlockReceived("b", blocks[0]); accepted {
+		t.Errorf("Expected block already received not to be accepted")
+	}
+
+	cancels, complete, accepted = p.BlockReceived("b", blocks[1])
+	if !accepted || !complete || !reflect.DeepEqual(cancels, []interface{}{"a"}) {
+		t.Errorf("Expected the piece to be complete and a cancelled but was %v %v %v", cancels, complete, accepted)
+	}
+
+	p.PieceFailed(1)
+	if p.InEndgame() {
+		t.Errorf("Expected failed piece to leave endgame")
+	}
+	if again := p.Pick("c", bits, 10); !reflect.DeepEqual(again, blocks) {
+		t.Errorf("Expected failed piece to be downloaded again but was %+v", again)
+	}
+	p.PieceVerified(1)
+	if !p.Done() {
+		t.Errorf("Expected to be done")
+	}
+}
+
+func TestAbortAndPeerLeftReturnBlocks(t *testing.T) {
+	p := NewPicker(testInfo(2*testPieceLength), nil, rand.New(rand.NewSource(1)))
+	bits := allPieces(2)
+	p.PeerBitfield(bits)
+	p.PeerHave(1)
+	if p.Availability(0) != 1 || p.Availability(1) != 2 {
+		t.Errorf("Unexpected availability %v %v", p.Availability(0), p.Availability(1))
+	}
+
+	blocks := p.Pick("a", bits, 4)
+	p.Abort("a", blocks[1])
+	if again := p.Pick("b", bits, 1); !reflect.DeepEqual(again, blocks[1:2]) {
+		t.Errorf("Expected aborted block to be picked again but was %+v", again)
+	}
+
+	p.PeerLeft("a", bits)
+	if p.Availability(0) != 0 || p.Availability(1) != 1 {
+		t.Errorf("Expected availability to drop when the peer left")
+	}
+	again := p.Pick("c", bits, 3)
+	if len(again) != 3 || p.InEndgame() {
+		t.Errorf("Expected the departed peer's blocks to be picked again but was %+v", again)
+	}
+}
+
+// Helpers
+
+func testInfo(length int) *model.Info {
+	numPieces := (length + testPieceLength - 1) / testPieceLength
+	return model.NewInfo(testPieceLength, make([]byte, numPieces*20), 0, []*model.File{model.NewFile("file", length, "")}, "", nil)
+}
+
+// addPeers adds availability for each piece
+func addPeers(p *Picker, availability map[int]int) {
+	for index, count := range availability {
+		for i := 0; i < count; i++ {
+			p.PeerHave(index)
+		}
+	}
+}
+
+func allPieces(numPieces int) *model.Bitfield {
+	bits := model.NewBitfield(numPieces)
+	bits.SetAll()
+	return bits
+}
+
+func piecesOf(numPieces int, indexes ...int) *model.Bitfield {
+	bits := model.NewBitfield(numPieces)
+	for _, index := range indexes {
+		bits.Set(index)
+	}
+	return bits
+}
@@ -0,0 +1,86 @@
+package picker
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"sort"
+)
+
+// Types
+
+// rarity keeps the pieces we want grouped by priority and by how many peers have them, so picks
+// can go through them rarest first without sorting every piece each time. It is not safe for
+// concurrent use.
+type rarity struct {
+	numPieces int
+	// levels holds the priorities with pieces, highest first
+	levels []Priority
+	// wanted holds the pieces of each priority, and byAvailability the same split by how many
+	// peers have them
+	wanted         map[Priority]*pieceSet
+	byAvailability map[Priority][]*pieceSet
+}
+
+type pieceSet struct {
+	bits  *model.Bitfield
+	count int
+}
+
+// Initialiser
+
+func newRarity(numPieces int) *rarity {
+	return &rarity{numPieces: numPieces, wanted: make(map[Priority]*pieceSet), byAvailability: make(map[Priority][]*pieceSet)}
+}
+
+// Public Methods
+
+func (r *rarity) add(index int, priority Priority, availability int) {
+	if _, ok := r.wanted[priority]; !ok {
+		r.wanted[priority] = r.newPieceSet()
+		r.levels = append(r.levels, priority)
+		sort.Slice(r.levels, func(i, j int) bool { return r.levels[i] > r.levels[j] })
+	}
+	sets := r.byAvailability[priority]
+	for len(sets) <= availability {
+		sets = append(sets, r.newPieceSet())
+	}
+	r.byAvailability[priority] = sets
+	r.wanted[priority].add(index)
+	sets[availability].add(index)
+}
+
+func (r *rarity) remove(index int, priority Priority, availability int) {
+	r.wanted[priority].remove(index)
+	r.byAvailability[priority][availability].remove(index)
+}
+
+// Helpers
+
+func (r *rarity) newPieceSet() *pieceSet {
+	return &pieceSet{bits: model.NewBitfield(r.numPieces)}
+}
+
+func (s *pieceSet) add(index int) {
+	s.bits.Set(index)
+	s.count++
+}
+
+func (s *pieceSet) remove(index int) {
+	s.bits.Clear(index)
+	s.count--
+}
+
+// each visits the pieces in the set in order, wrapping around from start, until visit returns
+// false. It returns false if visit did.
+func (s *pieceSet) each(start int, visit func(index int) bool) bool {
+	for index := s.bits.NextSet(start); index >= 0; index = s.bits.NextSet(index + 1) {
+		if !visit(index) {
+			return false
+		}
+	}
+	for index := s.bits.NextSet(0); index >= 0 && index < start; index = s.bits.NextSet(index + 1) {
+		if !visit(index) {
+			return false
+		}
+	}
+	return true
+}
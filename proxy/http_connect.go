@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// HTTP proxies tunnel TCP connections with the CONNECT method. They have no way to carry UDP.
+
+// Types
+
+type httpConnectDialer struct {
+	address  string
+	username string
+	password string
+	forward  net.Dialer
+}
+
+// bufferedConn keeps anything the proxy sent after its response, which belongs to the tunnel
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+// Initialiser
+
+func newHttpConnectDialer(address string, username string, password string) *httpConnectDialer {
+	return &httpConnectDialer{address: address, username: username, password: password}
+}
+
+// Public Methods
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		return nil, ErrUdpNotSupported
+	default:
+		return nil, fmt.Errorf("Unsupported network '%v' for HTTP proxy", network)
+	}
+
+	conn, err := d.forward.DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader *bufio.Reader
+	err = handshake(ctx, conn, func() error {
+		var err error
+		reader, err = d.connect(conn, address)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if reader.Buffered() == 0 {
+		return conn, nil
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Helpers
+
+func (d *httpConnectDialer) connect(conn net.Conn, address string) (*bufio.Reader, error) {
+	request := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if d.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.username + ":" + d.password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusProxyAuthRequired {
+		return nil, fmt.Errorf("HTTP proxy rejected credentials")
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("HTTP proxy refused to connect to %v with status %v", address, response.StatusCode)
+	}
+	return reader, nil
+}
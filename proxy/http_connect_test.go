@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newFakeHttpProxy is an in-process proxy which only supports CONNECT
+func newFakeHttpProxy(credentials string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if credentials != "" && r.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+
+		remote, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer remote.Close()
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+
+		go io.Copy(remote, conn)
+		io.Copy(conn, remote)
+	}))
+}
+
+func TestHttpConnect(t *testing.T) {
+	echo := newTcpEchoServer(t)
+	defer echo.Close()
+	proxy := newFakeHttpProxy("")
+	defer proxy.Close()
+
+	dialer, _ := NewDialer(Config{Type: PROXY_HTTP, Address: strings.TrimPrefix(proxy.URL, "http://")})
+	conn, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn, "through http")
+}
+
+func TestHttpConnectWithCredentials(t *testing.T) {
+	echo := newTcpEchoServer(t)
+	defer echo.Close()
+	proxy := newFakeHttpProxy("user:secret")
+	defer proxy.Close()
+	address := strings.TrimPrefix(proxy.URL, "http://")
+
+	dialer, _ := NewDialer(Config{Type: PROXY_HTTP, Address: address, Username: "user", Password: "secret"})
+	conn, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn, "authenticated")
+
+	dialer, _ = NewDialer(Config{Type: PROXY_HTTP, Address: address, Username: "user", Password: "wrong"})
+	if _, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Errorf("Expected error with the wrong password")
+	}
+}
+
+func TestHttpConnectRejectsUdp(t *testing.T) {
+	dialer, _ := NewDialer(Config{Type: PROXY_HTTP, Address: "127.0.0.1:3128"})
+	if _, err := dialer.DialContext(context.Background(), "udp", "127.0.0.1:6969"); err != ErrUdpNotSupported {
+		t.Errorf("Expected ErrUdpNotSupported but got %v", err)
+	}
+}
+
+func TestHttpConnectHonoursContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// A proxy which accepts connections but never answers
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Cancel once the CONNECT request has arrived
+		conn.Read(make([]byte, 1))
+		cancel()
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	dialer, _ := NewDialer(Config{Type: PROXY_HTTP, Address: listener.Addr().String()})
+	if _, err := dialer.DialContext(ctx, "tcp", "127.0.0.1:80"); err != context.Canceled {
+		t.Errorf("Expected cancelled dial but got %v", err)
+	}
+}
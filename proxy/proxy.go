@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Types
+
+// Dialer opens connections, either directly or through a proxy. The network is "tcp" or "udp"
+// and the address is a host:port pair, which proxies resolve themselves where they can.
+type Dialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+type Type int
+
+const (
+	PROXY_NONE Type = iota
+	PROXY_SOCKS5
+	PROXY_HTTP
+)
+
+const DEFAULT_HANDSHAKE_TIMEOUT = 30 * time.Second
+
+var ErrUdpNotSupported = errors.New("Proxy does not support UDP")
+
+// Config describes the proxy to use and which traffic goes through it. Traffic which isn't
+// proxied is dialled directly.
+type Config struct {
+	Type     Type
+	Address  string
+	Username string
+	Password string
+
+	Trackers bool
+	Peers    bool
+}
+
+type direct struct {
+	dialer net.Dialer
+}
+
+// Initialiser
+
+// Direct dials without a proxy
+func Direct() Dialer {
+	return &direct{}
+}
+
+// NewDialer returns a dialer for the proxy described by the config, regardless of which
+// traffic the config says should use it
+func NewDialer(config Config) (Dialer, error) {
+	switch config.Type {
+	case PROXY_NONE:
+		return Direct(), nil
+	case PROXY_SOCKS5:
+		return newSocks5Dialer(config.Address, config.Username, config.Password), nil
+	case PROXY_HTTP:
+		return newHttpConnectDialer(config.Address, config.Username, config.Password), nil
+	default:
+		return nil, fmt.Errorf("Unknown proxy type %v", config.Type)
+	}
+}
+
+// Public Methods
+
+// TrackerDialer returns the dialer for tracker announces and scrapes
+func (config Config) TrackerDialer() (Dialer, error) {
+	if !config.Trackers {
+		return Direct(), nil
+	}
+	return NewDialer(config)
+}
+
+// PeerDialer returns the dialer for connections to peers
+func (config Config) PeerDialer() (Dialer, error) {
+	if !config.Peers {
+		return Direct(), nil
+	}
+	return NewDialer(config)
+}
+
+// ParseType reads a proxy type as written in configuration - 'none', 'socks5' or 'http'
+func ParseType(value string) (Type, error) {
+	switch strings.ToLower(value) {
+	case "", "none":
+		return PROXY_NONE, nil
+	case "socks5":
+		return PROXY_SOCKS5, nil
+	case "http":
+		return PROXY_HTTP, nil
+	default:
+		return PROXY_NONE, fmt.Errorf("Unknown proxy type '%v'", value)
+	}
+}
+
+func (proxyType Type) String() string {
+	switch proxyType {
+	case PROXY_SOCKS5:
+		return "socks5"
+	case PROXY_HTTP:
+		return "http"
+	default:
+		return "none"
+	}
+}
+
+func (d *direct) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, network, address)
+}
+
+// Helpers
+
+// handshake runs a proxy handshake on conn, giving up when the context is done
+func handshake(ctx context.Context, conn net.Conn, run func() error) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DEFAULT_HANDSHAKE_TIMEOUT)
+	}
+	conn.SetDeadline(deadline)
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	err := run()
+	close(stop)
+	<-stopped
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	conn.SetDeadline(time.Time{})
+	return err
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Stand-in servers shared by the proxy tests
+
+func newTcpEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func newUdpEchoServer(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen %v", err)
+	}
+	go func() {
+		buffer := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func expectEcho(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatalf("Unexpected write error %v", err)
+	}
+	buffer := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buffer); err != nil {
+		t.Fatalf("Unexpected read error %v", err)
+	}
+	if !bytes.Equal(buffer, []byte(message)) {
+		t.Errorf("Expected echo of '%v' but got '%v'", message, string(buffer))
+	}
+}
+
+func TestConfigScopes(t *testing.T) {
+	config := Config{Type: PROXY_SOCKS5, Address: "127.0.0.1:1080", Trackers: true}
+
+	trackerDialer, err := config.TrackerDialer()
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, ok := trackerDialer.(*socks5Dialer); !ok {
+		t.Errorf("Expected trackers to go through the proxy but got %T", trackerDialer)
+	}
+
+	peerDialer, _ := config.PeerDialer()
+	if _, ok := peerDialer.(*direct); !ok {
+		t.Errorf("Expected peers to be dialled directly but got %T", peerDialer)
+	}
+
+	config = Config{Type: PROXY_HTTP, Address: "127.0.0.1:3128", Trackers: true, Peers: true}
+	peerDialer, _ = config.PeerDialer()
+	if _, ok := peerDialer.(*httpConnectDialer); !ok {
+		t.Errorf("Expected peers to go through the proxy but got %T", peerDialer)
+	}
+
+	// Saying what to proxy without a proxy type means everything is direct
+	config = Config{Trackers: true, Peers: true}
+	trackerDialer, _ = config.TrackerDialer()
+	if _, ok := trackerDialer.(*direct); !ok {
+		t.Errorf("Expected direct dialer without a proxy type but got %T", trackerDialer)
+	}
+}
+
+func TestParseType(t *testing.T) {
+	for value, expected := range map[string]Type{"": PROXY_NONE, "none": PROXY_NONE, "SOCKS5": PROXY_SOCKS5, "http": PROXY_HTTP} {
+		parsed, err := ParseType(value)
+		if err != nil || parsed != expected {
+			t.Errorf("Expected '%v' to parse as %v but got %v %v", value, expected, parsed, err)
+		}
+	}
+	if _, err := ParseType("socks4"); err == nil {
+		t.Errorf("Expected error for unsupported proxy type")
+	}
+}
+
+func TestDirectDialer(t *testing.T) {
+	echo := newTcpEchoServer(t)
+	defer echo.Close()
+
+	conn, err := Direct().DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn, "direct")
+}
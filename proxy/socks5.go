@@ -0,0 +1,381 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 (RFC 1928) with username/password authentication (RFC 1929)
+
+const (
+	SOCKS5_VERSION           = 0x05
+	SOCKS5_AUTH_NONE         = 0x00
+	SOCKS5_AUTH_PASSWORD     = 0x02
+	SOCKS5_AUTH_UNACCEPTABLE = 0xFF
+	SOCKS5_COMMAND_CONNECT   = 0x01
+	SOCKS5_COMMAND_ASSOCIATE = 0x03
+	SOCKS5_ADDRESS_IPV4      = 0x01
+	SOCKS5_ADDRESS_DOMAIN    = 0x03
+	SOCKS5_ADDRESS_IPV6      = 0x04
+	SOCKS5_REPLY_SUCCEEDED   = 0x00
+)
+
+// Types
+
+type socks5Dialer struct {
+	address  string
+	username string
+	password string
+	forward  net.Dialer
+}
+
+// socks5UdpConn sends datagrams to a single destination through a UDP relay. The association
+// lasts as long as the control connection stays open.
+type socks5UdpConn struct {
+	control net.Conn
+	relay   net.Conn
+	header  []byte
+
+	lock   sync.Mutex
+	remote net.Addr
+}
+
+// Initialiser
+
+func newSocks5Dialer(address string, username string, password string) *socks5Dialer {
+	return &socks5Dialer{address: address, username: username, password: password}
+}
+
+// Public Methods
+
+// DialContext connects over TCP with the CONNECT command, or over UDP with UDP ASSOCIATE
+func (d *socks5Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return d.connect(ctx, address)
+	case "udp", "udp4", "udp6":
+		return d.associate(ctx, address)
+	default:
+		return nil, fmt.Errorf("Unsupported network '%v' for SOCKS5 proxy", network)
+	}
+}
+
+func (c *socks5UdpConn) Read(b []byte) (int, error) {
+	buffer := make([]byte, len(b)+262)
+	for {
+		n, err := c.relay.Read(buffer)
+		if err != nil {
+			return 0, err
+		}
+
+		// Fragmented datagrams are rare enough that they are simply dropped
+		if n < 4 || buffer[2] != 0 {
+			continue
+		}
+		remote, headerLength, err := readSocks5Address(bytes.NewReader(buffer[3:n]))
+		if err != nil {
+			continue
+		}
+
+		c.lock.Lock()
+		c.remote = remote
+		c.lock.Unlock()
+		return copy(b, buffer[3+headerLength:n]), nil
+	}
+}
+
+func (c *socks5UdpConn) Write(b []byte) (int, error) {
+	packet := make([]byte, 0, len(c.header)+len(b))
+	packet = append(packet, c.header...)
+	packet = append(packet, b...)
+	if _, err := c.relay.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5UdpConn) Close() error {
+	c.control.Close()
+	return c.relay.Close()
+}
+
+func (c *socks5UdpConn) LocalAddr() net.Addr {
+	return c.relay.LocalAddr()
+}
+
+// RemoteAddr is the address the last datagram came from, as reported by the relay. Until
+// something has been received it is the relay itself.
+func (c *socks5UdpConn) RemoteAddr() net.Addr {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.remote
+}
+
+func (c *socks5UdpConn) SetDeadline(t time.Time) error {
+	return c.relay.SetDeadline(t)
+}
+
+func (c *socks5UdpConn) SetReadDeadline(t time.Time) error {
+	return c.relay.SetReadDeadline(t)
+}
+
+func (c *socks5UdpConn) SetWriteDeadline(t time.Time) error {
+	return c.relay.SetWriteDeadline(t)
+}
+
+// Commands
+
+func (d *socks5Dialer) connect(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := d.forward.DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+
+	err = handshake(ctx, conn, func() error {
+		_, err := d.request(conn, SOCKS5_COMMAND_CONNECT, address)
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (d *socks5Dialer) associate(ctx context.Context, address string) (net.Conn, error) {
+	header, err := socks5AddressBytes(address)
+	if err != nil {
+		return nil, err
+	}
+
+	control, err := d.forward.DialContext(ctx, "tcp", d.address)
+	if err != nil {
+		return nil, err
+	}
+
+	// The client's UDP address isn't known until the relay socket is opened, so zeros ask the
+	// proxy to accept datagrams from wherever they come
+	var relayAddr net.Addr
+	err = handshake(ctx, control, func() error {
+		var err error
+		relayAddr, err = d.request(control, SOCKS5_COMMAND_ASSOCIATE, "0.0.0.0:0")
+		return err
+	})
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	// Proxies often answer with an unspecified address, meaning their own
+	if relayUdpAddr, ok := relayAddr.(*net.UDPAddr); ok && relayUdpAddr.IP.IsUnspecified() {
+		proxyHost, _, _ := net.SplitHostPort(control.RemoteAddr().String())
+		relayUdpAddr.IP = net.ParseIP(proxyHost)
+	}
+	relay, err := d.forward.DialContext(ctx, "udp", relayAddr.String())
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	// Closing the control connection ends the association, so when the proxy does that the
+	// relay is closed too
+	go func() {
+		io.Copy(ioutil.Discard, control)
+		relay.Close()
+	}()
+
+	return &socks5UdpConn{
+		control: control,
+		relay:   relay,
+		header:  append([]byte{0, 0, 0}, header...),
+		remote:  relayAddr,
+	}, nil
+}
+
+// request negotiates authentication and sends a command, returning the bound address
+func (d *socks5Dialer) request(conn net.Conn, command byte, address string) (net.Addr, error) {
+	methods := []byte{SOCKS5_AUTH_NONE}
+	if d.username != "" {
+		methods = []byte{SOCKS5_AUTH_NONE, SOCKS5_AUTH_PASSWORD}
+	}
+	greeting := append([]byte{SOCKS5_VERSION, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+
+	choice := make([]byte, 2)
+	if _, err := io.ReadFull(conn, choice); err != nil {
+		return nil, err
+	}
+	if choice[0] != SOCKS5_VERSION {
+		return nil, fmt.Errorf("Proxy is not a SOCKS5 server")
+	}
+	switch choice[1] {
+	case SOCKS5_AUTH_NONE:
+	case SOCKS5_AUTH_PASSWORD:
+		if err := d.authenticate(conn); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy did not accept any authentication method")
+	}
+
+	addressBytes, err := socks5AddressBytes(address)
+	if err != nil {
+		return nil, err
+	}
+	request := append([]byte{SOCKS5_VERSION, command, 0}, addressBytes...)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[0] != SOCKS5_VERSION {
+		return nil, fmt.Errorf("Invalid SOCKS5 reply version %v", reply[0])
+	}
+	if reply[1] != SOCKS5_REPLY_SUCCEEDED {
+		return nil, fmt.Errorf("SOCKS5 proxy refused request - %v", socks5ReplyMessage(reply[1]))
+	}
+	bound, _, err := readSocks5Address(conn)
+	return bound, err
+}
+
+func (d *socks5Dialer) authenticate(conn net.Conn) error {
+	if len(d.username) > 255 || len(d.password) > 255 {
+		return fmt.Errorf("SOCKS5 username and password must be at most 255 bytes")
+	}
+	request := []byte{0x01, byte(len(d.username))}
+	request = append(request, d.username...)
+	request = append(request, byte(len(d.password)))
+	request = append(request, d.password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	response := make([]byte, 2)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return err
+	}
+	if response[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy rejected username and password")
+	}
+	return nil
+}
+
+// Helpers
+
+// socks5AddressBytes encodes the address type, address and port. Host names are passed on for
+// the proxy to resolve.
+func socks5AddressBytes(address string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 0xFFFF {
+		return nil, fmt.Errorf("Invalid port in address '%v'", address)
+	}
+
+	var encoded []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			encoded = append([]byte{SOCKS5_ADDRESS_IPV4}, ip4...)
+		} else {
+			encoded = append([]byte{SOCKS5_ADDRESS_IPV6}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name '%v' is too long for SOCKS5", host)
+		}
+		encoded = append([]byte{SOCKS5_ADDRESS_DOMAIN, byte(len(host))}, host...)
+	}
+	return append(encoded, byte(port>>8), byte(port)), nil
+}
+
+// readSocks5Address reads an address as encoded by socks5AddressBytes, returning it along with
+// the number of bytes it took up. Domain names are left unresolved.
+func readSocks5Address(reader io.Reader) (net.Addr, int, error) {
+	addressType := make([]byte, 1)
+	if _, err := io.ReadFull(reader, addressType); err != nil {
+		return nil, 0, err
+	}
+
+	var host []byte
+	length := 1
+	switch addressType[0] {
+	case SOCKS5_ADDRESS_IPV4:
+		host = make([]byte, net.IPv4len)
+	case SOCKS5_ADDRESS_IPV6:
+		host = make([]byte, net.IPv6len)
+	case SOCKS5_ADDRESS_DOMAIN:
+		domainLength := make([]byte, 1)
+		if _, err := io.ReadFull(reader, domainLength); err != nil {
+			return nil, 0, err
+		}
+		host = make([]byte, domainLength[0])
+		length++
+	default:
+		return nil, 0, fmt.Errorf("Unknown SOCKS5 address type %v", addressType[0])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, host); err != nil {
+		return nil, 0, err
+	}
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return nil, 0, err
+	}
+	length += len(host) + 2
+
+	portNumber := int(binary.BigEndian.Uint16(port))
+	if addressType[0] == SOCKS5_ADDRESS_DOMAIN {
+		return &unresolvedAddr{net.JoinHostPort(string(host), strconv.Itoa(portNumber))}, length, nil
+	}
+	return &net.UDPAddr{IP: net.IP(host), Port: portNumber}, length, nil
+}
+
+type unresolvedAddr struct {
+	address string
+}
+
+func (addr *unresolvedAddr) Network() string {
+	return "udp"
+}
+
+func (addr *unresolvedAddr) String() string {
+	return addr.address
+}
+
+func socks5ReplyMessage(code byte) string {
+	switch code {
+	case 0x01:
+		return "general failure"
+	case 0x02:
+		return "connection not allowed by ruleset"
+	case 0x03:
+		return "network unreachable"
+	case 0x04:
+		return "host unreachable"
+	case 0x05:
+		return "connection refused"
+	case 0x06:
+		return "TTL expired"
+	case 0x07:
+		return "command not supported"
+	case 0x08:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("unknown error %v", code)
+	}
+}
@@ -0,0 +1,272 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSocks5Server is an in-process SOCKS5 proxy supporting CONNECT and UDP ASSOCIATE
+type fakeSocks5Server struct {
+	listener net.Listener
+	username string
+	password string
+
+	lock      sync.Mutex
+	requested []string
+}
+
+func newFakeSocks5Server(t *testing.T, username string, password string) *fakeSocks5Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen %v", err)
+	}
+	server := &fakeSocks5Server{listener: listener, username: username, password: password}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeSocks5Server) requests() []string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return append([]string{}, server.requested...)
+}
+
+func (server *fakeSocks5Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return
+	}
+	methods := make([]byte, header[1])
+	io.ReadFull(conn, methods)
+
+	wanted := byte(SOCKS5_AUTH_NONE)
+	if server.username != "" {
+		wanted = SOCKS5_AUTH_PASSWORD
+	}
+	if !bytes.Contains(methods, []byte{wanted}) {
+		conn.Write([]byte{SOCKS5_VERSION, SOCKS5_AUTH_UNACCEPTABLE})
+		return
+	}
+	conn.Write([]byte{SOCKS5_VERSION, wanted})
+
+	if wanted == SOCKS5_AUTH_PASSWORD {
+		length := make([]byte, 2)
+		io.ReadFull(conn, length)
+		username := make([]byte, length[1])
+		io.ReadFull(conn, username)
+		io.ReadFull(conn, length[:1])
+		password := make([]byte, length[0])
+		io.ReadFull(conn, password)
+		if string(username) != server.username || string(password) != server.password {
+			conn.Write([]byte{0x01, 0x01})
+			return
+		}
+		conn.Write([]byte{0x01, 0x00})
+	}
+
+	request := make([]byte, 3)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return
+	}
+	target, _, err := readSocks5Address(conn)
+	if err != nil {
+		return
+	}
+	server.lock.Lock()
+	server.requested = append(server.requested, target.String())
+	server.lock.Unlock()
+
+	switch request[1] {
+	case SOCKS5_COMMAND_CONNECT:
+		server.connect(conn, target.String())
+	case SOCKS5_COMMAND_ASSOCIATE:
+		server.associate(conn)
+	default:
+		conn.Write([]byte{SOCKS5_VERSION, 0x07, 0, SOCKS5_ADDRESS_IPV4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+func (server *fakeSocks5Server) connect(conn net.Conn, target string) {
+	remote, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{SOCKS5_VERSION, 0x05, 0, SOCKS5_ADDRESS_IPV4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer remote.Close()
+	conn.Write([]byte{SOCKS5_VERSION, SOCKS5_REPLY_SUCCEEDED, 0, SOCKS5_ADDRESS_IPV4, 0, 0, 0, 0, 0, 0})
+
+	go io.Copy(remote, conn)
+	io.Copy(conn, remote)
+}
+
+// associate relays datagrams until the control connection closes. The reply gives an
+// unspecified address, as many real proxies do.
+func (server *fakeSocks5Server) associate(conn net.Conn) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	reply := []byte{SOCKS5_VERSION, SOCKS5_REPLY_SUCCEEDED, 0, SOCKS5_ADDRESS_IPV4, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(reply[8:], uint16(port))
+	conn.Write(reply)
+
+	go func() {
+		var client net.Addr
+		buffer := make([]byte, 2048)
+		for {
+			n, from, err := relay.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			if client == nil || from.String() == client.String() {
+				client = from
+				target, length, err := readSocks5Address(bytes.NewReader(buffer[3:n]))
+				if err != nil {
+					continue
+				}
+				targetAddr, err := net.ResolveUDPAddr("udp", target.String())
+				if err != nil {
+					continue
+				}
+				relay.WriteTo(buffer[3+length:n], targetAddr)
+				continue
+			}
+
+			header, _ := socks5AddressBytes(from.String())
+			packet := append([]byte{0, 0, 0}, header...)
+			relay.WriteTo(append(packet, buffer[:n]...), client)
+		}
+	}()
+	io.Copy(ioutil.Discard, conn)
+}
+
+func TestSocks5Connect(t *testing.T) {
+	echo := newTcpEchoServer(t)
+	defer echo.Close()
+	server := newFakeSocks5Server(t, "", "")
+	defer server.listener.Close()
+
+	dialer, _ := NewDialer(Config{Type: PROXY_SOCKS5, Address: server.listener.Addr().String()})
+	conn, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn, "through socks")
+
+	if requests := server.requests(); len(requests) != 1 || requests[0] != echo.Addr().String() {
+		t.Errorf("Unexpected proxy requests %v", requests)
+	}
+}
+
+func TestSocks5ConnectWithPassword(t *testing.T) {
+	echo := newTcpEchoServer(t)
+	defer echo.Close()
+	server := newFakeSocks5Server(t, "user", "secret")
+	defer server.listener.Close()
+
+	dialer, _ := NewDialer(Config{Type: PROXY_SOCKS5, Address: server.listener.Addr().String(), Username: "user", Password: "secret"})
+	conn, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn, "authenticated")
+
+	dialer, _ = NewDialer(Config{Type: PROXY_SOCKS5, Address: server.listener.Addr().String(), Username: "user", Password: "wrong"})
+	if _, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Errorf("Expected error with the wrong password")
+	}
+
+	dialer, _ = NewDialer(Config{Type: PROXY_SOCKS5, Address: server.listener.Addr().String()})
+	if _, err := dialer.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Errorf("Expected error without credentials")
+	}
+}
+
+func TestSocks5PassesHostNamesToProxy(t *testing.T) {
+	echo := newTcpEchoServer(t)
+	defer echo.Close()
+	server := newFakeSocks5Server(t, "", "")
+	defer server.listener.Close()
+
+	port := strconv.Itoa(echo.Addr().(*net.TCPAddr).Port)
+	dialer, _ := NewDialer(Config{Type: PROXY_SOCKS5, Address: server.listener.Addr().String()})
+	conn, err := dialer.DialContext(context.Background(), "tcp", "localhost:"+port)
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	conn.Close()
+
+	if requests := server.requests(); len(requests) != 1 || requests[0] != "localhost:"+port {
+		t.Errorf("Expected host name to be resolved by the proxy but requests were %v", requests)
+	}
+}
+
+func TestSocks5UdpAssociate(t *testing.T) {
+	echo := newUdpEchoServer(t)
+	defer echo.Close()
+	server := newFakeSocks5Server(t, "", "")
+	defer server.listener.Close()
+
+	dialer, _ := NewDialer(Config{Type: PROXY_SOCKS5, Address: server.listener.Addr().String()})
+	conn, err := dialer.DialContext(context.Background(), "udp", echo.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("datagram"))
+	buffer := make([]byte, 64)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Unexpected read error %v", err)
+	}
+	if string(buffer[:n]) != "datagram" {
+		t.Errorf("Expected datagram to be echoed but got '%v'", string(buffer[:n]))
+	}
+	if conn.RemoteAddr().String() != echo.LocalAddr().String() {
+		t.Errorf("Expected remote address %v but was %v", echo.LocalAddr(), conn.RemoteAddr())
+	}
+}
+
+func TestSocks5AddressBytes(t *testing.T) {
+	tests := map[string][]byte{
+		"10.0.0.1:80":     {SOCKS5_ADDRESS_IPV4, 10, 0, 0, 1, 0, 80},
+		"[::1]:6881":      {SOCKS5_ADDRESS_IPV6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1a, 0xe1},
+		"example.com:443": append(append([]byte{SOCKS5_ADDRESS_DOMAIN, 11}, "example.com"...), 0x01, 0xbb),
+	}
+	for address, expected := range tests {
+		encoded, err := socks5AddressBytes(address)
+		if err != nil || !bytes.Equal(encoded, expected) {
+			t.Errorf("Unexpected encoding of %v: %v %v", address, encoded, err)
+			continue
+		}
+		decoded, length, err := readSocks5Address(bytes.NewReader(encoded))
+		if err != nil || length != len(encoded) || decoded.String() != address {
+			t.Errorf("Address %v did not round trip - got %v (%v bytes) %v", address, decoded, length, err)
+		}
+	}
+}
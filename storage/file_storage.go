@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"container/list"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	DEFAULT_MAX_OPEN_FILES = 32
+	ZERO_CHUNK_LENGTH      = 1024 * 1024
+)
+
+// Preallocation decides how files are created before anything is written to them
+type Preallocation int
+
+const (
+	// Files are created when first written, and grow as data arrives
+	PREALLOCATE_NONE Preallocation = iota
+	// Files are created at full length up front without writing anything, which is sparse on
+	// filesystems that support it
+	PREALLOCATE_SPARSE
+	// Files are filled with zeros up front so the space is reserved on disk
+	PREALLOCATE_FULL
+)
+
+// Types
+
+type FileConfig struct {
+	Preallocation Preallocation
+	// MaxOpenFiles limits the file handles kept open, closing the least recently used
+	MaxOpenFiles int
+}
+
+// FileStorage stores a torrent in its files under a download directory
+type FileStorage struct {
+	info   *model.Info
+	dir    string
+	paths  []string
+	config FileConfig
+
+	lock    sync.Mutex
+	handles map[int]*list.Element
+	recent  *list.List
+	closed  bool
+}
+
+type handle struct {
+	file int
+	f    *os.File
+}
+
+// Initialiser
+
+// NewFileStorage checks the torrent's paths are safe and creates its files as the preallocation
+// setting asks. Files with no length are always created.
+func NewFileStorage(info *model.Info, dir string, config FileConfig) (*FileStorage, error) {
+	if config.MaxOpenFiles <= 0 {
+		config.MaxOpenFiles = DEFAULT_MAX_OPEN_FILES
+	}
+
+	s := &FileStorage{
+		info:    info,
+		dir:     dir,
+		paths:   make([]string, len(info.Files)),
+		config:  config,
+		handles: make(map[int]*list.Element),
+		recent:  list.New(),
+	}
+	for i := range info.Files {
+		path, err := info.FilePath(i)
+		if err != nil {
+			return nil, err
+		}
+		s.paths[i] = filepath.Join(dir, path)
+	}
+
+	for i, file := range info.Files {
+		if file.Length > 0 && config.Preallocation == PREALLOCATE_NONE {
+			continue
+		}
+		if err := s.preallocate(i); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Public Methods
+
+func (s *FileStorage) ReadAt(data []byte, piece int, offset int) (int, error) {
+	return s.each(data, piece, offset, false, func(f *os.File, part []byte, offset int64) (int, error) {
+		return f.ReadAt(part, offset)
+	})
+}
+
+func (s *FileStorage) WriteAt(data []byte, piece int, offset int) (int, error) {
+	return s.each(data, piece, offset, true, func(f *os.File, part []byte, offset int64) (int, error) {
+		return f.WriteAt(part, offset)
+	})
+}
+
+// Flush syncs every open file to disk. Files closed by the handle cache were synced then.
+func (s *FileStorage) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	for e := s.recent.Front(); e != nil; e = e.Next() {
+		if err := e.Value.(*handle).f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	var firstErr error
+	for s.recent.Len() > 0 {
+		if err := s.evict(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// OpenFiles returns how many file handles are open
+func (s *FileStorage) OpenFiles() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.recent.Len()
+}
+
+// Helpers
+
+// each runs a read or write over the files a piece range covers
+func (s *FileStorage) each(data []byte, piece int, offset int, create bool, run func(*os.File, []byte, int64) (int, error)) (int, error) {
+	parts, err := spans(s.info, piece, offset, len(data))
+	if err != nil {
+		return 0, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	total := 0
+	for _, part := range parts {
+		f, err := s.open(part.file, create)
+		if err != nil {
+			return total, err
+		}
+		n, err := run(f, data[total:total+part.length], part.offset)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// open returns the handle for a file, opening it and closing the least recently used handle if
+// needed. Must be called with the lock held.
+func (s *FileStorage) open(file int, create bool) (*os.File, error) {
+	if e, ok := s.handles[file]; ok {
+		s.recent.MoveToFront(e)
+		return e.Value.(*handle).f, nil
+	}
+
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(s.paths[file]), 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(s.paths[file], flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for s.recent.Len() >= s.config.MaxOpenFiles {
+		s.evict()
+	}
+	s.handles[file] = s.recent.PushFront(&handle{file: file, f: f})
+	return f, nil
+}
+
+// evict closes the least recently used handle. Must be called with the lock held.
+func (s *FileStorage) evict() error {
+	e := s.recent.Back()
+	h := e.Value.(*handle)
+	s.recent.Remove(e)
+	delete(s.handles, h.file)
+
+	syncErr := h.f.Sync()
+	if err := h.f.Close(); err != nil {
+		return err
+	}
+	return syncErr
+}
+
+func (s *FileStorage) preallocate(file int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := s.open(file, true)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	length := int64(s.info.Files[file].Length)
+	if stat.Size() >= length {
+		return nil
+	}
+	if s.config.Preallocation != PREALLOCATE_FULL {
+		return f.Truncate(length)
+	}
+
+	zeros := make([]byte, ZERO_CHUNK_LENGTH)
+	for offset := stat.Size(); offset < length; offset += int64(len(zeros)) {
+		chunk := zeros
+		if remaining := length - offset; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if _, err := f.WriteAt(chunk, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
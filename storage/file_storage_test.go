@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStorageWritesIntoFiles(t *testing.T) {
+	info := testInfo([]int{10, 0, 25, 5})
+	dir := t.TempDir()
+	s, err := NewFileStorage(info, dir, FileConfig{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer s.Close()
+
+	// Only the empty file exists until something is written
+	assertFileLength(t, filepath.Join(dir, "torrent", "sub", "file1"), 0)
+	if _, err := os.Stat(filepath.Join(dir, "torrent", "sub", "file0")); !os.IsNotExist(err) {
+		t.Errorf("Expected files not to be created without preallocation")
+	}
+	if _, err := s.ReadAt(make([]byte, 4), 0, 0); err == nil {
+		t.Errorf("Expected reading a file never written to fail")
+	}
+
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyzABCD")
+	for piece := 0; piece < info.NumPieces(); piece++ {
+		start := piece * 16
+		end := start + info.PieceSize(piece)
+		if _, err := s.WriteAt(data[start:end], piece, 0); err != nil {
+			t.Fatalf("Unexpected error writing piece %v: %v", piece, err)
+		}
+	}
+	s.Flush()
+
+	expected := map[string]string{"file0": "0123456789", "file1": "", "file2": "abcdefghijklmnopqrstuvwxy", "file3": "zABCD"}
+	for name, contents := range expected {
+		read, err := ioutil.ReadFile(filepath.Join(dir, "torrent", "sub", name))
+		if err != nil || string(read) != contents {
+			t.Errorf("Expected %v to hold %q but was %q %v", name, contents, read, err)
+		}
+	}
+}
+
+func TestFileStoragePreallocation(t *testing.T) {
+	info := testInfo([]int{3000000, 100})
+
+	for _, preallocation := range []Preallocation{PREALLOCATE_SPARSE, PREALLOCATE_FULL} {
+		dir := t.TempDir()
+		s, err := NewFileStorage(info, dir, FileConfig{Preallocation: preallocation})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		assertFileLength(t, filepath.Join(dir, "torrent", "sub", "file0"), 3000000)
+		assertFileLength(t, filepath.Join(dir, "torrent", "sub", "file1"), 100)
+
+		data := make([]byte, 16)
+		if n, err := s.ReadAt(data, 0, 0); err != nil || n != 16 || !bytes.Equal(data, make([]byte, 16)) {
+			t.Errorf("Expected preallocated data to read as zeros %v %v", n, err)
+		}
+		s.Close()
+	}
+}
+
+func TestFileStorageLimitsOpenFiles(t *testing.T) {
+	info := testInfo([]int{16, 16, 16, 16})
+	s, err := NewFileStorage(info, t.TempDir(), FileConfig{Preallocation: PREALLOCATE_SPARSE, MaxOpenFiles: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer s.Close()
+
+	for piece := 0; piece < 4; piece++ {
+		s.WriteAt(bytes.Repeat([]byte{byte(piece)}, 16), piece, 0)
+		if s.OpenFiles() > 2 {
+			t.Fatalf("Expected at most 2 open files but was %v", s.OpenFiles())
+		}
+	}
+
+	// Reading back reopens the files that were closed
+	for piece := 0; piece < 4; piece++ {
+		data := make([]byte, 16)
+		if _, err := s.ReadAt(data, piece, 0); err != nil || !bytes.Equal(data, bytes.Repeat([]byte{byte(piece)}, 16)) {
+			t.Errorf("Unexpected data for piece %v: %v %v", piece, data, err)
+		}
+	}
+
+	s.Close()
+	if s.OpenFiles() != 0 {
+		t.Errorf("Expected close to release every handle")
+	}
+}
+
+func TestFileStorageRefusesUnsafePaths(t *testing.T) {
+	info := testInfo([]int{10})
+	info.Files[0].Path = "../../escape"
+	if _, err := NewFileStorage(info, t.TempDir(), FileConfig{}); err == nil {
+		t.Errorf("Expected unsafe path to be refused")
+	}
+}
+
+// Helpers
+
+func assertFileLength(t *testing.T, path string, length int64) {
+	t.Helper()
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("Expected %v to exist %v", path, err)
+		return
+	}
+	if stat.Size() != length {
+		t.Errorf("Expected %v to be %v bytes but was %v", path, length, stat.Size())
+	}
+}
@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"sync"
+)
+
+// Types
+
+// MemoryStorage keeps a whole torrent in memory, for tests and small torrents
+type MemoryStorage struct {
+	info   *model.Info
+	lock   sync.RWMutex
+	data   []byte
+	closed bool
+}
+
+// Initialiser
+
+func NewMemoryStorage(info *model.Info) *MemoryStorage {
+	return &MemoryStorage{info: info, data: make([]byte, info.TotalLength())}
+}
+
+// Public Methods
+
+func (s *MemoryStorage) ReadAt(data []byte, piece int, offset int) (int, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	start, err := s.position(piece, offset, len(data))
+	if err != nil {
+		return 0, err
+	}
+	return copy(data, s.data[start:]), nil
+}
+
+func (s *MemoryStorage) WriteAt(data []byte, piece int, offset int) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	start, err := s.position(piece, offset, len(data))
+	if err != nil {
+		return 0, err
+	}
+	return copy(s.data[start:], data), nil
+}
+
+func (s *MemoryStorage) Flush() error {
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+// Bytes returns the torrent's data as stored, for checking in tests
+func (s *MemoryStorage) Bytes() []byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]byte{}, s.data...)
+}
+
+// Helpers
+
+func (s *MemoryStorage) position(piece int, offset int, length int) (int64, error) {
+	if s.closed {
+		return 0, ErrClosed
+	}
+	if piece < 0 || piece >= s.info.NumPieces() || offset < 0 || offset+length > s.info.PieceSize(piece) {
+		return 0, ErrOutOfRange
+	}
+	return int64(piece)*int64(s.info.PieceLength) + int64(offset), nil
+}
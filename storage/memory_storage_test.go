@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryStorageLaysOutData(t *testing.T) {
+	info := testInfo([]int{10, 20})
+	s := NewMemoryStorage(info)
+
+	if _, err := s.WriteAt([]byte{1, 2, 3}, 1, 11); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := s.WriteAt([]byte{9}, 0, 15); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if _, err := s.WriteAt([]byte{1, 2, 3}, 1, 12); err != ErrOutOfRange {
+		t.Errorf("Expected write past the end of the short last piece to fail but was %v", err)
+	}
+
+	expected := make([]byte, 30)
+	expected[15] = 9
+	copy(expected[27:], []byte{1, 2, 3})
+	if !bytes.Equal(s.Bytes(), expected) {
+		t.Errorf("Expected data %v but was %v", expected, s.Bytes())
+	}
+}
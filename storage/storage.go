@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"errors"
+	"github.com/onepointsixtwo/torrentsgo/model"
+)
+
+var (
+	ErrOutOfRange = errors.New("Read or write goes beyond the end of the piece")
+	ErrClosed     = errors.New("Storage is closed")
+)
+
+// Types
+
+// Storage holds the data of a torrent, addressed by piece and offset within the piece. Storage
+// implementations are safe for concurrent use.
+type Storage interface {
+	ReadAt(data []byte, piece int, offset int) (int, error)
+	WriteAt(data []byte, piece int, offset int) (int, error)
+	// Flush makes sure everything written so far is durable
+	Flush() error
+	Close() error
+}
+
+// span is the part of a read or write which falls in one file
+type span struct {
+	file   int
+	offset int64
+	length int
+}
+
+// Helpers
+
+// spans splits a read or write within a piece into the parts falling in each file, skipping
+// files with no length
+func spans(info *model.Info, piece int, offset int, length int) ([]span, error) {
+	if piece < 0 || piece >= info.NumPieces() || offset < 0 || offset+length > info.PieceSize(piece) {
+		return nil, ErrOutOfRange
+	}
+
+	position := int64(piece)*int64(info.PieceLength) + int64(offset)
+	result := make([]span, 0, 1)
+	fileOffset := int64(0)
+	for file, f := range info.Files {
+		fileEnd := fileOffset + int64(f.Length)
+		if length > 0 && position < fileEnd {
+			n := fileEnd - position
+			if n > int64(length) {
+				n = int64(length)
+			}
+			result = append(result, span{file: file, offset: position - fileOffset, length: int(n)})
+			position += n
+			length -= int(n)
+		}
+		fileOffset = fileEnd
+	}
+	return result, nil
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bytes"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"reflect"
+	"testing"
+)
+
+func TestSpansCrossFileBoundaries(t *testing.T) {
+	info := testInfo([]int{10, 0, 25, 5})
+
+	parts, err := spans(info, 0, 4, 12)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := []span{{file: 0, offset: 4, length: 6}, {file: 2, offset: 0, length: 6}}
+	if !reflect.DeepEqual(parts, expected) {
+		t.Errorf("Expected %+v but was %+v", expected, parts)
+	}
+
+	parts, _ = spans(info, 2, 0, 8)
+	expected = []span{{file: 2, offset: 22, length: 3}, {file: 3, offset: 0, length: 5}}
+	if !reflect.DeepEqual(parts, expected) {
+		t.Errorf("Expected %+v but was %+v", expected, parts)
+	}
+
+	for _, bad := range [][3]int{{3, 0, 1}, {-1, 0, 1}, {0, -1, 1}, {0, 10, 7}, {2, 0, 17}} {
+		if _, err := spans(info, bad[0], bad[1], bad[2]); err != ErrOutOfRange {
+			t.Errorf("Expected %v to be out of range but was %v", bad, err)
+		}
+	}
+}
+
+func TestStoragesRoundTrip(t *testing.T) {
+	info := testInfo([]int{10, 0, 25, 5})
+	fileStorage, err := NewFileStorage(info, t.TempDir(), FileConfig{Preallocation: PREALLOCATE_SPARSE, MaxOpenFiles: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error creating file storage %v", err)
+	}
+	storages := map[string]Storage{"memory": NewMemoryStorage(info), "file": fileStorage}
+
+	for name, s := range storages {
+		for piece := 0; piece < info.NumPieces(); piece++ {
+			data := bytes.Repeat([]byte{byte(piece + 1)}, info.PieceSize(piece))
+			if n, err := s.WriteAt(data, piece, 0); err != nil || n != len(data) {
+				t.Fatalf("Unexpected %v write of piece %v: %v %v", name, piece, n, err)
+			}
+		}
+		if err := s.Flush(); err != nil {
+			t.Errorf("Unexpected %v flush error %v", name, err)
+		}
+
+		data := make([]byte, 8)
+		if n, err := s.ReadAt(data, 0, 8); err != nil || n != 8 || !bytes.Equal(data, bytes.Repeat([]byte{1}, 8)) {
+			t.Errorf("Unexpected %v read across files %v %v %v", name, data, n, err)
+		}
+		last := make([]byte, info.PieceSize(2))
+		if n, err := s.ReadAt(last, 2, 0); err != nil || n != 8 || !bytes.Equal(last, bytes.Repeat([]byte{3}, 8)) {
+			t.Errorf("Unexpected %v read of last piece %v %v %v", name, last, n, err)
+		}
+		if _, err := s.WriteAt(make([]byte, 9), 2, 0); err != ErrOutOfRange {
+			t.Errorf("Expected %v write past the end to fail but was %v", name, err)
+		}
+
+		if err := s.Close(); err != nil {
+			t.Errorf("Unexpected %v close error %v", name, err)
+		}
+		if _, err := s.ReadAt(data, 0, 0); err != ErrClosed {
+			t.Errorf("Expected %v read after close to fail but was %v", name, err)
+		}
+	}
+}
+
+// Helpers
+
+// testInfo makes a torrent with 16 byte pieces in a directory
+func testInfo(lengths []int) *model.Info {
+	files := make([]*model.File, len(lengths))
+	total := 0
+	for i, length := range lengths {
+		files[i] = model.NewFile("sub/file"+string(rune('0'+i)), length, "")
+		total += length
+	}
+	return model.NewInfo(16, make([]byte, 20*((total+15)/16)), 0, files, "torrent", nil)
+}
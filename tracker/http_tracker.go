@@ -0,0 +1,342 @@
+package tracker
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	COMPACT_PEER_LENGTH  = 6
+	COMPACT_PEER6_LENGTH = 18
+)
+
+// Announce
+
+func (c *Client) announceHttp(ctx context.Context, request *AnnounceRequest) (*AnnounceResponse, error) {
+	c.trackerIdLock.Lock()
+	trackerId := c.trackerIds[string(request.InfoHash)]
+	c.trackerIdLock.Unlock()
+
+	query, err := announceQuery(request, trackerId)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := c.getBencoded(ctx, c.announceUrl, query)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := parseHttpAnnounceResponse(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	// The tracker id only needs to be sent while the tracker keeps giving one out
+	if response.TrackerId != "" {
+		c.trackerIdLock.Lock()
+		if request.Event == EVENT_STOPPED {
+			delete(c.trackerIds, string(request.InfoHash))
+		} else {
+			c.trackerIds[string(request.InfoHash)] = response.TrackerId
+		}
+		c.trackerIdLock.Unlock()
+	}
+	return response, nil
+}
+
+func announceQuery(request *AnnounceRequest, trackerId string) (string, error) {
+	infoHash, err := util.UrlEncodeHash(request.InfoHash)
+	if err != nil {
+		return "", err
+	}
+	peerId, err := util.UrlEncodeHash(request.PeerId)
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	values.Set("port", strconv.Itoa(request.Port))
+	values.Set("uploaded", strconv.FormatInt(request.Uploaded, 10))
+	values.Set("downloaded", strconv.FormatInt(request.Downloaded, 10))
+	values.Set("left", strconv.FormatInt(request.Left, 10))
+	values.Set("compact", "1")
+	if request.Event != EVENT_NONE {
+		values.Set("event", request.Event.String())
+	}
+	if request.NumWant > 0 {
+		values.Set("numwant", strconv.Itoa(request.NumWant))
+	}
+	if request.Key != 0 {
+		values.Set("key", strconv.FormatUint(uint64(request.Key), 16))
+	}
+	if trackerId != "" {
+		values.Set("trackerid", trackerId)
+	}
+
+	// The hashes are already escaped, so they can't go through url.Values
+	return "info_hash=" + infoHash + "&peer_id=" + peerId + "&" + values.Encode(), nil
+}
+
+func parseHttpAnnounceResponse(decoded *model.OrderedMap) (*AnnounceResponse, error) {
+	if failure := parseFailure(decoded); failure != nil {
+		return nil, failure
+	}
+
+	interval, ok := getInt(decoded, "interval")
+	if !ok {
+		return nil, fmt.Errorf("Announce response is missing interval")
+	}
+	minInterval, _ := getInt(decoded, "min interval")
+	seeders, _ := getInt(decoded, "complete")
+	leechers, _ := getInt(decoded, "incomplete")
+
+	peers, err := parsePeers(decoded.Get("peers"))
+	if err != nil {
+		return nil, err
+	}
+	if peers6, ok := getString(decoded, "peers6"); ok {
+		parsed, err := parseCompactPeers([]byte(peers6), COMPACT_PEER6_LENGTH)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, parsed...)
+	}
+
+	response := &AnnounceResponse{
+		Interval:    seconds(interval),
+		MinInterval: seconds(minInterval),
+		Seeders:     seeders,
+		Leechers:    leechers,
+		Peers:       peers,
+	}
+	response.Warning, _ = getString(decoded, "warning message")
+	response.TrackerId, _ = getString(decoded, "tracker id")
+
+	// BEP 24 gives the address as 4 or 16 raw bytes
+	if externalIp, ok := getString(decoded, "external ip"); ok && (len(externalIp) == net.IPv4len || len(externalIp) == net.IPv6len) {
+		response.ExternalIP = net.IP([]byte(externalIp))
+	}
+	return response, nil
+}
+
+// parseFailure reads the failure reason along with the BEP 31 retry hint, which is either a
+// number of minutes or 'never'
+func parseFailure(decoded *model.OrderedMap) *FailureError {
+	reason, ok := getString(decoded, "failure reason")
+	if !ok {
+		return nil
+	}
+
+	failure := &FailureError{Reason: reason}
+	switch retryIn := decoded.Get("retry in").(type) {
+	case int:
+		if retryIn > 0 {
+			failure.RetryIn = time.Duration(retryIn) * time.Minute
+		}
+	case string:
+		failure.RetryNever = retryIn == "never"
+	}
+	return failure
+}
+
+func parsePeers(value interface{}) ([]*Peer, error) {
+	switch v := value.(type) {
+	case nil:
+		return make([]*Peer, 0), nil
+	case string:
+		return parseCompactPeers([]byte(v), COMPACT_PEER_LENGTH)
+	case []interface{}:
+		return parseDictionaryPeers(v), nil
+	default:
+		return nil, fmt.Errorf("Unexpected type for peers %T", value)
+	}
+}
+
+func parseCompactPeers(data []byte, entryLength int) ([]*Peer, error) {
+	if len(data)%entryLength != 0 {
+		return nil, fmt.Errorf("Compact peers length %v is not a multiple of %v", len(data), entryLength)
+	}
+
+	ipLength := entryLength - 2
+	peers := make([]*Peer, 0, len(data)/entryLength)
+	for offset := 0; offset < len(data); offset += entryLength {
+		ip := make(net.IP, ipLength)
+		copy(ip, data[offset:offset+ipLength])
+		port := int(binary.BigEndian.Uint16(data[offset+ipLength:]))
+		peers = append(peers, &Peer{IP: ip, Port: port})
+	}
+	return peers, nil
+}
+
+func parseDictionaryPeers(list []interface{}) []*Peer {
+	peers := make([]*Peer, 0, len(list))
+	for _, item := range list {
+		dict, ok := item.(*model.OrderedMap)
+		if !ok {
+			continue
+		}
+		ipString, _ := getString(dict, "ip")
+		ip := net.ParseIP(ipString)
+		port, hasPort := getInt(dict, "port")
+		if ip == nil || !hasPort {
+			continue
+		}
+		peer := &Peer{IP: ip, Port: port}
+		if peerId, ok := getString(dict, "peer id"); ok {
+			peer.PeerId = []byte(peerId)
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Scrape
+
+func (c *Client) scrapeHttp(ctx context.Context, infoHashes [][]byte) ([]*ScrapeResult, error) {
+	scrapeUrl, err := ScrapeUrl(c.announceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	query := bytes.NewBuffer(nil)
+	for i, infoHash := range infoHashes {
+		encoded, err := util.UrlEncodeHash(infoHash)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			query.WriteString("&")
+		}
+		query.WriteString("info_hash=" + encoded)
+	}
+
+	decoded, err := c.getBencoded(ctx, scrapeUrl, query.String())
+	if err != nil {
+		if statusErr, ok := err.(*statusError); ok && statusErr.notFound() {
+			return nil, ErrScrapeNotSupported
+		}
+		return nil, err
+	}
+
+	return parseHttpScrapeResponse(decoded, infoHashes)
+}
+
+func parseHttpScrapeResponse(decoded *model.OrderedMap, infoHashes [][]byte) ([]*ScrapeResult, error) {
+	if failure := parseFailure(decoded); failure != nil {
+		return nil, failure
+	}
+
+	files, ok := decoded.Get("files").(*model.OrderedMap)
+	if !ok {
+		return nil, fmt.Errorf("Scrape response is missing files dictionary")
+	}
+
+	results := make([]*ScrapeResult, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		stats, ok := files.Get(string(infoHash)).(*model.OrderedMap)
+		if !ok {
+			continue
+		}
+		seeders, _ := getInt(stats, "complete")
+		completed, _ := getInt(stats, "downloaded")
+		leechers, _ := getInt(stats, "incomplete")
+		results = append(results, &ScrapeResult{InfoHash: infoHash, Seeders: seeders, Completed: completed, Leechers: leechers})
+	}
+	return results, nil
+}
+
+// Transport
+
+type statusError struct {
+	code int
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("Tracker responded with HTTP status %v", err.code)
+}
+
+func (err *statusError) notFound() bool {
+	return err.code == http.StatusNotFound || err.code == http.StatusNotImplemented
+}
+
+func (c *Client) getBencoded(ctx context.Context, base *url.URL, query string) (*model.OrderedMap, error) {
+	requestUrl := *base
+	if requestUrl.RawQuery != "" {
+		requestUrl.RawQuery = requestUrl.RawQuery + "&" + query
+	} else {
+		requestUrl.RawQuery = query
+	}
+
+	request, err := http.NewRequest(http.MethodGet, requestUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// Asking for gzip explicitly means it isn't decompressed for us, but some trackers
+	// compress whatever the request says so the body is checked either way
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	response, err := c.httpClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, &statusError{response.StatusCode}
+	}
+
+	body, err := decompressedBody(response)
+	if err != nil {
+		return nil, err
+	}
+
+	// The limit applies after decompression, so a small compressed body can't expand without bound
+	decoded, err := bencoding.DecodeBencodingLimited(body, c.maxResponseLength)
+	if err == bencoding.ErrTooLarge {
+		return nil, fmt.Errorf("Tracker response exceeds maximum length of %v bytes", c.maxResponseLength)
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to decode tracker response - %v", err)
+	}
+	return decoded, nil
+}
+
+// decompressedBody unwraps gzip bodies, recognising them by their magic number since a bencoded
+// response can never start with it
+func decompressedBody(response *http.Response) (io.Reader, error) {
+	reader := bufio.NewReader(response.Body)
+	magic, _ := reader.Peek(2)
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return reader, nil
+	}
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decompress tracker response - %v", err)
+	}
+	return gzipReader, nil
+}
+
+// checkRedirect follows a limited number of redirects, and only to other HTTP trackers
+func checkRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= MAX_REDIRECTS {
+		return fmt.Errorf("Tracker redirected more than %v times", MAX_REDIRECTS)
+	}
+	if request.URL.Scheme != "http" && request.URL.Scheme != "https" {
+		return fmt.Errorf("Tracker redirected to unsupported scheme '%v'", request.URL.Scheme)
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package tracker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testInfoHash  = []byte("aaaaaaaaaaaaaaaaaaaa")
+	testInfoHash2 = []byte("bbbbbbbbbbbbbbbbbbbb")
+	testPeerId    = []byte("-GT0001-123456789012")
+)
+
+func newTestHttpClient(t *testing.T, server *httptest.Server, path string) *Client {
+	announceUrl, _ := url.Parse(server.URL + path)
+	client, err := NewClient(announceUrl)
+	if err != nil {
+		t.Fatalf("Unable to create client %v", err)
+	}
+	return client
+}
+
+func TestHttpAnnounceCompact(t *testing.T) {
+	var query url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		w.Write([]byte("d8:completei3e10:incompletei5e8:intervali1800e12:min intervali60e5:peers12:\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2e"))
+	}))
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce?passkey=abc")
+	request := &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId, Port: 6881, Left: 100, Event: EVENT_STARTED}
+	response, err := client.Announce(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Unexpected error announcing %v", err)
+	}
+
+	if query.Get("passkey") != "abc" || query.Get("info_hash") != string(testInfoHash) || query.Get("peer_id") != string(testPeerId) {
+		t.Errorf("Unexpected announce query %v", query)
+	}
+	if query.Get("event") != "started" || query.Get("left") != "100" || query.Get("compact") != "1" {
+		t.Errorf("Unexpected announce query %v", query)
+	}
+
+	if response.Interval.Seconds() != 1800 || response.MinInterval.Seconds() != 60 {
+		t.Errorf("Unexpected intervals %v %v", response.Interval, response.MinInterval)
+	}
+	if response.Seeders != 3 || response.Leechers != 5 {
+		t.Errorf("Unexpected seeders/leechers %v/%v", response.Seeders, response.Leechers)
+	}
+	if len(response.Peers) != 2 {
+		t.Fatalf("Expected two peers but got %v", len(response.Peers))
+	}
+	if response.Peers[0].IP.String() != "127.0.0.1" || response.Peers[0].Port != 6881 {
+		t.Errorf("Unexpected first peer %v:%v", response.Peers[0].IP, response.Peers[0].Port)
+	}
+	if response.Peers[1].IP.String() != "10.0.0.2" || response.Peers[1].Port != 6882 {
+		t.Errorf("Unexpected second peer %v:%v", response.Peers[1].IP, response.Peers[1].Port)
+	}
+}
+
+func TestHttpAnnounceDictionaryPeers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peersld2:ip9:127.0.0.17:peer id20:-XX0001-0000000000004:porti51413eeee"))
+	}))
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	response, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+	if err != nil {
+		t.Fatalf("Unexpected error announcing %v", err)
+	}
+	if len(response.Peers) != 1 {
+		t.Fatalf("Expected one peer but got %v", len(response.Peers))
+	}
+	peer := response.Peers[0]
+	if peer.IP.String() != "127.0.0.1" || peer.Port != 51413 || string(peer.PeerId) != "-XX0001-000000000000" {
+		t.Errorf("Unexpected peer %v:%v %v", peer.IP, peer.Port, string(peer.PeerId))
+	}
+}
+
+func TestHttpAnnounceFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason12:unregisterede"))
+	}))
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	_, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+	failure, ok := err.(*FailureError)
+	if !ok || failure.Reason != "unregistered" {
+		t.Errorf("Expected failure error with reason 'unregistered' but was %v", err)
+	}
+}
+
+func TestHttpScrape(t *testing.T) {
+	requests := 0
+	var infoHashes []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/scrape" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		infoHashes = r.URL.Query()["info_hash"]
+
+		body := bytes.NewBufferString("d5:filesd")
+		body.WriteString("20:" + string(testInfoHash) + "d8:completei5e10:downloadedi50e10:incompletei10ee")
+		body.WriteString("20:" + string(testInfoHash2) + "d8:completei1e10:downloadedi2e10:incompletei3ee")
+		body.WriteString("ee")
+		w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	unknownHash := []byte(strings.Repeat("c", 20))
+	results, err := client.Scrape(context.Background(), testInfoHash, unknownHash, testInfoHash2)
+	if err != nil {
+		t.Fatalf("Unexpected scrape error %v", err)
+	}
+
+	if requests != 1 || len(infoHashes) != 3 {
+		t.Errorf("Expected one batched request with three hashes but got %v requests and %v hashes", requests, len(infoHashes))
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected two results but got %v", len(results))
+	}
+	first := results[0]
+	if !bytes.Equal(first.InfoHash, testInfoHash) || first.Seeders != 5 || first.Completed != 50 || first.Leechers != 10 {
+		t.Errorf("Unexpected first scrape result %+v", first)
+	}
+	second := results[1]
+	if !bytes.Equal(second.InfoHash, testInfoHash2) || second.Seeders != 1 || second.Completed != 2 || second.Leechers != 3 {
+		t.Errorf("Unexpected second scrape result %+v", second)
+	}
+}
+
+func TestHttpScrapeBatches(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("d5:filesdee"))
+	}))
+	defer server.Close()
+
+	hashes := make([][]byte, HTTP_SCRAPE_BATCH+1)
+	for i := range hashes {
+		hashes[i] = testInfoHash
+	}
+
+	client := newTestHttpClient(t, server, "/announce")
+	if _, err := client.Scrape(context.Background(), hashes...); err != nil {
+		t.Fatalf("Unexpected scrape error %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected two scrape requests but got %v", requests)
+	}
+}
+
+func TestHttpScrapeNotSupported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	if _, err := client.Scrape(context.Background(), testInfoHash); err != ErrScrapeNotSupported {
+		t.Errorf("Expected ErrScrapeNotSupported for missing scrape endpoint but got %v", err)
+	}
+
+	client = newTestHttpClient(t, server, "/tracker")
+	if _, err := client.Scrape(context.Background(), testInfoHash); err != ErrScrapeNotSupported {
+		t.Errorf("Expected ErrScrapeNotSupported for unconventional announce url but got %v", err)
+	}
+}
+
+// Recorded responses
+
+func newRecordedResponseServer(t *testing.T, file string, contentEncoding string) (*httptest.Server, chan url.Values) {
+	body, err := ioutil.ReadFile("../testresources/tracker/" + file)
+	if err != nil {
+		t.Fatalf("Unable to read recorded response %v", err)
+	}
+	queries := make(chan url.Values, 8)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		if contentEncoding != "" {
+			w.Header().Set("Content-Encoding", contentEncoding)
+		}
+		w.Write(body)
+	}))
+	return server, queries
+}
+
+func TestHttpAnnounceExtensions(t *testing.T) {
+	server, queries := newRecordedResponseServer(t, "announce-extensions.bencoded", "")
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	request := &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId, Event: EVENT_STARTED}
+	response, err := client.Announce(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Unexpected error announcing %v", err)
+	}
+
+	if response.Warning != "Your client is outdated, please upgrade" {
+		t.Errorf("Unexpected warning '%v'", response.Warning)
+	}
+	if response.TrackerId != "7f3a9c" {
+		t.Errorf("Unexpected tracker id '%v'", response.TrackerId)
+	}
+	if !response.ExternalIP.Equal(net.IPv4(203, 0, 113, 7)) {
+		t.Errorf("Unexpected external ip %v", response.ExternalIP)
+	}
+	if len(response.Peers) != 2 || response.Peers[1].IP.String() != "2001:db8::1" {
+		t.Errorf("Expected IPv4 and IPv6 peers but got %v", len(response.Peers))
+	}
+
+	if query := <-queries; query.Get("trackerid") != "" {
+		t.Errorf("First announce should not send a tracker id but sent '%v'", query.Get("trackerid"))
+	}
+
+	// The tracker id is echoed back on later announces for the same torrent only
+	request.Event = EVENT_NONE
+	client.Announce(context.Background(), request)
+	if query := <-queries; query.Get("trackerid") != "7f3a9c" {
+		t.Errorf("Expected tracker id to be sent back but was '%v'", query.Get("trackerid"))
+	}
+	client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash2, PeerId: testPeerId})
+	if query := <-queries; query.Get("trackerid") != "" {
+		t.Errorf("Tracker id should not be sent for another torrent but was '%v'", query.Get("trackerid"))
+	}
+}
+
+func TestHttpAnnounceGzip(t *testing.T) {
+	// Sent both with and without the header, as some trackers compress without saying so
+	for _, contentEncoding := range []string{"gzip", ""} {
+		server, _ := newRecordedResponseServer(t, "announce-gzip.bencoded.gz", contentEncoding)
+
+		client := newTestHttpClient(t, server, "/announce")
+		response, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+		server.Close()
+		if err != nil {
+			t.Fatalf("Unexpected error announcing with content encoding '%v': %v", contentEncoding, err)
+		}
+		if response.Interval.Seconds() != 600 || len(response.Peers) != 1 {
+			t.Errorf("Unexpected gzipped announce response %+v", response)
+		}
+	}
+}
+
+func TestHttpAnnounceRetryIn(t *testing.T) {
+	server, _ := newRecordedResponseServer(t, "failure-retry-in.bencoded", "")
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	_, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+	failure, ok := err.(*FailureError)
+	if !ok {
+		t.Fatalf("Expected failure error but got %v", err)
+	}
+	if failure.Reason != "Tracker is overloaded" || failure.RetryIn != 5*time.Minute || failure.RetryNever {
+		t.Errorf("Unexpected failure %+v", failure)
+	}
+}
+
+func TestHttpAnnounceRetryNever(t *testing.T) {
+	server, _ := newRecordedResponseServer(t, "failure-retry-never.bencoded", "")
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	_, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+	failure, ok := err.(*FailureError)
+	if !ok || !failure.RetryNever || failure.RetryIn != 0 {
+		t.Errorf("Expected failure never to be retried but got %v", err)
+	}
+}
+
+func TestHttpAnnounceFollowsRedirects(t *testing.T) {
+	server, queries := newRecordedResponseServer(t, "announce-extensions.bencoded", "")
+	defer server.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, server.URL+"/moved/announce?"+r.URL.RawQuery, http.StatusMovedPermanently)
+	}))
+	defer redirect.Close()
+
+	client := newTestHttpClient(t, redirect, "/announce")
+	if _, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId}); err != nil {
+		t.Fatalf("Unexpected error following redirect %v", err)
+	}
+	if query := <-queries; query.Get("info_hash") != string(testInfoHash) {
+		t.Errorf("Redirected announce lost its query %v", query)
+	}
+}
+
+func TestHttpAnnounceRedirectLoop(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, server.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	if _, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId}); err == nil {
+		t.Errorf("Expected error for endless redirects")
+	}
+}
+
+func TestHttpAnnounceResponseTooLarge(t *testing.T) {
+	server, _ := newRecordedResponseServer(t, "announce-extensions.bencoded", "")
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	client.maxResponseLength = 100
+	if _, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId}); err == nil {
+		t.Errorf("Expected error for response over the maximum length")
+	}
+}
+
+func TestHttpAnnounceGzipLimitAppliesAfterDecompression(t *testing.T) {
+	compressed := bytes.NewBuffer(nil)
+	writer := gzip.NewWriter(compressed)
+	writer.Write([]byte("d8:intervali1800e5:peers2000000:"))
+	writer.Write(make([]byte, 2000000))
+	writer.Write([]byte("e"))
+	writer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	client := newTestHttpClient(t, server, "/announce")
+	if _, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId}); err == nil {
+		t.Errorf("Expected error for response which decompresses past the maximum length")
+	}
+}
@@ -0,0 +1,439 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/peerid"
+	"github.com/onepointsixtwo/torrentsgo/proxy"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"io"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_NUM_WANT          = 50
+	DEFAULT_ANNOUNCE_INTERVAL = 30 * time.Minute
+	ANNOUNCE_RETRY_MIN        = 15 * time.Second
+	ANNOUNCE_RETRY_MAX        = 30 * time.Minute
+	STOPPED_ANNOUNCE_TIMEOUT  = 5 * time.Second
+)
+
+// Types
+
+// Announcer is the part of Client used by the Manager, so that tests can stand in for trackers
+type Announcer interface {
+	AnnounceUrl() *url.URL
+	Announce(ctx context.Context, request *AnnounceRequest) (*AnnounceResponse, error)
+}
+
+type dialerSetter interface {
+	SetDialer(dialer proxy.Dialer)
+}
+
+type AnnouncerFactory func(announceUrl *url.URL) (Announcer, error)
+
+// TransferStats reports the totals sent with each announce
+type TransferStats func() (uploaded int64, downloaded int64, left int64)
+
+type ManagerConfig struct {
+	PeerId  []byte
+	Port    int
+	NumWant int
+	Clock   util.Clock
+	// Dialer is used by the default announcers, see proxy.Config.TrackerDialer
+	Dialer       proxy.Dialer
+	NewAnnouncer AnnouncerFactory
+}
+
+type PeerBatch struct {
+	InfoHash []byte
+	Source   *url.URL
+	Peers    []*Peer
+}
+
+// Manager schedules announces for every torrent it is given, walking the BEP 12 tiers of
+// trackers and publishing the peers they return on the Peers channel.
+type Manager struct {
+	config ManagerConfig
+	key    uint32
+	peers  chan *PeerBatch
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock       sync.Mutex
+	torrents   map[string]*announceState
+	announcers map[string]Announcer
+}
+
+type announceState struct {
+	infoHash []byte
+	stats    TransferStats
+	tiers    [][]Announcer
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+	// ctx is cancelled when the torrent is removed, so Remove needn't wait for slow trackers
+	ctx    context.Context
+	cancel context.CancelFunc
+	// Trackers which asked never to be retried (BEP 31). Only used by the announce goroutine.
+	abandoned map[Announcer]bool
+
+	// Guarded by the manager lock
+	event        Event
+	started      bool
+	lastAnnounce time.Time
+	minInterval  time.Duration
+	lastTracker  Announcer
+}
+
+// Initialiser
+
+func NewManager(config ManagerConfig) *Manager {
+	if config.PeerId == nil {
+		config.PeerId = peerid.New()
+	}
+	if config.NumWant == 0 {
+		config.NumWant = DEFAULT_NUM_WANT
+	}
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+	if config.NewAnnouncer == nil {
+		dialer := config.Dialer
+		config.NewAnnouncer = func(announceUrl *url.URL) (Announcer, error) {
+			announcer, err := NewAnnouncer(announceUrl)
+			if err != nil || dialer == nil {
+				return announcer, err
+			}
+			announcer.(dialerSetter).SetDialer(dialer)
+			return announcer, nil
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		config:     config,
+		key:        rand.Uint32(),
+		peers:      make(chan *PeerBatch, 16),
+		ctx:        ctx,
+		cancel:     cancel,
+		torrents:   make(map[string]*announceState),
+		announcers: make(map[string]Announcer),
+	}
+}
+
+// Public Methods
+
+// Peers delivers the peers returned by trackers. It is closed when the manager is closed.
+func (m *Manager) Peers() <-chan *PeerBatch {
+	return m.peers
+}
+
+// Add starts announcing a torrent, beginning with a 'started' event
+func (m *Manager) Add(infoHash []byte, tiers [][]*url.URL, stats TransferStats) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.ctx.Err() != nil {
+		return fmt.Errorf("Tracker manager is closed")
+	}
+	if _, exists := m.torrents[string(infoHash)]; exists {
+		return fmt.Errorf("Torrent %x is already being announced", infoHash)
+	}
+
+	announcerTiers := m.announcerTiers(tiers)
+	if len(announcerTiers) == 0 {
+		return fmt.Errorf("Torrent %x has no usable trackers", infoHash)
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	state := &announceState{
+		infoHash:  infoHash,
+		stats:     stats,
+		tiers:     announcerTiers,
+		ctx:       ctx,
+		cancel:    cancel,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		abandoned: make(map[Announcer]bool),
+		event:     EVENT_STARTED,
+	}
+	m.torrents[string(infoHash)] = state
+
+	m.wg.Add(1)
+	go m.run(state)
+	return nil
+}
+
+// Completed sends a 'completed' event straight away
+func (m *Manager) Completed(infoHash []byte) {
+	m.lock.Lock()
+	state, ok := m.torrents[string(infoHash)]
+	if ok && state.started {
+		state.event = EVENT_COMPLETED
+	}
+	m.lock.Unlock()
+
+	if ok {
+		state.signal()
+	}
+}
+
+// Reannounce asks for more peers. The announce is delayed until the tracker's min interval has passed.
+func (m *Manager) Reannounce(infoHash []byte) {
+	m.lock.Lock()
+	state, ok := m.torrents[string(infoHash)]
+	m.lock.Unlock()
+
+	if ok {
+		state.signal()
+	}
+}
+
+// Remove stops announcing a torrent, sending a 'stopped' event to the tracker last used
+func (m *Manager) Remove(infoHash []byte) {
+	m.lock.Lock()
+	state, ok := m.torrents[string(infoHash)]
+	delete(m.torrents, string(infoHash))
+	m.lock.Unlock()
+
+	if ok {
+		state.cancel()
+		close(state.stop)
+		<-state.done
+	}
+}
+
+func (m *Manager) Close() error {
+	m.lock.Lock()
+	states := make([]*announceState, 0, len(m.torrents))
+	for _, state := range m.torrents {
+		states = append(states, state)
+	}
+	m.torrents = make(map[string]*announceState)
+	m.lock.Unlock()
+
+	m.cancel()
+	for _, state := range states {
+		close(state.stop)
+	}
+	m.wg.Wait()
+	close(m.peers)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, announcer := range m.announcers {
+		if closer, ok := announcer.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+	return nil
+}
+
+// Scheduling
+
+func (m *Manager) run(state *announceState) {
+	defer m.wg.Done()
+	defer close(state.done)
+	defer state.cancel()
+
+	failures := 0
+	wait := time.Duration(0)
+	for {
+		timer := m.config.Clock.NewTimer(wait)
+		select {
+		case <-timer.C():
+		case <-state.wake:
+			timer.Stop()
+			if earliest := m.earliestAnnounce(state); earliest > 0 {
+				wait = earliest
+				continue
+			}
+		case <-state.stop:
+			timer.Stop()
+			m.announceStopped(state)
+			return
+		}
+
+		response, err := m.announce(state)
+		if err != nil {
+			failures++
+			wait = retryDelay(failures)
+			if failure, ok := err.(*FailureError); ok && failure.RetryIn > 0 {
+				wait = failure.RetryIn
+			}
+			continue
+		}
+
+		failures = 0
+		wait = response.Interval
+		if wait <= 0 {
+			wait = DEFAULT_ANNOUNCE_INTERVAL
+		}
+		if wait < response.MinInterval {
+			wait = response.MinInterval
+		}
+	}
+}
+
+// earliestAnnounce returns how long until a requested announce may be sent
+func (m *Manager) earliestAnnounce(state *announceState) time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if state.event != EVENT_NONE || state.lastAnnounce.IsZero() {
+		return 0
+	}
+	return state.lastAnnounce.Add(state.minInterval).Sub(m.config.Clock.Now())
+}
+
+func (m *Manager) announce(state *announceState) (*AnnounceResponse, error) {
+	m.lock.Lock()
+	event := state.event
+	m.lock.Unlock()
+
+	request := m.request(state, event)
+	response, announcer, err := m.announceToTiers(state, request)
+	if err != nil {
+		return nil, err
+	}
+
+	m.lock.Lock()
+	if state.event == event {
+		state.event = EVENT_NONE
+	}
+	state.started = true
+	state.lastAnnounce = m.config.Clock.Now()
+	state.minInterval = response.MinInterval
+	state.lastTracker = announcer
+	m.lock.Unlock()
+
+	if len(response.Peers) > 0 {
+		batch := &PeerBatch{InfoHash: state.infoHash, Source: announcer.AnnounceUrl(), Peers: response.Peers}
+		select {
+		case m.peers <- batch:
+		case <-state.ctx.Done():
+		}
+	}
+	return response, nil
+}
+
+// announceToTiers tries each tier in turn as described in BEP 12. A tracker which answers is
+// moved to the front of its tier so that it is tried first next time.
+func (m *Manager) announceToTiers(state *announceState, request *AnnounceRequest) (*AnnounceResponse, Announcer, error) {
+	var lastErr error
+	for _, tier := range state.tiers {
+		for i, announcer := range tier {
+			if state.abandoned[announcer] {
+				continue
+			}
+			response, err := announcer.Announce(state.ctx, request)
+			if err != nil {
+				lastErr = err
+				if failure, ok := err.(*FailureError); ok && failure.RetryNever {
+					state.abandoned[announcer] = true
+				}
+				if state.ctx.Err() != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			copy(tier[1:i+1], tier[0:i])
+			tier[0] = announcer
+			return response, announcer, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("No trackers are left to announce %x to", state.infoHash)
+	}
+	return nil, nil, lastErr
+}
+
+func (m *Manager) announceStopped(state *announceState) {
+	m.lock.Lock()
+	started := state.started
+	announcer := state.lastTracker
+	m.lock.Unlock()
+
+	if !started || announcer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), STOPPED_ANNOUNCE_TIMEOUT)
+	defer cancel()
+	announcer.Announce(ctx, m.request(state, EVENT_STOPPED))
+}
+
+// Helpers
+
+func (m *Manager) request(state *announceState, event Event) *AnnounceRequest {
+	uploaded, downloaded, left := state.stats()
+	numWant := m.config.NumWant
+	if event == EVENT_STOPPED {
+		numWant = 0
+	}
+	return &AnnounceRequest{
+		InfoHash:   state.infoHash,
+		PeerId:     m.config.PeerId,
+		Port:       m.config.Port,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		Event:      event,
+		NumWant:    numWant,
+		Key:        m.key,
+	}
+}
+
+// announcerTiers shuffles each tier as BEP 12 requires, sharing announcers between torrents
+// so that UDP connection ids are reused.
+func (m *Manager) announcerTiers(tiers [][]*url.URL) [][]Announcer {
+	announcerTiers := make([][]Announcer, 0, len(tiers))
+	for _, tier := range tiers {
+		announcerTier := make([]Announcer, 0, len(tier))
+		for _, announceUrl := range tier {
+			announcer, ok := m.announcers[announceUrl.String()]
+			if !ok {
+				var err error
+				announcer, err = m.config.NewAnnouncer(announceUrl)
+				if err != nil {
+					continue
+				}
+				m.announcers[announceUrl.String()] = announcer
+			}
+			announcerTier = append(announcerTier, announcer)
+		}
+
+		if len(announcerTier) > 0 {
+			rand.Shuffle(len(announcerTier), func(i, j int) {
+				announcerTier[i], announcerTier[j] = announcerTier[j], announcerTier[i]
+			})
+			announcerTiers = append(announcerTiers, announcerTier)
+		}
+	}
+	return announcerTiers
+}
+
+func retryDelay(failures int) time.Duration {
+	delay := ANNOUNCE_RETRY_MIN
+	for i := 1; i < failures && delay < ANNOUNCE_RETRY_MAX; i++ {
+		delay = delay * 2
+	}
+	if delay > ANNOUNCE_RETRY_MAX {
+		delay = ANNOUNCE_RETRY_MAX
+	}
+	return delay
+}
+
+func (state *announceState) signal() {
+	select {
+	case state.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,330 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeAnnouncer struct {
+	announceUrl *url.URL
+	requests    chan *AnnounceRequest
+
+	lock     sync.Mutex
+	response *AnnounceResponse
+	fail     bool
+	failure  *FailureError
+	// hang makes announces wait until they are cancelled, as a dead tracker would
+	hang bool
+}
+
+func newFakeAnnouncer(name string) *fakeAnnouncer {
+	announceUrl, _ := url.Parse("http://" + name + "/announce")
+	response := &AnnounceResponse{Interval: 30 * time.Minute, Peers: []*Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 6881}}}
+	return &fakeAnnouncer{announceUrl: announceUrl, requests: make(chan *AnnounceRequest, 16), response: response}
+}
+
+func (announcer *fakeAnnouncer) AnnounceUrl() *url.URL {
+	return announcer.announceUrl
+}
+
+func (announcer *fakeAnnouncer) Announce(ctx context.Context, request *AnnounceRequest) (*AnnounceResponse, error) {
+	announcer.requests <- request
+
+	announcer.lock.Lock()
+	defer announcer.lock.Unlock()
+	if announcer.hang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if announcer.failure != nil {
+		return nil, announcer.failure
+	}
+	if announcer.fail {
+		return nil, fmt.Errorf("Tracker %v is down", announcer.announceUrl.Host)
+	}
+	return announcer.response, nil
+}
+
+func (announcer *fakeAnnouncer) setFail(fail bool) {
+	announcer.lock.Lock()
+	defer announcer.lock.Unlock()
+	announcer.fail = fail
+}
+
+func (announcer *fakeAnnouncer) setFailure(failure *FailureError) {
+	announcer.lock.Lock()
+	defer announcer.lock.Unlock()
+	announcer.failure = failure
+}
+
+func (announcer *fakeAnnouncer) expectRequest(t *testing.T, event Event) *AnnounceRequest {
+	t.Helper()
+	select {
+	case request := <-announcer.requests:
+		if request.Event != event {
+			t.Errorf("Expected %v to receive event '%v' but was '%v'", announcer.announceUrl.Host, event, request.Event)
+		}
+		return request
+	case <-time.After(time.Second):
+		t.Fatalf("Expected %v to receive an announce", announcer.announceUrl.Host)
+		return nil
+	}
+}
+
+func (announcer *fakeAnnouncer) expectNoRequest(t *testing.T) {
+	t.Helper()
+	select {
+	case request := <-announcer.requests:
+		t.Errorf("Unexpected announce to %v with event '%v'", announcer.announceUrl.Host, request.Event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func newTestManager(clock *mock.MockClock, announcers ...*fakeAnnouncer) *Manager {
+	byUrl := make(map[string]Announcer)
+	for _, announcer := range announcers {
+		byUrl[announcer.announceUrl.String()] = announcer
+	}
+
+	config := ManagerConfig{
+		PeerId: testPeerId,
+		Port:   6881,
+		Clock:  clock,
+		NewAnnouncer: func(announceUrl *url.URL) (Announcer, error) {
+			announcer, ok := byUrl[announceUrl.String()]
+			if !ok {
+				return nil, fmt.Errorf("No stand-in for %v", announceUrl)
+			}
+			return announcer, nil
+		},
+	}
+	return NewManager(config)
+}
+
+func testStats() (int64, int64, int64) {
+	return 10, 20, 30
+}
+
+func TestManagerAnnouncesOnInterval(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	tracker := newFakeAnnouncer("one")
+	manager := newTestManager(clock, tracker)
+	defer manager.Close()
+
+	if err := manager.Add(testInfoHash, [][]*url.URL{{tracker.announceUrl}}, testStats); err != nil {
+		t.Fatalf("Unexpected error adding torrent %v", err)
+	}
+
+	request := tracker.expectRequest(t, EVENT_STARTED)
+	if request.Uploaded != 10 || request.Downloaded != 20 || request.Left != 30 || request.Port != 6881 {
+		t.Errorf("Unexpected announce request %+v", request)
+	}
+
+	batch := <-manager.Peers()
+	if string(batch.InfoHash) != string(testInfoHash) || len(batch.Peers) != 1 || batch.Source != tracker.announceUrl {
+		t.Errorf("Unexpected peer batch %+v", batch)
+	}
+
+	clock.BlockUntil(1)
+	clock.Advance(29 * time.Minute)
+	tracker.expectNoRequest(t)
+	clock.Advance(time.Minute)
+	tracker.expectRequest(t, EVENT_NONE)
+}
+
+func TestManagerBacksOffExponentially(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	tracker := newFakeAnnouncer("one")
+	tracker.setFail(true)
+	manager := newTestManager(clock, tracker)
+	defer manager.Close()
+
+	manager.Add(testInfoHash, [][]*url.URL{{tracker.announceUrl}}, testStats)
+	tracker.expectRequest(t, EVENT_STARTED)
+
+	clock.BlockUntil(1)
+	clock.Advance(ANNOUNCE_RETRY_MIN)
+	tracker.expectRequest(t, EVENT_STARTED)
+
+	clock.BlockUntil(1)
+	clock.Advance(ANNOUNCE_RETRY_MIN)
+	tracker.expectNoRequest(t)
+
+	tracker.setFail(false)
+	clock.Advance(ANNOUNCE_RETRY_MIN)
+	tracker.expectRequest(t, EVENT_STARTED)
+
+	clock.BlockUntil(1)
+	clock.Advance(30 * time.Minute)
+	tracker.expectRequest(t, EVENT_NONE)
+}
+
+func TestManagerHonoursRetryIn(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	tracker := newFakeAnnouncer("one")
+	tracker.setFailure(&FailureError{Reason: "overloaded", RetryIn: 10 * time.Minute})
+	manager := newTestManager(clock, tracker)
+	defer manager.Close()
+
+	manager.Add(testInfoHash, [][]*url.URL{{tracker.announceUrl}}, testStats)
+	tracker.expectRequest(t, EVENT_STARTED)
+
+	clock.BlockUntil(1)
+	clock.Advance(ANNOUNCE_RETRY_MIN)
+	tracker.expectNoRequest(t)
+	clock.Advance(10*time.Minute - ANNOUNCE_RETRY_MIN)
+	tracker.expectRequest(t, EVENT_STARTED)
+}
+
+func TestManagerAbandonsTrackerAskingNeverToRetry(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	gone := newFakeAnnouncer("gone")
+	backup := newFakeAnnouncer("backup")
+	gone.setFailure(&FailureError{Reason: "unregistered torrent", RetryNever: true})
+	manager := newTestManager(clock, gone, backup)
+	defer manager.Close()
+
+	manager.Add(testInfoHash, [][]*url.URL{{gone.announceUrl}, {backup.announceUrl}}, testStats)
+	gone.expectRequest(t, EVENT_STARTED)
+	backup.expectRequest(t, EVENT_STARTED)
+
+	clock.BlockUntil(1)
+	clock.Advance(30 * time.Minute)
+	backup.expectRequest(t, EVENT_NONE)
+	gone.expectNoRequest(t)
+}
+
+func TestRetryDelay(t *testing.T) {
+	expected := []time.Duration{15 * time.Second, 30 * time.Second, time.Minute, 2 * time.Minute}
+	for i, delay := range expected {
+		if retryDelay(i+1) != delay {
+			t.Errorf("Expected delay after %v failures to be %v but was %v", i+1, delay, retryDelay(i+1))
+		}
+	}
+	if retryDelay(100) != ANNOUNCE_RETRY_MAX {
+		t.Errorf("Expected delay to be capped at %v but was %v", ANNOUNCE_RETRY_MAX, retryDelay(100))
+	}
+}
+
+func TestManagerFailsOverBetweenTiers(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	primary := newFakeAnnouncer("primary")
+	backup := newFakeAnnouncer("backup")
+	primary.setFail(true)
+	manager := newTestManager(clock, primary, backup)
+	defer manager.Close()
+
+	manager.Add(testInfoHash, [][]*url.URL{{primary.announceUrl}, {backup.announceUrl}}, testStats)
+	primary.expectRequest(t, EVENT_STARTED)
+	backup.expectRequest(t, EVENT_STARTED)
+
+	// Tiers are always walked from the first so the primary is given another chance
+	primary.setFail(false)
+	clock.BlockUntil(1)
+	clock.Advance(30 * time.Minute)
+	primary.expectRequest(t, EVENT_NONE)
+	backup.expectNoRequest(t)
+}
+
+func TestManagerPromotesWorkingTrackerWithinTier(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	down := newFakeAnnouncer("down")
+	up := newFakeAnnouncer("up")
+	down.setFail(true)
+	manager := newTestManager(clock, down, up)
+	defer manager.Close()
+
+	manager.Add(testInfoHash, [][]*url.URL{{down.announceUrl, up.announceUrl}}, testStats)
+	up.expectRequest(t, EVENT_STARTED)
+
+	clock.BlockUntil(1)
+	clock.Advance(30 * time.Minute)
+	up.expectRequest(t, EVENT_NONE)
+
+	// The tier is shuffled, so the failing tracker may be tried first once but never again
+	if len(down.requests) > 1 {
+		t.Errorf("Failing tracker should not be retried once another in its tier answered")
+	}
+}
+
+func TestManagerSendsCompletedAndStopped(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	tracker := newFakeAnnouncer("one")
+	manager := newTestManager(clock, tracker)
+	defer manager.Close()
+
+	manager.Add(testInfoHash, [][]*url.URL{{tracker.announceUrl}}, testStats)
+	tracker.expectRequest(t, EVENT_STARTED)
+
+	clock.BlockUntil(1)
+	manager.Completed(testInfoHash)
+	tracker.expectRequest(t, EVENT_COMPLETED)
+
+	clock.BlockUntil(1)
+	manager.Remove(testInfoHash)
+	request := tracker.expectRequest(t, EVENT_STOPPED)
+	if request.NumWant != 0 {
+		t.Errorf("Stopped announce should not ask for peers but numwant was %v", request.NumWant)
+	}
+}
+
+func TestManagerRemoveCancelsAnnounceInProgress(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	dead, other := newFakeAnnouncer("dead"), newFakeAnnouncer("other")
+	dead.hang = true
+	manager := newTestManager(clock, dead, other)
+	defer manager.Close()
+
+	manager.Add(testInfoHash, [][]*url.URL{{dead.announceUrl}, {other.announceUrl}}, testStats)
+	dead.expectRequest(t, EVENT_STARTED)
+
+	removed := make(chan struct{})
+	go func() {
+		manager.Remove(testInfoHash)
+		close(removed)
+	}()
+	select {
+	case <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("Remove waited for the announce to the dead tracker")
+	}
+	// The rest of the tiers aren't tried once the torrent is removed
+	other.expectNoRequest(t)
+}
+
+func TestManagerReannounceHonoursMinInterval(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	tracker := newFakeAnnouncer("one")
+	tracker.response.MinInterval = time.Minute
+	manager := newTestManager(clock, tracker)
+	defer manager.Close()
+
+	manager.Add(testInfoHash, [][]*url.URL{{tracker.announceUrl}}, testStats)
+	tracker.expectRequest(t, EVENT_STARTED)
+
+	clock.BlockUntil(1)
+	clock.Advance(20 * time.Second)
+	manager.Reannounce(testInfoHash)
+	tracker.expectNoRequest(t)
+
+	clock.BlockUntil(1)
+	clock.Advance(40 * time.Second)
+	tracker.expectRequest(t, EVENT_NONE)
+}
+
+func TestManagerRejectsTorrentWithoutTrackers(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	manager := newTestManager(clock)
+	defer manager.Close()
+
+	unknown, _ := url.Parse("http://unknown/announce")
+	if err := manager.Add(testInfoHash, [][]*url.URL{{unknown}}, testStats); err == nil {
+		t.Errorf("Expected error adding torrent with no usable trackers")
+	}
+}
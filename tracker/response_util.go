@@ -0,0 +1,20 @@
+package tracker
+
+import (
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"time"
+)
+
+func getString(m *model.OrderedMap, key string) (string, bool) {
+	value, ok := m.Get(key).(string)
+	return value, ok
+}
+
+func getInt(m *model.OrderedMap, key string) (int, bool) {
+	value, ok := m.Get(key).(int)
+	return value, ok
+}
+
+func seconds(value int) time.Duration {
+	return time.Duration(value) * time.Second
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/tracker"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// ServeHTTP answers requests whose last path segment is 'announce' or 'scrape'. For private
+// trackers the segment before it is the passkey.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	dir, action := path.Split(r.URL.Path)
+	passkey := path.Base(dir)
+	if passkey == "/" || passkey == "." {
+		passkey = ""
+	}
+
+	switch action {
+	case "announce":
+		s.serveAnnounce(w, r, passkey)
+	case "scrape":
+		s.serveScrape(w, r, passkey)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Announce
+
+func (s *Server) serveAnnounce(w http.ResponseWriter, r *http.Request, passkey string) {
+	query := r.URL.Query()
+	request, err := parseAnnounceQuery(query, r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+	request.passkey = passkey
+
+	result, err := s.announce(request)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	response := model.NewOrderedMap()
+	response.Add("complete", result.stats.Seeders)
+	response.Add("incomplete", result.stats.Leechers)
+	response.Add("interval", int(s.config.Interval.Seconds()))
+	response.Add("min interval", int(s.config.MinInterval.Seconds()))
+	if query.Get("compact") == "0" {
+		response.Add("peers", dictionaryPeers(result.peers, query.Get("no_peer_id") == "1"))
+	} else {
+		peers, peers6 := compactPeers(result.peers)
+		response.Add("peers", string(peers))
+		if len(peers6) > 0 {
+			response.Add("peers6", string(peers6))
+		}
+	}
+	writeBencoded(w, response)
+}
+
+func parseAnnounceQuery(query url.Values, remoteAddr string) (*announceRequest, error) {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil {
+		return nil, failure("Invalid port")
+	}
+	uploaded, err1 := parseCount(query, "uploaded")
+	downloaded, err2 := parseCount(query, "downloaded")
+	left, err3 := parseCount(query, "left")
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, failure("Invalid transfer statistics")
+	}
+	numWant, _ := strconv.Atoi(query.Get("numwant"))
+
+	request := &announceRequest{
+		infoHash:   []byte(query.Get("info_hash")),
+		peerId:     []byte(query.Get("peer_id")),
+		ip:         net.ParseIP(host),
+		port:       port,
+		uploaded:   uploaded,
+		downloaded: downloaded,
+		left:       left,
+		event:      parseEvent(query.Get("event")),
+		numWant:    numWant,
+	}
+	return request, nil
+}
+
+func parseCount(query url.Values, key string) (int64, error) {
+	value := query.Get(key)
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func parseEvent(event string) tracker.Event {
+	switch event {
+	case "started":
+		return tracker.EVENT_STARTED
+	case "completed":
+		return tracker.EVENT_COMPLETED
+	case "stopped":
+		return tracker.EVENT_STOPPED
+	default:
+		return tracker.EVENT_NONE
+	}
+}
+
+// compactPeers packs IPv4 peers into 6 byte entries and IPv6 peers into 18 byte entries (BEP 7)
+func compactPeers(peers []*Peer) ([]byte, []byte) {
+	peers4 := bytes.NewBuffer(nil)
+	peers6 := bytes.NewBuffer(nil)
+	for _, peer := range peers {
+		if ip4 := peer.IP.To4(); ip4 != nil {
+			peers4.Write(ip4)
+			peers4.Write([]byte{byte(peer.Port >> 8), byte(peer.Port)})
+		} else if ip16 := peer.IP.To16(); ip16 != nil {
+			peers6.Write(ip16)
+			peers6.Write([]byte{byte(peer.Port >> 8), byte(peer.Port)})
+		}
+	}
+	return peers4.Bytes(), peers6.Bytes()
+}
+
+func dictionaryPeers(peers []*Peer, noPeerId bool) []interface{} {
+	list := make([]interface{}, 0, len(peers))
+	for _, peer := range peers {
+		dict := model.NewOrderedMap()
+		dict.Add("ip", peer.IP.String())
+		if !noPeerId {
+			dict.Add("peer id", string(peer.PeerId))
+		}
+		dict.Add("port", peer.Port)
+		list = append(list, dict)
+	}
+	return list
+}
+
+// Scrape
+
+func (s *Server) serveScrape(w http.ResponseWriter, r *http.Request, passkey string) {
+	values := r.URL.Query()["info_hash"]
+	infoHashes := make([][]byte, 0, len(values))
+	for _, value := range values {
+		infoHashes = append(infoHashes, []byte(value))
+	}
+
+	entries, err := s.scrape(passkey, infoHashes)
+	if err != nil {
+		writeFailure(w, err)
+		return
+	}
+
+	// Bencoded dictionaries must have their keys sorted
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].infoHash, entries[j].infoHash) < 0
+	})
+
+	files := model.NewOrderedMap()
+	for _, entry := range entries {
+		if _, exists := files.GetExists(string(entry.infoHash)); exists {
+			continue
+		}
+		stats := model.NewOrderedMap()
+		stats.Add("complete", entry.stats.Seeders)
+		stats.Add("downloaded", entry.stats.Completed)
+		stats.Add("incomplete", entry.stats.Leechers)
+		files.Add(string(entry.infoHash), stats)
+	}
+
+	response := model.NewOrderedMap()
+	response.Add("files", files)
+	writeBencoded(w, response)
+}
+
+// Helpers
+
+func writeFailure(w http.ResponseWriter, err error) {
+	response := model.NewOrderedMap()
+	response.Add("failure reason", failureReason(err))
+	writeBencoded(w, response)
+}
+
+func writeBencoded(w http.ResponseWriter, response *model.OrderedMap) {
+	encoded, err := bencoding.EncodeBencoding(response)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(encoded)
+}
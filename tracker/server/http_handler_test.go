@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"github.com/onepointsixtwo/torrentsgo/bencoding"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"github.com/onepointsixtwo/torrentsgo/tracker"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var (
+	testInfoHash = []byte("aaaaaaaaaaaaaaaaaaaa")
+	testPeerOne  = []byte("-GT0001-000000000001")
+	testPeerTwo  = []byte("-GT0001-000000000002")
+)
+
+func newTestHttpTracker(t *testing.T, config Config) (*Server, *httptest.Server) {
+	if config.Clock == nil {
+		config.Clock = mock.NewMockClock(time.Unix(1000, 0))
+	}
+	trackerServer := NewServer(config)
+	return trackerServer, httptest.NewServer(trackerServer)
+}
+
+func newTestClient(t *testing.T, announce string) *tracker.Client {
+	announceUrl, _ := url.Parse(announce)
+	client, err := tracker.NewClient(announceUrl)
+	if err != nil {
+		t.Fatalf("Unable to create tracker client %v", err)
+	}
+	return client
+}
+
+func TestHttpAnnounceReturnsOtherPeers(t *testing.T) {
+	_, httpServer := newTestHttpTracker(t, Config{})
+	defer httpServer.Close()
+	client := newTestClient(t, httpServer.URL+"/announce")
+
+	first := &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001, Left: 0, Event: tracker.EVENT_STARTED}
+	response, err := client.Announce(context.Background(), first)
+	if err != nil {
+		t.Fatalf("Unexpected announce error %v", err)
+	}
+	if len(response.Peers) != 0 || response.Seeders != 1 || response.Leechers != 0 {
+		t.Errorf("Unexpected response to first announce %+v", response)
+	}
+	if response.Interval != DEFAULT_INTERVAL || response.MinInterval != DEFAULT_MIN_INTERVAL {
+		t.Errorf("Unexpected intervals %v %v", response.Interval, response.MinInterval)
+	}
+
+	second := &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerTwo, Port: 1002, Left: 10, Event: tracker.EVENT_STARTED}
+	response, err = client.Announce(context.Background(), second)
+	if err != nil {
+		t.Fatalf("Unexpected announce error %v", err)
+	}
+	if response.Seeders != 1 || response.Leechers != 1 {
+		t.Errorf("Expected one seeder and one leecher but was %v and %v", response.Seeders, response.Leechers)
+	}
+	if len(response.Peers) != 1 || response.Peers[0].Port != 1001 || response.Peers[0].IP.String() != "127.0.0.1" {
+		t.Fatalf("Expected the seeder to be returned but was %v", response.Peers)
+	}
+
+	second.Event = tracker.EVENT_STOPPED
+	response, err = client.Announce(context.Background(), second)
+	if err != nil {
+		t.Fatalf("Unexpected announce error %v", err)
+	}
+	if response.Leechers != 0 || len(response.Peers) != 0 {
+		t.Errorf("Expected stopped peer to be removed but response was %+v", response)
+	}
+}
+
+func TestHttpAnnounceNonCompact(t *testing.T) {
+	_, httpServer := newTestHttpTracker(t, Config{})
+	defer httpServer.Close()
+
+	announce := func(peerId []byte, port string, extra string) *model.OrderedMap {
+		query := "info_hash=" + url.QueryEscape(string(testInfoHash)) + "&peer_id=" + url.QueryEscape(string(peerId)) + "&port=" + port + "&left=5" + extra
+		response, err := http.Get(httpServer.URL + "/announce?" + query)
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		defer response.Body.Close()
+		body, _ := ioutil.ReadAll(response.Body)
+		decoded, err := bencoding.DecodeBencoding(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Unable to decode response %v", err)
+		}
+		return decoded
+	}
+
+	announce(testPeerOne, "1001", "")
+	decoded := announce(testPeerTwo, "1002", "&compact=0")
+	peers, ok := decoded.Get("peers").([]interface{})
+	if !ok || len(peers) != 1 {
+		t.Fatalf("Expected a list of one peer but was %v", decoded.Get("peers"))
+	}
+	peer := peers[0].(*model.OrderedMap)
+	if peer.Get("peer id") != string(testPeerOne) || peer.Get("port") != 1001 || peer.Get("ip") != "127.0.0.1" {
+		t.Errorf("Unexpected peer dictionary %v %v %v", peer.Get("peer id"), peer.Get("ip"), peer.Get("port"))
+	}
+
+	decoded = announce(testPeerTwo, "1002", "&compact=0&no_peer_id=1")
+	peer = decoded.Get("peers").([]interface{})[0].(*model.OrderedMap)
+	if _, exists := peer.GetExists("peer id"); exists {
+		t.Errorf("Peer id should be left out when no_peer_id is set")
+	}
+}
+
+func TestHttpAnnounceFailures(t *testing.T) {
+	_, httpServer := newTestHttpTracker(t, Config{Whitelist: NewWhitelist(testInfoHash)})
+	defer httpServer.Close()
+	client := newTestClient(t, httpServer.URL+"/announce")
+
+	unknown := []byte("bbbbbbbbbbbbbbbbbbbb")
+	_, err := client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: unknown, PeerId: testPeerOne, Port: 1001})
+	if failure, ok := err.(*tracker.FailureError); !ok || failure.Reason != "Torrent is not registered with this tracker" {
+		t.Errorf("Expected failure for torrent not in whitelist but was %v", err)
+	}
+
+	_, err = client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 0})
+	if failure, ok := err.(*tracker.FailureError); !ok || failure.Reason != "Invalid port" {
+		t.Errorf("Expected failure for invalid port but was %v", err)
+	}
+}
+
+func TestHttpScrape(t *testing.T) {
+	_, httpServer := newTestHttpTracker(t, Config{})
+	defer httpServer.Close()
+	client := newTestClient(t, httpServer.URL+"/announce")
+
+	client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001, Left: 10})
+	client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001, Event: tracker.EVENT_COMPLETED})
+	client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerTwo, Port: 1002, Left: 10})
+
+	unknown := []byte("bbbbbbbbbbbbbbbbbbbb")
+	results, err := client.Scrape(context.Background(), unknown, testInfoHash)
+	if err != nil {
+		t.Fatalf("Unexpected scrape error %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected two scrape results but got %v", len(results))
+	}
+	if results[0].Seeders != 0 || results[0].Leechers != 0 {
+		t.Errorf("Expected empty stats for unknown torrent but was %+v", results[0])
+	}
+	if results[1].Seeders != 1 || results[1].Leechers != 1 || results[1].Completed != 1 {
+		t.Errorf("Unexpected scrape result %+v", results[1])
+	}
+}
+
+func TestHttpPeerExpiry(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	trackerServer, httpServer := newTestHttpTracker(t, Config{Clock: clock, Interval: time.Minute})
+	defer httpServer.Close()
+	client := newTestClient(t, httpServer.URL+"/announce")
+
+	client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001})
+	clock.Advance(2 * time.Minute)
+
+	response, _ := client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerTwo, Port: 1002, Left: 1})
+	if len(response.Peers) != 0 {
+		t.Errorf("Expired peer should not be returned but got %v", response.Peers)
+	}
+
+	trackerServer.ExpirePeers()
+	response, _ = client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerTwo, Port: 1002, Left: 1})
+	if response.Seeders != 0 || response.Leechers != 1 {
+		t.Errorf("Expected expired seeder to be removed from stats but was %v seeders %v leechers", response.Seeders, response.Leechers)
+	}
+}
+
+func TestHttpUnknownPath(t *testing.T) {
+	_, httpServer := newTestHttpTracker(t, Config{})
+	defer httpServer.Close()
+
+	response, err := http.Get(httpServer.URL + "/other")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown path but was %v", response.StatusCode)
+	}
+}
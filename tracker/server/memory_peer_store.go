@@ -0,0 +1,156 @@
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type MemoryPeerStore struct {
+	lock     sync.RWMutex
+	torrents map[string]*memoryTorrent
+}
+
+type memoryTorrent struct {
+	peers     map[string]*Peer
+	completed int
+}
+
+// Initialiser
+
+func NewMemoryPeerStore() *MemoryPeerStore {
+	return &MemoryPeerStore{torrents: make(map[string]*memoryTorrent)}
+}
+
+// Public Methods
+
+func (store *MemoryPeerStore) PutPeer(infoHash []byte, peer *Peer) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	stored := *peer
+	store.torrent(infoHash).peers[string(peer.PeerId)] = &stored
+	return nil
+}
+
+func (store *MemoryPeerStore) GetPeer(infoHash []byte, peerId []byte) (*Peer, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	torrent, ok := store.torrents[string(infoHash)]
+	if !ok {
+		return nil, nil
+	}
+	peer, ok := torrent.peers[string(peerId)]
+	if !ok {
+		return nil, nil
+	}
+	copied := *peer
+	return &copied, nil
+}
+
+func (store *MemoryPeerStore) DeletePeer(infoHash []byte, peerId []byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	torrent, ok := store.torrents[string(infoHash)]
+	if ok {
+		delete(torrent.peers, string(peerId))
+	}
+	return nil
+}
+
+func (store *MemoryPeerStore) AddCompleted(infoHash []byte) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.torrent(infoHash).completed++
+	return nil
+}
+
+func (store *MemoryPeerStore) GetPeers(infoHash []byte, max int, leechersOnly bool) ([]*Peer, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	torrent, ok := store.torrents[string(infoHash)]
+	if !ok {
+		return make([]*Peer, 0), nil
+	}
+
+	all := make([]*Peer, 0, len(torrent.peers))
+	for _, peer := range torrent.peers {
+		if leechersOnly && peer.IsSeeder() {
+			continue
+		}
+		copied := *peer
+		all = append(all, &copied)
+	}
+	if len(all) <= max {
+		return all, nil
+	}
+
+	rand.Shuffle(len(all), func(i, j int) {
+		all[i], all[j] = all[j], all[i]
+	})
+	return all[:max], nil
+}
+
+func (store *MemoryPeerStore) GetStats(infoHash []byte) (*TorrentStats, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	stats := &TorrentStats{}
+	torrent, ok := store.torrents[string(infoHash)]
+	if !ok {
+		return stats, nil
+	}
+
+	stats.Completed = torrent.completed
+	for _, peer := range torrent.peers {
+		if peer.IsSeeder() {
+			stats.Seeders++
+		} else {
+			stats.Leechers++
+		}
+	}
+	return stats, nil
+}
+
+func (store *MemoryPeerStore) InfoHashes() ([][]byte, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	hashes := make([][]byte, 0, len(store.torrents))
+	for infoHash := range store.torrents {
+		hashes = append(hashes, []byte(infoHash))
+	}
+	return hashes, nil
+}
+
+func (store *MemoryPeerStore) ExpirePeers(lastSeenBefore time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for infoHash, torrent := range store.torrents {
+		for peerId, peer := range torrent.peers {
+			if peer.LastSeen.Before(lastSeenBefore) {
+				delete(torrent.peers, peerId)
+			}
+		}
+		if len(torrent.peers) == 0 && torrent.completed == 0 {
+			delete(store.torrents, infoHash)
+		}
+	}
+	return nil
+}
+
+// Helpers
+
+func (store *MemoryPeerStore) torrent(infoHash []byte) *memoryTorrent {
+	torrent, ok := store.torrents[string(infoHash)]
+	if !ok {
+		torrent = &memoryTorrent{peers: make(map[string]*Peer)}
+		store.torrents[string(infoHash)] = torrent
+	}
+	return torrent
+}
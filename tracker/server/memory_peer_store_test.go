@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemoryPeerStoreStats(t *testing.T) {
+	store := NewMemoryPeerStore()
+	now := time.Unix(1000, 0)
+	store.PutPeer(testInfoHash, &Peer{PeerId: testPeerOne, IP: net.IPv4(10, 0, 0, 1), Port: 1, LastSeen: now})
+	store.PutPeer(testInfoHash, &Peer{PeerId: testPeerTwo, IP: net.IPv4(10, 0, 0, 2), Port: 2, Left: 5, LastSeen: now})
+	store.AddCompleted(testInfoHash)
+
+	stats, _ := store.GetStats(testInfoHash)
+	if stats.Seeders != 1 || stats.Leechers != 1 || stats.Completed != 1 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Announcing again replaces the stored peer
+	store.PutPeer(testInfoHash, &Peer{PeerId: testPeerTwo, IP: net.IPv4(10, 0, 0, 2), Port: 2, LastSeen: now})
+	stats, _ = store.GetStats(testInfoHash)
+	if stats.Seeders != 2 || stats.Leechers != 0 {
+		t.Errorf("Unexpected stats after update %+v", stats)
+	}
+
+	store.DeletePeer(testInfoHash, testPeerOne)
+	peers, _ := store.GetPeers(testInfoHash, 10, false)
+	if len(peers) != 1 || string(peers[0].PeerId) != string(testPeerTwo) {
+		t.Errorf("Unexpected peers after delete %v", peers)
+	}
+}
+
+func TestMemoryPeerStoreLimitsPeers(t *testing.T) {
+	store := NewMemoryPeerStore()
+	for i := 0; i < 20; i++ {
+		peerId := []byte("-GT0001-0000000000" + string(rune('a'+i)) + "x")
+		store.PutPeer(testInfoHash, &Peer{PeerId: peerId, IP: net.IPv4(10, 0, 0, byte(i)), Port: i + 1})
+	}
+
+	peers, _ := store.GetPeers(testInfoHash, 5, false)
+	if len(peers) != 5 {
+		t.Errorf("Expected 5 peers but got %v", len(peers))
+	}
+}
+
+func TestMemoryPeerStoreLeavesOutSeeders(t *testing.T) {
+	store := NewMemoryPeerStore()
+	for i := 0; i < 20; i++ {
+		peerId := []byte("-GT0001-0000000000" + string(rune('a'+i)) + "x")
+		left := int64(0)
+		if i >= 18 {
+			left = 100
+		}
+		store.PutPeer(testInfoHash, &Peer{PeerId: peerId, IP: net.IPv4(10, 0, 0, byte(i)), Port: i + 1, Left: left})
+	}
+
+	// The two leechers are found however many seeders there are
+	peers, _ := store.GetPeers(testInfoHash, 5, true)
+	if len(peers) != 2 || peers[0].IsSeeder() || peers[1].IsSeeder() {
+		t.Errorf("Expected the 2 leechers but got %v peers", len(peers))
+	}
+}
+
+func TestMemoryPeerStoreExpiry(t *testing.T) {
+	store := NewMemoryPeerStore()
+	store.PutPeer(testInfoHash, &Peer{PeerId: testPeerOne, LastSeen: time.Unix(100, 0)})
+	store.PutPeer(testInfoHash, &Peer{PeerId: testPeerTwo, LastSeen: time.Unix(200, 0)})
+
+	store.ExpirePeers(time.Unix(150, 0))
+	peers, _ := store.GetPeers(testInfoHash, 10, false)
+	if len(peers) != 1 || string(peers[0].PeerId) != string(testPeerTwo) {
+		t.Errorf("Expected only the recently seen peer to remain but was %v", peers)
+	}
+
+	store.ExpirePeers(time.Unix(300, 0))
+	hashes, _ := store.InfoHashes()
+	if len(hashes) != 0 {
+		t.Errorf("Expected empty torrent to be forgotten but had %v", len(hashes))
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// Types
+
+type Peer struct {
+	PeerId     []byte
+	IP         net.IP
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	LastSeen   time.Time
+	// UserId is only set by private trackers
+	UserId string
+}
+
+type TorrentStats struct {
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+// PeerStore keeps the swarm for each torrent. Implementations must be safe for concurrent use.
+type PeerStore interface {
+	PutPeer(infoHash []byte, peer *Peer) error
+	// GetPeer returns nil when the peer is not in the swarm
+	GetPeer(infoHash []byte, peerId []byte) (*Peer, error)
+	DeletePeer(infoHash []byte, peerId []byte) error
+	AddCompleted(infoHash []byte) error
+	// GetPeers returns up to max peers, chosen at random when the swarm is larger. With
+	// leechersOnly, seeders are left out before choosing.
+	GetPeers(infoHash []byte, max int, leechersOnly bool) ([]*Peer, error)
+	GetStats(infoHash []byte) (*TorrentStats, error)
+	InfoHashes() ([][]byte, error)
+	ExpirePeers(lastSeenBefore time.Time) error
+}
+
+func (peer *Peer) IsSeeder() bool {
+	return peer.Left == 0
+}
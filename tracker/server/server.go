@@ -0,0 +1,348 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/tracker"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_INTERVAL     = 30 * time.Minute
+	DEFAULT_MIN_INTERVAL = time.Minute
+	DEFAULT_NUM_WANT     = 50
+	MAX_NUM_WANT         = 200
+	HASH_LENGTH          = 20
+)
+
+// Types
+
+type Config struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	// PeerExpiry is how long a peer is kept without announcing. Defaults to one and a half intervals.
+	PeerExpiry time.Duration
+	Store      PeerStore
+	// Whitelist limits the torrents served. All torrents are served when it is nil.
+	Whitelist *Whitelist
+	// Users makes the tracker private. Requests must then carry a passkey in their path, such
+	// as /<passkey>/announce, and transfer totals are credited to the passkey's user.
+	Users UserStore
+	// BannedClients are peer id prefixes, such as "-XL0", whose announces are refused
+	BannedClients []string
+	Clock         util.Clock
+}
+
+// Server is a BitTorrent tracker. It serves HTTP announce and scrape requests as an http.Handler
+// and UDP requests through ServeUDP.
+type Server struct {
+	config Config
+	secret []byte
+}
+
+type announceRequest struct {
+	passkey    string
+	infoHash   []byte
+	peerId     []byte
+	ip         net.IP
+	port       int
+	uploaded   int64
+	downloaded int64
+	left       int64
+	event      tracker.Event
+	numWant    int
+}
+
+type announceResult struct {
+	peers []*Peer
+	stats *TorrentStats
+}
+
+type scrapeEntry struct {
+	infoHash []byte
+	stats    *TorrentStats
+}
+
+// failure is an error whose message is sent back to the client as the failure reason
+type failure string
+
+// Initialiser
+
+func NewServer(config Config) *Server {
+	if config.Interval == 0 {
+		config.Interval = DEFAULT_INTERVAL
+	}
+	if config.MinInterval == 0 {
+		config.MinInterval = DEFAULT_MIN_INTERVAL
+	}
+	if config.PeerExpiry == 0 {
+		config.PeerExpiry = config.Interval * 3 / 2
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryPeerStore()
+	}
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &Server{config: config, secret: secret}
+}
+
+// Public Methods
+
+// ExpirePeers drops peers which have not announced within the peer expiry
+func (s *Server) ExpirePeers() error {
+	return s.config.Store.ExpirePeers(s.config.Clock.Now().Add(-s.config.PeerExpiry))
+}
+
+// RunExpiry expires peers once a minute until the context is done
+func (s *Server) RunExpiry(ctx context.Context) {
+	for {
+		timer := s.config.Clock.NewTimer(time.Minute)
+		select {
+		case <-timer.C():
+			s.ExpirePeers()
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (err failure) Error() string {
+	return string(err)
+}
+
+// Announce and scrape handling shared by HTTP and UDP
+
+func (s *Server) announce(request *announceRequest) (*announceResult, error) {
+	if len(request.infoHash) != HASH_LENGTH {
+		return nil, failure("Invalid info hash")
+	}
+	if len(request.peerId) != HASH_LENGTH {
+		return nil, failure("Invalid peer id")
+	}
+	if request.port <= 0 || request.port > 65535 {
+		return nil, failure("Invalid port")
+	}
+	if s.isBanned(request.peerId) {
+		return nil, failure("Client is banned from this tracker")
+	}
+	user, err := s.authenticate(request.passkey)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorise(user, request.infoHash); err != nil {
+		return nil, err
+	}
+
+	store := s.config.Store
+	if user != nil {
+		if err := s.creditTransfer(user, request); err != nil {
+			return nil, err
+		}
+	}
+
+	if request.event == tracker.EVENT_STOPPED {
+		if err := store.DeletePeer(request.infoHash, request.peerId); err != nil {
+			return nil, err
+		}
+		stats, err := store.GetStats(request.infoHash)
+		if err != nil {
+			return nil, err
+		}
+		return &announceResult{peers: make([]*Peer, 0), stats: stats}, nil
+	}
+
+	now := s.config.Clock.Now()
+	peer := &Peer{
+		PeerId:     request.peerId,
+		IP:         request.ip,
+		Port:       request.port,
+		Uploaded:   request.uploaded,
+		Downloaded: request.downloaded,
+		Left:       request.left,
+		LastSeen:   now,
+	}
+	if user != nil {
+		peer.UserId = user.Id
+	}
+	if err := store.PutPeer(request.infoHash, peer); err != nil {
+		return nil, err
+	}
+	if request.event == tracker.EVENT_COMPLETED {
+		if err := store.AddCompleted(request.infoHash); err != nil {
+			return nil, err
+		}
+	}
+
+	numWant := request.numWant
+	if numWant <= 0 {
+		numWant = DEFAULT_NUM_WANT
+	}
+	if numWant > MAX_NUM_WANT {
+		numWant = MAX_NUM_WANT
+	}
+
+	// Seeders have nothing to gain from other seeders
+	candidates, err := store.GetPeers(request.infoHash, numWant+1, peer.IsSeeder())
+	if err != nil {
+		return nil, err
+	}
+	expiredBefore := now.Add(-s.config.PeerExpiry)
+	peers := make([]*Peer, 0, len(candidates))
+	for _, candidate := range candidates {
+		if string(candidate.PeerId) == string(request.peerId) || candidate.LastSeen.Before(expiredBefore) {
+			continue
+		}
+		if len(peers) < numWant {
+			peers = append(peers, candidate)
+		}
+	}
+
+	stats, err := store.GetStats(request.infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return &announceResult{peers: peers, stats: stats}, nil
+}
+
+// scrape returns statistics for each served info hash, or for every torrent when none are given
+func (s *Server) scrape(passkey string, infoHashes [][]byte) ([]*scrapeEntry, error) {
+	user, err := s.authenticate(passkey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(infoHashes) == 0 {
+		all, err := s.config.Store.InfoHashes()
+		if err != nil {
+			return nil, err
+		}
+		infoHashes = all
+	}
+
+	entries := make([]*scrapeEntry, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		if len(infoHash) != HASH_LENGTH {
+			return nil, failure(fmt.Sprintf("Invalid info hash of length %v", len(infoHash)))
+		}
+		if s.authorise(user, infoHash) != nil {
+			continue
+		}
+		stats, err := s.config.Store.GetStats(infoHash)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &scrapeEntry{infoHash: infoHash, stats: stats})
+	}
+	return entries, nil
+}
+
+// Private tracker support
+
+// authenticate returns the user owning the passkey, or nil when the tracker is public
+func (s *Server) authenticate(passkey string) (*User, error) {
+	if s.config.Users == nil {
+		return nil, nil
+	}
+	if passkey == "" {
+		return nil, failure("Passkey required")
+	}
+
+	user, err := s.config.Users.UserForPasskey(passkey)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, failure("Unknown passkey")
+	}
+	if user.Disabled {
+		return nil, failure("Account disabled")
+	}
+	return user, nil
+}
+
+func (s *Server) authorise(user *User, infoHash []byte) error {
+	if s.config.Whitelist != nil && !s.config.Whitelist.Contains(infoHash) {
+		return failure("Torrent is not registered with this tracker")
+	}
+	if user == nil {
+		return nil
+	}
+
+	allowed, err := s.config.Users.CanAccess(user.Id, infoHash)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return failure("Torrent is not available to this account")
+	}
+	return nil
+}
+
+// creditTransfer adds the change in the peer's uploaded and downloaded totals since its last
+// announce to the user. Clients restart their totals with each 'started' event, so those are
+// credited in full, but only when the peer isn't already stored. Otherwise resending 'started'
+// with growing totals would credit them again each time.
+func (s *Server) creditTransfer(user *User, request *announceRequest) error {
+	uploaded := request.uploaded
+	downloaded := request.downloaded
+	if uploaded < 0 || downloaded < 0 {
+		return failure("Invalid transfer statistics")
+	}
+
+	previous, err := s.config.Store.GetPeer(request.infoHash, request.peerId)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		if previous.UserId != user.Id {
+			return nil
+		}
+		uploaded = transferDelta(uploaded, previous.Uploaded)
+		downloaded = transferDelta(downloaded, previous.Downloaded)
+	} else if request.event != tracker.EVENT_STARTED {
+		// Without a previous announce the totals can't be trusted not to be counted twice
+		return nil
+	}
+
+	if uploaded == 0 && downloaded == 0 {
+		return nil
+	}
+	return s.config.Users.AddTransfer(user.Id, uploaded, downloaded)
+}
+
+// Helpers
+
+// transferDelta returns how much a total has grown. A total lower than before means the client
+// restarted its count without a 'started' event, and nothing is credited for it.
+func transferDelta(total int64, previous int64) int64 {
+	if total < previous {
+		return 0
+	}
+	return total - previous
+}
+
+func (s *Server) isBanned(peerId []byte) bool {
+	for _, prefix := range s.config.BannedClients {
+		if strings.HasPrefix(string(peerId), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// failureReason hides internal errors, such as those from the peer store, from clients
+func failureReason(err error) string {
+	if reason, ok := err.(failure); ok {
+		return string(reason)
+	}
+	return "Internal tracker error"
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"github.com/onepointsixtwo/torrentsgo/tracker"
+	"testing"
+)
+
+func newPrivateTestTracker(t *testing.T) (*MemoryUserStore, func(passkey string) *tracker.Client, func()) {
+	users := NewMemoryUserStore()
+	users.AddUser(&User{Id: "alice", Passkey: "alicekey"})
+	users.AddUser(&User{Id: "bob", Passkey: "bobkey", AllTorrents: true})
+	users.AddUser(&User{Id: "mallory", Passkey: "mallorykey", AllTorrents: true, Disabled: true})
+	users.Grant("alice", testInfoHash)
+
+	_, httpServer := newTestHttpTracker(t, Config{Users: users, BannedClients: []string{"-XL0"}})
+	client := func(passkey string) *tracker.Client {
+		return newTestClient(t, httpServer.URL+"/"+passkey+"/announce")
+	}
+	return users, client, httpServer.Close
+}
+
+func expectFailure(t *testing.T, err error, reason string) {
+	t.Helper()
+	failure, ok := err.(*tracker.FailureError)
+	if !ok || failure.Reason != reason {
+		t.Errorf("Expected failure '%v' but was %v", reason, err)
+	}
+}
+
+func TestPrivateTrackerAccessControl(t *testing.T) {
+	_, client, closeServer := newPrivateTestTracker(t)
+	defer closeServer()
+
+	request := &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001}
+	if _, err := client("alicekey").Announce(context.Background(), request); err != nil {
+		t.Errorf("Expected alice to be able to announce granted torrent but got %v", err)
+	}
+
+	other := &tracker.AnnounceRequest{InfoHash: []byte("bbbbbbbbbbbbbbbbbbbb"), PeerId: testPeerOne, Port: 1001}
+	_, err := client("alicekey").Announce(context.Background(), other)
+	expectFailure(t, err, "Torrent is not available to this account")
+
+	if _, err := client("bobkey").Announce(context.Background(), other); err != nil {
+		t.Errorf("Expected bob to be able to announce any torrent but got %v", err)
+	}
+
+	_, err = client("wrongkey").Announce(context.Background(), request)
+	expectFailure(t, err, "Unknown passkey")
+
+	_, err = client("mallorykey").Announce(context.Background(), request)
+	expectFailure(t, err, "Account disabled")
+
+	banned := &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: []byte("-XL0012-000000000000"), Port: 1001}
+	_, err = client("alicekey").Announce(context.Background(), banned)
+	expectFailure(t, err, "Client is banned from this tracker")
+}
+
+func TestPrivateTrackerRequiresPasskey(t *testing.T) {
+	users := NewMemoryUserStore()
+	_, httpServer := newTestHttpTracker(t, Config{Users: users})
+	defer httpServer.Close()
+
+	client := newTestClient(t, httpServer.URL+"/announce")
+	_, err := client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001})
+	expectFailure(t, err, "Passkey required")
+}
+
+func TestPrivateTrackerCreditsTransferDeltas(t *testing.T) {
+	users, client, closeServer := newPrivateTestTracker(t)
+	defer closeServer()
+	alice := client("alicekey")
+
+	announce := func(uploaded int64, downloaded int64, event tracker.Event) {
+		request := &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001, Uploaded: uploaded, Downloaded: downloaded, Left: 10, Event: event}
+		if _, err := alice.Announce(context.Background(), request); err != nil {
+			t.Fatalf("Unexpected announce error %v", err)
+		}
+	}
+
+	announce(0, 0, tracker.EVENT_STARTED)
+	announce(100, 400, tracker.EVENT_NONE)
+	announce(300, 500, tracker.EVENT_NONE)
+	announce(350, 500, tracker.EVENT_STOPPED)
+
+	// A new session starts counting from zero again
+	announce(50, 0, tracker.EVENT_STARTED)
+
+	user := users.User("alice")
+	if user.Uploaded != 400 || user.Downloaded != 500 {
+		t.Errorf("Expected alice to be credited 400 up and 500 down but was %v and %v", user.Uploaded, user.Downloaded)
+	}
+}
+
+func TestPrivateTrackerDoesntCreditCountersWhichGoBackwards(t *testing.T) {
+	users, client, closeServer := newPrivateTestTracker(t)
+	defer closeServer()
+	alice := client("alicekey")
+
+	announce := func(uploaded int64, downloaded int64, event tracker.Event) {
+		request := &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001, Uploaded: uploaded, Downloaded: downloaded, Left: 10, Event: event}
+		if _, err := alice.Announce(context.Background(), request); err != nil {
+			t.Fatalf("Unexpected announce error %v", err)
+		}
+	}
+
+	announce(0, 0, tracker.EVENT_STARTED)
+	announce(100, 400, tracker.EVENT_NONE)
+	// Only the upload count restarted, so only the download is credited
+	announce(50, 600, tracker.EVENT_NONE)
+	announce(80, 600, tracker.EVENT_NONE)
+
+	user := users.User("alice")
+	if user.Uploaded != 130 || user.Downloaded != 600 {
+		t.Errorf("Expected alice to be credited 130 up and 600 down but was %v and %v", user.Uploaded, user.Downloaded)
+	}
+}
+
+func TestPrivateTrackerIgnoresTotalsWithoutPreviousAnnounce(t *testing.T) {
+	users, client, closeServer := newPrivateTestTracker(t)
+	defer closeServer()
+
+	request := &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001, Uploaded: 1000000, Left: 10}
+	client("alicekey").Announce(context.Background(), request)
+
+	if user := users.User("alice"); user.Uploaded != 0 {
+		t.Errorf("Totals without a previous announce should not be credited but uploaded was %v", user.Uploaded)
+	}
+}
+
+func TestPrivateTrackerDoesntCreditRepeatedStarts(t *testing.T) {
+	users, client, closeServer := newPrivateTestTracker(t)
+	defer closeServer()
+	alice := client("alicekey")
+
+	for _, uploaded := range []int64{100, 200, 300} {
+		request := &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001, Uploaded: uploaded, Left: 10, Event: tracker.EVENT_STARTED}
+		if _, err := alice.Announce(context.Background(), request); err != nil {
+			t.Fatalf("Unexpected announce error %v", err)
+		}
+	}
+
+	// Only the first start is credited in full, then only what the totals grew by
+	if user := users.User("alice"); user.Uploaded != 300 {
+		t.Errorf("Expected alice to be credited 300 up but was %v", user.Uploaded)
+	}
+}
+
+func TestPrivateTrackerScrape(t *testing.T) {
+	_, client, closeServer := newPrivateTestTracker(t)
+	defer closeServer()
+
+	client("bobkey").Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001})
+	other := []byte("bbbbbbbbbbbbbbbbbbbb")
+	client("bobkey").Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: other, PeerId: testPeerOne, Port: 1001})
+
+	results, err := client("alicekey").Scrape(context.Background(), testInfoHash, other)
+	if err != nil {
+		t.Fatalf("Unexpected scrape error %v", err)
+	}
+	if len(results) != 1 || string(results[0].InfoHash) != string(testInfoHash) {
+		t.Errorf("Expected alice to only see the torrent granted to her but got %v results", len(results))
+	}
+
+	_, err = client("wrongkey").Scrape(context.Background(), testInfoHash)
+	expectFailure(t, err, "Unknown passkey")
+}
+
+func TestPrivateTrackerRefusesUdp(t *testing.T) {
+	_, conn := newTestUdpTracker(t, Config{Users: NewMemoryUserStore()})
+	defer conn.Close()
+	client := newTestClient(t, "udp://"+conn.LocalAddr().String())
+	defer client.Close()
+
+	_, err := client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001})
+	expectFailure(t, err, "Passkey required")
+}
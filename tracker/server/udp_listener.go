@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/onepointsixtwo/torrentsgo/tracker"
+	"net"
+	"time"
+)
+
+const (
+	UDP_ANNOUNCE_LENGTH      = 98
+	UDP_CONNECTION_ID_WINDOW = time.Minute
+)
+
+// ServeUDP answers UDP tracker requests (BEP 15) read from conn until it is closed. UDP requests
+// carry no passkey, so private trackers refuse them.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	buffer := make([]byte, tracker.UDP_MAX_PACKET_LENGTH)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+
+		response := s.handlePacket(buffer[:n], addr)
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// handlePacket returns the response to a single packet, or nil if it should be ignored
+func (s *Server) handlePacket(packet []byte, addr net.Addr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := binary.BigEndian.Uint32(packet[12:16])
+
+	if action == tracker.UDP_ACTION_CONNECT {
+		if binary.BigEndian.Uint64(packet[0:8]) != tracker.UDP_PROTOCOL_ID {
+			return nil
+		}
+		response := udpHeader(tracker.UDP_ACTION_CONNECT, transactionId)
+		binary.Write(response, binary.BigEndian, s.connectionId(addr, s.config.Clock.Now()))
+		return response.Bytes()
+	}
+
+	if !s.validConnectionId(binary.BigEndian.Uint64(packet[0:8]), addr) {
+		return udpError(transactionId, "Connection id expired")
+	}
+
+	switch action {
+	case tracker.UDP_ACTION_ANNOUNCE:
+		return s.handleUdpAnnounce(packet, addr, transactionId)
+	case tracker.UDP_ACTION_SCRAPE:
+		return s.handleUdpScrape(packet, transactionId)
+	default:
+		return udpError(transactionId, "Unknown action")
+	}
+}
+
+func (s *Server) handleUdpAnnounce(packet []byte, addr net.Addr, transactionId uint32) []byte {
+	if len(packet) < UDP_ANNOUNCE_LENGTH {
+		return udpError(transactionId, "Announce packet too short")
+	}
+
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+
+	// The packet buffer is reused, so the hashes are copied before they are stored
+	request := &announceRequest{
+		infoHash:   append([]byte(nil), packet[16:36]...),
+		peerId:     append([]byte(nil), packet[36:56]...),
+		ip:         udpAddr.IP,
+		downloaded: int64(binary.BigEndian.Uint64(packet[56:64])),
+		left:       int64(binary.BigEndian.Uint64(packet[64:72])),
+		uploaded:   int64(binary.BigEndian.Uint64(packet[72:80])),
+		event:      tracker.Event(binary.BigEndian.Uint32(packet[80:84])),
+		numWant:    int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+		port:       int(binary.BigEndian.Uint16(packet[96:98])),
+	}
+	result, err := s.announce(request)
+	if err != nil {
+		return udpError(transactionId, failureReason(err))
+	}
+
+	response := udpHeader(tracker.UDP_ACTION_ANNOUNCE, transactionId)
+	binary.Write(response, binary.BigEndian, uint32(s.config.Interval.Seconds()))
+	binary.Write(response, binary.BigEndian, uint32(result.stats.Leechers))
+	binary.Write(response, binary.BigEndian, uint32(result.stats.Seeders))
+
+	// Only peers of the same address family fit in the response
+	peers4, peers6 := compactPeers(result.peers)
+	if udpAddr.IP.To4() != nil {
+		response.Write(peers4)
+	} else {
+		response.Write(peers6)
+	}
+	return response.Bytes()
+}
+
+func (s *Server) handleUdpScrape(packet []byte, transactionId uint32) []byte {
+	body := packet[16:]
+	if len(body) == 0 || len(body)%HASH_LENGTH != 0 || len(body)/HASH_LENGTH > tracker.UDP_SCRAPE_BATCH {
+		return udpError(transactionId, "Invalid scrape request")
+	}
+
+	response := udpHeader(tracker.UDP_ACTION_SCRAPE, transactionId)
+	for offset := 0; offset < len(body); offset += HASH_LENGTH {
+		// Every requested hash needs an entry, so unknown torrents are reported as empty
+		stats := &TorrentStats{}
+		entries, err := s.scrape("", [][]byte{body[offset : offset+HASH_LENGTH]})
+		if err != nil {
+			return udpError(transactionId, failureReason(err))
+		}
+		if len(entries) == 1 {
+			stats = entries[0].stats
+		}
+		binary.Write(response, binary.BigEndian, uint32(stats.Seeders))
+		binary.Write(response, binary.BigEndian, uint32(stats.Completed))
+		binary.Write(response, binary.BigEndian, uint32(stats.Leechers))
+	}
+	return response.Bytes()
+}
+
+// Connection ids
+
+// connectionId is derived from the client address and the current time window, so no state
+// needs to be kept for connected clients.
+func (s *Server) connectionId(addr net.Addr, now time.Time) uint64 {
+	window := now.UnixNano() / int64(UDP_CONNECTION_ID_WINDOW)
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(addr.String()))
+	binary.Write(mac, binary.BigEndian, window)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+// validConnectionId accepts ids from the current or previous window, giving clients at least
+// the one minute lifetime BEP 15 promises.
+func (s *Server) validConnectionId(connectionId uint64, addr net.Addr) bool {
+	now := s.config.Clock.Now()
+	return connectionId == s.connectionId(addr, now) || connectionId == s.connectionId(addr, now.Add(-UDP_CONNECTION_ID_WINDOW))
+}
+
+// Helpers
+
+func udpHeader(action uint32, transactionId uint32) *bytes.Buffer {
+	header := bytes.NewBuffer(nil)
+	binary.Write(header, binary.BigEndian, action)
+	binary.Write(header, binary.BigEndian, transactionId)
+	return header
+}
+
+func udpError(transactionId uint32, message string) []byte {
+	response := udpHeader(tracker.UDP_ACTION_ERROR, transactionId)
+	response.WriteString(message)
+	return response.Bytes()
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"github.com/onepointsixtwo/torrentsgo/tracker"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestUdpTracker(t *testing.T, config Config) (*Server, net.PacketConn) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen %v", err)
+	}
+	trackerServer := NewServer(config)
+	go trackerServer.ServeUDP(conn)
+	return trackerServer, conn
+}
+
+func TestUdpAnnounceAndScrape(t *testing.T) {
+	_, conn := newTestUdpTracker(t, Config{})
+	defer conn.Close()
+	client := newTestClient(t, "udp://"+conn.LocalAddr().String())
+	defer client.Close()
+
+	client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001, Event: tracker.EVENT_STARTED})
+	response, err := client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerTwo, Port: 1002, Left: 3, Event: tracker.EVENT_STARTED})
+	if err != nil {
+		t.Fatalf("Unexpected announce error %v", err)
+	}
+	if response.Seeders != 1 || response.Leechers != 1 || response.Interval != DEFAULT_INTERVAL {
+		t.Errorf("Unexpected announce response %+v", response)
+	}
+	if len(response.Peers) != 1 || response.Peers[0].Port != 1001 {
+		t.Errorf("Expected the first peer to be returned but got %v", response.Peers)
+	}
+
+	results, err := client.Scrape(context.Background(), testInfoHash, []byte("bbbbbbbbbbbbbbbbbbbb"))
+	if err != nil {
+		t.Fatalf("Unexpected scrape error %v", err)
+	}
+	if len(results) != 2 || results[0].Seeders != 1 || results[0].Leechers != 1 || results[1].Seeders != 0 {
+		t.Errorf("Unexpected scrape results %+v %+v", results[0], results[1])
+	}
+}
+
+func TestUdpAnnounceNotWhitelisted(t *testing.T) {
+	_, conn := newTestUdpTracker(t, Config{Whitelist: NewWhitelist()})
+	defer conn.Close()
+	client := newTestClient(t, "udp://"+conn.LocalAddr().String())
+	defer client.Close()
+
+	_, err := client.Announce(context.Background(), &tracker.AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerOne, Port: 1001})
+	if failure, ok := err.(*tracker.FailureError); !ok || failure.Reason != "Torrent is not registered with this tracker" {
+		t.Errorf("Expected whitelist failure but was %v", err)
+	}
+}
+
+func TestUdpConnectionIdExpires(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(0, 0))
+	trackerServer := NewServer(Config{Clock: clock})
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+
+	connectionId := trackerServer.connectionId(addr, clock.Now())
+	clock.Advance(90 * time.Second)
+	if !trackerServer.validConnectionId(connectionId, addr) {
+		t.Errorf("Connection id should still be valid after 90 seconds")
+	}
+	clock.Advance(time.Minute)
+	if trackerServer.validConnectionId(connectionId, addr) {
+		t.Errorf("Connection id should have expired")
+	}
+
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 5000}
+	if trackerServer.validConnectionId(trackerServer.connectionId(addr, clock.Now()), other) {
+		t.Errorf("Connection id should only be valid for the address it was given to")
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"sync"
+)
+
+// Types
+
+type User struct {
+	Id         string
+	Passkey    string
+	Uploaded   int64
+	Downloaded int64
+	Disabled   bool
+	// AllTorrents lets the user announce any torrent rather than only those granted to them
+	AllTorrents bool
+}
+
+// UserStore backs a private tracker. Implementations must be safe for concurrent use.
+type UserStore interface {
+	// UserForPasskey returns nil when no user has the passkey
+	UserForPasskey(passkey string) (*User, error)
+	AddTransfer(userId string, uploaded int64, downloaded int64) error
+	CanAccess(userId string, infoHash []byte) (bool, error)
+}
+
+type MemoryUserStore struct {
+	lock       sync.RWMutex
+	users      map[string]*User
+	passkeys   map[string]string
+	authorised map[string]map[string]bool
+}
+
+// Initialiser
+
+func NewMemoryUserStore() *MemoryUserStore {
+	return &MemoryUserStore{
+		users:      make(map[string]*User),
+		passkeys:   make(map[string]string),
+		authorised: make(map[string]map[string]bool),
+	}
+}
+
+// Public Methods
+
+func (store *MemoryUserStore) AddUser(user *User) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if existing, ok := store.users[user.Id]; ok {
+		delete(store.passkeys, existing.Passkey)
+	}
+	stored := *user
+	store.users[user.Id] = &stored
+	store.passkeys[user.Passkey] = user.Id
+}
+
+// Grant allows a user to announce a torrent
+func (store *MemoryUserStore) Grant(userId string, infoHash []byte) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	torrents, ok := store.authorised[userId]
+	if !ok {
+		torrents = make(map[string]bool)
+		store.authorised[userId] = torrents
+	}
+	torrents[string(infoHash)] = true
+}
+
+func (store *MemoryUserStore) Revoke(userId string, infoHash []byte) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.authorised[userId], string(infoHash))
+}
+
+// User returns a copy of the user with the given id, or nil
+func (store *MemoryUserStore) User(userId string) *User {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	user, ok := store.users[userId]
+	if !ok {
+		return nil
+	}
+	copied := *user
+	return &copied
+}
+
+func (store *MemoryUserStore) UserForPasskey(passkey string) (*User, error) {
+	store.lock.RLock()
+	userId, ok := store.passkeys[passkey]
+	store.lock.RUnlock()
+
+	if !ok {
+		return nil, nil
+	}
+	return store.User(userId), nil
+}
+
+func (store *MemoryUserStore) AddTransfer(userId string, uploaded int64, downloaded int64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user, ok := store.users[userId]
+	if ok {
+		user.Uploaded += uploaded
+		user.Downloaded += downloaded
+	}
+	return nil
+}
+
+func (store *MemoryUserStore) CanAccess(userId string, infoHash []byte) (bool, error) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	user, ok := store.users[userId]
+	if !ok {
+		return false, nil
+	}
+	return user.AllTorrents || store.authorised[userId][string(infoHash)], nil
+}
+
+// Ratio is uploaded divided by downloaded, or zero when nothing has been downloaded
+func (user *User) Ratio() float64 {
+	if user.Downloaded == 0 {
+		return 0
+	}
+	return float64(user.Uploaded) / float64(user.Downloaded)
+}
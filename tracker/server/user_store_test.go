@@ -0,0 +1,51 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestMemoryUserStore(t *testing.T) {
+	store := NewMemoryUserStore()
+	store.AddUser(&User{Id: "alice", Passkey: "key1"})
+
+	user, _ := store.UserForPasskey("key1")
+	if user == nil || user.Id != "alice" {
+		t.Fatalf("Expected to find alice by passkey but got %v", user)
+	}
+	if user, _ := store.UserForPasskey("other"); user != nil {
+		t.Errorf("Expected no user for unknown passkey but got %v", user)
+	}
+
+	// Changing passkey invalidates the old one
+	store.AddUser(&User{Id: "alice", Passkey: "key2"})
+	if user, _ := store.UserForPasskey("key1"); user != nil {
+		t.Errorf("Old passkey should no longer be valid")
+	}
+
+	if allowed, _ := store.CanAccess("alice", testInfoHash); allowed {
+		t.Errorf("User should not have access before being granted")
+	}
+	store.Grant("alice", testInfoHash)
+	if allowed, _ := store.CanAccess("alice", testInfoHash); !allowed {
+		t.Errorf("User should have access once granted")
+	}
+	store.Revoke("alice", testInfoHash)
+	if allowed, _ := store.CanAccess("alice", testInfoHash); allowed {
+		t.Errorf("User should not have access once revoked")
+	}
+}
+
+func TestUserRatio(t *testing.T) {
+	store := NewMemoryUserStore()
+	store.AddUser(&User{Id: "bob", Passkey: "key"})
+	store.AddTransfer("bob", 300, 200)
+	store.AddTransfer("bob", 100, 0)
+
+	user := store.User("bob")
+	if user.Uploaded != 400 || user.Downloaded != 200 || user.Ratio() != 2 {
+		t.Errorf("Unexpected totals %v/%v ratio %v", user.Uploaded, user.Downloaded, user.Ratio())
+	}
+	if (&User{}).Ratio() != 0 {
+		t.Errorf("Ratio with nothing downloaded should be zero")
+	}
+}
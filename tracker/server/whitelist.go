@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Whitelist restricts the torrents a tracker will serve
+type Whitelist struct {
+	lock   sync.RWMutex
+	hashes map[string]bool
+}
+
+// Initialisers
+
+func NewWhitelist(infoHashes ...[]byte) *Whitelist {
+	whitelist := &Whitelist{hashes: make(map[string]bool)}
+	for _, infoHash := range infoHashes {
+		whitelist.Add(infoHash)
+	}
+	return whitelist
+}
+
+// LoadWhitelist reads hex encoded info hashes, one per line. Blank lines and lines starting
+// with '#' are ignored.
+func LoadWhitelist(reader io.Reader) (*Whitelist, error) {
+	whitelist := NewWhitelist()
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		infoHash, err := hex.DecodeString(line)
+		if err != nil || len(infoHash) != 20 {
+			return nil, fmt.Errorf("Invalid info hash on line %v of whitelist", lineNumber)
+		}
+		whitelist.Add(infoHash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return whitelist, nil
+}
+
+// Public Methods
+
+func (whitelist *Whitelist) Add(infoHash []byte) {
+	whitelist.lock.Lock()
+	defer whitelist.lock.Unlock()
+	whitelist.hashes[string(infoHash)] = true
+}
+
+func (whitelist *Whitelist) Remove(infoHash []byte) {
+	whitelist.lock.Lock()
+	defer whitelist.lock.Unlock()
+	delete(whitelist.hashes, string(infoHash))
+}
+
+func (whitelist *Whitelist) Contains(infoHash []byte) bool {
+	whitelist.lock.RLock()
+	defer whitelist.lock.RUnlock()
+	return whitelist.hashes[string(infoHash)]
+}
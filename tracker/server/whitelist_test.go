@@ -0,0 +1,35 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadWhitelist(t *testing.T) {
+	contents := "# build artifacts\n6161616161616161616161616161616161616161\n\n  6262626262626262626262626262626262626262  \n"
+	whitelist, err := LoadWhitelist(strings.NewReader(contents))
+	if err != nil {
+		t.Fatalf("Unexpected error loading whitelist %v", err)
+	}
+
+	if !whitelist.Contains(testInfoHash) || !whitelist.Contains([]byte("bbbbbbbbbbbbbbbbbbbb")) {
+		t.Errorf("Expected both hashes to be whitelisted")
+	}
+	if whitelist.Contains([]byte("cccccccccccccccccccc")) {
+		t.Errorf("Unexpected hash in whitelist")
+	}
+
+	whitelist.Remove(testInfoHash)
+	if whitelist.Contains(testInfoHash) {
+		t.Errorf("Removed hash should no longer be whitelisted")
+	}
+}
+
+func TestLoadWhitelistInvalid(t *testing.T) {
+	if _, err := LoadWhitelist(strings.NewReader("nothex\n")); err == nil {
+		t.Errorf("Expected error for invalid whitelist line")
+	}
+	if _, err := LoadWhitelist(strings.NewReader("6161\n")); err == nil {
+		t.Errorf("Expected error for short info hash")
+	}
+}
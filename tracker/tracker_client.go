@@ -1 +1,255 @@
 package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types
+
+type Event int
+
+const (
+	// Values match the event field of the UDP tracker protocol (BEP 15)
+	EVENT_NONE Event = iota
+	EVENT_COMPLETED
+	EVENT_STARTED
+	EVENT_STOPPED
+)
+
+const (
+	DEFAULT_TIMEOUT     = 15 * time.Second
+	DEFAULT_UDP_RETRIES = 2
+	HTTP_SCRAPE_BATCH   = 50
+	UDP_SCRAPE_BATCH    = 74
+	MAX_RESPONSE_LENGTH = 1024 * 1024
+	MAX_REDIRECTS       = 5
+)
+
+var ErrScrapeNotSupported = errors.New("Tracker does not support scrape")
+
+type Client struct {
+	announceUrl       *url.URL
+	httpClient        *http.Client
+	timeout           time.Duration
+	udpRetries        int
+	maxResponseLength int64
+	dialer            proxy.Dialer
+
+	// Tracker ids sent back on later announces, by info hash
+	trackerIdLock sync.Mutex
+	trackerIds    map[string]string
+
+	udpLock sync.Mutex
+	udp     *udpConnection
+}
+
+type AnnounceRequest struct {
+	InfoHash   []byte
+	PeerId     []byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	NumWant    int
+	Key        uint32
+
+	// Offers are WebRTC offers relayed to other peers by WebTorrent trackers. Other trackers ignore them.
+	Offers []*Offer
+}
+
+// Offer is an opaque WebRTC offer. The tracker relays it along with its id, and any answer
+// comes back on the WebSocketClient's Signals channel.
+type Offer struct {
+	OfferId []byte
+	Offer   json.RawMessage
+}
+
+type AnnounceResponse struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	Seeders     int
+	Leechers    int
+	Peers       []*Peer
+
+	// Warning is a message from the tracker which didn't stop the announce succeeding
+	Warning   string
+	TrackerId string
+	// ExternalIP is our address as seen by the tracker (BEP 24), or nil if it wasn't given
+	ExternalIP net.IP
+}
+
+type Peer struct {
+	IP     net.IP
+	Port   int
+	PeerId []byte
+}
+
+type ScrapeResult struct {
+	InfoHash  []byte
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// FailureError is returned when the tracker answered but refused the request. Trackers
+// supporting BEP 31 say when to try again, or that there's no point trying again.
+type FailureError struct {
+	Reason     string
+	RetryIn    time.Duration
+	RetryNever bool
+}
+
+// Initialiser
+
+func NewClient(announceUrl *url.URL) (*Client, error) {
+	switch announceUrl.Scheme {
+	case "http", "https", "udp":
+	default:
+		return nil, fmt.Errorf("Unsupported tracker scheme '%v'", announceUrl.Scheme)
+	}
+
+	httpClient := &http.Client{Timeout: DEFAULT_TIMEOUT, CheckRedirect: checkRedirect}
+	return &Client{
+		announceUrl:       announceUrl,
+		httpClient:        httpClient,
+		timeout:           DEFAULT_TIMEOUT,
+		udpRetries:        DEFAULT_UDP_RETRIES,
+		maxResponseLength: MAX_RESPONSE_LENGTH,
+		dialer:            proxy.Direct(),
+		trackerIds:        make(map[string]string),
+	}, nil
+}
+
+// NewAnnouncer returns a Client, or a WebSocketClient for ws and wss URLs
+func NewAnnouncer(announceUrl *url.URL) (Announcer, error) {
+	switch announceUrl.Scheme {
+	case "ws", "wss":
+		return NewWebSocketClient(announceUrl)
+	default:
+		return NewClient(announceUrl)
+	}
+}
+
+// Public Methods
+
+func (c *Client) AnnounceUrl() *url.URL {
+	return c.announceUrl
+}
+
+// SetTimeout changes how long a single request may take. For UDP trackers this is the
+// initial retransmission timeout, which doubles on every retry.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+	c.httpClient.Timeout = timeout
+}
+
+// SetDialer sends all tracker traffic through the dialer, for example to use a proxy. UDP trackers
+// need a dialer which supports UDP.
+func (c *Client) SetDialer(dialer proxy.Dialer) {
+	c.dialer = dialer
+	c.httpClient.Transport = &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: DEFAULT_TIMEOUT,
+	}
+}
+
+func (c *Client) Announce(ctx context.Context, request *AnnounceRequest) (*AnnounceResponse, error) {
+	if c.isUdp() {
+		return c.announceUdp(ctx, request)
+	}
+	return c.announceHttp(ctx, request)
+}
+
+// Scrape asks the tracker for swarm statistics of each of the given info hashes. Hashes are
+// sent in batches, and hashes the tracker knows nothing about are left out of the result.
+// ErrScrapeNotSupported is returned when the tracker has no scrape endpoint.
+func (c *Client) Scrape(ctx context.Context, infoHashes ...[]byte) ([]*ScrapeResult, error) {
+	batchSize := HTTP_SCRAPE_BATCH
+	if c.isUdp() {
+		batchSize = UDP_SCRAPE_BATCH
+	}
+
+	results := make([]*ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += batchSize {
+		end := start + batchSize
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		var batch []*ScrapeResult
+		var err error
+		if c.isUdp() {
+			batch, err = c.scrapeUdp(ctx, infoHashes[start:end])
+		} else {
+			batch, err = c.scrapeHttp(ctx, infoHashes[start:end])
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+// Close releases the socket held open for UDP trackers
+func (c *Client) Close() error {
+	c.udpLock.Lock()
+	defer c.udpLock.Unlock()
+
+	if c.udp == nil {
+		return nil
+	}
+	err := c.udp.conn.Close()
+	c.udp = nil
+	return err
+}
+
+// ScrapeUrl derives the scrape URL from an HTTP announce URL. By convention this only works when
+// the last path segment begins with 'announce', which is then replaced with 'scrape'.
+func ScrapeUrl(announceUrl *url.URL) (*url.URL, error) {
+	path := announceUrl.Path
+	lastSlash := strings.LastIndex(path, "/")
+	lastSegment := path[lastSlash+1:]
+	if !strings.HasPrefix(lastSegment, "announce") {
+		return nil, ErrScrapeNotSupported
+	}
+
+	scrapeUrl := *announceUrl
+	scrapeUrl.Path = path[:lastSlash+1] + "scrape" + strings.TrimPrefix(lastSegment, "announce")
+	scrapeUrl.RawPath = ""
+	return &scrapeUrl, nil
+}
+
+func (event Event) String() string {
+	switch event {
+	case EVENT_COMPLETED:
+		return "completed"
+	case EVENT_STARTED:
+		return "started"
+	case EVENT_STOPPED:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+func (err *FailureError) Error() string {
+	return fmt.Sprintf("Tracker returned failure - %v", err.Reason)
+}
+
+// Helpers
+
+func (c *Client) isUdp() bool {
+	return c.announceUrl.Scheme == "udp"
+}
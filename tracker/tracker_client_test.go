@@ -1 +1,156 @@
 package tracker
+
+import (
+	"context"
+	"github.com/onepointsixtwo/torrentsgo/proxy"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestScrapeUrl(t *testing.T) {
+	cases := []struct {
+		announce string
+		scrape   string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4"},
+		{"http://linuxtracker.org:2710/00000000000000000000000000000000/announce", "http://linuxtracker.org:2710/00000000000000000000000000000000/scrape"},
+	}
+
+	for _, c := range cases {
+		announceUrl, _ := url.Parse(c.announce)
+		scrapeUrl, err := ScrapeUrl(announceUrl)
+		if err != nil {
+			t.Errorf("Unexpected error deriving scrape url from %v - %v", c.announce, err)
+			continue
+		}
+		if scrapeUrl.String() != c.scrape {
+			t.Errorf("Expected scrape url for %v to be %v but was %v", c.announce, c.scrape, scrapeUrl)
+		}
+	}
+}
+
+func TestScrapeUrlNotSupported(t *testing.T) {
+	announces := []string{
+		"http://example.com/a",
+		"http://example.com/x%064announce",
+		"http://example.com/announce/x",
+	}
+
+	for _, announce := range announces {
+		announceUrl, _ := url.Parse(announce)
+		_, err := ScrapeUrl(announceUrl)
+		if err != ErrScrapeNotSupported {
+			t.Errorf("Expected scrape to be unsupported for %v but error was %v", announce, err)
+		}
+	}
+}
+
+func TestNewClientRejectsUnknownScheme(t *testing.T) {
+	announceUrl, _ := url.Parse("wss://tracker.example.com/announce")
+	_, err := NewClient(announceUrl)
+	if err == nil {
+		t.Errorf("Expected error creating client for unsupported scheme")
+	}
+}
+
+func TestEventString(t *testing.T) {
+	if EVENT_STARTED.String() != "started" || EVENT_COMPLETED.String() != "completed" || EVENT_STOPPED.String() != "stopped" {
+		t.Errorf("Unexpected event names")
+	}
+	if EVENT_NONE.String() != "" {
+		t.Errorf("Expected empty name for no event but was '%v'", EVENT_NONE.String())
+	}
+}
+
+// recordingDialer dials directly, remembering what was asked for
+type recordingDialer struct {
+	lock  sync.Mutex
+	dials []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	d.lock.Lock()
+	d.dials = append(d.dials, network+" "+address)
+	d.lock.Unlock()
+	return proxy.Direct().DialContext(ctx, network, address)
+}
+
+func (d *recordingDialer) recorded() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string{}, d.dials...)
+}
+
+func TestHttpAnnounceUsesDialer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800ee"))
+	}))
+	defer server.Close()
+
+	dialer := &recordingDialer{}
+	client := newTestHttpClient(t, server, "/announce")
+	client.SetDialer(dialer)
+	if _, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId}); err != nil {
+		t.Fatalf("Unexpected error announcing %v", err)
+	}
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	if dials := dialer.recorded(); len(dials) != 1 || dials[0] != "tcp "+host {
+		t.Errorf("Expected announce to go through the dialer but dials were %v", dials)
+	}
+}
+
+func TestUdpAnnounceUsesDialer(t *testing.T) {
+	tracker := newFakeUdpTracker(t)
+	tracker.start()
+	defer tracker.conn.Close()
+
+	dialer := &recordingDialer{}
+	client := tracker.client(t)
+	defer client.Close()
+	client.SetDialer(dialer)
+	if _, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId}); err != nil {
+		t.Fatalf("Unexpected error announcing %v", err)
+	}
+
+	if dials := dialer.recorded(); len(dials) != 1 || dials[0] != "udp "+tracker.conn.LocalAddr().String() {
+		t.Errorf("Expected announce to go through the dialer but dials were %v", dials)
+	}
+}
+
+func TestUdpAnnounceFailsWithoutProxyUdpSupport(t *testing.T) {
+	announceUrl, _ := url.Parse("udp://127.0.0.1:6969/announce")
+	client, _ := NewClient(announceUrl)
+	dialer, _ := proxy.NewDialer(proxy.Config{Type: proxy.PROXY_HTTP, Address: "127.0.0.1:3128"})
+	client.SetDialer(dialer)
+
+	// Falling back to a direct connection would leak traffic around the proxy
+	_, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+	if err != proxy.ErrUdpNotSupported {
+		t.Errorf("Expected ErrUdpNotSupported but got %v", err)
+	}
+}
+
+func TestManagerAppliesDialerToAnnouncers(t *testing.T) {
+	dialer := &recordingDialer{}
+	manager := NewManager(ManagerConfig{Dialer: dialer})
+	defer manager.Close()
+
+	announceUrl, _ := url.Parse("udp://127.0.0.1:6969/announce")
+	announcer, err := manager.config.NewAnnouncer(announceUrl)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if client, ok := announcer.(*Client); !ok || client.dialer != dialer {
+		t.Errorf("Expected announcer to use the configured dialer")
+	}
+}
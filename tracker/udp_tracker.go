@@ -0,0 +1,229 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+
+const (
+	UDP_PROTOCOL_ID            = 0x41727101980
+	UDP_ACTION_CONNECT         = 0
+	UDP_ACTION_ANNOUNCE        = 1
+	UDP_ACTION_SCRAPE          = 2
+	UDP_ACTION_ERROR           = 3
+	UDP_CONNECTION_ID_LIFETIME = time.Minute
+	UDP_MAX_PACKET_LENGTH      = 2048
+)
+
+type udpConnection struct {
+	conn         net.Conn
+	connectionId uint64
+	connectedAt  time.Time
+}
+
+// Announce
+
+func (c *Client) announceUdp(ctx context.Context, request *AnnounceRequest) (*AnnounceResponse, error) {
+	if len(request.InfoHash) != 20 || len(request.PeerId) != 20 {
+		return nil, fmt.Errorf("Info hash and peer id must both be 20 bytes")
+	}
+
+	numWant := int32(-1)
+	if request.NumWant > 0 {
+		numWant = int32(request.NumWant)
+	}
+
+	body := bytes.NewBuffer(nil)
+	body.Write(request.InfoHash)
+	body.Write(request.PeerId)
+	binary.Write(body, binary.BigEndian, request.Downloaded)
+	binary.Write(body, binary.BigEndian, request.Left)
+	binary.Write(body, binary.BigEndian, request.Uploaded)
+	binary.Write(body, binary.BigEndian, int32(request.Event))
+	binary.Write(body, binary.BigEndian, uint32(0))
+	binary.Write(body, binary.BigEndian, request.Key)
+	binary.Write(body, binary.BigEndian, numWant)
+	binary.Write(body, binary.BigEndian, uint16(request.Port))
+
+	response, remote, err := c.udpRequest(ctx, UDP_ACTION_ANNOUNCE, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, fmt.Errorf("UDP announce response too short (%v bytes)", len(response))
+	}
+
+	// Trackers reached over IPv6 answer with IPv6 peers
+	peerLength := COMPACT_PEER_LENGTH
+	if udpAddr, ok := remote.(*net.UDPAddr); ok && udpAddr.IP.To4() == nil {
+		peerLength = COMPACT_PEER6_LENGTH
+	}
+	peers, err := parseCompactPeers(response[12:], peerLength)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := int(binary.BigEndian.Uint32(response[0:4]))
+	announceResponse := &AnnounceResponse{
+		Interval: seconds(interval),
+		Leechers: int(binary.BigEndian.Uint32(response[4:8])),
+		Seeders:  int(binary.BigEndian.Uint32(response[8:12])),
+		Peers:    peers,
+	}
+	return announceResponse, nil
+}
+
+// Scrape
+
+func (c *Client) scrapeUdp(ctx context.Context, infoHashes [][]byte) ([]*ScrapeResult, error) {
+	body := bytes.NewBuffer(nil)
+	for _, infoHash := range infoHashes {
+		if len(infoHash) != 20 {
+			return nil, fmt.Errorf("Info hash must be 20 bytes but was %v", len(infoHash))
+		}
+		body.Write(infoHash)
+	}
+
+	response, _, err := c.udpRequest(ctx, UDP_ACTION_SCRAPE, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < len(infoHashes)*12 {
+		return nil, fmt.Errorf("UDP scrape response too short for %v hashes (%v bytes)", len(infoHashes), len(response))
+	}
+
+	results := make([]*ScrapeResult, 0, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		entry := response[i*12:]
+		result := &ScrapeResult{
+			InfoHash:  infoHash,
+			Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+			Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+			Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// Transport
+
+// udpRequest connects if needed and sends a single action, returning the response payload
+// following the action and transaction id along with the tracker's address.
+func (c *Client) udpRequest(ctx context.Context, action uint32, body []byte) ([]byte, net.Addr, error) {
+	c.udpLock.Lock()
+	defer c.udpLock.Unlock()
+
+	if c.udp == nil {
+		conn, err := c.dialer.DialContext(ctx, "udp", c.announceUrl.Host)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.udp = &udpConnection{conn: conn}
+	}
+
+	if time.Since(c.udp.connectedAt) > UDP_CONNECTION_ID_LIFETIME {
+		connectRequest := bytes.NewBuffer(nil)
+		binary.Write(connectRequest, binary.BigEndian, uint64(UDP_PROTOCOL_ID))
+		response, err := c.udpRoundTrip(ctx, connectRequest.Bytes(), UDP_ACTION_CONNECT, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(response) < 8 {
+			return nil, nil, fmt.Errorf("UDP connect response too short (%v bytes)", len(response))
+		}
+		c.udp.connectionId = binary.BigEndian.Uint64(response)
+		c.udp.connectedAt = time.Now()
+	}
+
+	connectionId := make([]byte, 8)
+	binary.BigEndian.PutUint64(connectionId, c.udp.connectionId)
+	response, err := c.udpRoundTrip(ctx, connectionId, action, body)
+	if err != nil {
+		if _, ok := err.(*FailureError); !ok {
+			// The connection id may have been rejected, so get a new one next time
+			c.udp.connectedAt = time.Time{}
+		}
+		return nil, nil, err
+	}
+	return response, c.udp.conn.RemoteAddr(), nil
+}
+
+func (c *Client) udpRoundTrip(ctx context.Context, prefix []byte, action uint32, body []byte) ([]byte, error) {
+	transactionId := rand.Uint32()
+	packet := bytes.NewBuffer(nil)
+	packet.Write(prefix)
+	binary.Write(packet, binary.BigEndian, action)
+	binary.Write(packet, binary.BigEndian, transactionId)
+	packet.Write(body)
+
+	conn := c.udp.conn
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	timeout := c.timeout
+	buffer := make([]byte, UDP_MAX_PACKET_LENGTH)
+	for attempt := 0; attempt <= c.udpRetries; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if _, err := conn.Write(packet.Bytes()); err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					if ctxDeadline, ok := ctx.Deadline(); ok && !time.Now().Before(ctxDeadline) {
+						return nil, context.DeadlineExceeded
+					}
+					break
+				}
+				return nil, err
+			}
+			if n < 8 || binary.BigEndian.Uint32(buffer[4:8]) != transactionId {
+				continue
+			}
+
+			responseAction := binary.BigEndian.Uint32(buffer[0:4])
+			if responseAction == UDP_ACTION_ERROR {
+				return nil, &FailureError{Reason: string(buffer[8:n])}
+			}
+			if responseAction != action {
+				return nil, fmt.Errorf("Expected UDP tracker action %v but received %v", action, responseAction)
+			}
+
+			response := make([]byte, n-8)
+			copy(response, buffer[8:n])
+			return response, nil
+		}
+
+		timeout = timeout * 2
+	}
+
+	return nil, fmt.Errorf("UDP tracker %v did not respond", c.announceUrl.Host)
+}
@@ -0,0 +1,198 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeUdpTracker answers connect, announce and scrape requests with canned values
+type fakeUdpTracker struct {
+	conn         *net.UDPConn
+	connectionId uint64
+	connects     int32
+	scrapes      int32
+	failScrape   bool
+	dropFirst    bool
+}
+
+func newFakeUdpTracker(t *testing.T) *fakeUdpTracker {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Unable to listen %v", err)
+	}
+	return &fakeUdpTracker{conn: conn, connectionId: 0x1122334455667788}
+}
+
+func (tracker *fakeUdpTracker) start() {
+	go tracker.serve()
+}
+
+func (tracker *fakeUdpTracker) serve() {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := tracker.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if tracker.dropFirst {
+			tracker.dropFirst = false
+			continue
+		}
+		packet := buffer[:n]
+		action := binary.BigEndian.Uint32(packet[8:12])
+		transactionId := binary.BigEndian.Uint32(packet[12:16])
+
+		response := bytes.NewBuffer(nil)
+		switch action {
+		case UDP_ACTION_CONNECT:
+			atomic.AddInt32(&tracker.connects, 1)
+			binary.Write(response, binary.BigEndian, uint32(UDP_ACTION_CONNECT))
+			binary.Write(response, binary.BigEndian, transactionId)
+			binary.Write(response, binary.BigEndian, tracker.connectionId)
+		case UDP_ACTION_ANNOUNCE:
+			binary.Write(response, binary.BigEndian, uint32(UDP_ACTION_ANNOUNCE))
+			binary.Write(response, binary.BigEndian, transactionId)
+			binary.Write(response, binary.BigEndian, []uint32{1800, 7, 4})
+			response.Write([]byte{10, 0, 0, 1, 0x1a, 0xe1})
+		case UDP_ACTION_SCRAPE:
+			atomic.AddInt32(&tracker.scrapes, 1)
+			if tracker.failScrape {
+				binary.Write(response, binary.BigEndian, uint32(UDP_ACTION_ERROR))
+				binary.Write(response, binary.BigEndian, transactionId)
+				response.WriteString("scrape disabled")
+				break
+			}
+			binary.Write(response, binary.BigEndian, uint32(UDP_ACTION_SCRAPE))
+			binary.Write(response, binary.BigEndian, transactionId)
+			hashes := (n - 16) / 20
+			for i := 0; i < hashes; i++ {
+				binary.Write(response, binary.BigEndian, []uint32{uint32(i + 1), 100, 2})
+			}
+		}
+		tracker.conn.WriteToUDP(response.Bytes(), addr)
+	}
+}
+
+func (tracker *fakeUdpTracker) client(t *testing.T) *Client {
+	announceUrl, _ := url.Parse("udp://" + tracker.conn.LocalAddr().String() + "/announce")
+	client, err := NewClient(announceUrl)
+	if err != nil {
+		t.Fatalf("Unable to create client %v", err)
+	}
+	client.SetTimeout(100 * time.Millisecond)
+	return client
+}
+
+func TestUdpAnnounce(t *testing.T) {
+	tracker := newFakeUdpTracker(t)
+	tracker.start()
+	defer tracker.conn.Close()
+	client := tracker.client(t)
+	defer client.Close()
+
+	request := &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId, Port: 6881, Event: EVENT_STARTED}
+	response, err := client.Announce(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Unexpected announce error %v", err)
+	}
+	if response.Interval.Seconds() != 1800 || response.Leechers != 7 || response.Seeders != 4 {
+		t.Errorf("Unexpected announce response %+v", response)
+	}
+	if len(response.Peers) != 1 || response.Peers[0].IP.String() != "10.0.0.1" || response.Peers[0].Port != 6881 {
+		t.Errorf("Unexpected peers in announce response %v", response.Peers)
+	}
+
+	// The connection id should be reused for the next request
+	if _, err := client.Announce(context.Background(), request); err != nil {
+		t.Fatalf("Unexpected announce error %v", err)
+	}
+	if atomic.LoadInt32(&tracker.connects) != 1 {
+		t.Errorf("Expected a single connect but there were %v", atomic.LoadInt32(&tracker.connects))
+	}
+}
+
+func TestUdpRetransmits(t *testing.T) {
+	tracker := newFakeUdpTracker(t)
+	tracker.dropFirst = true
+	tracker.start()
+	defer tracker.conn.Close()
+	client := tracker.client(t)
+	defer client.Close()
+
+	_, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+	if err != nil {
+		t.Errorf("Expected announce to succeed after retransmitting but got %v", err)
+	}
+}
+
+func TestUdpScrape(t *testing.T) {
+	tracker := newFakeUdpTracker(t)
+	tracker.start()
+	defer tracker.conn.Close()
+	client := tracker.client(t)
+	defer client.Close()
+
+	hashes := make([][]byte, UDP_SCRAPE_BATCH+2)
+	for i := range hashes {
+		hashes[i] = testInfoHash
+	}
+	hashes[1] = testInfoHash2
+
+	results, err := client.Scrape(context.Background(), hashes...)
+	if err != nil {
+		t.Fatalf("Unexpected scrape error %v", err)
+	}
+	if atomic.LoadInt32(&tracker.scrapes) != 2 {
+		t.Errorf("Expected scrape to be sent in two batches but was %v", atomic.LoadInt32(&tracker.scrapes))
+	}
+	if len(results) != len(hashes) {
+		t.Fatalf("Expected %v results but got %v", len(hashes), len(results))
+	}
+	second := results[1]
+	if !bytes.Equal(second.InfoHash, testInfoHash2) || second.Seeders != 2 || second.Completed != 100 || second.Leechers != 2 {
+		t.Errorf("Unexpected scrape result %+v", second)
+	}
+	if results[UDP_SCRAPE_BATCH].Seeders != 1 {
+		t.Errorf("Expected the second batch to start counting from one but was %v", results[UDP_SCRAPE_BATCH].Seeders)
+	}
+}
+
+func TestUdpScrapeError(t *testing.T) {
+	tracker := newFakeUdpTracker(t)
+	tracker.failScrape = true
+	tracker.start()
+	defer tracker.conn.Close()
+	client := tracker.client(t)
+	defer client.Close()
+
+	_, err := client.Scrape(context.Background(), testInfoHash)
+	failure, ok := err.(*FailureError)
+	if !ok || failure.Reason != "scrape disabled" {
+		t.Errorf("Expected failure error from tracker but got %v", err)
+	}
+}
+
+func TestUdpContextCancelled(t *testing.T) {
+	conn, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	defer conn.Close()
+	announceUrl, _ := url.Parse("udp://" + conn.LocalAddr().String())
+	client, _ := NewClient(announceUrl)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.Announce(ctx, &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded but got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Announce should have returned when the context expired")
+	}
+}
@@ -0,0 +1,423 @@
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/proxy"
+	"github.com/onepointsixtwo/torrentsgo/websocket"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// WebTorrent trackers speak JSON over a websocket. Binary values such as info hashes are sent as
+// strings with one character per byte.
+
+const (
+	WEBSOCKET_SIGNAL_BUFFER = 32
+)
+
+// Types
+
+// WebSocketClient announces to WebTorrent trackers. A single connection is shared by all
+// torrents and is reopened on the next request after it drops.
+type WebSocketClient struct {
+	announceUrl *url.URL
+	dialer      *websocket.Dialer
+	timeout     time.Duration
+	signals     chan *Signal
+
+	lock    sync.Mutex
+	session *webSocketSession
+	closed  bool
+}
+
+// Signal is an offer from another peer, or an answer to one of our offers, relayed by the tracker
+type Signal struct {
+	InfoHash []byte
+	PeerId   []byte
+	OfferId  []byte
+	Offer    json.RawMessage
+	Answer   json.RawMessage
+}
+
+type webSocketSession struct {
+	conn      *websocket.Conn
+	announces map[string][]chan *webSocketResponse
+	scrapes   []chan *webSocketResponse
+	done      chan struct{}
+	err       error
+}
+
+type webSocketResponse struct {
+	Action         string                         `json:"action"`
+	InfoHash       string                         `json:"info_hash"`
+	PeerId         string                         `json:"peer_id"`
+	OfferId        string                         `json:"offer_id"`
+	Offer          json.RawMessage                `json:"offer"`
+	Answer         json.RawMessage                `json:"answer"`
+	Interval       int                            `json:"interval"`
+	MinInterval    int                            `json:"min interval"`
+	Complete       int                            `json:"complete"`
+	Incomplete     int                            `json:"incomplete"`
+	FailureReason  string                         `json:"failure reason"`
+	WarningMessage string                         `json:"warning message"`
+	Files          map[string]webSocketScrapeFile `json:"files"`
+}
+
+type webSocketScrapeFile struct {
+	Complete   int `json:"complete"`
+	Incomplete int `json:"incomplete"`
+	Downloaded int `json:"downloaded"`
+}
+
+// Initialiser
+
+func NewWebSocketClient(announceUrl *url.URL) (*WebSocketClient, error) {
+	if announceUrl.Scheme != "ws" && announceUrl.Scheme != "wss" {
+		return nil, fmt.Errorf("Unsupported websocket tracker scheme '%v'", announceUrl.Scheme)
+	}
+	return &WebSocketClient{
+		announceUrl: announceUrl,
+		dialer:      &websocket.Dialer{},
+		timeout:     DEFAULT_TIMEOUT,
+		signals:     make(chan *Signal, WEBSOCKET_SIGNAL_BUFFER),
+	}, nil
+}
+
+// Public Methods
+
+func (c *WebSocketClient) AnnounceUrl() *url.URL {
+	return c.announceUrl
+}
+
+func (c *WebSocketClient) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+func (c *WebSocketClient) SetDialer(dialer proxy.Dialer) {
+	c.dialer.NetDial = dialer.DialContext
+}
+
+// Signals delivers offers and answers relayed by the tracker. Signals which arrive while the
+// buffer is full are dropped, as the peer will have given up on them by the time they are read.
+// It is closed when the client is closed.
+func (c *WebSocketClient) Signals() <-chan *Signal {
+	return c.signals
+}
+
+// Announce sends the request along with any offers. WebTorrent trackers never return peers
+// directly, they arrive as Signals instead.
+func (c *WebSocketClient) Announce(ctx context.Context, request *AnnounceRequest) (*AnnounceResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	message := map[string]interface{}{
+		"action":     "announce",
+		"info_hash":  binaryString(request.InfoHash),
+		"peer_id":    binaryString(request.PeerId),
+		"uploaded":   request.Uploaded,
+		"downloaded": request.Downloaded,
+		"left":       request.Left,
+		"numwant":    request.NumWant,
+	}
+	if request.Event != EVENT_NONE {
+		message["event"] = request.Event.String()
+	}
+	if len(request.Offers) > 0 {
+		offers := make([]map[string]interface{}, 0, len(request.Offers))
+		for _, offer := range request.Offers {
+			offers = append(offers, map[string]interface{}{"offer": offer.Offer, "offer_id": binaryString(offer.OfferId)})
+		}
+		message["offers"] = offers
+	}
+
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Trackers don't reliably answer a stopped event, and nothing is done with the answer anyway
+	if request.Event == EVENT_STOPPED {
+		return &AnnounceResponse{}, c.send(session, message)
+	}
+
+	key := string(request.InfoHash)
+	waiter := make(chan *webSocketResponse, 1)
+	c.lock.Lock()
+	session.announces[key] = append(session.announces[key], waiter)
+	c.lock.Unlock()
+
+	response, err := c.await(ctx, session, message, waiter)
+	if err != nil {
+		c.lock.Lock()
+		session.announces[key] = removeWaiter(session.announces[key], waiter)
+		c.lock.Unlock()
+		return nil, err
+	}
+
+	if response.FailureReason != "" {
+		return nil, &FailureError{Reason: response.FailureReason}
+	}
+	return &AnnounceResponse{
+		Interval:    seconds(response.Interval),
+		MinInterval: seconds(response.MinInterval),
+		Seeders:     response.Complete,
+		Leechers:    response.Incomplete,
+		Peers:       []*Peer{},
+		Warning:     response.WarningMessage,
+	}, nil
+}
+
+// SendAnswer answers an offer received on the Signals channel
+func (c *WebSocketClient) SendAnswer(ctx context.Context, peerId []byte, offer *Signal, answer json.RawMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	session, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return c.send(session, map[string]interface{}{
+		"action":     "announce",
+		"info_hash":  binaryString(offer.InfoHash),
+		"peer_id":    binaryString(peerId),
+		"to_peer_id": binaryString(offer.PeerId),
+		"offer_id":   binaryString(offer.OfferId),
+		"answer":     answer,
+	})
+}
+
+func (c *WebSocketClient) Scrape(ctx context.Context, infoHashes ...[]byte) ([]*ScrapeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	hashes := make([]string, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		hashes = append(hashes, binaryString(infoHash))
+	}
+	message := map[string]interface{}{"action": "scrape", "info_hash": hashes}
+
+	session, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	waiter := make(chan *webSocketResponse, 1)
+	c.lock.Lock()
+	session.scrapes = append(session.scrapes, waiter)
+	c.lock.Unlock()
+
+	response, err := c.await(ctx, session, message, waiter)
+	if err != nil {
+		c.lock.Lock()
+		session.scrapes = removeWaiter(session.scrapes, waiter)
+		c.lock.Unlock()
+		return nil, err
+	}
+	if response.FailureReason != "" {
+		return nil, &FailureError{Reason: response.FailureReason}
+	}
+
+	results := make([]*ScrapeResult, 0, len(response.Files))
+	for infoHash, file := range response.Files {
+		hash, err := binaryBytes(infoHash)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, &ScrapeResult{InfoHash: hash, Seeders: file.Complete, Completed: file.Downloaded, Leechers: file.Incomplete})
+	}
+	return results, nil
+}
+
+func (c *WebSocketClient) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.signals)
+	if c.session != nil {
+		return c.session.conn.Close()
+	}
+	return nil
+}
+
+// Connection
+
+// connect returns the open session, dialling a new one if there is none
+func (c *WebSocketClient) connect(ctx context.Context) (*webSocketSession, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil, fmt.Errorf("Tracker client is closed")
+	}
+	if c.session != nil {
+		return c.session, nil
+	}
+
+	conn, err := c.dialer.Dial(ctx, c.announceUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	session := &webSocketSession{conn: conn, announces: make(map[string][]chan *webSocketResponse), done: make(chan struct{})}
+	c.session = session
+	go c.read(session)
+	return session, nil
+}
+
+func (c *WebSocketClient) read(session *webSocketSession) {
+	for {
+		_, data, err := session.conn.ReadMessage()
+		if err != nil {
+			c.lock.Lock()
+			if c.session == session {
+				c.session = nil
+			}
+			session.err = err
+			c.lock.Unlock()
+			session.conn.Close()
+			close(session.done)
+			return
+		}
+
+		response := &webSocketResponse{}
+		if err := json.Unmarshal(data, response); err != nil {
+			continue
+		}
+		c.dispatch(session, response)
+	}
+}
+
+func (c *WebSocketClient) dispatch(session *webSocketSession, response *webSocketResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if response.Offer != nil || response.Answer != nil {
+		signal, err := responseSignal(response)
+		if err != nil || c.closed {
+			return
+		}
+		select {
+		case c.signals <- signal:
+		default:
+		}
+		return
+	}
+
+	if response.Action == "scrape" {
+		if len(session.scrapes) > 0 {
+			session.scrapes[0] <- response
+			session.scrapes = session.scrapes[1:]
+		}
+		return
+	}
+
+	// A failure without an info hash can't be matched to a request, so it fails all of them
+	if response.InfoHash == "" && response.FailureReason != "" {
+		for key, waiters := range session.announces {
+			for _, waiter := range waiters {
+				waiter <- response
+			}
+			delete(session.announces, key)
+		}
+		for _, waiter := range session.scrapes {
+			waiter <- response
+		}
+		session.scrapes = nil
+		return
+	}
+
+	infoHash, err := binaryBytes(response.InfoHash)
+	if err != nil {
+		return
+	}
+	key := string(infoHash)
+	if waiters := session.announces[key]; len(waiters) > 0 {
+		waiters[0] <- response
+		session.announces[key] = waiters[1:]
+	}
+}
+
+func (c *WebSocketClient) await(ctx context.Context, session *webSocketSession, message interface{}, waiter chan *webSocketResponse) (*webSocketResponse, error) {
+	if err := c.send(session, message); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-waiter:
+		return response, nil
+	case <-session.done:
+		select {
+		case response := <-waiter:
+			return response, nil
+		default:
+		}
+		return nil, fmt.Errorf("Tracker connection closed - %v", session.err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *WebSocketClient) send(session *webSocketSession, message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if err := session.conn.WriteMessage(websocket.OPCODE_TEXT, data); err != nil {
+		session.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Helpers
+
+func responseSignal(response *webSocketResponse) (*Signal, error) {
+	infoHash, err := binaryBytes(response.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	peerId, err := binaryBytes(response.PeerId)
+	if err != nil {
+		return nil, err
+	}
+	offerId, err := binaryBytes(response.OfferId)
+	if err != nil {
+		return nil, err
+	}
+	return &Signal{InfoHash: infoHash, PeerId: peerId, OfferId: offerId, Offer: response.Offer, Answer: response.Answer}, nil
+}
+
+func removeWaiter(waiters []chan *webSocketResponse, waiter chan *webSocketResponse) []chan *webSocketResponse {
+	for i, w := range waiters {
+		if w == waiter {
+			return append(waiters[:i], waiters[i+1:]...)
+		}
+	}
+	return waiters
+}
+
+// binaryString encodes each byte as the character with that code point
+func binaryString(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func binaryBytes(value string) ([]byte, error) {
+	data := make([]byte, 0, len(value))
+	for _, r := range value {
+		if r > 0xFF {
+			return nil, fmt.Errorf("Unable to decode binary string - character %q is out of range", r)
+		}
+		data = append(data, byte(r))
+	}
+	return data, nil
+}
@@ -0,0 +1,261 @@
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/onepointsixtwo/torrentsgo/websocket"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebSocketTracker relays offers and answers between the peers connected to it, like a
+// WebTorrent tracker does
+type fakeWebSocketTracker struct {
+	server  *httptest.Server
+	lock    sync.Mutex
+	peers   map[string]*websocket.Conn
+	seeders int
+	failAll bool
+}
+
+func newFakeWebSocketTracker() *fakeWebSocketTracker {
+	tracker := &fakeWebSocketTracker{peers: make(map[string]*websocket.Conn)}
+	tracker.server = httptest.NewServer(http.HandlerFunc(tracker.serve))
+	return tracker
+}
+
+func (tracker *fakeWebSocketTracker) url() *url.URL {
+	u, _ := url.Parse(strings.Replace(tracker.server.URL, "http://", "ws://", 1) + "/announce")
+	return u
+}
+
+func (tracker *fakeWebSocketTracker) serve(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		message := make(map[string]interface{})
+		json.Unmarshal(data, &message)
+		tracker.handle(conn, message)
+	}
+}
+
+func (tracker *fakeWebSocketTracker) handle(conn *websocket.Conn, message map[string]interface{}) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+
+	if tracker.failAll {
+		writeJson(conn, map[string]interface{}{"failure reason": "go away"})
+		return
+	}
+
+	if message["action"] == "scrape" {
+		files := make(map[string]interface{})
+		for _, infoHash := range message["info_hash"].([]interface{}) {
+			files[infoHash.(string)] = map[string]interface{}{"complete": tracker.seeders, "incomplete": 1, "downloaded": 7}
+		}
+		writeJson(conn, map[string]interface{}{"action": "scrape", "files": files})
+		return
+	}
+
+	peerId := message["peer_id"].(string)
+	tracker.peers[peerId] = conn
+
+	if answer, ok := message["answer"]; ok {
+		if to, ok := tracker.peers[message["to_peer_id"].(string)]; ok {
+			writeJson(to, map[string]interface{}{"action": "announce", "info_hash": message["info_hash"], "peer_id": peerId, "offer_id": message["offer_id"], "answer": answer})
+		}
+		return
+	}
+
+	if message["left"] == 0.0 {
+		tracker.seeders++
+	}
+	writeJson(conn, map[string]interface{}{"action": "announce", "info_hash": message["info_hash"], "interval": 120, "complete": tracker.seeders, "incomplete": 0})
+
+	offers, _ := message["offers"].([]interface{})
+	for _, offer := range offers {
+		for otherId, other := range tracker.peers {
+			if otherId == peerId {
+				continue
+			}
+			offer := offer.(map[string]interface{})
+			writeJson(other, map[string]interface{}{"action": "announce", "info_hash": message["info_hash"], "peer_id": peerId, "offer_id": offer["offer_id"], "offer": offer["offer"]})
+		}
+	}
+}
+
+func (tracker *fakeWebSocketTracker) dropConnections() {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	for peerId, conn := range tracker.peers {
+		conn.Close()
+		delete(tracker.peers, peerId)
+	}
+}
+
+func writeJson(conn *websocket.Conn, message interface{}) {
+	data, _ := json.Marshal(message)
+	conn.WriteMessage(websocket.OPCODE_TEXT, data)
+}
+
+func newTestWebSocketClient(t *testing.T, tracker *fakeWebSocketTracker) *WebSocketClient {
+	client, err := NewWebSocketClient(tracker.url())
+	if err != nil {
+		t.Fatalf("Unable to create client %v", err)
+	}
+	client.SetTimeout(5 * time.Second)
+	return client
+}
+
+func receiveSignal(t *testing.T, client *WebSocketClient) *Signal {
+	select {
+	case signal := <-client.Signals():
+		return signal
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for signal")
+		return nil
+	}
+}
+
+func TestWebSocketAnnounceRelaysOffersAndAnswers(t *testing.T) {
+	tracker := newFakeWebSocketTracker()
+	defer tracker.server.Close()
+
+	// Hashes outside ASCII check that binary strings survive the round trip
+	infoHash := []byte("\xff\x00\x80aaaaaaaaaaaaaaaaa")
+	seederId := []byte("-GT0001-seeder\xfe\xfe\xfe\xfe\xfe\xfe")
+	leecherId := []byte("-WW0001-leecher00000")
+
+	seeder := newTestWebSocketClient(t, tracker)
+	defer seeder.Close()
+	leecher := newTestWebSocketClient(t, tracker)
+	defer leecher.Close()
+
+	response, err := seeder.Announce(context.Background(), &AnnounceRequest{InfoHash: infoHash, PeerId: seederId, Event: EVENT_STARTED, NumWant: 5})
+	if err != nil {
+		t.Fatalf("Unexpected error announcing %v", err)
+	}
+	if response.Interval != 2*time.Minute || response.Seeders != 1 {
+		t.Errorf("Unexpected announce response %+v", response)
+	}
+
+	offer := &Offer{OfferId: []byte("offer-\x01\x02"), Offer: json.RawMessage(`{"type":"offer","sdp":"v=0"}`)}
+	request := &AnnounceRequest{InfoHash: infoHash, PeerId: leecherId, Left: 100, Event: EVENT_STARTED, NumWant: 1, Offers: []*Offer{offer}}
+	if _, err := leecher.Announce(context.Background(), request); err != nil {
+		t.Fatalf("Unexpected error announcing %v", err)
+	}
+
+	received := receiveSignal(t, seeder)
+	if !bytes.Equal(received.InfoHash, infoHash) || !bytes.Equal(received.PeerId, leecherId) || !bytes.Equal(received.OfferId, offer.OfferId) {
+		t.Errorf("Unexpected offer signal %+v", received)
+	}
+	if string(received.Offer) != `{"sdp":"v=0","type":"offer"}` || received.Answer != nil {
+		t.Errorf("Unexpected offer payload %s", received.Offer)
+	}
+
+	if err := seeder.SendAnswer(context.Background(), seederId, received, json.RawMessage(`{"type":"answer"}`)); err != nil {
+		t.Fatalf("Unexpected error answering %v", err)
+	}
+	answer := receiveSignal(t, leecher)
+	if !bytes.Equal(answer.PeerId, seederId) || !bytes.Equal(answer.OfferId, offer.OfferId) || string(answer.Answer) != `{"type":"answer"}` {
+		t.Errorf("Unexpected answer signal %+v", answer)
+	}
+}
+
+func TestWebSocketScrape(t *testing.T) {
+	tracker := newFakeWebSocketTracker()
+	defer tracker.server.Close()
+	tracker.seeders = 4
+
+	client := newTestWebSocketClient(t, tracker)
+	defer client.Close()
+
+	results, err := client.Scrape(context.Background(), testInfoHash, testInfoHash2)
+	if err != nil {
+		t.Fatalf("Unexpected error scraping %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("Expected two results but got %v", len(results))
+	}
+	for _, result := range results {
+		if result.Seeders != 4 || result.Leechers != 1 || result.Completed != 7 {
+			t.Errorf("Unexpected scrape result %+v", result)
+		}
+	}
+}
+
+func TestWebSocketFailure(t *testing.T) {
+	tracker := newFakeWebSocketTracker()
+	defer tracker.server.Close()
+	tracker.failAll = true
+
+	client := newTestWebSocketClient(t, tracker)
+	defer client.Close()
+
+	_, err := client.Announce(context.Background(), &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId})
+	failure, ok := err.(*FailureError)
+	if !ok || failure.Reason != "go away" {
+		t.Errorf("Expected failure error but got %v", err)
+	}
+}
+
+func TestWebSocketReconnects(t *testing.T) {
+	tracker := newFakeWebSocketTracker()
+	defer tracker.server.Close()
+
+	client := newTestWebSocketClient(t, tracker)
+	defer client.Close()
+
+	request := &AnnounceRequest{InfoHash: testInfoHash, PeerId: testPeerId}
+	if _, err := client.Announce(context.Background(), request); err != nil {
+		t.Fatalf("Unexpected error announcing %v", err)
+	}
+
+	client.lock.Lock()
+	session := client.session
+	client.lock.Unlock()
+	tracker.dropConnections()
+	<-session.done
+
+	if _, err := client.Announce(context.Background(), request); err != nil {
+		t.Errorf("Expected announce to reconnect but got %v", err)
+	}
+}
+
+func TestNewAnnouncer(t *testing.T) {
+	for rawUrl, expectWebSocket := range map[string]bool{"wss://tracker.example/": true, "ws://tracker.example/": true, "udp://tracker.example:80": false, "http://tracker.example/announce": false} {
+		announceUrl, _ := url.Parse(rawUrl)
+		announcer, err := NewAnnouncer(announceUrl)
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %v", rawUrl, err)
+		}
+		if _, ok := announcer.(*WebSocketClient); ok != expectWebSocket {
+			t.Errorf("Unexpected announcer type %T for %v", announcer, rawUrl)
+		}
+	}
+}
+
+func TestBinaryString(t *testing.T) {
+	data := []byte{0, 0x7f, 0x80, 0xff}
+	decoded, err := binaryBytes(binaryString(data))
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Errorf("Binary string did not round trip %v %v", decoded, err)
+	}
+	if _, err := binaryBytes("Ā"); err == nil {
+		t.Errorf("Expected error decoding character outside byte range")
+	}
+}
@@ -0,0 +1,105 @@
+package utp
+
+import (
+	"time"
+)
+
+const (
+	// LEDBAT aims to add no more than this much queuing delay to the path
+	TARGET_DELAY = 100 * time.Millisecond
+	// Most the window grows by in a round trip with no queuing delay
+	MAX_WINDOW_INCREASE = 3000
+	// The lowest delay seen in this long is taken as the delay with empty queues
+	BASE_DELAY_WINDOW = 2 * time.Minute
+	// Timeouts before any round trip has been measured, and the least they can be after
+	INITIAL_TIMEOUT = time.Second
+	MIN_TIMEOUT     = 500 * time.Millisecond
+)
+
+// Types
+
+// delayHistory tracks the lowest one way delay seen recently. Delays are measured between two
+// clocks which aren't in step, so only their differences from this base mean anything. It isn't
+// safe for concurrent use.
+type delayHistory struct {
+	// current and previous are the lowest delays in this and the last half of BASE_DELAY_WINDOW
+	current  uint32
+	previous uint32
+	samples  int
+	rotated  time.Time
+}
+
+// rttEstimator keeps a smoothed round trip time and its variance to set the retransmission
+// timeout, as TCP does (RFC 6298). It isn't safe for concurrent use.
+type rttEstimator struct {
+	rtt      time.Duration
+	variance time.Duration
+	measured bool
+}
+
+// Public Methods
+
+func (h *delayHistory) add(delay uint32, now time.Time) {
+	if h.samples == 0 {
+		h.current, h.previous, h.rotated = delay, delay, now
+	} else if now.Sub(h.rotated) >= BASE_DELAY_WINDOW/2 {
+		h.previous, h.current, h.rotated = h.current, delay, now
+	} else if delay < h.current {
+		h.current = delay
+	}
+	h.samples++
+}
+
+// queuing returns how far delay is above the base delay
+func (h *delayHistory) queuing(delay uint32) time.Duration {
+	base := h.current
+	if h.previous < base {
+		base = h.previous
+	}
+	if delay < base {
+		return 0
+	}
+	return time.Duration(delay-base) * time.Microsecond
+}
+
+// ledbatWindow returns the congestion window after bytesAcked more bytes were acknowledged with
+// the given queuing delay (RFC 6817). The window grows while the delay is under TARGET_DELAY and
+// shrinks once it is over.
+func ledbatWindow(window int, bytesAcked int, delay time.Duration) int {
+	offTarget := float64(TARGET_DELAY-delay) / float64(TARGET_DELAY)
+	windowFactor := float64(bytesAcked) / float64(window)
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	window += int(MAX_WINDOW_INCREASE * offTarget * windowFactor)
+	if window < MIN_WINDOW {
+		return MIN_WINDOW
+	}
+	if window > MAX_WINDOW {
+		return MAX_WINDOW
+	}
+	return window
+}
+
+func (e *rttEstimator) add(sample time.Duration) {
+	if !e.measured {
+		e.rtt, e.variance, e.measured = sample, sample/2, true
+		return
+	}
+	delta := e.rtt - sample
+	if delta < 0 {
+		delta = -delta
+	}
+	e.variance += (delta - e.variance) / 4
+	e.rtt += (sample - e.rtt) / 8
+}
+
+func (e *rttEstimator) timeout() time.Duration {
+	if !e.measured {
+		return INITIAL_TIMEOUT
+	}
+	if timeout := e.rtt + 4*e.variance; timeout > MIN_TIMEOUT {
+		return timeout
+	}
+	return MIN_TIMEOUT
+}
@@ -0,0 +1,66 @@
+package utp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLedbatWindowFollowsQueuingDelay(t *testing.T) {
+	window := 50000
+	if grown := ledbatWindow(window, window, 0); grown != window+MAX_WINDOW_INCREASE {
+		t.Errorf("Expected the window to grow by %v with no delay but got %v", MAX_WINDOW_INCREASE, grown-window)
+	}
+	if grown := ledbatWindow(window, window/2, TARGET_DELAY/2); grown != window+MAX_WINDOW_INCREASE/4 {
+		t.Errorf("Expected the window to grow in proportion to bytes acked and delay but got %v", grown-window)
+	}
+	if same := ledbatWindow(window, window, TARGET_DELAY); same != window {
+		t.Errorf("Expected the window to stay put at the target delay but got %v", same)
+	}
+	if shrunk := ledbatWindow(window, window, 2*TARGET_DELAY); shrunk != window-MAX_WINDOW_INCREASE {
+		t.Errorf("Expected the window to shrink over the target delay but got %v", shrunk)
+	}
+	if least := ledbatWindow(MIN_WINDOW, MIN_WINDOW, 10*TARGET_DELAY); least != MIN_WINDOW {
+		t.Errorf("Expected the window to stop at %v but got %v", MIN_WINDOW, least)
+	}
+	if most := ledbatWindow(MAX_WINDOW, MAX_WINDOW, 0); most != MAX_WINDOW {
+		t.Errorf("Expected the window to stop at %v but got %v", MAX_WINDOW, most)
+	}
+}
+
+func TestDelayHistoryTracksBaseDelay(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := delayHistory{}
+	h.add(5000, now)
+	h.add(3000, now.Add(time.Second))
+	h.add(9000, now.Add(2*time.Second))
+	if queuing := h.queuing(9000); queuing != 6*time.Millisecond {
+		t.Errorf("Expected 6ms of queuing but got %v", queuing)
+	}
+	if queuing := h.queuing(1000); queuing != 0 {
+		t.Errorf("Expected no queuing below the base delay but got %v", queuing)
+	}
+
+	// The base is forgotten after a whole window, so a route change doesn't leave it too low
+	h.add(8000, now.Add(BASE_DELAY_WINDOW/2))
+	h.add(8000, now.Add(BASE_DELAY_WINDOW))
+	if queuing := h.queuing(9000); queuing != time.Millisecond {
+		t.Errorf("Expected 1ms of queuing after the base delay changed but got %v", queuing)
+	}
+}
+
+func TestRttEstimatorTimeout(t *testing.T) {
+	e := rttEstimator{}
+	if timeout := e.timeout(); timeout != INITIAL_TIMEOUT {
+		t.Errorf("Expected %v before any samples but got %v", INITIAL_TIMEOUT, timeout)
+	}
+	e.add(400 * time.Millisecond)
+	if timeout := e.timeout(); timeout != 1200*time.Millisecond {
+		t.Errorf("Expected the rtt plus four times its variance but got %v", timeout)
+	}
+	for i := 0; i < 50; i++ {
+		e.add(10 * time.Millisecond)
+	}
+	if timeout := e.timeout(); timeout != MIN_TIMEOUT {
+		t.Errorf("Expected %v for short round trips but got %v", MIN_TIMEOUT, timeout)
+	}
+}
@@ -0,0 +1,616 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Packets are kept under this size so they aren't fragmented
+	PACKET_SIZE = 1400
+	// Most data in one packet, leaving room for the header and selective acks
+	MAX_PAYLOAD = 1300
+	// Congestion window bounds, in bytes of packets in flight
+	MIN_WINDOW     = PACKET_SIZE
+	INITIAL_WINDOW = 10 * PACKET_SIZE
+	MAX_WINDOW     = RECEIVE_BUFFER
+	// Most bytes received but not yet read which are buffered, which is the window we advertise
+	RECEIVE_BUFFER = 1024 * 1024
+	// Most packets in flight, and so the furthest ahead of the next expected packet that
+	// out of order packets are kept
+	MAX_OUTSTANDING_PACKETS = 256
+	// A packet is resent without waiting for a timeout once this many later packets have arrived
+	FAST_RESEND_THRESHOLD = 3
+	// Connections fail after this many timeouts in a row, each twice as long as the last
+	MAX_TIMEOUTS     = 6
+	MAX_SYN_TIMEOUTS = 3
+)
+
+// Connection states
+const (
+	CONN_SYN_SENT = iota
+	CONN_CONNECTED
+	CONN_CLOSED
+)
+
+var (
+	ErrTimeout = errors.New("uTP connection timed out")
+	ErrReset   = errors.New("uTP connection reset by peer")
+)
+
+// Types
+
+// Conn is a uTP connection (BEP 29). It is reliable and ordered like TCP, but backs off when it
+// sees queuing delay rising (LEDBAT), so it gives way to other traffic on the link.
+type Conn struct {
+	socket *Socket
+	remote *net.UDPAddr
+	// recvId is the id of packets sent to us, and sendId the id of packets we send
+	recvId uint16
+	sendId uint16
+
+	lock  sync.Mutex
+	state int
+	// err is why the connection failed, or net.ErrClosed once it has been closed
+	err    error
+	closed bool
+	// changed is closed and replaced whenever something a blocked Read, Write or Dial waits for
+	// happens
+	changed chan struct{}
+
+	// Sending. seqNr is the sequence number of our next packet.
+	seqNr      uint16
+	outgoing   []*outgoingPacket
+	window     int
+	peerWindow int
+	rtt        rttEstimator
+	delays     delayHistory
+	timeoutAt  time.Time
+	timeouts   int
+	// duplicateAcks counts acks in a row which didn't move the ack number on
+	duplicateAcks int
+	lastAckNr     uint16
+	lastDecrease  time.Time
+
+	// Receiving. ackNr is the sequence number of the last packet received in order.
+	ackNr      uint16
+	received   []byte
+	outOfOrder map[uint16]*packet
+	// replyDelay is the one way delay of the last packet received, which is sent back so the
+	// other end can measure its queuing delay
+	replyDelay uint32
+	// advertised is the receive window we last told the other end about
+	advertised    int
+	eof           bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+type outgoingPacket struct {
+	typ     byte
+	seqNr   uint16
+	payload []byte
+	sentAt  time.Time
+	// transmissions is how many times the packet has been sent. Round trips are only measured
+	// from packets sent once, as it isn't known which copy an ack is for.
+	transmissions int
+	// resend is set for packets which were lost and haven't been sent again yet
+	resend bool
+	acked  bool
+}
+
+// Initialiser
+
+func newConn(socket *Socket, remote *net.UDPAddr, recvId uint16, sendId uint16) *Conn {
+	return &Conn{
+		socket:     socket,
+		remote:     remote,
+		recvId:     recvId,
+		sendId:     sendId,
+		changed:    make(chan struct{}),
+		window:     INITIAL_WINDOW,
+		peerWindow: RECEIVE_BUFFER,
+		outOfOrder: make(map[uint16]*packet),
+	}
+}
+
+// Public Methods
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for {
+		if c.closed {
+			return 0, net.ErrClosed
+		}
+		if len(c.received) > 0 {
+			n := copy(b, c.received)
+			c.received = c.received[n:]
+			if c.advertised < RECEIVE_BUFFER/2 && c.state == CONN_CONNECTED {
+				// Let the other end know the window has opened up again
+				c.sendState()
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if err := c.wait(c.readDeadline, nil); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write returns once all of b has been sent, which waits for the congestion window to have room.
+// The data isn't known to have arrived until later.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	written := 0
+	for written < len(b) {
+		if c.closed {
+			return written, net.ErrClosed
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		size := len(b) - written
+		if size > MAX_PAYLOAD {
+			size = MAX_PAYLOAD
+		}
+		if c.state == CONN_CONNECTED && c.canSend(size) {
+			payload := append([]byte(nil), b[written:written+size]...)
+			c.queue(ST_DATA, payload)
+			written += size
+			continue
+		}
+		if err := c.wait(c.writeDeadline, nil); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close sends a FIN after any data written, and returns without waiting for it to be acknowledged.
+// The connection stays open in the background until it is, or times out.
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.err != nil || c.state != CONN_CONNECTED {
+		c.destroy(net.ErrClosed)
+		return nil
+	}
+	c.queue(ST_FIN, nil)
+	c.signal()
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.signal()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.readDeadline = t
+	c.signal()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.writeDeadline = t
+	c.signal()
+	return nil
+}
+
+// Helpers
+
+// connect sends the SYN which opens an outgoing connection
+func (c *Conn) connect() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.state = CONN_SYN_SENT
+	c.seqNr = 1
+	c.queue(ST_SYN, nil)
+}
+
+// accept answers the SYN which opened an incoming connection
+func (c *Conn) accept(syn *packet, seqNr uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.state = CONN_CONNECTED
+	c.seqNr = seqNr
+	c.ackNr = syn.seqNr
+	c.handleTimestamps(syn, c.socket.now())
+	c.sendState()
+}
+
+// waitConnected waits for the answer to our SYN
+func (c *Conn) waitConnected(done <-chan struct{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.state == CONN_SYN_SENT && c.err == nil {
+		if err := c.wait(time.Time{}, done); err != nil {
+			return err
+		}
+	}
+	return c.err
+}
+
+// handle processes a packet sent to the connection
+func (c *Conn) handle(p *packet) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == CONN_CLOSED {
+		return
+	}
+	now := c.socket.now()
+	if p.typ == ST_RESET {
+		c.destroy(ErrReset)
+		return
+	}
+	if p.typ == ST_SYN {
+		// Our answer was lost, so the SYN was sent again
+		c.sendState()
+		return
+	}
+	c.handleTimestamps(p, now)
+	c.peerWindow = int(p.windowSize)
+
+	if c.state == CONN_SYN_SENT {
+		if p.typ != ST_STATE || p.ackNr != 1 {
+			return
+		}
+		c.state = CONN_CONNECTED
+		// The other end's first data packet has the sequence number of its answer
+		c.ackNr = p.seqNr - 1
+	}
+	c.handleAck(p, now)
+
+	if p.typ == ST_DATA || p.typ == ST_FIN {
+		c.receive(p)
+		c.sendState()
+	}
+	c.flush(now)
+	c.signal()
+
+	// Once both ends have finished and everything is acknowledged there is nothing left to do
+	if c.closed && len(c.outgoing) == 0 {
+		c.destroy(net.ErrClosed)
+	}
+}
+
+func (c *Conn) handleTimestamps(p *packet, now time.Time) {
+	c.replyDelay = timestamp(now) - p.timestamp
+	if p.timestampDiff != 0 {
+		c.delays.add(p.timestampDiff, now)
+	}
+}
+
+// handleAck removes the packets the other end has acknowledged, adjusting the congestion window,
+// and resends packets which later packets have overtaken
+func (c *Conn) handleAck(p *packet, now time.Time) {
+	bytesAcked := 0
+	ackedNew := false
+	// advanced is set when the ack number moves on, rather than only selective acks arriving
+	advanced := false
+	for _, o := range c.outgoing {
+		if o.acked {
+			continue
+		}
+		cumulative := !seqBefore(p.ackNr, o.seqNr)
+		if cumulative || selectivelyAcked(p, o.seqNr) {
+			o.acked = true
+			ackedNew = true
+			advanced = advanced || cumulative
+			if !o.resend {
+				bytesAcked += len(o.payload) + HEADER_LENGTH
+			}
+			if o.transmissions == 1 {
+				c.rtt.add(now.Sub(o.sentAt))
+			}
+		}
+	}
+	remaining := c.outgoing[:0]
+	for _, o := range c.outgoing {
+		if !o.acked {
+			remaining = append(remaining, o)
+		}
+	}
+	c.outgoing = remaining
+
+	// Like libutp, a packet counts as lost once the selective acks show enough later packets have
+	// arrived, including those acked before this ack
+	for _, o := range c.outgoing {
+		if !o.resend && o.transmissions == 1 && selectiveAcksAfter(p, o.seqNr) >= FAST_RESEND_THRESHOLD {
+			c.lost(o, now)
+		}
+	}
+
+	if ackedNew {
+		c.timeouts = 0
+		c.timeoutAt = now.Add(c.rtt.timeout())
+		c.window = ledbatWindow(c.window, bytesAcked, c.delays.queuing(p.timestampDiff))
+	}
+	if advanced {
+		c.duplicateAcks = 0
+	} else if len(c.outgoing) > 0 && p.ackNr == c.lastAckNr && p.typ == ST_STATE {
+		c.duplicateAcks++
+		if c.duplicateAcks == FAST_RESEND_THRESHOLD && !c.outgoing[0].resend {
+			c.lost(c.outgoing[0], now)
+		}
+	}
+	c.lastAckNr = p.ackNr
+}
+
+// lost marks a packet to be sent again, halving the window at most once a round trip
+func (c *Conn) lost(o *outgoingPacket, now time.Time) {
+	o.resend = true
+	if now.Sub(c.lastDecrease) >= c.rtt.rtt {
+		c.window /= 2
+		if c.window < MIN_WINDOW {
+			c.window = MIN_WINDOW
+		}
+		c.lastDecrease = now
+	}
+}
+
+// receive adds a data or FIN packet to what can be read, keeping those which arrive early until
+// the packets before them do
+func (c *Conn) receive(p *packet) {
+	if !seqBefore(c.ackNr, p.seqNr) || int(p.seqNr-c.ackNr) > MAX_OUTSTANDING_PACKETS || c.eof {
+		return
+	}
+	if len(c.received)+len(p.payload) > RECEIVE_BUFFER {
+		// Dropped without an ack, so it is sent again once we have room
+		return
+	}
+	c.outOfOrder[p.seqNr] = p
+	for {
+		next, ok := c.outOfOrder[c.ackNr+1]
+		if !ok {
+			return
+		}
+		delete(c.outOfOrder, c.ackNr+1)
+		c.ackNr++
+		if next.typ == ST_FIN {
+			c.eof = true
+			c.outOfOrder = make(map[uint16]*packet)
+			return
+		}
+		if !c.closed {
+			c.received = append(c.received, next.payload...)
+		}
+	}
+}
+
+// tick resends packets which have gone unacknowledged for too long, failing the connection after
+// too many timeouts in a row
+func (c *Conn) tick(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.state == CONN_CLOSED || len(c.outgoing) == 0 || now.Before(c.timeoutAt) {
+		return
+	}
+	c.timeouts++
+	limit := MAX_TIMEOUTS
+	if c.state == CONN_SYN_SENT {
+		limit = MAX_SYN_TIMEOUTS
+	}
+	if c.timeouts >= limit {
+		c.destroy(ErrTimeout)
+		return
+	}
+	for _, o := range c.outgoing {
+		o.resend = true
+	}
+	c.window = MIN_WINDOW
+	c.lastDecrease = now
+	c.timeoutAt = now.Add(c.rtt.timeout() << uint(c.timeouts))
+	c.flush(now)
+}
+
+// canSend reports whether a packet with size bytes of payload fits in the window. One packet may
+// always be in flight, so a small window can't stall the connection.
+func (c *Conn) canSend(size int) bool {
+	if len(c.outgoing) >= MAX_OUTSTANDING_PACKETS {
+		return false
+	}
+	inFlight := c.inFlight()
+	window := c.window
+	if c.peerWindow < window {
+		window = c.peerWindow
+	}
+	return inFlight == 0 || inFlight+size+HEADER_LENGTH <= window
+}
+
+func (c *Conn) inFlight() int {
+	bytes := 0
+	for _, o := range c.outgoing {
+		if !o.resend {
+			bytes += len(o.payload) + HEADER_LENGTH
+		}
+	}
+	return bytes
+}
+
+// queue sends a packet which takes a sequence number, keeping it until it is acknowledged
+func (c *Conn) queue(typ byte, payload []byte) {
+	o := &outgoingPacket{typ: typ, seqNr: c.seqNr, payload: payload}
+	c.seqNr++
+	if len(c.outgoing) == 0 {
+		c.timeoutAt = c.socket.now().Add(c.rtt.timeout())
+	}
+	c.outgoing = append(c.outgoing, o)
+	c.transmit(o, c.socket.now())
+}
+
+// flush resends lost packets as the window allows
+func (c *Conn) flush(now time.Time) {
+	for _, o := range c.outgoing {
+		if o.resend {
+			if !c.canSend(len(o.payload)) {
+				return
+			}
+			o.resend = false
+			c.transmit(o, now)
+		}
+	}
+}
+
+func (c *Conn) transmit(o *outgoingPacket, now time.Time) {
+	o.sentAt = now
+	o.transmissions++
+	p := c.header(o.typ, now)
+	p.seqNr = o.seqNr
+	p.payload = o.payload
+	if o.typ == ST_SYN {
+		p.connId = c.recvId
+	}
+	c.socket.send(p, c.remote)
+}
+
+// sendState acknowledges what we have received
+func (c *Conn) sendState() {
+	c.socket.send(c.header(ST_STATE, c.socket.now()), c.remote)
+}
+
+func (c *Conn) header(typ byte, now time.Time) *packet {
+	window := RECEIVE_BUFFER - len(c.received)
+	if window < 0 {
+		window = 0
+	}
+	c.advertised = window
+	return &packet{
+		typ:           typ,
+		connId:        c.sendId,
+		timestamp:     timestamp(now),
+		timestampDiff: c.replyDelay,
+		windowSize:    uint32(window),
+		seqNr:         c.seqNr,
+		ackNr:         c.ackNr,
+		selectiveAcks: c.selectiveAcks(),
+	}
+}
+
+// selectiveAcks returns the bitmask of out of order packets received, or nil if there are none
+func (c *Conn) selectiveAcks() []byte {
+	if len(c.outOfOrder) == 0 {
+		return nil
+	}
+	highest := 0
+	for seqNr := range c.outOfOrder {
+		if offset := int(seqNr - c.ackNr - 2); offset > highest {
+			highest = offset
+		}
+	}
+	mask := make([]byte, (highest/32+1)*4)
+	for seqNr := range c.outOfOrder {
+		offset := int(seqNr - c.ackNr - 2)
+		mask[offset/8] |= 1 << uint(offset%8)
+	}
+	return mask
+}
+
+// destroy ends the connection, waking anything waiting on it and forgetting it in the socket
+func (c *Conn) destroy(err error) {
+	if c.state == CONN_CLOSED {
+		return
+	}
+	c.state = CONN_CLOSED
+	if c.err == nil {
+		c.err = err
+	}
+	c.outgoing = nil
+	c.socket.remove(c)
+	c.signal()
+}
+
+// abort ends the connection at once, without telling the other end
+func (c *Conn) abort(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+	c.destroy(err)
+}
+
+func (c *Conn) signal() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases the lock until the connection changes, deadline passes or done is closed. It
+// must be called with the lock held.
+func (c *Conn) wait(deadline time.Time, done <-chan struct{}) error {
+	changed := c.changed
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		if !time.Now().Before(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	c.lock.Unlock()
+	defer c.lock.Lock()
+	select {
+	case <-changed:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-done:
+		return ErrTimeout
+	}
+}
+
+// selectivelyAcked reports whether the packet's selective acks include seqNr
+func selectivelyAcked(p *packet, seqNr uint16) bool {
+	offset := int(seqNr - p.ackNr - 2)
+	if offset < 0 || offset >= len(p.selectiveAcks)*8 {
+		return false
+	}
+	return p.selectiveAcks[offset/8]&(1<<uint(offset%8)) != 0
+}
+
+// selectiveAcksAfter counts the packets after seqNr which an ack's selective acks say arrived
+func selectiveAcksAfter(p *packet, seqNr uint16) int {
+	count := 0
+	for offset := 0; offset < len(p.selectiveAcks)*8; offset++ {
+		acked := p.selectiveAcks[offset/8]&(1<<uint(offset%8)) != 0
+		if acked && seqBefore(seqNr, p.ackNr+2+uint16(offset)) {
+			count++
+		}
+	}
+	return count
+}
+
+func timestamp(now time.Time) uint32 {
+	return uint32(now.UnixNano() / int64(time.Microsecond))
+}
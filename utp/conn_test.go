@@ -0,0 +1,31 @@
+package utp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSingleLossIsResentWithoutTimeout(t *testing.T) {
+	c := newConn(nil, nil, 1, 2)
+	c.state = CONN_CONNECTED
+	now := time.Now()
+	for seqNr := uint16(10); seqNr < 18; seqNr++ {
+		c.outgoing = append(c.outgoing, &outgoingPacket{typ: ST_DATA, seqNr: seqNr, payload: []byte("data"), sentAt: now, transmissions: 1})
+	}
+	lost := c.outgoing[0]
+
+	// Packet 10 is lost, and each later packet is selectively acked as it arrives
+	sacks := make([]byte, 4)
+	for seqNr := uint16(11); seqNr < 18; seqNr++ {
+		offset := seqNr - 11
+		sacks[offset/8] |= 1 << (offset % 8)
+		c.handleAck(&packet{typ: ST_STATE, ackNr: 9, selectiveAcks: append([]byte{}, sacks...)}, now)
+
+		if arrived := int(seqNr - 10); lost.resend != (arrived >= FAST_RESEND_THRESHOLD) {
+			t.Fatalf("Expected the lost packet to be resent only once %v later packets arrived, but resend was %v after %v", FAST_RESEND_THRESHOLD, lost.resend, arrived)
+		}
+	}
+	if len(c.outgoing) != 1 || c.outgoing[0] != lost {
+		t.Errorf("Expected only the lost packet to be outstanding but %v are", len(c.outgoing))
+	}
+}
@@ -0,0 +1,109 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Packet types
+const (
+	ST_DATA  = 0
+	ST_FIN   = 1
+	ST_STATE = 2
+	ST_RESET = 3
+	ST_SYN   = 4
+)
+
+const (
+	VERSION       = 1
+	HEADER_LENGTH = 20
+	// Extension types
+	EXTENSION_NONE           = 0
+	EXTENSION_SELECTIVE_ACKS = 1
+)
+
+// Types
+
+// packet is a uTP packet (BEP 29). Timestamps are in microseconds.
+type packet struct {
+	typ           byte
+	connId        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	windowSize    uint32
+	seqNr         uint16
+	ackNr         uint16
+	// selectiveAcks is a bitmask of received packets past ackNr + 1, the first bit being ackNr + 2.
+	// Its length is a multiple of four.
+	selectiveAcks []byte
+	payload       []byte
+}
+
+var ErrInvalidPacket = errors.New("Invalid uTP packet")
+
+// Public Methods
+
+func (p *packet) encode() []byte {
+	length := HEADER_LENGTH + len(p.payload)
+	if len(p.selectiveAcks) > 0 {
+		length += 2 + len(p.selectiveAcks)
+	}
+	data := make([]byte, HEADER_LENGTH, length)
+	data[0] = p.typ<<4 | VERSION
+	if len(p.selectiveAcks) > 0 {
+		data[1] = EXTENSION_SELECTIVE_ACKS
+	}
+	binary.BigEndian.PutUint16(data[2:], p.connId)
+	binary.BigEndian.PutUint32(data[4:], p.timestamp)
+	binary.BigEndian.PutUint32(data[8:], p.timestampDiff)
+	binary.BigEndian.PutUint32(data[12:], p.windowSize)
+	binary.BigEndian.PutUint16(data[16:], p.seqNr)
+	binary.BigEndian.PutUint16(data[18:], p.ackNr)
+	if len(p.selectiveAcks) > 0 {
+		data = append(data, EXTENSION_NONE, byte(len(p.selectiveAcks)))
+		data = append(data, p.selectiveAcks...)
+	}
+	return append(data, p.payload...)
+}
+
+// parsePacket reads a packet, skipping extensions other than selective acks
+func parsePacket(data []byte) (*packet, error) {
+	if len(data) < HEADER_LENGTH || data[0]&0x0f != VERSION || data[0]>>4 > ST_SYN {
+		return nil, ErrInvalidPacket
+	}
+	p := &packet{
+		typ:           data[0] >> 4,
+		connId:        binary.BigEndian.Uint16(data[2:]),
+		timestamp:     binary.BigEndian.Uint32(data[4:]),
+		timestampDiff: binary.BigEndian.Uint32(data[8:]),
+		windowSize:    binary.BigEndian.Uint32(data[12:]),
+		seqNr:         binary.BigEndian.Uint16(data[16:]),
+		ackNr:         binary.BigEndian.Uint16(data[18:]),
+	}
+
+	extension := data[1]
+	data = data[HEADER_LENGTH:]
+	for extension != EXTENSION_NONE {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, ErrInvalidPacket
+		}
+		next, length := data[0], int(data[1])
+		if extension == EXTENSION_SELECTIVE_ACKS {
+			if length == 0 || length%4 != 0 {
+				return nil, ErrInvalidPacket
+			}
+			p.selectiveAcks = data[2 : 2+length]
+		}
+		extension = next
+		data = data[2+length:]
+	}
+	p.payload = data
+	return p, nil
+}
+
+// Helpers
+
+// seqBefore reports whether sequence number a comes before b, allowing for wrapping
+func seqBefore(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
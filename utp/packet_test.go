@@ -0,0 +1,69 @@
+package utp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := map[string]*packet{
+		"data":           {typ: ST_DATA, connId: 1234, timestamp: 5000, timestampDiff: 200, windowSize: 65536, seqNr: 10, ackNr: 65535, payload: []byte("hello")},
+		"selective acks": {typ: ST_STATE, connId: 1, seqNr: 3, ackNr: 7, selectiveAcks: []byte{0x05, 0, 0, 0x80}},
+		"syn":            {typ: ST_SYN, connId: 65535, seqNr: 1},
+	}
+
+	for name, p := range tests {
+		parsed, err := parsePacket(p.encode())
+		if err != nil {
+			t.Errorf("%v: Unexpected error %v", name, err)
+			continue
+		}
+		if len(p.payload) == 0 {
+			parsed.payload = nil
+		}
+		if !reflect.DeepEqual(parsed, p) {
+			t.Errorf("%v: Expected %+v but got %+v", name, p, parsed)
+		}
+	}
+}
+
+func TestParsePacketSkipsUnknownExtensions(t *testing.T) {
+	data := (&packet{typ: ST_DATA, connId: 9, seqNr: 2}).encode()
+	data[1] = 2
+	data = append(data, EXTENSION_SELECTIVE_ACKS, 3, 'a', 'b', 'c', EXTENSION_NONE, 4, 4, 0, 0, 1, 'x')
+
+	p, err := parsePacket(data)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if !bytes.Equal(p.selectiveAcks, []byte{4, 0, 0, 1}) || string(p.payload) != "x" {
+		t.Errorf("Unexpected selective acks %v or payload %q", p.selectiveAcks, p.payload)
+	}
+}
+
+func TestParseInvalidPackets(t *testing.T) {
+	valid := (&packet{typ: ST_STATE}).encode()
+	tests := map[string][]byte{
+		"short":              valid[:HEADER_LENGTH-1],
+		"wrong version":      append([]byte{ST_STATE<<4 | 2}, valid[1:]...),
+		"unknown type":       append([]byte{7<<4 | VERSION}, valid[1:]...),
+		"truncated ext":      append(append([]byte{valid[0], EXTENSION_SELECTIVE_ACKS}, valid[2:]...), EXTENSION_NONE, 4, 0),
+		"odd selective acks": append(append([]byte{valid[0], EXTENSION_SELECTIVE_ACKS}, valid[2:]...), EXTENSION_NONE, 3, 0, 0, 0),
+	}
+
+	for name, data := range tests {
+		if _, err := parsePacket(data); err != ErrInvalidPacket {
+			t.Errorf("%v: Expected ErrInvalidPacket but got %v", name, err)
+		}
+	}
+}
+
+func TestSeqBeforeWraps(t *testing.T) {
+	if !seqBefore(1, 2) || seqBefore(2, 1) || seqBefore(5, 5) {
+		t.Error("Unexpected ordering of nearby sequence numbers")
+	}
+	if !seqBefore(65535, 0) || seqBefore(0, 65535) || !seqBefore(65000, 100) {
+		t.Error("Unexpected ordering of sequence numbers across the wrap")
+	}
+}
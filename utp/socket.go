@@ -0,0 +1,303 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"github.com/onepointsixtwo/torrentsgo/util"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// How often connections are checked for packets which need resending
+	TICK_INTERVAL = 50 * time.Millisecond
+	// Most incoming connections waiting to be accepted. SYNs past this are reset.
+	ACCEPT_BACKLOG = 32
+	// Largest packet read, which is more than any well behaved peer sends
+	MAX_PACKET_LENGTH = 64 * 1024
+)
+
+// Types
+
+type Config struct {
+	// Conn carries the packets of every connection. It is closed by Close.
+	Conn  net.PacketConn
+	Clock util.Clock
+}
+
+// Socket runs uTP connections over one UDP socket. It is a net.Listener for incoming connections
+// and has DialContext for outgoing ones, so it can be used in place of TCP.
+type Socket struct {
+	config   Config
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	accepted chan *Conn
+
+	lock   sync.Mutex
+	conns  map[connKey]*Conn
+	random *rand.Rand
+	closed bool
+}
+
+// connKey identifies a connection by the other end's address and the id of packets sent to us
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Initialiser
+
+func NewSocket(config Config) (*Socket, error) {
+	if config.Conn == nil {
+		return nil, errors.New("uTP socket needs a connection")
+	}
+	if config.Clock == nil {
+		config.Clock = util.NewRealClock()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Socket{
+		config:   config,
+		ctx:      ctx,
+		cancel:   cancel,
+		accepted: make(chan *Conn, ACCEPT_BACKLOG),
+		conns:    make(map[connKey]*Conn),
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.tickLoop()
+	return s, nil
+}
+
+// Listen opens a socket on a UDP address, given as host:port
+func Listen(address string) (*Socket, error) {
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewSocket(Config{Conn: conn})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Public Methods
+
+// Accept waits for the next incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accepted:
+		return c, nil
+	case <-s.ctx.Done():
+		return nil, net.ErrClosed
+	}
+}
+
+// DialContext opens a connection to address, given as host:port. The network may be tcp or udp,
+// with or without 4 or 6, so the socket can stand in for a TCP dialer such as proxy.Direct.
+func (s *Socket) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "udp":
+		network = "udp"
+	case "tcp4", "udp4":
+		network = "udp4"
+	case "tcp6", "udp6":
+		network = "udp6"
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil, net.ErrClosed
+	}
+	// The other end sends to us with the id of our SYN, and we send to it with one more
+	var id uint16
+	for {
+		id = uint16(s.random.Intn(1 << 16))
+		if s.conns[connKey{addr.String(), id}] == nil && s.conns[connKey{addr.String(), id + 1}] == nil {
+			break
+		}
+	}
+	c := newConn(s, addr, id, id+1)
+	s.conns[connKey{addr.String(), id}] = c
+	s.lock.Unlock()
+
+	c.connect()
+	if err := c.waitConnected(ctx.Done()); err != nil {
+		c.abort(net.ErrClosed)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops the socket and closes its connection, failing every uTP connection on it
+func (s *Socket) Close() error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+	s.closed = true
+	conns := s.snapshot()
+	s.lock.Unlock()
+
+	s.cancel()
+	for _, c := range conns {
+		c.abort(net.ErrClosed)
+	}
+	err := s.config.Conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.config.Conn.LocalAddr()
+}
+
+// Helpers
+
+func (s *Socket) readLoop() {
+	defer s.wg.Done()
+	buffer := make([]byte, MAX_PACKET_LENGTH)
+	for {
+		n, addr, err := s.config.Conn.ReadFrom(buffer)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return
+			}
+			// A temporary failure, such as an ICMP error for an earlier packet
+			continue
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		p, err := parsePacket(append([]byte(nil), buffer[:n]...))
+		if err != nil {
+			continue
+		}
+		s.dispatch(p, udpAddr)
+	}
+}
+
+// dispatch passes a packet to its connection, opening one for a new SYN and resetting any
+// connection we don't know
+func (s *Socket) dispatch(p *packet, addr *net.UDPAddr) {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	switch p.typ {
+	case ST_SYN:
+		key := connKey{addr.String(), p.connId + 1}
+		if c := s.conns[key]; c != nil {
+			s.lock.Unlock()
+			c.handle(p)
+			return
+		}
+		if len(s.accepted) >= ACCEPT_BACKLOG {
+			s.lock.Unlock()
+			s.reset(p, addr)
+			return
+		}
+		c := newConn(s, addr, p.connId+1, p.connId)
+		s.conns[key] = c
+		seqNr := uint16(s.random.Intn(1 << 16))
+		s.lock.Unlock()
+		c.accept(p, seqNr)
+		s.accepted <- c
+
+	case ST_RESET:
+		// A reset carries the id of the packet it answers, which is the one we receive on only if
+		// that was our SYN
+		c := s.conns[connKey{addr.String(), p.connId}]
+		for _, id := range []uint16{p.connId - 1, p.connId + 1} {
+			if other := s.conns[connKey{addr.String(), id}]; c == nil && other != nil && other.sendId == p.connId {
+				c = other
+			}
+		}
+		s.lock.Unlock()
+		if c != nil {
+			c.handle(p)
+		}
+
+	default:
+		c := s.conns[connKey{addr.String(), p.connId}]
+		s.lock.Unlock()
+		if c != nil {
+			c.handle(p)
+		} else if p.typ == ST_DATA || p.typ == ST_FIN {
+			s.reset(p, addr)
+		}
+	}
+}
+
+// tickLoop regularly has connections resend what has gone unacknowledged
+func (s *Socket) tickLoop() {
+	defer s.wg.Done()
+	for {
+		timer := s.config.Clock.NewTimer(TICK_INTERVAL)
+		select {
+		case <-timer.C():
+			s.lock.Lock()
+			conns := s.snapshot()
+			s.lock.Unlock()
+			now := s.now()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		case <-s.ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// reset tells the other end a packet was for a connection we don't have
+func (s *Socket) reset(p *packet, addr *net.UDPAddr) {
+	s.send(&packet{typ: ST_RESET, connId: p.connId, timestamp: timestamp(s.now()), ackNr: p.seqNr}, addr)
+}
+
+func (s *Socket) send(p *packet, addr *net.UDPAddr) {
+	// Lost packets are resent, so failures are left to look like loss
+	s.config.Conn.WriteTo(p.encode(), addr)
+}
+
+func (s *Socket) now() time.Time {
+	return s.config.Clock.Now()
+}
+
+// remove forgets a connection once it has ended
+func (s *Socket) remove(c *Conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := connKey{c.remote.String(), c.recvId}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// snapshot returns the open connections. It must be called with the lock held.
+func (s *Socket) snapshot() []*Conn {
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
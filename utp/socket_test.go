@@ -0,0 +1,236 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/onepointsixtwo/torrentsgo/mock"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const TEST_TIMEOUT = 30 * time.Second
+
+func newTestSocket(t *testing.T, network *mock.MockPacketNetwork, address string, config Config) *Socket {
+	conn, err := network.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Conn = conn
+	s, err := NewSocket(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// connect dials from one socket to the other, returning both ends
+func connect(t *testing.T, from *Socket, to *Socket) (net.Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := to.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dialled, err := from.DialContext(context.Background(), "udp", to.Addr().String())
+	if err != nil {
+		t.Fatalf("Unexpected error dialling %v", err)
+	}
+	t.Cleanup(func() { dialled.Close() })
+	conn := <-accepted
+	if conn == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return dialled, conn
+}
+
+// exchange writes data while reading length bytes from the other end
+func exchange(conn net.Conn, data []byte, length int, received chan []byte, errs chan error) {
+	go func() {
+		_, err := conn.Write(data)
+		errs <- err
+	}()
+	read := make([]byte, length)
+	if _, err := io.ReadFull(conn, read); err != nil {
+		errs <- err
+	}
+	received <- read
+}
+
+func randomBytes(length int, seed int64) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestTransferOverLossyLink(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	a := newTestSocket(t, network, "10.0.0.1:6881", Config{})
+	b := newTestSocket(t, network, "10.0.0.2:6881", Config{})
+	dialled, accepted := connect(t, a, b)
+	network.SetLoss(0.1)
+
+	fromA, fromB := randomBytes(100*1024, 1), randomBytes(80*1024, 2)
+	receivedA, receivedB := make(chan []byte, 1), make(chan []byte, 1)
+	errs := make(chan error, 4)
+	go exchange(dialled, fromA, len(fromB), receivedA, errs)
+	go exchange(accepted, fromB, len(fromA), receivedB, errs)
+
+	for _, expected := range []struct {
+		received chan []byte
+		data     []byte
+	}{{receivedA, fromB}, {receivedB, fromA}} {
+		select {
+		case data := <-expected.received:
+			if !bytes.Equal(data, expected.data) {
+				t.Errorf("Expected %v bytes to arrive intact", len(expected.data))
+			}
+		case err := <-errs:
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+		case <-time.After(TEST_TIMEOUT):
+			t.Fatal("Timed out transferring")
+		}
+	}
+}
+
+func TestReadReturnsEOFAfterClose(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	a := newTestSocket(t, network, "10.0.0.1:6881", Config{})
+	b := newTestSocket(t, network, "10.0.0.2:6881", Config{})
+	dialled, accepted := connect(t, a, b)
+
+	dialled.Write([]byte("goodbye"))
+	dialled.Close()
+	accepted.SetReadDeadline(time.Now().Add(TEST_TIMEOUT))
+	data, err := ioutil.ReadAll(accepted)
+	if err != nil || string(data) != "goodbye" {
+		t.Errorf("Expected to read goodbye then EOF but got %q %v", data, err)
+	}
+	if _, err := accepted.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected EOF reading again but got %v", err)
+	}
+	if _, err := dialled.Write([]byte("more")); err != net.ErrClosed {
+		t.Errorf("Expected ErrClosed writing after close but got %v", err)
+	}
+}
+
+func TestDialTimesOut(t *testing.T) {
+	clock := mock.NewMockClock(time.Unix(1000, 0))
+	network := mock.NewMockPacketNetwork()
+	a := newTestSocket(t, network, "10.0.0.1:6881", Config{Clock: clock})
+	silent, _ := network.Listen("10.0.0.2:6881")
+	defer silent.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.DialContext(context.Background(), "tcp", silent.LocalAddr().String())
+		done <- err
+	}()
+
+	// The SYN is sent again after each timeout, and the dial fails after too many
+	syns := 0
+	buffer := make([]byte, MAX_PACKET_LENGTH)
+	for {
+		select {
+		case err := <-done:
+			if err != ErrTimeout {
+				t.Errorf("Expected ErrTimeout but got %v", err)
+			}
+			if syns != MAX_SYN_TIMEOUTS {
+				t.Errorf("Expected %v SYNs but got %v", MAX_SYN_TIMEOUTS, syns)
+			}
+			return
+		default:
+		}
+		silent.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		if n, _, err := silent.ReadFrom(buffer); err == nil {
+			if p, err := parsePacket(buffer[:n]); err != nil || p.typ != ST_SYN {
+				t.Fatalf("Expected a SYN but got %+v %v", p, err)
+			}
+			syns++
+		}
+		clock.BlockUntil(1)
+		clock.Advance(TICK_INTERVAL)
+	}
+}
+
+func TestDialStopsWithContext(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	a := newTestSocket(t, network, "10.0.0.1:6881", Config{})
+	silent, _ := network.Listen("10.0.0.2:6881")
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := a.DialContext(ctx, "udp", silent.LocalAddr().String()); err != context.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded but got %v", err)
+	}
+	if _, err := a.DialContext(ctx, "unix", silent.LocalAddr().String()); err == nil {
+		t.Error("Expected an error dialling an unknown network")
+	}
+}
+
+func TestConnectionIsResetWhenOtherEndForgetsIt(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	a := newTestSocket(t, network, "10.0.0.1:6881", Config{})
+	b := newTestSocket(t, network, "10.0.0.2:6881", Config{})
+	dialled, _ := connect(t, a, b)
+
+	// A new socket in b's place doesn't know the connection
+	b.Close()
+	newTestSocket(t, network, "10.0.0.2:6881", Config{})
+	dialled.Write([]byte("hello?"))
+	dialled.SetReadDeadline(time.Now().Add(TEST_TIMEOUT))
+	if _, err := dialled.Read(make([]byte, 10)); err != ErrReset {
+		t.Errorf("Expected ErrReset but got %v", err)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	a := newTestSocket(t, network, "10.0.0.1:6881", Config{})
+	b := newTestSocket(t, network, "10.0.0.2:6881", Config{})
+	dialled, accepted := connect(t, a, b)
+
+	dialled.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := dialled.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected ErrDeadlineExceeded but got %v", err)
+	}
+
+	// Clearing the deadline lets reads wait again
+	dialled.SetReadDeadline(time.Time{})
+	accepted.Write([]byte("late"))
+	buffer := make([]byte, 10)
+	if n, err := dialled.Read(buffer); err != nil || string(buffer[:n]) != "late" {
+		t.Errorf("Expected to read late but got %q %v", buffer[:n], err)
+	}
+}
+
+func TestCloseFailsAcceptAndConnections(t *testing.T) {
+	network := mock.NewMockPacketNetwork()
+	a := newTestSocket(t, network, "10.0.0.1:6881", Config{})
+	b := newTestSocket(t, network, "10.0.0.2:6881", Config{})
+	dialled, _ := connect(t, a, b)
+
+	a.Close()
+	if _, err := a.Accept(); err != net.ErrClosed {
+		t.Errorf("Expected ErrClosed accepting but got %v", err)
+	}
+	if _, err := dialled.Read(make([]byte, 10)); err != net.ErrClosed {
+		t.Errorf("Expected ErrClosed reading but got %v", err)
+	}
+	if _, err := a.DialContext(context.Background(), "udp", b.Addr().String()); err != net.ErrClosed {
+		t.Errorf("Expected ErrClosed dialling but got %v", err)
+	}
+}
@@ -0,0 +1,240 @@
+package verify
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// Types
+
+type Config struct {
+	// Workers is how many pieces are hashed at once, defaulting to the number of CPUs
+	Workers int
+	// Progress, if set, is called after each piece is checked. Calls are never concurrent.
+	Progress func(Progress)
+}
+
+type Progress struct {
+	Checked int
+	Good    int
+	Total   int
+}
+
+// Result of checking a download against its torrent
+type Result struct {
+	// Good has a bit set for each piece which matched its hash
+	Good *model.Bitfield
+	// Missing and Truncated list the paths of files, relative to the download directory, which
+	// don't exist or are shorter than they should be
+	Missing   []string
+	Truncated []string
+}
+
+type piece struct {
+	index int
+	data  []byte
+}
+
+type checked struct {
+	index int
+	good  bool
+}
+
+// Public Methods
+
+// Verify reads the files of a torrent from a download directory and checks every piece against
+// its hash. Pieces are read in order, so reading stays sequential, and hashed by a pool of workers.
+func Verify(ctx context.Context, metaInfo *model.MetaInfo, dir string, config Config) (*Result, error) {
+	info := metaInfo.Info
+	if err := info.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid torrent - %v", err)
+	}
+	workers := config.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	files, result, err := openFiles(info, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer files.close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pieces := make(chan piece, workers)
+	results := make(chan checked, workers)
+	readErr := make(chan error, 1)
+
+	go func() {
+		defer close(pieces)
+		readErr <- files.readPieces(ctx, info, pieces, results)
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range pieces {
+				hash := sha1.Sum(p.data)
+				select {
+				case results <- checked{p.index, bytes.Equal(hash[:], info.PieceHash(p.index))}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	progress := Progress{Total: info.NumPieces()}
+	for c := range results {
+		progress.Checked++
+		if c.good {
+			result.Good.Set(c.index)
+			progress.Good++
+		}
+		if config.Progress != nil {
+			config.Progress(progress)
+		}
+	}
+
+	if err := <-readErr; err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Helpers
+
+// fileSet holds the files of a torrent open for reading. Pieces covering a file which is missing
+// or too short can't be good.
+type fileSet struct {
+	files    []*os.File
+	offsets  []int64
+	lengths  []int64
+	complete []bool
+}
+
+func openFiles(info *model.Info, dir string) (*fileSet, *Result, error) {
+	set := &fileSet{
+		files:    make([]*os.File, len(info.Files)),
+		offsets:  make([]int64, len(info.Files)),
+		lengths:  make([]int64, len(info.Files)),
+		complete: make([]bool, len(info.Files)),
+	}
+	result := &Result{Good: model.NewBitfieldForInfo(info), Missing: make([]string, 0), Truncated: make([]string, 0)}
+
+	for i, file := range info.Files {
+		set.offsets[i] = info.FileOffset(i)
+		set.lengths[i] = int64(file.Length)
+		path, err := info.FilePath(i)
+		if err != nil {
+			set.close()
+			return nil, nil, err
+		}
+
+		f, err := os.Open(filepath.Join(dir, path))
+		if os.IsNotExist(err) {
+			result.Missing = append(result.Missing, path)
+			continue
+		}
+		if err != nil {
+			set.close()
+			return nil, nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			set.close()
+			return nil, nil, err
+		}
+		if stat.Size() < int64(file.Length) {
+			result.Truncated = append(result.Truncated, path)
+		} else {
+			set.complete[i] = true
+		}
+		set.files[i] = f
+	}
+	return set, result, nil
+}
+
+// readPieces sends each piece which can be read in full to be hashed. Pieces covering a missing
+// or truncated file are reported straight away as bad.
+func (set *fileSet) readPieces(ctx context.Context, info *model.Info, pieces chan<- piece, results chan<- checked) error {
+	for index := 0; index < info.NumPieces(); index++ {
+		data := make([]byte, info.PieceSize(index))
+		ok, err := set.readAt(data, int64(index)*int64(info.PieceLength))
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			select {
+			case pieces <- piece{index, data}:
+			case <-ctx.Done():
+				return nil
+			}
+		} else {
+			select {
+			case results <- checked{index, false}:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// readAt fills data from the torrent's files starting at offset, returning false if any of it is in
+// a file which is missing or too short
+func (set *fileSet) readAt(data []byte, offset int64) (bool, error) {
+	for i, f := range set.files {
+		fileLength := set.lengths[i]
+		fileOffset := set.offsets[i]
+		if len(data) == 0 {
+			break
+		}
+		if offset >= fileOffset+fileLength || fileLength == 0 {
+			continue
+		}
+
+		n := fileOffset + fileLength - offset
+		if n > int64(len(data)) {
+			n = int64(len(data))
+		}
+		if !set.complete[i] {
+			return false, nil
+		}
+		if _, err := f.ReadAt(data[:n], offset-fileOffset); err != nil && err != io.EOF {
+			return false, err
+		}
+		data = data[n:]
+		offset += n
+	}
+	return true, nil
+}
+
+func (set *fileSet) close() {
+	for _, f := range set.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+}
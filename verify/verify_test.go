@@ -0,0 +1,165 @@
+package verify
+
+import (
+	"context"
+	"crypto/sha1"
+	"github.com/onepointsixtwo/torrentsgo/model"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const (
+	testPieceLength = 64
+)
+
+func TestVerifyCompleteDownload(t *testing.T) {
+	metaInfo, data := testTorrent([]int{100, 0, 37, 200})
+	dir := writeFiles(t, metaInfo.Info, data)
+
+	updates := make([]Progress, 0)
+	result, err := Verify(context.Background(), metaInfo, dir, Config{Workers: 3, Progress: func(progress Progress) {
+		updates = append(updates, progress)
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error verifying %v", err)
+	}
+	if !result.Good.All() {
+		t.Errorf("Expected every piece to be good but was %v", result.Good)
+	}
+	if len(result.Missing) != 0 || len(result.Truncated) != 0 {
+		t.Errorf("Expected no missing or truncated files but was %v %v", result.Missing, result.Truncated)
+	}
+
+	numPieces := metaInfo.Info.NumPieces()
+	if len(updates) != numPieces {
+		t.Fatalf("Expected progress for each of %v pieces but was %v", numPieces, len(updates))
+	}
+	if last := updates[numPieces-1]; last != (Progress{Checked: numPieces, Good: numPieces, Total: numPieces}) {
+		t.Errorf("Unexpected final progress %+v", last)
+	}
+}
+
+func TestVerifyFindsCorruptPieces(t *testing.T) {
+	metaInfo, data := testTorrent([]int{100, 37, 200})
+	// Corrupt the byte at the boundary between the first two files, which is in piece 1
+	data[100] ^= 0xff
+	dir := writeFiles(t, metaInfo.Info, data)
+
+	result, err := Verify(context.Background(), metaInfo, dir, Config{})
+	if err != nil {
+		t.Fatalf("Unexpected error verifying %v", err)
+	}
+	for index := 0; index < metaInfo.Info.NumPieces(); index++ {
+		if result.Good.Test(index) != (index != 1) {
+			t.Errorf("Expected piece %v good to be %v", index, index != 1)
+		}
+	}
+}
+
+func TestVerifyReportsMissingAndTruncatedFiles(t *testing.T) {
+	metaInfo, data := testTorrent([]int{100, 37, 200, 50})
+	dir := writeFiles(t, metaInfo.Info, data)
+
+	os.Remove(filepath.Join(dir, "torrent", "file1"))
+	os.Truncate(filepath.Join(dir, "torrent", "dir", "file2"), 150)
+
+	result, err := Verify(context.Background(), metaInfo, dir, Config{Workers: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error verifying %v", err)
+	}
+	if !reflect.DeepEqual(result.Missing, []string{filepath.Join("torrent", "file1")}) {
+		t.Errorf("Unexpected missing files %v", result.Missing)
+	}
+	if !reflect.DeepEqual(result.Truncated, []string{filepath.Join("torrent", "dir", "file2")}) {
+		t.Errorf("Unexpected truncated files %v", result.Truncated)
+	}
+
+	// Bytes 100-337 are in the missing and truncated files, which are pieces 1 to 5
+	for index := 0; index < metaInfo.Info.NumPieces(); index++ {
+		expected := index == 0 || index == 6
+		if result.Good.Test(index) != expected {
+			t.Errorf("Expected piece %v good to be %v", index, expected)
+		}
+	}
+}
+
+func TestVerifyRefusesUnsafePaths(t *testing.T) {
+	metaInfo, _ := testTorrent([]int{10})
+	metaInfo.Info.Files[0].Path = "../outside"
+	if _, err := Verify(context.Background(), metaInfo, t.TempDir(), Config{}); err == nil {
+		t.Errorf("Expected unsafe path to be refused")
+	}
+}
+
+func TestVerifyRefusesInconsistentGeometry(t *testing.T) {
+	// More piece hashes than the data needs
+	metaInfo, data := testTorrent([]int{10})
+	dir := writeFiles(t, metaInfo.Info, data)
+	metaInfo.Info.Pieces = append(metaInfo.Info.Pieces, make([]byte, 20)...)
+	if _, err := Verify(context.Background(), metaInfo, dir, Config{}); err == nil {
+		t.Errorf("Expected a torrent with too many pieces to be refused")
+	}
+}
+
+func TestVerifyStopsWhenCancelled(t *testing.T) {
+	metaInfo, data := testTorrent([]int{10000})
+	dir := writeFiles(t, metaInfo.Info, data)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err := Verify(ctx, metaInfo, dir, Config{Workers: 1, Progress: func(progress Progress) {
+		cancel()
+	}})
+	if err != context.Canceled {
+		t.Errorf("Expected cancelled error but was %v", err)
+	}
+}
+
+// Helpers
+
+// testTorrent makes a multi-file torrent of random data, with the second file in a subdirectory
+func testTorrent(lengths []int) (*model.MetaInfo, []byte) {
+	random := rand.New(rand.NewSource(1))
+	files := make([]*model.File, len(lengths))
+	total := 0
+	for i, length := range lengths {
+		path := "file" + string(rune('0'+i))
+		if i == 2 {
+			path = "dir/" + path
+		}
+		files[i] = model.NewFile(path, length, "")
+		total += length
+	}
+
+	data := make([]byte, total)
+	random.Read(data)
+	pieces := make([]byte, 0)
+	for offset := 0; offset < total; offset += testPieceLength {
+		end := offset + testPieceLength
+		if end > total {
+			end = total
+		}
+		hash := sha1.Sum(data[offset:end])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	info := model.NewInfo(testPieceLength, pieces, 0, files, "torrent", nil)
+	return &model.MetaInfo{Info: info}, data
+}
+
+func writeFiles(t *testing.T, info *model.Info, data []byte) string {
+	dir := t.TempDir()
+	for i, file := range info.Files {
+		path, _ := info.FilePath(i)
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		offset := info.FileOffset(i)
+		if err := ioutil.WriteFile(path, data[offset:offset+int64(file.Length)], 0644); err != nil {
+			t.Fatalf("Unable to write test file %v", err)
+		}
+	}
+	return dir
+}
@@ -0,0 +1,226 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// A minimal RFC 6455 implementation, covering what trackers need: text and binary messages,
+// fragmentation, ping/pong and the closing handshake.
+
+const (
+	OPCODE_CONTINUATION = 0x0
+	OPCODE_TEXT         = 0x1
+	OPCODE_BINARY       = 0x2
+	OPCODE_CLOSE        = 0x8
+	OPCODE_PING         = 0x9
+	OPCODE_PONG         = 0xA
+
+	DEFAULT_MAX_MESSAGE_LENGTH = 1024 * 1024
+	MAX_CONTROL_PAYLOAD        = 125
+	ACCEPT_GUID                = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// Types
+
+type Conn struct {
+	conn             net.Conn
+	reader           *bufio.Reader
+	isClient         bool
+	MaxMessageLength int
+
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// Initialiser
+
+func newConn(conn net.Conn, reader *bufio.Reader, isClient bool) *Conn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	return &Conn{conn: conn, reader: reader, isClient: isClient, MaxMessageLength: DEFAULT_MAX_MESSAGE_LENGTH}
+}
+
+// Public Methods
+
+// ReadMessage returns the next complete text or binary message. Pings are answered while
+// waiting. io.EOF is returned once the other side has closed the connection.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	message := make([]byte, 0)
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case OPCODE_PING:
+			if err := c.writeFrame(OPCODE_PONG, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OPCODE_PONG:
+			continue
+		case OPCODE_CLOSE:
+			c.writeFrame(OPCODE_CLOSE, nil)
+			c.conn.Close()
+			return 0, nil, io.EOF
+		case OPCODE_TEXT, OPCODE_BINARY:
+			if messageType != 0 {
+				return 0, nil, fmt.Errorf("New websocket message started before previous one finished")
+			}
+			messageType = int(f.opcode)
+		case OPCODE_CONTINUATION:
+			if messageType == 0 {
+				return 0, nil, fmt.Errorf("Websocket continuation frame without a message")
+			}
+		default:
+			return 0, nil, fmt.Errorf("Unknown websocket opcode %v", f.opcode)
+		}
+
+		if len(message)+len(f.payload) > c.MaxMessageLength {
+			return 0, nil, fmt.Errorf("Websocket message exceeds maximum length of %v", c.MaxMessageLength)
+		}
+		message = append(message, f.payload...)
+		if f.fin {
+			return messageType, message, nil
+		}
+	}
+}
+
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if messageType != OPCODE_TEXT && messageType != OPCODE_BINARY {
+		return fmt.Errorf("Invalid websocket message type %v", messageType)
+	}
+	return c.writeFrame(byte(messageType), data)
+}
+
+func (c *Conn) Ping(data []byte) error {
+	return c.writeFrame(OPCODE_PING, data)
+}
+
+// Close sends a close frame and closes the underlying connection
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.writeFrame(OPCODE_CLOSE, nil)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Framing
+
+func (c *Conn) readFrame() (*frame, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, err
+	}
+
+	f := &frame{fin: header[0]&0x80 != 0, opcode: header[0] & 0x0F}
+	if header[0]&0x70 != 0 {
+		return nil, fmt.Errorf("Websocket frame uses unsupported extension bits")
+	}
+	masked := header[1]&0x80 != 0
+	if masked == c.isClient {
+		return nil, fmt.Errorf("Websocket frame masking is the wrong way round")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	if f.opcode >= OPCODE_CLOSE && (length > MAX_CONTROL_PAYLOAD || !f.fin) {
+		return nil, fmt.Errorf("Invalid websocket control frame")
+	}
+	if length > uint64(c.MaxMessageLength) {
+		return nil, fmt.Errorf("Websocket frame of %v bytes exceeds maximum length of %v", length, c.MaxMessageLength)
+	}
+
+	mask := make([]byte, 4)
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return nil, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		applyMask(f.payload, mask)
+	}
+	return f, nil
+}
+
+// writeFrame writes a single unfragmented frame. Clients must mask their frames.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | opcode
+	length := len(payload)
+	switch {
+	case length <= MAX_CONTROL_PAYLOAD:
+		header[1] = byte(length)
+	case length <= 0xFFFF:
+		header[1] = 126
+		header = append(header, byte(length>>8), byte(length))
+	default:
+		header[1] = 127
+		extended := make([]byte, 8)
+		binary.BigEndian.PutUint64(extended, uint64(length))
+		header = append(header, extended...)
+	}
+
+	data := payload
+	if c.isClient {
+		header[1] |= 0x80
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		header = append(header, mask...)
+		data = make([]byte, length)
+		copy(data, payload)
+		applyMask(data, mask)
+	}
+
+	_, err := c.conn.Write(append(header, data...))
+	return err
+}
+
+func applyMask(data []byte, mask []byte) {
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+}
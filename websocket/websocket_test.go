@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func newEchoServer(t *testing.T) (*httptest.Server, *url.URL) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			messageType, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(messageType, message)
+		}
+	}))
+	u, _ := url.Parse(strings.Replace(server.URL, "http://", "ws://", 1) + "/echo")
+	return server, u
+}
+
+func TestEcho(t *testing.T) {
+	server, u := newEchoServer(t)
+	defer server.Close()
+
+	conn, err := Dial(context.Background(), u, nil)
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	defer conn.Close()
+
+	messages := [][]byte{[]byte("hello"), bytes.Repeat([]byte("a"), 300), bytes.Repeat([]byte("b"), 70000)}
+	for _, message := range messages {
+		if err := conn.WriteMessage(OPCODE_TEXT, message); err != nil {
+			t.Fatalf("Unexpected write error %v", err)
+		}
+		messageType, echoed, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Unexpected read error %v", err)
+		}
+		if messageType != OPCODE_TEXT || !bytes.Equal(echoed, message) {
+			t.Errorf("Echoed message of %v bytes did not match", len(message))
+		}
+	}
+}
+
+func TestReadAnswersPingAndReassemblesFragments(t *testing.T) {
+	client, server := net.Pipe()
+	clientConn := newConn(client, nil, true)
+	serverConn := newConn(server, nil, false)
+
+	go func() {
+		serverConn.writeFrame(OPCODE_PING, []byte("p"))
+		// A message split across a text frame and a continuation frame
+		server.Write([]byte{OPCODE_TEXT, 3, 'a', 'b', 'c'})
+		server.Write([]byte{0x80 | OPCODE_CONTINUATION, 2, 'd', 'e'})
+	}()
+
+	pong := make(chan *frame, 1)
+	go func() {
+		f, _ := serverConn.readFrame()
+		pong <- f
+	}()
+
+	messageType, message, err := clientConn.ReadMessage()
+	if err != nil {
+		t.Fatalf("Unexpected read error %v", err)
+	}
+	if messageType != OPCODE_TEXT || string(message) != "abcde" {
+		t.Errorf("Expected reassembled message 'abcde' but was '%v'", string(message))
+	}
+
+	f := <-pong
+	if f == nil || f.opcode != OPCODE_PONG || string(f.payload) != "p" {
+		t.Errorf("Expected ping to be answered with pong but got %+v", f)
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	server, u := newEchoServer(t)
+	defer server.Close()
+
+	conn, err := Dial(context.Background(), u, nil)
+	if err != nil {
+		t.Fatalf("Unexpected dial error %v", err)
+	}
+	conn.writeFrame(OPCODE_CLOSE, nil)
+	if _, _, err := conn.ReadMessage(); err != io.EOF {
+		t.Errorf("Expected EOF once closed but got %v", err)
+	}
+}
+
+func TestMessageLengthLimit(t *testing.T) {
+	client, server := net.Pipe()
+	clientConn := newConn(client, nil, true)
+	clientConn.MaxMessageLength = 10
+	serverConn := newConn(server, nil, false)
+
+	go serverConn.WriteMessage(OPCODE_BINARY, make([]byte, 11))
+	if _, _, err := clientConn.ReadMessage(); err == nil {
+		t.Errorf("Expected error reading message over the length limit")
+	}
+}
+
+func TestUpgradeRejectsPlainRequest(t *testing.T) {
+	server, _ := newEchoServer(t)
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected bad request for non-websocket request but was %v", response.StatusCode)
+	}
+}
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	if acceptKey("dGhlIHNhbXBsZSBub25jZQ==") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %v", acceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+	}
+}